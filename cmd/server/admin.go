@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/livekit/protocol/auth"
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/source"
+	"github.com/livekit/egress/pkg/service"
+)
+
+const (
+	bearerPrefix = "Bearer "
+
+	abortPathPrefix   = "/abort/"
+	deletePathPrefix  = "/delete/"
+	layoutPathPrefix  = "/layout/"
+	overlayPathPrefix = "/overlay/"
+	messagePathPrefix = "/message/"
+
+	maxLayoutSize  = 4096
+	maxOverlaySize = 4096
+	maxMessageSize = 64 << 10
+)
+
+// adminHandler takes requests which change egresses the protocol has no request for. It only listens on localhost, and
+// requests need a token signed with the api key and secret, with the roomRecord grant
+type adminHandler struct {
+	svc       *service.Service
+	apiKey    string
+	apiSecret string
+}
+
+func (h *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := h.authenticate(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, abortPathPrefix):
+		h.abort(w, r)
+	case strings.HasPrefix(r.URL.Path, deletePathPrefix):
+		h.delete(w, r)
+	case strings.HasPrefix(r.URL.Path, layoutPathPrefix):
+		h.updateLayout(w, r)
+	case strings.HasPrefix(r.URL.Path, overlayPathPrefix):
+		h.updateTextOverlay(w, r)
+	case strings.HasPrefix(r.URL.Path, messagePathPrefix):
+		h.sendTemplateMessage(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *adminHandler) authenticate(r *http.Request) error {
+	authHeader := r.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, bearerPrefix) {
+		return errors.ErrPermissionDenied
+	}
+
+	v, err := auth.ParseAPIToken(strings.TrimPrefix(authHeader, bearerPrefix))
+	if err != nil || v.APIKey() != h.apiKey {
+		return errors.ErrPermissionDenied
+	}
+	grants, err := v.Verify(h.apiSecret)
+	if err != nil || grants.Video == nil || !grants.Video.RoomRecord {
+		return errors.ErrPermissionDenied
+	}
+	return nil
+}
+
+// abort ends an egress without uploading it, for POST /abort/<egress_id>
+func (h *adminHandler) abort(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	egressID := strings.TrimPrefix(r.URL.Path, abortPathPrefix)
+	if err := h.svc.AbortEgress(egressID); err != nil {
+		if errors.Is(err, errors.ErrEgressNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+		} else {
+			logger.Errorw("failed to abort egress", err, "egressID", egressID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// delete removes the uploads of an egress which recently ended, for POST /delete/<egress_id>
+func (h *adminHandler) delete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	egressID := strings.TrimPrefix(r.URL.Path, deletePathPrefix)
+	deleted, err := h.svc.DeleteEgress(r.Context(), egressID)
+	switch {
+	case errors.Is(err, errors.ErrEgressNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case errors.Is(err, errors.ErrEgressRunning), errors.Is(err, errors.ErrDeleteInProgress):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	res := map[string]interface{}{
+		"deleted": deleted,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		logger.Errorw("failed to delete egress", err, "egressID", egressID)
+		res["error"] = err.Error()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// updateLayout rearranges the video tracks of a track composite, for POST /layout/<egress_id> with the layout as the body
+func (h *adminHandler) updateLayout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	egressID := strings.TrimPrefix(r.URL.Path, layoutPathPrefix)
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxLayoutSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	layout := strings.TrimSpace(string(body))
+	if layout == "" {
+		http.Error(w, errors.ErrInvalidInput("layout").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err = h.svc.UpdateLayout(egressID, layout); err != nil {
+		switch {
+		case errors.Is(err, errors.ErrEgressNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errors.ErrNoTrackLayout):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logger.Errorw("failed to update layout", err, "egressID", egressID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// updateTextOverlay sets the text shown over the video, for POST /overlay/<egress_id> with a json body such as
+// {"text": "LIVE", "position": "top-right"}. Empty text hides the overlay
+func (h *adminHandler) updateTextOverlay(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	egressID := strings.TrimPrefix(r.URL.Path, overlayPathPrefix)
+	overlay := &service.TextOverlay{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxOverlaySize)).Decode(overlay); err != nil {
+		http.Error(w, errors.ErrInvalidInput("overlay").Error(), http.StatusBadRequest)
+		return
+	}
+	if overlay.Position != "" && !config.IsOverlayPosition(overlay.Position) {
+		http.Error(w, errors.ErrInvalidInput("position").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.svc.UpdateTextOverlay(egressID, overlay); err != nil {
+		switch {
+		case errors.Is(err, errors.ErrEgressNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errors.ErrNoTextOverlay):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logger.Errorw("failed to update text overlay", err, "egressID", egressID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// sendTemplateMessage relays a message to the template of a room composite, for POST /message/<egress_id> with a json
+// body such as {"type": "countdown", "data": {"seconds": 10}}. The template receives it through window.egress
+func (h *adminHandler) sendTemplateMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	egressID := strings.TrimPrefix(r.URL.Path, messagePathPrefix)
+	msg := &source.TemplateMessage{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxMessageSize)).Decode(msg); err != nil {
+		http.Error(w, errors.ErrInvalidInput("message").Error(), http.StatusBadRequest)
+		return
+	}
+	if msg.Type == "" {
+		http.Error(w, errors.ErrInvalidInput("type").Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.svc.SendTemplateMessage(egressID, msg); err != nil {
+		switch {
+		case errors.Is(err, errors.ErrEgressNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errors.ErrNoTemplate):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		default:
+			logger.Errorw("failed to send template message", err, "egressID", egressID)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
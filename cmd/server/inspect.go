@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/urfave/cli/v2"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/service"
+)
+
+const (
+	inspectTimeout = 10 * time.Second
+	inspectUsage   = "usage: egress inspect <egress_id> [info|pipeline|dot|eos]"
+)
+
+// runInspect queries the handler running an egress on this node through its admin socket, and prints the response
+func runInspect(c *cli.Context) error {
+	egressID := c.Args().Get(0)
+	if egressID == "" {
+		return errors.New(inspectUsage)
+	}
+
+	method, urlPath := http.MethodGet, service.AdminPathInfo
+	switch c.Args().Get(1) {
+	case "", "info":
+	case "pipeline":
+		urlPath = service.AdminPathPipeline
+	case "dot":
+		urlPath = service.AdminPathDot
+	case "eos":
+		method, urlPath = http.MethodPost, service.AdminPathEOS
+	default:
+		return errors.New(inspectUsage)
+	}
+
+	socketPath := service.GetAdminSocketPath(egressID)
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: inspectTimeout,
+	}
+
+	req, err := http.NewRequest(method, "http://handler"+urlPath, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not reach handler for %s: %w", egressID, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, body)
+	}
+	if method == http.MethodPost {
+		fmt.Println("egress ending")
+		return nil
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
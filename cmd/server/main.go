@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -20,7 +21,9 @@ import (
 
 	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/sink"
 	"github.com/livekit/egress/pkg/service"
+	"github.com/livekit/egress/pkg/stats"
 	"github.com/livekit/egress/version"
 )
 
@@ -44,10 +47,21 @@ func main() {
 					&cli.StringFlag{
 						Name: "temp-path",
 					},
+					&cli.IntFlag{
+						Name: "upload-metrics-fd",
+					},
 				},
 				Action: runHandler,
 				Hidden: true,
 			},
+			{
+				Name:      "inspect",
+				Usage:     "queries an egress running on this node",
+				ArgsUsage: "<egress_id> [info|pipeline|dot|eos]",
+				Description: "prints the egress info (default), the pipeline state and queue levels, or the pipeline graph " +
+					"in dot format, or stops the egress, through its handler's admin socket",
+				Action: runInspect,
+			},
 		},
 		Flags: []cli.Flag{
 			&cli.StringFlag{
@@ -89,6 +103,22 @@ func runService(c *cli.Context) error {
 		}()
 	}
 
+	if conf.AdminPort != 0 {
+		// bound before the service starts, so it doesn't take requests it can't be administered for
+		adminListener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", conf.AdminPort))
+		if err != nil {
+			return err
+		}
+		go func() {
+			err := http.Serve(adminListener, &adminHandler{
+				svc:       svc,
+				apiKey:    conf.ApiKey,
+				apiSecret: conf.ApiSecret,
+			})
+			logger.Errorw("admin server stopped", err)
+		}()
+	}
+
 	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, syscall.SIGTERM, syscall.SIGQUIT)
 
@@ -110,6 +140,23 @@ func runService(c *cli.Context) error {
 }
 
 func runHandler(c *cli.Context) error {
+	// sent by the service when the egress is aborted, when a track composite's layout or the text overlay is updated, and
+	// when a template message is relayed. They're registered first, and held until the handler is running, so that none
+	// are lost
+	abortChan := make(chan os.Signal, 1)
+	signal.Notify(abortChan, syscall.SIGUSR1)
+	updateChan := make(chan os.Signal, 1)
+	signal.Notify(updateChan, syscall.SIGUSR2)
+
+	var uploads *stats.UploadReporter
+	if fd := c.Int("upload-metrics-fd"); fd > 0 {
+		// keeps chrome and other children from holding the pipe open after the handler exits
+		syscall.CloseOnExec(fd)
+		uploads = stats.NewUploadReporter(os.NewFile(uintptr(fd), "upload-metrics"))
+	}
+	// signals held by the service can be sent now
+	uploads.ReportReady()
+
 	conf, err := getConfig(c)
 	if err != nil {
 		return err
@@ -131,6 +178,11 @@ func runHandler(c *cli.Context) error {
 		os.Setenv("TMPDIR", tmpPath)
 	}
 
+	if conf.VAAPI.Device != "" {
+		// read by gstreamer-vaapi when its plugin loads
+		os.Setenv("GST_VAAPI_DRM_DEVICE", conf.VAAPI.Device)
+	}
+
 	rc, err := redis.GetRedisClient(conf.Redis)
 	if err != nil {
 		span.RecordError(err)
@@ -146,7 +198,7 @@ func runHandler(c *cli.Context) error {
 	}
 
 	rpcHandler := egress.NewRedisRPCServer(rc)
-	handler := service.NewHandler(conf, rpcHandler)
+	handler := service.NewHandler(conf, rpcHandler, uploads, tmpPath)
 
 	killChan := make(chan os.Signal, 1)
 	signal.Notify(killChan, syscall.SIGINT)
@@ -157,6 +209,18 @@ func runHandler(c *cli.Context) error {
 		handler.Kill()
 	}()
 
+	go func() {
+		sig := <-abortChan
+		logger.Infow("abort requested, discarding recording", "signal", sig)
+		handler.Abort()
+	}()
+
+	go func() {
+		for range updateChan {
+			handler.Update(tmpPath)
+		}
+	}()
+
 	handler.HandleRequest(ctx, req)
 	return nil
 }
@@ -175,5 +239,12 @@ func getConfig(c *cli.Context) (*config.Config, error) {
 		configBody = string(content)
 	}
 
-	return config.NewConfig(configBody)
+	conf, err := config.NewConfig(configBody)
+	if err != nil {
+		return nil, err
+	}
+
+	// requests only name their bucket, so bucket settings are applied by the sink
+	sink.SetS3Buckets(conf.S3Buckets)
+	return conf, nil
 }
@@ -66,6 +66,15 @@ func integration(configFile string) error {
 	)
 }
 
+// Benchmark runs the pipeline benchmarks, which don't need a LiveKit server or cloud credentials
+func Benchmark() error {
+	return run(
+		fmt.Sprintf("docker pull livekit/gstreamer:%s-dev", gstVersion),
+		"docker build -t egress-test -f build/test/Dockerfile .",
+		"docker run --rm --entrypoint go egress-test test -run=^$ -bench=. -benchmem --tags=benchmark ./test/benchmark",
+	)
+}
+
 func GStreamer() error {
 	commands := []string{"docker pull ubuntu:22.04"}
 	for _, build := range []string{"base", "dev", "prod"} {
@@ -1,8 +1,12 @@
 package config
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-logr/zapr"
@@ -16,6 +20,7 @@ import (
 	"github.com/livekit/protocol/utils"
 
 	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/secrets"
 )
 
 const (
@@ -23,9 +28,86 @@ const (
 	trackCompositeCpuCost = 2
 	trackCpuCost          = 1
 
-	defaultLocalOutputDirectory = "/"
+	defaultLocalOutputDirectory      = "/"
+	defaultSlateStallTimeout         = 2 * time.Second
+	defaultWatchdogTimeout           = 15 * time.Second
+	defaultFileCheckTimeout          = 30 * time.Second
+	defaultAudioBedVolume            = 0.3
+	defaultAudioBedDuckedVolume      = 0.05
+	defaultLoudnessTarget            = -23
+	defaultFailoverThreshold         = 3
+	defaultRistSenderBuffer          = 1200 * time.Millisecond
+	defaultRistMinRTCPInterval       = 100 * time.Millisecond
+	defaultRistMaxRTCPBandwidth      = 0.05
+	defaultPreviewDuration           = 5 * time.Second
+	defaultPreviewFramerate          = 10
+	defaultPreviewWidth              = 320
+	defaultVP9CPUUsed                = 4
+	defaultUploadConcurrency         = 4
+	defaultWebsocketRefreshInterval  = 10 * time.Minute
+	defaultWebsocketReconnectTimeout = 30 * time.Second
+	defaultWebsocketBufferSize       = 16
+	defaultRetentionTagKey           = "retention-days"
+	defaultSegmentDuration           = 6
+	defaultCompatibilityVersion      = 3
+
+	// longest segment duration in seconds, for requests and config
+	MaxSegmentDuration = 60
+
+	SegmentContainerTS   = "ts"
+	SegmentContainerFMP4 = "fmp4"
+	SegmentContainerAAC  = "aac"
+
+	PlaylistTypeEvent = "event"
+	PlaylistTypeVOD   = "vod"
+
+	SnapshotFormatJPEG = "jpeg"
+	SnapshotFormatPNG  = "png"
+
+	CaptionsFormatVTT = "vtt"
+	CaptionsFormatSRT = "srt"
+
+	TimecodeModeWallClock = "wallclock"
+	TimecodeModeRunning   = "running"
+
+	defaultTimecodePosition = "top-left"
+	defaultTimecodeFormat   = "%Y-%m-%d %H:%M:%S"
+	defaultTimecodeFont     = "Monospace 16"
+
+	defaultTextOverlayPosition = "bottom-left"
+	defaultTextOverlayFont     = "Sans Bold 24"
+
+	H264EncoderX264  = "x264enc"
+	H264EncoderNVENC = "nvh264enc"
+	H264EncoderVAAPI = "vaapih264enc"
+
+	defaultH264Preset = "veryfast"
+
+	defaultStreamHealthInterval = 10 * time.Second
+
+	RateControlCBR = "cbr"
+	RateControlVBR = "vbr"
+	RateControlCRF = "crf"
+
+	defaultRateControlQuality    = 23
+	defaultRateControlBufferSize = time.Second
+
+	H265EncoderX265  = "x265enc"
+	H265EncoderNVENC = "nvh265enc"
+	H265EncoderVAAPI = "vaapih265enc"
+
+	UploadCompressionGzip = "gzip"
+
+	TrackContainerMKV  = "mkv"
+	TrackContainerWebM = "webm"
+
+	OpusDTXGaps    = "gaps"
+	OpusDTXSilence = "silence"
 )
 
+// rtmp connect args become gstreamer structure fields
+var connectArgRegexp = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
 type Config struct {
 	Redis     *redis.RedisConfig `yaml:"redis"`      // required
 	ApiKey    string             `yaml:"api_key"`    // required (env LIVEKIT_API_KEY)
@@ -33,19 +115,138 @@ type Config struct {
 	WsUrl     string             `yaml:"ws_url"`     // required (env LIVEKIT_WS_URL)
 
 	HealthPort           int    `yaml:"health_port"`
+	AdminPort            int    `yaml:"admin_port"` // localhost only, for requests authenticated with the api key and secret
 	PrometheusPort       int    `yaml:"prometheus_port"`
 	LogLevel             string `yaml:"log_level"`
 	TemplateBase         string `yaml:"template_base"`
 	Insecure             bool   `yaml:"insecure"`
 	LocalOutputDirectory string `yaml:"local_directory"` // used for temporary storage before upload
 
+	Tmpfs              TmpfsConfig   `yaml:"tmpfs"`                // used for segments before upload
+	UploadVerification bool          `yaml:"upload_verification"`  // check upload credentials before responding to requests
+	PerfReport         bool          `yaml:"perf_report"`          // store a performance report next to file and segment outputs
+	BackgroundUploads  bool          `yaml:"background_uploads"`   // file outputs are uploaded by the service, after the handler exits
+	UploadConcurrency  int           `yaml:"upload_concurrency"`   // files uploaded at once when the egress ends. Defaults to 4
+	UploadCompression  string        `yaml:"upload_compression"`   // content encoding for uploaded playlists and json reports, gzip or none (default)
+	PassthroughAudio   bool          `yaml:"passthrough_audio"`    // mux track composite opus audio without transcoding, when the container supports it
+	FrameAccurateStart bool          `yaml:"frame_accurate_start"` // capture templates before they start recording, to start at the exact frame
+	StartTimeout       time.Duration `yaml:"start_timeout"`        // egresses whose room never becomes active end without uploading. Defaults to waiting indefinitely
+	TrackContainer     string        `yaml:"track_container"`      // mkv or webm, for video track files without an extension selecting one. Defaults to ivf for vp8 and mp4 for h264
+	OpusDTX            string        `yaml:"opus_dtx"`             // silence or gaps (default), how pauses in dtx audio tracks are written
+	DataCapture        bool          `yaml:"data_capture"`         // store data messages received during track, track composite and sdk room composite egress next to file and segment outputs
+	DeleteWindow       time.Duration `yaml:"delete_window"`        // how long the uploads of an ended egress can be deleted through the admin port. Defaults to 0 (disabled)
+	KeyFrameInterval   time.Duration `yaml:"key_frame_interval"`   // time between keyframes for every video encode, such as 2s for cdns requiring it. Defaults to the segment duration for segments, and the encoder's default otherwise
+	TrackLayouts       bool          `yaml:"track_layouts"`        // read a layout of several tracks from track composite video track ids
+
 	S3    *S3Config    `yaml:"s3"`
 	Azure *AzureConfig `yaml:"azure"`
 	GCP   *GCPConfig   `yaml:"gcp"`
 
+	// settings for uploads to specific s3 buckets, including buckets from requests
+	S3Buckets map[string]*S3BucketConfig `yaml:"s3_buckets"`
+
+	// execution environment for the chrome instance running each room composite template
+	Chrome ChromeConfig `yaml:"chrome"`
+
+	// signature and integrity checks for templates, before they are loaded
+	Templates TemplatesConfig `yaml:"templates"`
+
+	// secret references which requests can use
+	Secrets SecretsConfig `yaml:"secrets"`
+
 	// CPU costs for various egress types
 	CPUCost CPUCostConfig `yaml:"cpu_cost"`
 
+	// segmented file output settings
+	Segments SegmentsConfig `yaml:"segments"`
+
+	// metadata written to file outputs
+	FileMetadata FileMetadataConfig `yaml:"file_metadata"`
+
+	// expiry hints set on uploaded objects, for bucket lifecycle rules
+	Retention RetentionConfig `yaml:"retention"`
+
+	// wav file output settings
+	Wav WavConfig `yaml:"wav"`
+
+	// clips added to the start and end of file outputs
+	Bumpers BumpersConfig `yaml:"bumpers"`
+
+	// validation of mp4 file outputs before they're uploaded
+	FileCheck FileCheckConfig `yaml:"file_check"`
+
+	// background audio mixed into composite outputs
+	AudioBed AudioBedConfig `yaml:"audio_bed"`
+
+	// ebu r128 loudness normalization of composite audio
+	Loudness LoudnessConfig `yaml:"loudness"`
+
+	// shown in place of track composite video while the video source is stalled
+	Slate SlateConfig `yaml:"slate"`
+
+	// drawn behind composited video, and shown in place of stalled or muted track composite video when there's no slate
+	Background BackgroundConfig `yaml:"background"`
+
+	// what happens when the pipeline doesn't finish after being sent EOS
+	Watchdog WatchdogConfig `yaml:"watchdog"`
+
+	// track and track composite behavior once their tracks end
+	TrackEnd TrackEndConfig `yaml:"track_end"`
+
+	// track egress websocket destinations
+	Websocket WebsocketConfig `yaml:"websocket"`
+
+	// still images captured alongside file and segment outputs
+	Snapshots SnapshotsConfig `yaml:"snapshots"`
+
+	// caption files built from transcription data messages
+	Captions CaptionsConfig `yaml:"captions"`
+
+	// a clock burned into encoded video
+	Timecode TimecodeConfig `yaml:"timecode"`
+
+	// text drawn over encoded video, set while the egress is running
+	TextOverlay TextOverlayConfig `yaml:"text_overlay"`
+
+	// short animated gifs captured alongside file and segment outputs
+	Previews PreviewsConfig `yaml:"previews"`
+
+	// h264 encoder, for every output encoding h264
+	H264 H264Config `yaml:"h264"`
+
+	// h265 encoding for file and segment outputs
+	H265 H265Config `yaml:"h265"`
+
+	// intel and amd gpus used by vaapi encoders
+	VAAPI VAAPIConfig `yaml:"vaapi"`
+
+	// vp9 encoding for webm and mkv outputs
+	VP9 VP9Config `yaml:"vp9"`
+
+	// properties set on encoder elements, by element name, for settings without their own config. Applied last
+	EncoderOptions map[string]map[string]string `yaml:"encoder_options"`
+
+	// video rate control, by egress type (file, segments, stream or websocket). Other types keep each encoder's default
+	RateControl map[string]*RateControlConfig `yaml:"rate_control"`
+
+	// retransmission settings for rist stream outputs
+	Rist RistConfig `yaml:"rist"`
+
+	// tls settings for rtmps stream outputs
+	RTMPS RTMPSConfig `yaml:"rtmps"`
+
+	// connect command settings for rtmp and rtmps stream outputs, by ingest host
+	RTMPConnect map[string]*RTMPConnectConfig `yaml:"rtmp_connect"`
+
+	// how often the health of each stream output is reported. Defaults to 10s, negative values disable it
+	StreamHealthInterval time.Duration `yaml:"stream_health_interval"`
+
+	// encoding limits for stream outputs, by ingest host. Limited destinations get their own transrated copy of the video
+	StreamCaps map[string]*StreamCapConfig `yaml:"stream_caps"`
+
+	// named storage, used by requests with a bucket or container name of "profile:<name>"
+	StorageProfiles map[string]*StorageProfileConfig `yaml:"storage_profiles"`
+
 	SessionLimits `yaml:"session_limits"`
 
 	// internal
@@ -61,6 +262,11 @@ type S3Config struct {
 	Bucket    string `yaml:"bucket"`
 }
 
+type S3BucketConfig struct {
+	RequesterPays bool   `yaml:"requester_pays"` // the egress's credentials are charged for requests to the bucket
+	ACL           string `yaml:"acl"`            // canned acl for uploaded objects, such as bucket-owner-full-control
+}
+
 type AzureConfig struct {
 	AccountName   string `yaml:"account_name"` // (env AZURE_STORAGE_ACCOUNT)
 	AccountKey    string `yaml:"account_key"`  // (env AZURE_STORAGE_KEY)
@@ -72,12 +278,252 @@ type GCPConfig struct {
 	Bucket          string `yaml:"bucket"`
 }
 
+type ChromeConfig struct {
+	Sandbox         bool     `yaml:"sandbox"`          // use chrome's sandbox, which needs unprivileged user namespaces
+	Launcher        []string `yaml:"launcher"`         // command chrome is run with, such as bwrap or nsjail with a seccomp profile
+	RestrictNetwork bool     `yaml:"restrict_network"` // only connect to the template, livekit, and allowed hosts
+	AllowedHosts    []string `yaml:"allowed_hosts"`    // additional hosts templates can connect to, supports wildcards such as *.example.com
+}
+
+type TemplatesConfig struct {
+	SigningKey       string            `yaml:"signing_key"`       // hmac-sha256 key for signed template urls, can be a secret reference
+	RequireSignature bool              `yaml:"require_signature"` // reject custom base urls that aren't signed
+	Integrity        map[string]string `yaml:"integrity"`         // template url -> subresource integrity hashes of its html
+}
+
+type SecretsConfig struct {
+	RequestReferences []string `yaml:"request_references"` // prefixes of the references requests can use, such as vault://secret/data/youtube#. Requests can't use any by default
+}
+
+type TmpfsConfig struct {
+	Directory string `yaml:"directory"`
+	SizeLimit int64  `yaml:"size_limit"` // in MB. Segments spill over to local_directory above this usage
+}
+
 type SessionLimits struct {
 	FileOutputMaxDuration    time.Duration `yaml:"file_output_max_duration"`
 	StreamOutputMaxDuration  time.Duration `yaml:"stream_output_max_duration"`
 	SegmentOutputMaxDuration time.Duration `yaml:"segment_output_max_duration"`
 }
 
+type SegmentsConfig struct {
+	Container            string `yaml:"container"`              // ts (default) or fmp4
+	AudioOnlyContainer   string `yaml:"audio_only_container"`   // ts, fmp4, or aac (packed audio). Defaults to container
+	InMemory             bool   `yaml:"in_memory"`              // upload segments from memory without writing them to disk
+	SegmentDuration      int    `yaml:"segment_duration"`       // seconds, used when the request doesn't set one. Defaults to 6
+	FirstSegmentDuration int    `yaml:"first_segment_duration"` // seconds, a shorter first segment so live playback can start sooner. Defaults to the segment duration
+	PlaylistWindow       int    `yaml:"playlist_window"`        // segments kept in a live playlist, older ones are deleted. Defaults to 0 (keep all)
+	PlaylistType         string `yaml:"playlist_type"`          // event (default) or vod, which switches the event playlist to vod once complete
+	SingleFile           bool   `yaml:"single_file"`            // write segments as byte ranges of a single media file
+	ContentAddressed     bool   `yaml:"content_addressed"`      // name segments by the sha-256 of their contents
+	TimedMetadata        bool   `yaml:"timed_metadata"`         // add ID3 timed metadata sent by the room or template to ts segments
+
+	Encryption    SegmentEncryptionConfig    `yaml:"encryption"`
+	Failover      SegmentFailoverConfig      `yaml:"failover"`
+	Compatibility SegmentCompatibilityConfig `yaml:"compatibility"`
+}
+
+type SegmentEncryptionConfig struct {
+	Enabled     bool   `yaml:"enabled"`      // encrypt hls segments with AES-128
+	KeyURI      string `yaml:"key_uri"`      // written to EXT-X-KEY, supports {filename}. Defaults to the key filename
+	KeyRotation int    `yaml:"key_rotation"` // number of segments per key. Defaults to a single key
+}
+
+type SegmentCompatibilityConfig struct {
+	Enabled bool `yaml:"enabled"` // write playlists and segments for legacy players
+	Version int  `yaml:"version"` // EXT-X-VERSION of playlists in compatibility mode, 1 to 6. Defaults to 3
+}
+
+type SegmentFailoverConfig struct {
+	S3        *S3Config    `yaml:"s3"`
+	Azure     *AzureConfig `yaml:"azure"`
+	GCP       *GCPConfig   `yaml:"gcp"`
+	Threshold int          `yaml:"threshold"` // consecutive failed segment uploads before failing over. Defaults to 3
+
+	Upload interface{} `yaml:"-"` // one of S3, Azure, or GCP
+}
+
+type StorageProfileConfig struct {
+	S3         *S3Config    `yaml:"s3"`
+	Azure      *AzureConfig `yaml:"azure"`
+	GCP        *GCPConfig   `yaml:"gcp"`
+	PathPrefix string       `yaml:"path_prefix"` // prepended to file and segment storage paths
+
+	// overrides file_metadata for files stored with this profile. Tags are added to the file_metadata tags
+	FileMetadata FileMetadataConfig `yaml:"file_metadata"`
+
+	// replaces retention for files and segments stored with this profile
+	Retention *RetentionConfig `yaml:"retention"`
+
+	// ends file and segment egresses stored with this profile sooner than session_limits
+	MaxDuration time.Duration `yaml:"max_duration"`
+
+	Name   string      `yaml:"-"`
+	Upload interface{} `yaml:"-"` // one of S3, Azure, or GCP
+}
+
+type RetentionConfig struct {
+	TTL    time.Duration `yaml:"ttl"`     // how long uploads should be kept. Defaults to 0 (no hints)
+	TagKey string        `yaml:"tag_key"` // s3 object tag, azure blob index tag, and gcs metadata key holding the ttl in days. Defaults to retention-days
+}
+
+type FileMetadataConfig struct {
+	Title    string            `yaml:"title"`    // supports {room_name}, {egress_id}, and {track_id}
+	Language string            `yaml:"language"` // ISO 639-2 code, applied to every track
+	Tags     map[string]string `yaml:"tags"`     // custom key/value pairs, written as extended comments
+}
+
+type WavConfig struct {
+	BitDepth int32 `yaml:"bit_depth"` // 16 (default), 24, or 32
+}
+
+type BumpersConfig struct {
+	Intro string `yaml:"intro"` // local file or url
+	Outro string `yaml:"outro"` // local file or url
+}
+
+type FileCheckConfig struct {
+	Enabled bool          `yaml:"enabled"` // defaults to false
+	Timeout time.Duration `yaml:"timeout"` // for decoding the first and last gop. Defaults to 30s
+}
+
+type LoudnessConfig struct {
+	Enabled bool    `yaml:"enabled"` // defaults to false
+	Target  float64 `yaml:"target"`  // integrated loudness in LUFS, from -70 to -5. Defaults to -23, the ebu r128 target
+}
+
+type AudioBedConfig struct {
+	File         string  `yaml:"file"`          // local file or url, looped for the duration of the egress
+	Volume       float64 `yaml:"volume"`        // 0 to 1, defaults to 0.3
+	DuckedVolume float64 `yaml:"ducked_volume"` // volume while the program has audio, defaults to 0.05
+}
+
+type SlateConfig struct {
+	Image        string        `yaml:"image"`         // png or jpeg file
+	StallTimeout time.Duration `yaml:"stall_timeout"` // time without video before the slate is shown. Defaults to 2s
+}
+
+type BackgroundConfig struct {
+	Color string `yaml:"color"` // hex rgb, such as #1a1a2e. Defaults to black, or white for -light layouts
+	Image string `yaml:"image"` // png or jpeg file or url, shown instead of the color and scaled to fit the frame
+
+	// internal
+	ARGB uint32 `yaml:"-"`
+}
+
+type WatchdogConfig struct {
+	Timeout     time.Duration `yaml:"timeout"`      // time after EOS before the pipeline is considered frozen. Defaults to 15s
+	DotDump     bool          `yaml:"dot_dump"`     // store a graphviz dump of the frozen pipeline next to the recording
+	StackTraces bool          `yaml:"stack_traces"` // store the handler's goroutine stacks next to the recording
+	Finalize    bool          `yaml:"finalize"`     // push EOS past the frozen elements, and upload what was written before failing
+}
+
+type TrackEndConfig struct {
+	Stop   bool          `yaml:"stop"`   // complete as soon as any subscribed track is unpublished, or its publisher leaves
+	Linger time.Duration `yaml:"linger"` // time to keep recording before completing
+}
+
+type WebsocketConfig struct {
+	RefreshUrl       string        `yaml:"refresh_url"`       // called for a new destination url before the current one expires
+	RefreshInterval  time.Duration `yaml:"refresh_interval"`  // time between refreshes, unless the endpoint returns an expiry. Defaults to 10m
+	ReconnectTimeout time.Duration `yaml:"reconnect_timeout"` // how long to keep reconnecting after the connection drops. Defaults to 30s, negative to disable
+	BufferSize       int           `yaml:"buffer_size"`       // in MB, media kept while reconnecting. Defaults to 16
+
+	// connection settings, by destination host
+	Hosts map[string]*WebsocketHostConfig `yaml:"hosts"`
+}
+
+type WebsocketHostConfig struct {
+	Headers            map[string]string `yaml:"headers"`              // sent when connecting, supports ${secret} references
+	CAFile             string            `yaml:"ca_file"`              // pem bundle trusted in addition to the system roots
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"` // skips certificate verification, for testing
+	CertFile           string            `yaml:"cert_file"`            // client certificate, for mutual tls
+	KeyFile            string            `yaml:"key_file"`
+}
+
+type SnapshotsConfig struct {
+	Interval time.Duration `yaml:"interval"` // time between images. Defaults to 0 (disabled)
+	Format   string        `yaml:"format"`   // jpeg (default) or png
+	Width    int32         `yaml:"width"`    // image width, keeping the aspect ratio. Defaults to the video width
+}
+
+type CaptionsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Format  string `yaml:"format"` // vtt (default) or srt
+	Embed   bool   `yaml:"embed"`  // embeds CEA-608 captions in h264 stream outputs. Defaults to false
+}
+
+type TimecodeConfig struct {
+	Mode     string `yaml:"mode"`     // wallclock or running. Defaults to none (disabled)
+	Position string `yaml:"position"` // top-left (default), top-center, top-right, bottom-left, bottom-center or bottom-right
+	Format   string `yaml:"format"`   // strftime format of the wall clock. Defaults to %Y-%m-%d %H:%M:%S
+	Font     string `yaml:"font"`     // pango font description. Defaults to Monospace 16
+}
+
+type TextOverlayConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Position string `yaml:"position"` // position of text updates which don't set one. Defaults to bottom-left
+	Font     string `yaml:"font"`     // pango font description. Defaults to Sans Bold 24
+}
+
+type PreviewsConfig struct {
+	Interval  time.Duration `yaml:"interval"`  // time between the start of each preview. Defaults to 0 (disabled)
+	Duration  time.Duration `yaml:"duration"`  // defaults to 5s
+	Framerate int32         `yaml:"framerate"` // defaults to 10
+	Width     int32         `yaml:"width"`     // defaults to 320, keeping the aspect ratio
+}
+
+type H264Config struct {
+	Encoder string `yaml:"encoder"` // x264enc (default), nvh264enc or vaapih264enc, which fall back to x264enc on nodes without a gpu
+	Preset  string `yaml:"preset"`  // x264enc speed preset, from ultrafast to veryslow. Defaults to veryfast
+	Level   string `yaml:"level"`   // level signaled in the stream, such as 4.1. Chosen by the encoder when empty
+}
+
+type H265Config struct {
+	Enabled bool   `yaml:"enabled"` // encode file and segment outputs as h265 unless the request picks an h264 codec
+	Encoder string `yaml:"encoder"` // x265enc (default), nvh265enc or vaapih265enc
+}
+
+type VAAPIConfig struct {
+	Device string `yaml:"device"` // drm render node, such as /dev/dri/renderD129. Defaults to the first one found
+}
+
+type VP9Config struct {
+	Enabled bool  `yaml:"enabled"`  // encode webm and mkv outputs as vp9 unless the request picks an h264 codec
+	CPUUsed int32 `yaml:"cpu_used"` // speed, from 0 (best quality) to 8 (fastest). Defaults to 4
+	Quality int32 `yaml:"quality"`  // constrained quality level, from 1 (best) to 63. Defaults to 0, constant bitrate
+}
+
+type RateControlConfig struct {
+	Mode       string        `yaml:"mode"`        // cbr, vbr or crf
+	Quality    int32         `yaml:"quality"`     // crf quality, from 0 (best) to 51. Defaults to 23
+	BufferSize time.Duration `yaml:"buffer_size"` // vbv buffer, as time at the bitrate. Defaults to 1s
+}
+
+type RistConfig struct {
+	SenderBuffer     time.Duration `yaml:"sender_buffer"`      // packets kept for retransmission. Defaults to 1.2s
+	MinRTCPInterval  time.Duration `yaml:"min_rtcp_interval"`  // defaults to 100ms
+	MaxRTCPBandwidth float64       `yaml:"max_rtcp_bandwidth"` // fraction of the stream bitrate used for retransmissions. Defaults to 0.05
+}
+
+type RTMPSConfig struct {
+	CAFile             string            `yaml:"ca_file"`              // pem bundle trusted in addition to the system roots
+	InsecureSkipVerify bool              `yaml:"insecure_skip_verify"` // skips certificate verification, for testing
+	ServerNames        map[string]string `yaml:"server_names"`         // server name sent for each ingest host, when it differs
+}
+
+type RTMPConnectConfig struct {
+	FlashVersion string                 `yaml:"flash_version"` // flashVer sent in the connect command. Defaults to gstreamer's
+	Args         map[string]interface{} `yaml:"args"`          // extra connect arguments, as strings, numbers, or booleans
+}
+
+type StreamCapConfig struct {
+	MaxBitrate  int32         `yaml:"max_bitrate"` // video bitrate in kbps
+	MaxWidth    int32         `yaml:"max_width"`
+	MaxHeight   int32         `yaml:"max_height"`
+	MaxDuration time.Duration `yaml:"max_duration"` // ends stream egresses to the host sooner than session_limits
+}
+
 type CPUCostConfig struct {
 	RoomCompositeCpuCost  float64 `yaml:"room_composite_cpu_cost"`
 	TrackCompositeCpuCost float64 `yaml:"track_composite_cpu_cost"`
@@ -99,30 +545,66 @@ func NewConfig(confString string) (*Config, error) {
 		}
 	}
 
-	if conf.S3 != nil {
-		conf.FileUpload = &livekit.S3Upload{
-			AccessKey: conf.S3.AccessKey,
-			Secret:    conf.S3.Secret,
-			Region:    conf.S3.Region,
-			Endpoint:  conf.S3.Endpoint,
-			Bucket:    conf.S3.Bucket,
-		}
-	} else if conf.GCP != nil {
-		var credentials []byte
-		if conf.GCP.CredentialsJSON != "" {
-			credentials = []byte(conf.GCP.CredentialsJSON)
-		}
-		conf.FileUpload = &livekit.GCPUpload{
-			Credentials: credentials,
-			Bucket:      conf.GCP.Bucket,
+	// credentials can be secret references, such as vault://secret/data/egress#api_secret.
+	// Storage credentials are resolved for each egress instead
+	credentials := []*string{&conf.ApiKey, &conf.ApiSecret, &conf.Templates.SigningKey}
+	if conf.Redis != nil {
+		credentials = append(credentials, &conf.Redis.Password, &conf.Redis.SentinelPassword)
+	}
+	for _, c := range credentials {
+		value, err := secrets.Resolve(*c)
+		if err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
 		}
-	} else if conf.Azure != nil {
-		conf.FileUpload = &livekit.AzureBlobUpload{
-			AccountName:   conf.Azure.AccountName,
-			AccountKey:    conf.Azure.AccountKey,
-			ContainerName: conf.Azure.ContainerName,
+		*c = value
+	}
+
+	conf.FileUpload = getFileUpload(conf.S3, conf.GCP, conf.Azure)
+
+	if conf.AdminPort != 0 && (conf.ApiKey == "" || conf.ApiSecret == "") {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("admin_port requires api_key and api_secret"))
+	}
+
+	if conf.UploadConcurrency == 0 {
+		conf.UploadConcurrency = defaultUploadConcurrency
+	} else if conf.UploadConcurrency < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid upload concurrency %d", conf.UploadConcurrency))
+	}
+	switch conf.UploadCompression {
+	case "", UploadCompressionGzip:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid upload compression %s", conf.UploadCompression))
+	}
+
+	if conf.StartTimeout < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid start timeout %s", conf.StartTimeout))
+	}
+	if conf.DeleteWindow < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid delete window %s", conf.DeleteWindow))
+	}
+
+	switch conf.TrackContainer {
+	case "", TrackContainerMKV, TrackContainerWebM:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid track container %s", conf.TrackContainer))
+	}
+
+	switch conf.OpusDTX {
+	case "", OpusDTXGaps, OpusDTXSilence:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid opus dtx handling %s", conf.OpusDTX))
+	}
+
+	if conf.Templates.RequireSignature && conf.Templates.SigningKey == "" {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("templates require a signature, but no signing key is set"))
+	}
+
+	for _, prefix := range conf.Secrets.RequestReferences {
+		if !strings.Contains(prefix, "://") {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid request secret reference %q", prefix))
 		}
 	}
+
 	// Setting CPU costs from config. Ensure that CPU costs are positive
 	if conf.CPUCost.TrackCpuCost <= 0.0 {
 		conf.CPUCost.TrackCpuCost = trackCpuCost
@@ -134,10 +616,417 @@ func NewConfig(confString string) (*Config, error) {
 		conf.CPUCost.RoomCompositeCpuCost = roomCompositeCpuCost
 	}
 
+	switch conf.Segments.Container {
+	case "":
+		conf.Segments.Container = SegmentContainerTS
+	case SegmentContainerTS, SegmentContainerFMP4:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid segment container %s", conf.Segments.Container))
+	}
+	switch conf.Segments.AudioOnlyContainer {
+	case "":
+		conf.Segments.AudioOnlyContainer = conf.Segments.Container
+	case SegmentContainerTS, SegmentContainerFMP4, SegmentContainerAAC:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid audio only segment container %s", conf.Segments.AudioOnlyContainer))
+	}
+
+	if conf.Segments.SegmentDuration == 0 {
+		conf.Segments.SegmentDuration = defaultSegmentDuration
+	} else if conf.Segments.SegmentDuration < 0 || conf.Segments.SegmentDuration > MaxSegmentDuration {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid segment duration %d", conf.Segments.SegmentDuration))
+	}
+	if conf.Segments.FirstSegmentDuration < 0 || conf.Segments.FirstSegmentDuration > MaxSegmentDuration {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid first segment duration %d", conf.Segments.FirstSegmentDuration))
+	}
+	if conf.Segments.PlaylistWindow < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid playlist window %d", conf.Segments.PlaylistWindow))
+	}
+	switch conf.Segments.PlaylistType {
+	case "":
+		conf.Segments.PlaylistType = PlaylistTypeEvent
+	case PlaylistTypeEvent, PlaylistTypeVOD:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid playlist type %s", conf.Segments.PlaylistType))
+	}
+	if conf.Segments.SingleFile && conf.Segments.PlaylistWindow > 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("single file segments cannot have a playlist window"))
+	}
+	if conf.Segments.SingleFile && conf.Segments.ContentAddressed {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("single file segments cannot be content addressed"))
+	}
+	if conf.Segments.PlaylistType == PlaylistTypeVOD && conf.Segments.PlaylistWindow > 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("vod playlists cannot have a playlist window"))
+	}
+
+	if conf.Segments.Compatibility.Version == 0 {
+		conf.Segments.Compatibility.Version = defaultCompatibilityVersion
+	} else if conf.Segments.Compatibility.Version < 1 || conf.Segments.Compatibility.Version > 6 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid compatibility version %d", conf.Segments.Compatibility.Version))
+	}
+
+	if conf.Segments.Encryption.Enabled {
+		if conf.Segments.Encryption.KeyURI == "" {
+			conf.Segments.Encryption.KeyURI = "{filename}"
+		}
+		if conf.Segments.Encryption.KeyRotation < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid key rotation %d", conf.Segments.Encryption.KeyRotation))
+		}
+	}
+
+	switch conf.Wav.BitDepth {
+	case 0:
+		conf.Wav.BitDepth = 16
+	case 16, 24, 32:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid wav bit depth %d", conf.Wav.BitDepth))
+	}
+
+	if l := conf.FileMetadata.Language; l != "" && len(l) != 3 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid ISO 639-2 language code %s", l))
+	}
+
+	if err := validateRetention(&conf.Retention); err != nil {
+		return nil, err
+	}
+
+	for name, profile := range conf.StorageProfiles {
+		if profile == nil || (profile.S3 == nil && profile.GCP == nil && profile.Azure == nil) {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("storage profile %s has no storage", name))
+		}
+		profile.Name = name
+		profile.Upload = getFileUpload(profile.S3, profile.GCP, profile.Azure)
+		if profile.MaxDuration < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid max_duration for storage profile %s", name))
+		}
+
+		if profile.Retention == nil {
+			profile.Retention = &conf.Retention
+		} else if err := validateRetention(profile.Retention); err != nil {
+			return nil, err
+		}
+
+		metadata := &profile.FileMetadata
+		if metadata.Title == "" {
+			metadata.Title = conf.FileMetadata.Title
+		}
+		if metadata.Language == "" {
+			metadata.Language = conf.FileMetadata.Language
+		} else if len(metadata.Language) != 3 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid ISO 639-2 language code %s", metadata.Language))
+		}
+		if len(conf.FileMetadata.Tags) > 0 {
+			tags := make(map[string]string, len(conf.FileMetadata.Tags)+len(metadata.Tags))
+			for k, v := range conf.FileMetadata.Tags {
+				tags[k] = v
+			}
+			for k, v := range metadata.Tags {
+				tags[k] = v
+			}
+			metadata.Tags = tags
+		}
+	}
+
+	if conf.Slate.Image != "" {
+		if _, err := os.Stat(conf.Slate.Image); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid slate image: %v", err))
+		}
+	}
+	if conf.Background.Color != "" {
+		argb, err := parseColor(conf.Background.Color)
+		if err != nil {
+			return nil, errors.ErrCouldNotParseConfig(err)
+		}
+		conf.Background.ARGB = argb
+	}
+	if conf.Background.Image != "" && !strings.Contains(conf.Background.Image, "://") {
+		if _, err := os.Stat(conf.Background.Image); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid background image: %v", err))
+		}
+	}
+	if conf.Slate.StallTimeout <= 0 && (conf.Slate.Image != "" || conf.Background.Color != "" || conf.Background.Image != "") {
+		conf.Slate.StallTimeout = defaultSlateStallTimeout
+	}
+
+	if conf.Watchdog.Timeout == 0 {
+		conf.Watchdog.Timeout = defaultWatchdogTimeout
+	} else if conf.Watchdog.Timeout < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid watchdog timeout %s", conf.Watchdog.Timeout))
+	}
+
+	if conf.FileCheck.Timeout == 0 {
+		conf.FileCheck.Timeout = defaultFileCheckTimeout
+	} else if conf.FileCheck.Timeout < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid file check timeout %s", conf.FileCheck.Timeout))
+	}
+
+	if conf.Websocket.RefreshUrl != "" && conf.Websocket.RefreshInterval == 0 {
+		conf.Websocket.RefreshInterval = defaultWebsocketRefreshInterval
+	}
+	if conf.Websocket.ReconnectTimeout == 0 {
+		conf.Websocket.ReconnectTimeout = defaultWebsocketReconnectTimeout
+	}
+	if conf.Websocket.BufferSize == 0 {
+		conf.Websocket.BufferSize = defaultWebsocketBufferSize
+	} else if conf.Websocket.BufferSize < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid websocket buffer size %d", conf.Websocket.BufferSize))
+	}
+	for host, h := range conf.Websocket.Hosts {
+		if h == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("missing websocket settings for %s", host))
+		}
+		if (h.CertFile == "") != (h.KeyFile == "") {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("websocket client certificate for %s needs both cert_file and key_file", host))
+		}
+	}
+	if conf.Websocket.RefreshInterval < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid websocket refresh interval %s", conf.Websocket.RefreshInterval))
+	}
+
+	if conf.TrackEnd.Linger < 0 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid track end linger %s", conf.TrackEnd.Linger))
+	}
+
+	if conf.AudioBed.File != "" {
+		if conf.AudioBed.Volume == 0 {
+			conf.AudioBed.Volume = defaultAudioBedVolume
+		}
+		if conf.AudioBed.DuckedVolume == 0 {
+			conf.AudioBed.DuckedVolume = defaultAudioBedDuckedVolume
+		}
+		if conf.AudioBed.Volume < 0 || conf.AudioBed.Volume > 1 || conf.AudioBed.DuckedVolume < 0 || conf.AudioBed.DuckedVolume > 1 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid audio bed volume"))
+		}
+	}
+
+	if conf.Loudness.Enabled {
+		if conf.Loudness.Target == 0 {
+			conf.Loudness.Target = defaultLoudnessTarget
+		}
+		if conf.Loudness.Target < -70 || conf.Loudness.Target > -5 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid loudness target %v", conf.Loudness.Target))
+		}
+	}
+
+	if failover := &conf.Segments.Failover; failover.S3 != nil || failover.GCP != nil || failover.Azure != nil {
+		failover.Upload = getFileUpload(failover.S3, failover.GCP, failover.Azure)
+		if failover.Threshold == 0 {
+			failover.Threshold = defaultFailoverThreshold
+		} else if failover.Threshold < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid segment failover threshold %d", failover.Threshold))
+		}
+	}
+
+	if conf.Snapshots.Interval != 0 {
+		switch conf.Snapshots.Format {
+		case "":
+			conf.Snapshots.Format = SnapshotFormatJPEG
+		case SnapshotFormatJPEG, SnapshotFormatPNG:
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid snapshot format %s", conf.Snapshots.Format))
+		}
+		if conf.Snapshots.Interval < 100*time.Millisecond || conf.Snapshots.Width < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid snapshot config"))
+		}
+	}
+
+	if conf.Timecode.Mode != "" {
+		switch conf.Timecode.Mode {
+		case TimecodeModeWallClock, TimecodeModeRunning:
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid timecode mode %s", conf.Timecode.Mode))
+		}
+		if conf.Timecode.Position == "" {
+			conf.Timecode.Position = defaultTimecodePosition
+		} else if !IsOverlayPosition(conf.Timecode.Position) {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid timecode position %s", conf.Timecode.Position))
+		}
+		if conf.Timecode.Format == "" {
+			conf.Timecode.Format = defaultTimecodeFormat
+		}
+		if conf.Timecode.Font == "" {
+			conf.Timecode.Font = defaultTimecodeFont
+		}
+	}
+
+	if conf.TextOverlay.Enabled {
+		if conf.TextOverlay.Position == "" {
+			conf.TextOverlay.Position = defaultTextOverlayPosition
+		} else if !IsOverlayPosition(conf.TextOverlay.Position) {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid text overlay position %s", conf.TextOverlay.Position))
+		}
+		if conf.TextOverlay.Font == "" {
+			conf.TextOverlay.Font = defaultTextOverlayFont
+		}
+	}
+
+	if conf.Captions.Enabled {
+		switch conf.Captions.Format {
+		case "":
+			conf.Captions.Format = CaptionsFormatVTT
+		case CaptionsFormatVTT, CaptionsFormatSRT:
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid captions format %s", conf.Captions.Format))
+		}
+	}
+
+	if conf.Previews.Interval != 0 {
+		if conf.Previews.Duration == 0 {
+			conf.Previews.Duration = defaultPreviewDuration
+		}
+		if conf.Previews.Framerate == 0 {
+			conf.Previews.Framerate = defaultPreviewFramerate
+		}
+		if conf.Previews.Width == 0 {
+			conf.Previews.Width = defaultPreviewWidth
+		}
+		if conf.Previews.Duration < 0 || conf.Previews.Duration > conf.Previews.Interval ||
+			conf.Previews.Framerate < 0 || conf.Previews.Framerate > 50 || conf.Previews.Width < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid preview config"))
+		}
+	}
+
+	if conf.KeyFrameInterval < 0 || conf.KeyFrameInterval > MaxSegmentDuration*time.Second {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid key_frame_interval %s", conf.KeyFrameInterval))
+	}
+
+	switch conf.H264.Encoder {
+	case "":
+		conf.H264.Encoder = H264EncoderX264
+	case H264EncoderX264, H264EncoderNVENC, H264EncoderVAAPI:
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid h264 encoder %s", conf.H264.Encoder))
+	}
+	switch conf.H264.Preset {
+	case "":
+		conf.H264.Preset = defaultH264Preset
+	case "ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow":
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid h264 preset %s", conf.H264.Preset))
+	}
+	switch conf.H264.Level {
+	case "", "1", "1b", "1.1", "1.2", "1.3", "2", "2.1", "2.2", "3", "3.1", "3.2", "4", "4.1", "4.2", "5", "5.1", "5.2":
+	default:
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid h264 level %s", conf.H264.Level))
+	}
+
+	if conf.H265.Enabled {
+		switch conf.H265.Encoder {
+		case "":
+			conf.H265.Encoder = H265EncoderX265
+		case H265EncoderX265, H265EncoderNVENC, H265EncoderVAAPI:
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid h265 encoder %s", conf.H265.Encoder))
+		}
+	}
+
+	if conf.VP9.Enabled {
+		if conf.VP9.CPUUsed == 0 {
+			conf.VP9.CPUUsed = defaultVP9CPUUsed
+		}
+		if conf.VP9.CPUUsed < 0 || conf.VP9.CPUUsed > 8 || conf.VP9.Quality < 0 || conf.VP9.Quality > 63 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid vp9 config"))
+		}
+	}
+
+	if conf.Rist.SenderBuffer == 0 {
+		conf.Rist.SenderBuffer = defaultRistSenderBuffer
+	}
+	if conf.Rist.MinRTCPInterval == 0 {
+		conf.Rist.MinRTCPInterval = defaultRistMinRTCPInterval
+	}
+	if conf.Rist.MaxRTCPBandwidth == 0 {
+		conf.Rist.MaxRTCPBandwidth = defaultRistMaxRTCPBandwidth
+	}
+	if conf.Rist.SenderBuffer < 0 || conf.Rist.MinRTCPInterval < 0 || conf.Rist.MaxRTCPBandwidth < 0 || conf.Rist.MaxRTCPBandwidth > 1 {
+		return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rist config"))
+	}
+
+	for bucket, b := range conf.S3Buckets {
+		if b == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("missing settings for s3 bucket %s", bucket))
+		}
+		switch b.ACL {
+		case "", "private", "public-read", "public-read-write", "authenticated-read",
+			"aws-exec-read", "bucket-owner-read", "bucket-owner-full-control":
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid acl %s for s3 bucket %s", b.ACL, bucket))
+		}
+	}
+
+	for host, connect := range conf.RTMPConnect {
+		if connect == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("missing rtmp connect settings for %s", host))
+		}
+		for name, value := range connect.Args {
+			if !connectArgRegexp.MatchString(name) {
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rtmp connect arg %s", name))
+			}
+			switch value.(type) {
+			case string, int, float64, bool:
+			default:
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rtmp connect arg %s: %v", name, value))
+			}
+		}
+	}
+
+	if conf.StreamHealthInterval == 0 {
+		conf.StreamHealthInterval = defaultStreamHealthInterval
+	}
+
+	for element, options := range conf.EncoderOptions {
+		for name := range options {
+			if element == "" || name == "" {
+				return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid encoder option %s for %s", name, element))
+			}
+		}
+	}
+
+	for egressType, rc := range conf.RateControl {
+		switch egressType {
+		case "file", "segments", "stream", "websocket":
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rate_control egress type %s", egressType))
+		}
+		if rc == nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rate control for %s", egressType))
+		}
+		switch rc.Mode {
+		case RateControlCBR, RateControlVBR, RateControlCRF:
+		default:
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rate control mode %s", rc.Mode))
+		}
+		if rc.Quality == 0 {
+			rc.Quality = defaultRateControlQuality
+		}
+		if rc.BufferSize == 0 {
+			rc.BufferSize = defaultRateControlBufferSize
+		}
+		if rc.Quality < 0 || rc.Quality > 51 || rc.BufferSize < 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rate control for %s", egressType))
+		}
+	}
+
+	for host, limit := range conf.StreamCaps {
+		if limit == nil || limit.MaxBitrate < 0 || limit.MaxWidth < 0 || limit.MaxHeight < 0 || limit.MaxDuration < 0 ||
+			limit.MaxBitrate == 0 && limit.MaxWidth == 0 && limit.MaxHeight == 0 && limit.MaxDuration == 0 {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid stream cap for %s", host))
+		}
+	}
+
+	if conf.RTMPS.CAFile != "" {
+		if _, err := os.Stat(conf.RTMPS.CAFile); err != nil {
+			return nil, errors.ErrCouldNotParseConfig(fmt.Errorf("invalid rtmps ca_file: %v", err))
+		}
+	}
+
 	conf.LocalOutputDirectory = path.Clean(conf.LocalOutputDirectory)
 	if conf.LocalOutputDirectory == "." {
 		conf.LocalOutputDirectory = defaultLocalOutputDirectory
 	}
+	if conf.Tmpfs.Directory != "" {
+		conf.Tmpfs.Directory = path.Clean(conf.Tmpfs.Directory)
+	}
 
 	if err := conf.initLogger(); err != nil {
 		return nil, err
@@ -146,6 +1035,72 @@ func NewConfig(confString string) (*Config, error) {
 	return conf, nil
 }
 
+// getFileUpload converts the first storage config set into its upload request type
+func getFileUpload(s3 *S3Config, gcp *GCPConfig, azure *AzureConfig) interface{} {
+	switch {
+	case s3 != nil:
+		return &livekit.S3Upload{
+			AccessKey: getEnvDefault(s3.AccessKey, "AWS_ACCESS_KEY_ID"),
+			Secret:    getEnvDefault(s3.Secret, "AWS_SECRET_ACCESS_KEY"),
+			Region:    getEnvDefault(s3.Region, "AWS_DEFAULT_REGION"),
+			Endpoint:  s3.Endpoint,
+			Bucket:    s3.Bucket,
+		}
+	case gcp != nil:
+		// without credentials_json, the client uses GOOGLE_APPLICATION_CREDENTIALS
+		var credentials []byte
+		if gcp.CredentialsJSON != "" {
+			credentials = []byte(gcp.CredentialsJSON)
+		}
+		return &livekit.GCPUpload{
+			Credentials: credentials,
+			Bucket:      gcp.Bucket,
+		}
+	case azure != nil:
+		return &livekit.AzureBlobUpload{
+			AccountName:   getEnvDefault(azure.AccountName, "AZURE_STORAGE_ACCOUNT"),
+			AccountKey:    getEnvDefault(azure.AccountKey, "AZURE_STORAGE_KEY"),
+			ContainerName: azure.ContainerName,
+		}
+	default:
+		return nil
+	}
+}
+
+// validateRetention sets the default tag key. Lifecycle rules count in days, so shorter ttls can't be applied
+func validateRetention(retention *RetentionConfig) error {
+	if retention.TTL == 0 {
+		return nil
+	}
+	if retention.TTL < 24*time.Hour {
+		return errors.ErrCouldNotParseConfig(fmt.Errorf("retention ttl %s is shorter than a day", retention.TTL))
+	}
+	if retention.TagKey == "" {
+		retention.TagKey = defaultRetentionTagKey
+	}
+	return nil
+}
+
+// parseColor reads a hex rgb color, with or without a leading #, as opaque argb
+func parseColor(color string) (uint32, error) {
+	hex := strings.TrimPrefix(color, "#")
+	if len(hex) != 6 {
+		return 0, fmt.Errorf("invalid color %s", color)
+	}
+	rgb, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid color %s", color)
+	}
+	return 0xff000000 | uint32(rgb), nil
+}
+
+func getEnvDefault(value, env string) string {
+	if value != "" {
+		return value
+	}
+	return os.Getenv(env)
+}
+
 func (c *Config) initLogger() error {
 	conf := zap.NewProductionConfig()
 	if c.LogLevel != "" {
@@ -159,3 +1114,13 @@ func (c *Config) initLogger() error {
 	logger.SetLogger(zapr.NewLogger(l).WithValues("nodeID", c.NodeID), "egress")
 	return nil
 }
+
+// IsOverlayPosition checks that a position is a vertical edge and a horizontal alignment, such as bottom-right
+func IsOverlayPosition(position string) bool {
+	parts := strings.Split(position, "-")
+	if len(parts) != 2 {
+		return false
+	}
+	return (parts[0] == "top" || parts[0] == "bottom") &&
+		(parts[1] == "left" || parts[1] == "center" || parts[1] == "right")
+}
@@ -3,6 +3,7 @@ package errors
 import (
 	"errors"
 	"fmt"
+	"strings"
 )
 
 var (
@@ -11,6 +12,14 @@ var (
 	ErrGhostPadFailed      = errors.New("failed to add ghost pad to bin")
 	ErrStreamAlreadyExists = errors.New("stream already exists")
 	ErrStreamNotFound      = errors.New("stream not found")
+	ErrEgressAborted       = errors.New("egress aborted")
+	ErrEgressNotFound      = errors.New("egress not found")
+	ErrEgressRunning       = errors.New("egress still running")
+	ErrDeleteInProgress    = errors.New("egress uploads already being deleted")
+	ErrNoTrackLayout       = errors.New("egress has no track layout")
+	ErrNoTextOverlay       = errors.New("egress has no text overlay")
+	ErrNoTemplate          = errors.New("egress has no template")
+	ErrPermissionDenied    = errors.New("permission denied")
 )
 
 func New(err string) error {
@@ -41,6 +50,10 @@ func ErrInvalidUrl(url, protocol string) error {
 	return fmt.Errorf("invalid %s url: %s", protocol, url)
 }
 
+func ErrTemplateRejected(reason string) error {
+	return fmt.Errorf("template rejected: %s", reason)
+}
+
 func ErrTrackNotFound(trackID string) error {
 	return fmt.Errorf("track %s not found", trackID)
 }
@@ -53,6 +66,34 @@ func ErrUploadFailed(location string, err error) error {
 	return fmt.Errorf("%s upload failed: %v", location, err)
 }
 
+func ErrUploadsFailed(errs []error) error {
+	return fmt.Errorf("%d uploads failed: %s", len(errs), joinErrors(errs))
+}
+
+func ErrDeletesFailed(errs []error) error {
+	return fmt.Errorf("%d deletes failed: %s", len(errs), joinErrors(errs))
+}
+
+func joinErrors(errs []error) string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func ErrFileCheckFailed(err error) error {
+	return fmt.Errorf("file check failed: %v", err)
+}
+
+func ErrTLSHandshakeFailed(host string, err error) error {
+	return fmt.Errorf("tls handshake with %s failed: %v", host, err)
+}
+
+func ErrWHIPFailed(host string, err error) error {
+	return fmt.Errorf("whip session with %s failed: %v", host, err)
+}
+
 func ErrWebSocketClosed(addr string) error {
 	return errors.New(fmt.Sprintf("websocket already closed: %s", addr))
 }
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+
+	"github.com/livekit/protocol/livekit"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+	"github.com/livekit/egress/pkg/pipeline/source"
+	"github.com/livekit/egress/pkg/stats"
+)
+
+// storedFile is an upload which is deleted if the egress is aborted, or reported so that it can be deleted after
+// the egress ends. Without an upload, it's a local output
+type storedFile struct {
+	upload   interface{}
+	filepath string
+}
+
+// Abort ends the egress without finalizing it, for recordings which must be discarded.
+// Nothing more is uploaded, anything already stored is deleted, and the egress ends as aborted
+func (p *Pipeline) Abort(ctx context.Context) {
+	p.Logger.Infow("aborting egress")
+	p.aborted.Store(true)
+	p.setEndedReason(EndReasonAborted)
+
+	// ends the wait for the room to become active, if it's still waiting
+	p.closedOnce.Do(func() {
+		close(p.closed)
+	})
+	p.stop()
+}
+
+// recordStored keeps track of stored files, so they can be deleted if the egress is aborted
+func (p *Pipeline) recordStored(upload interface{}, filepath string) {
+	p.storedMu.Lock()
+	p.stored = append(p.stored, storedFile{upload: upload, filepath: filepath})
+	p.storedMu.Unlock()
+}
+
+// UploadedFiles returns the storage paths of everything the egress uploaded, and of anything stored in the failover storage
+func (p *Pipeline) UploadedFiles() *stats.UploadedFiles {
+	uploaded := &stats.UploadedFiles{
+		EgressID: p.Info.EgressId,
+	}
+
+	p.storedMu.Lock()
+	defer p.storedMu.Unlock()
+
+	for _, f := range p.stored {
+		switch {
+		case f.upload == nil:
+		case p.failover != nil && f.upload == p.failover.secondary:
+			uploaded.FailoverFilepaths = append(uploaded.FailoverFilepaths, f.filepath)
+		default:
+			uploaded.StorageFilepaths = append(uploaded.StorageFilepaths, f.filepath)
+		}
+	}
+	return uploaded
+}
+
+// discardIfAborted deletes everything the egress has stored, returning true if it was aborted
+func (p *Pipeline) discardIfAborted(ctx context.Context) bool {
+	if !p.aborted.Load() {
+		return false
+	}
+
+	// pending segment and image uploads are skipped, but have to finish before their files are deleted
+	if p.endedSegments != nil {
+		p.segmentsWg.Wait()
+	}
+	p.imagesWg.Wait()
+
+	p.storedMu.Lock()
+	stored := p.stored
+	p.stored = nil
+	p.storedMu.Unlock()
+
+	for _, f := range stored {
+		if f.upload != nil {
+			if err := sink.DeleteUploaded(ctx, f.upload, f.filepath); err != nil {
+				p.Logger.Warnw("failed to delete aborted upload", err, "location", f.filepath)
+			}
+		} else {
+			p.removeLocalOutput(f.filepath)
+		}
+	}
+
+	if p.FileUpload == nil {
+		// local outputs which would have been finalized on stop
+		for _, localFilepath := range p.localOutputs() {
+			p.removeLocalOutput(localFilepath)
+		}
+	}
+
+	// a deferred upload is never handed off, so the handler removes the temp dir
+	p.uploadDeferred = false
+	p.Info.Error = ""
+	p.Info.Status = livekit.EgressStatus_EGRESS_ABORTED
+	return true
+}
+
+func (p *Pipeline) localOutputs() []string {
+	var outputs []string
+	switch p.EgressType {
+	case params.EgressTypeFile:
+		outputs = append(outputs, p.LocalFilepath)
+	case params.EgressTypeSegmentedFile:
+		outputs = append(outputs, p.PlaylistFilename, p.MasterPlaylistFilename, p.SingleFileFilename)
+	}
+
+	suffixes := []string{perfReportSuffix, frozenDotSuffix, frozenStacksSuffix, panicStacksSuffix}
+	if p.DataCapture {
+		suffixes = append(suffixes, source.DataCaptureSuffix)
+	}
+	if p.CaptionsFormat == config.CaptionsFormatVTT || p.CaptionsFormat == config.CaptionsFormatSRT {
+		suffixes = append(suffixes, source.CaptionsSuffix(p.CaptionsFormat))
+	}
+	for _, suffix := range suffixes {
+		if localFilepath, _ := p.GetSidecarFilepaths(suffix); localFilepath != "" {
+			outputs = append(outputs, localFilepath)
+		}
+	}
+	return outputs
+}
+
+func (p *Pipeline) removeLocalOutput(localFilepath string) {
+	if localFilepath == "" {
+		return
+	}
+	if err := os.Remove(localFilepath); err != nil && !os.IsNotExist(err) {
+		p.Logger.Warnw("failed to delete aborted output", err, "path", localFilepath)
+	}
+}
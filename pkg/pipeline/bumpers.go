@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/protocol/tracer"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// addBumpers joins the intro and outro clips with the recording, replacing the local file.
+// The clips are decoded and re-encoded with the recording's settings, so they need to contain the same kinds of tracks.
+func (p *Pipeline) addBumpers(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Pipeline.addBumpers")
+	defer span.End()
+
+	var uris []string
+	for _, clip := range []string{p.IntroClip, p.LocalFilepath, p.OutroClip} {
+		if clip == "" {
+			continue
+		}
+		uri, err := params.MediaURI(clip)
+		if err != nil {
+			return err
+		}
+		uris = append(uris, uri)
+	}
+
+	tmpFilepath := p.LocalFilepath + ".bumpers"
+	description, err := p.bumpersDescription(uris, tmpFilepath)
+	if err != nil {
+		return err
+	}
+
+	p.Logger.Debugw("adding bumpers", "intro", p.IntroClip, "outro", p.OutroClip)
+	pipeline, err := gst.NewPipelineFromString(description)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = pipeline.SetState(gst.StateNull)
+	}()
+
+	if err = pipeline.SetState(gst.StatePlaying); err != nil {
+		return err
+	}
+
+	msg := pipeline.GetPipelineBus().TimedPopFiltered(gst.ClockTimeNone, gst.MessageEOS|gst.MessageError)
+	if msg == nil {
+		return errors.New("bumper pipeline closed unexpectedly")
+	}
+	if msg.Type() == gst.MessageError {
+		_ = os.Remove(tmpFilepath)
+		return msg.ParseError()
+	}
+
+	return os.Rename(tmpFilepath, p.LocalFilepath)
+}
+
+func (p *Pipeline) bumpersDescription(uris []string, location string) (string, error) {
+	var mux string
+	switch p.OutputType {
+	case params.OutputTypeMP4:
+		mux = "mp4mux faststart=true"
+	case params.OutputTypeOGG:
+		mux = "oggmux"
+	case params.OutputTypeWebM:
+		mux = "webmmux"
+	case params.OutputTypeMKV:
+		mux = "matroskamux"
+	default:
+		return "", errors.ErrNotSupported(fmt.Sprintf("bumpers with %s", p.OutputType))
+	}
+
+	var audioEncoder, videoEncoder string
+	if p.AudioEnabled {
+		switch p.AudioCodec {
+		case params.MimeTypeOpus:
+			audioEncoder = fmt.Sprintf("audio/x-raw,rate=48000,channels=2 ! opusenc bitrate=%d", p.AudioBitrate*1000)
+		case params.MimeTypeAAC:
+			audioEncoder = fmt.Sprintf("audio/x-raw,rate=%d,channels=2 ! faac bitrate=%d", p.AudioFrequency, p.AudioBitrate*1000)
+		default:
+			return "", errors.ErrNotSupported(fmt.Sprintf("bumpers with %s", p.AudioCodec))
+		}
+	}
+	if p.VideoEnabled {
+		raw := fmt.Sprintf("video/x-raw,format=I420,width=%d,height=%d,framerate=%d/1,pixel-aspect-ratio=1/1", p.Width, p.Height, p.Framerate)
+		switch p.VideoCodec {
+		case params.MimeTypeH264:
+			x264 := fmt.Sprintf("x264enc bitrate=%d speed-preset=%s", p.VideoBitrate, p.VideoPreset)
+			if keyFrameInterval := p.KeyFrameInterval(); keyFrameInterval > 0 {
+				x264 += fmt.Sprintf(" key-int-max=%d option-string=\"scenecut=0\"", keyFrameInterval)
+			}
+			videoEncoder = fmt.Sprintf("%s ! %s ! video/x-h264,profile=%s", raw, x264, p.VideoProfile)
+		case params.MimeTypeH265:
+			videoEncoder = fmt.Sprintf("%s ! %s bitrate=%d ! h265parse ! video/x-h265,profile=main", raw, p.VideoEncoder, p.VideoBitrate)
+		case params.MimeTypeVP8:
+			videoEncoder = fmt.Sprintf("%s ! vp8enc target-bitrate=%d deadline=1 cpu-used=4", raw, p.VideoBitrate*1000)
+		case params.MimeTypeVP9:
+			videoEncoder = fmt.Sprintf("%s ! vp9enc target-bitrate=%d deadline=1 cpu-used=%d", raw, p.VideoBitrate*1000, p.VP9CPUUsed)
+		default:
+			return "", errors.ErrNotSupported(fmt.Sprintf("bumpers with %s", p.VideoCodec))
+		}
+	}
+
+	elements := []string{fmt.Sprintf("%s name=mux ! filesink location=%q", mux, location)}
+	if audioEncoder != "" {
+		elements = append(elements, fmt.Sprintf("concat name=audio ! audioconvert ! audioresample ! %s ! queue ! mux.", audioEncoder))
+	}
+	if videoEncoder != "" {
+		elements = append(elements, fmt.Sprintf("concat name=video ! videoconvert ! videoscale ! videorate ! %s ! queue ! mux.", videoEncoder))
+	}
+	for i, uri := range uris {
+		elements = append(elements, fmt.Sprintf("uridecodebin uri=%q name=clip%d", uri, i))
+		if audioEncoder != "" {
+			elements = append(elements, fmt.Sprintf("clip%d. ! audio/x-raw ! queue ! audioconvert ! audioresample ! audio.", i))
+		}
+		if videoEncoder != "" {
+			elements = append(elements, fmt.Sprintf("clip%d. ! video/x-raw ! queue ! videoconvert ! videoscale ! video.", i))
+		}
+	}
+
+	return strings.Join(elements, " "), nil
+}
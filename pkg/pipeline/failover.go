@@ -0,0 +1,163 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// segmentFailover moves segment and playlist uploads to secondary storage once uploads to the primary
+// have failed for enough consecutive segments. Files already stored in the primary stay there,
+// and the playlist points to them by their absolute locations
+type segmentFailover struct {
+	mu        sync.Mutex
+	primary   interface{}
+	secondary interface{}
+	threshold int
+	active    bool
+
+	stored map[string]string // filename -> location, for files stored in the primary
+	failed []failedSegment   // consecutive segments that could not be stored in the primary
+}
+
+type failedSegment struct {
+	localPath       string
+	storageFilepath string
+	data            []byte // set for in-memory segments
+}
+
+func newSegmentFailover(p *params.Params) *segmentFailover {
+	return &segmentFailover{
+		primary:   p.FileUpload,
+		secondary: p.FailoverUpload,
+		threshold: p.FailoverThreshold,
+		stored:    make(map[string]string),
+	}
+}
+
+// uploaded records where a file was stored, until the failover happens
+func (f *segmentFailover) uploaded(storageFilepath, location string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.active {
+		f.stored[path.Base(storageFilepath)] = location
+	}
+}
+
+// segmentStored returns true when this failure should trigger the failover
+func (f *segmentFailover) segmentStored(segment failedSegment, err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active {
+		return false
+	}
+	if err == nil {
+		// earlier failures are missing from the primary, as they would be without a failover
+		f.failed = nil
+		return false
+	}
+
+	f.failed = append(f.failed, segment)
+	return len(f.failed) >= f.threshold
+}
+
+// activate switches to the secondary, returning the locations of files stored in the primary and the segments to retry
+func (f *segmentFailover) activate() (map[string]string, []failedSegment) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.active = true
+	failed := f.failed
+	f.failed = nil
+	return f.stored, failed
+}
+
+// upload returns the storage that uploads go to
+func (f *segmentFailover) upload() interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.active {
+		return f.secondary
+	}
+	return f.primary
+}
+
+// expire returns the storage holding an expired file
+func (f *segmentFailover) expire(filename string, current interface{}) interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.stored[filename]; ok {
+		delete(f.stored, filename)
+		return f.primary
+	}
+	return current
+}
+
+// getUpload returns the storage that uploads go to, which is the secondary once segment uploads have failed over.
+// Uploads run on several goroutines, so they never read FileUpload directly
+func (p *Pipeline) getUpload() interface{} {
+	if p.failover != nil {
+		return p.failover.upload()
+	}
+	return p.FileUpload
+}
+
+// segmentStored counts consecutive segment upload failures, failing over once there are too many
+func (p *Pipeline) segmentStored(localPath, storageFilepath string, data []byte, err error) {
+	if p.failover == nil {
+		return
+	}
+
+	segment := failedSegment{localPath: localPath, storageFilepath: storageFilepath, data: data}
+	if p.failover.segmentStored(segment, err) {
+		p.failOver()
+	}
+}
+
+// failOver moves uploads to the secondary storage. Segments that failed are stored again, along with
+// the files the following segments depend on, and the playlist references everything else in the primary
+func (p *Pipeline) failOver() {
+	locations, failed := p.failover.activate()
+	p.Logger.Warnw("segment uploads failing, switching to failover storage", nil, "failedSegments", len(failed))
+
+	if p.playlistWriter != nil {
+		keyFilepath, err := p.playlistWriter.Rebase(locations)
+		if err != nil {
+			p.Logger.Errorw("failed to rebase playlist", err)
+		}
+		if keyFilepath != "" {
+			_, _, _ = p.storeFile(context.Background(), keyFilepath, p.GetStorageFilepath(keyFilepath), params.OutputTypeKey)
+		}
+	}
+
+	if p.GetSegmentOutputType() == params.OutputTypeMP4 {
+		if p.SegmentsInMemory {
+			// stored again with the next segment
+			p.initSegmentStored = false
+		} else if _, err := os.Stat(p.InitSegmentFilename); err == nil {
+			initStoragePath := p.GetStorageFilepath(p.InitSegmentFilename)
+			_, size, _ := p.storeFile(context.Background(), p.InitSegmentFilename, initStoragePath, params.OutputTypeMP4)
+			p.SegmentsInfo.Size += size
+		}
+	}
+
+	for _, segment := range failed {
+		var size int64
+		if segment.data != nil {
+			_, size, _ = p.storeData(context.Background(), segment.data, segment.storageFilepath, p.GetSegmentOutputType())
+		} else {
+			_, size, _ = p.storeFile(context.Background(), segment.localPath, segment.storageFilepath, p.GetSegmentOutputType())
+		}
+		p.SegmentsInfo.Size += size
+	}
+
+	// the master playlist references the media playlist, which is now stored in the secondary
+	p.masterPlaylistStored = false
+}
@@ -0,0 +1,131 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/protocol/tracer"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+)
+
+const (
+	// decoded at each end of the file, unless the keyframe interval is longer
+	fileCheckWindow = 2 * time.Second
+
+	// allowed difference between the file's duration and the recorded duration, unless 5% of it is more
+	fileCheckDurationDrift = 5 * time.Second
+)
+
+// checkFile validates an mp4 file output before it's uploaded. It needs a moov box, which is moved ahead of the media data
+// if it isn't already, a duration close to the recorded one, and its first and last gops need to decode
+func (p *Pipeline) checkFile(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "Pipeline.checkFile")
+	defer span.End()
+
+	duration, moved, err := sink.CheckMP4(p.LocalFilepath)
+	if err != nil {
+		return err
+	}
+	if moved {
+		p.Logger.Infow("moved moov box ahead of the media data")
+	}
+	if duration <= 0 {
+		return errors.New("file has no duration")
+	}
+
+	// bumpers lengthen the file
+	if recorded := time.Duration(p.FileInfo.Duration); recorded > 0 && p.IntroClip == "" && p.OutroClip == "" {
+		drift := duration - recorded
+		if drift < 0 {
+			drift = -drift
+		}
+		if drift > fileCheckDurationDrift && drift > recorded/20 {
+			return fmt.Errorf("file duration %s doesn't match recorded duration %s", duration, recorded)
+		}
+	}
+
+	return p.decodeFileEnds(duration)
+}
+
+// decodeFileEnds decodes the start of the file, and the end of it from the last keyframe before the window
+func (p *Pipeline) decodeFileEnds(duration time.Duration) error {
+	window := fileCheckWindow
+	if keyFrameInterval := p.KeyFrameInterval(); keyFrameInterval > 0 && p.Framerate > 0 {
+		if gop := time.Duration(keyFrameInterval) * time.Second / time.Duration(p.Framerate); gop > window {
+			window = gop
+		}
+	}
+	if window > duration {
+		window = duration
+	}
+
+	uri, err := params.MediaURI(p.LocalFilepath)
+	if err != nil {
+		return err
+	}
+	elements := []string{fmt.Sprintf("uridecodebin uri=%q name=file", uri)}
+	if p.AudioEnabled {
+		elements = append(elements, "file. ! audio/x-raw ! queue ! fakesink sync=false")
+	}
+	if p.VideoEnabled {
+		elements = append(elements, "file. ! video/x-raw ! queue ! fakesink sync=false")
+	}
+
+	pipeline, err := gst.NewPipelineFromString(strings.Join(elements, " "))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = pipeline.SetState(gst.StateNull)
+	}()
+
+	deadline := time.Now().Add(p.FileCheck.Timeout)
+	wait := func(msgTypes gst.MessageType) error {
+		msg := pipeline.GetPipelineBus().TimedPopFiltered(time.Until(deadline), msgTypes|gst.MessageError)
+		if msg == nil {
+			return errors.New("timed out decoding file")
+		}
+		if msg.Type() == gst.MessageError {
+			return msg.ParseError()
+		}
+		return nil
+	}
+
+	if err = pipeline.SetState(gst.StatePaused); err != nil {
+		return err
+	}
+	if err = wait(gst.MessageAsyncDone); err != nil {
+		return err
+	}
+
+	if !pipeline.SendEvent(gst.NewSeekEvent(
+		1, gst.FormatTime, gst.SeekFlagFlush|gst.SeekFlagAccurate, gst.SeekTypeSet, 0, gst.SeekTypeSet, int64(window),
+	)) {
+		return errors.New("could not seek to start of file")
+	}
+	if err = pipeline.SetState(gst.StatePlaying); err != nil {
+		return err
+	}
+	if err = wait(gst.MessageEOS); err != nil {
+		return fmt.Errorf("start of file: %w", err)
+	}
+
+	if !pipeline.SendEvent(gst.NewSeekEvent(
+		1, gst.FormatTime, gst.SeekFlagFlush|gst.SeekFlagKeyUnit|gst.SeekFlagSnapBefore,
+		gst.SeekTypeSet, int64(duration-window), gst.SeekTypeNone, -1,
+	)) {
+		return errors.New("could not seek to end of file")
+	}
+	if err = wait(gst.MessageEOS); err != nil {
+		return fmt.Errorf("end of file: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package pipeline
+
+import (
+	"google.golang.org/protobuf/proto"
+
+	"github.com/livekit/egress/pkg/stats"
+)
+
+// DeferFileUpload leaves the upload of file outputs to the service, which finishes it after the handler exits
+func (p *Pipeline) DeferFileUpload() {
+	p.deferUpload = true
+}
+
+// DeferredUpload returns the upload to hand off once Run has returned, or nil if the file was already stored
+func (p *Pipeline) DeferredUpload() *stats.UploadHandoff {
+	if !p.uploadDeferred {
+		return nil
+	}
+
+	info, err := proto.Marshal(p.Info)
+	if err != nil {
+		p.Logger.Errorw("could not marshal egress info", err)
+		return nil
+	}
+
+	return &stats.UploadHandoff{
+		Info:            info,
+		LocalFilepath:   p.LocalFilepath,
+		StorageFilepath: p.StorageFilepath,
+		OutputType:      string(p.OutputType),
+		Reason:          p.EndedReason(),
+	}
+}
@@ -0,0 +1,126 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
+	"os"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	snapshotMessage  = "GstMultiFileSink"
+	snapshotFilename = "filename"
+)
+
+// storeSnapshot uploads a still image once the snapshot branch has written it
+func (p *Pipeline) storeSnapshot(s *gst.Structure) {
+	value, err := s.GetValue(snapshotFilename)
+	if err != nil {
+		p.Logger.Errorw("failed to read snapshot filename", err)
+		return
+	}
+	localFilepath, ok := value.(string)
+	if !ok {
+		p.Logger.Errorw("invalid type for snapshot filename", nil)
+		return
+	}
+
+	p.imagesWg.Add(1)
+	go func() {
+		defer p.imagesWg.Done()
+		defer p.recoverPanic()
+
+		p.storeImage(localFilepath, p.SnapshotType, &p.snapshotCount)
+	}()
+}
+
+// startPreviewWorker encodes and uploads each animated preview as its frames are collected
+func (p *Pipeline) startPreviewWorker() {
+	p.imagesWg.Add(1)
+	go func() {
+		defer p.imagesWg.Done()
+		defer p.recoverPanic()
+
+		index := 0
+		for frames := range p.in.Previews() {
+			localFilepath := fmt.Sprintf("%s_%05d%s", p.PreviewPrefix, index, params.FileExtensionGIF)
+			index++
+
+			data, err := encodePreview(frames, int(p.PreviewWidth), int(p.PreviewHeight), p.PreviewFramerate)
+			if err != nil {
+				p.Logger.Errorw("failed to encode preview", err)
+				continue
+			}
+			if err = os.WriteFile(localFilepath, data, 0644); err != nil {
+				p.Logger.Errorw("failed to write preview", err)
+				continue
+			}
+			p.storeImage(localFilepath, params.OutputTypeGIF, &p.previewCount)
+		}
+	}()
+}
+
+// encodePreview converts RGBA frames into a looping gif
+func encodePreview(frames [][]byte, width, height int, framerate int32) ([]byte, error) {
+	bounds := image.Rect(0, 0, width, height)
+	delay := int(100 / framerate) // in 100ths of a second
+
+	anim := &gif.GIF{}
+	for _, frame := range frames {
+		if len(frame) < width*height*4 {
+			return nil, fmt.Errorf("invalid preview frame size %d", len(frame))
+		}
+		src := &image.RGBA{Pix: frame, Stride: width * 4, Rect: bounds}
+		dst := image.NewPaletted(bounds, palette.Plan9)
+		draw.FloydSteinberg.Draw(dst, bounds, src, image.Point{})
+
+		anim.Image = append(anim.Image, dst)
+		anim.Delay = append(anim.Delay, delay)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, anim); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// storeImage uploads a snapshot or preview next to the recording
+func (p *Pipeline) storeImage(localFilepath string, mime params.OutputType, count *atomic.Int32) {
+	storageFilepath := p.GetImageStorageFilepath(localFilepath)
+	location, _, err := p.storeFile(context.Background(), localFilepath, storageFilepath, mime)
+	if err != nil {
+		p.Logger.Errorw("failed to store image", err, "location", storageFilepath)
+		return
+	}
+	count.Inc()
+	p.Logger.Debugw("image stored", "location", location)
+
+	if p.FileUpload != nil {
+		if err = os.Remove(localFilepath); err != nil {
+			p.Logger.Errorw("failed to delete image", err)
+		}
+	}
+}
+
+// waitForImages waits for pending snapshot and preview uploads. EgressInfo has nowhere to list them, so they're logged instead
+func (p *Pipeline) waitForImages() {
+	p.in.EndPreviews()
+	p.imagesWg.Wait()
+
+	if count := p.snapshotCount.Load(); count > 0 {
+		p.Logger.Infow("snapshots stored", "count", count, "prefix", p.GetImageStorageFilepath(p.SnapshotPrefix))
+	}
+	if count := p.previewCount.Load(); count > 0 {
+		p.Logger.Infow("previews stored", "count", count, "prefix", p.GetImageStorageFilepath(p.PreviewPrefix))
+	}
+}
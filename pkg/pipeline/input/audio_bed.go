@@ -0,0 +1,251 @@
+package input
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	// program audio above this level ducks the bed
+	duckingThreshold = -40 // dBFS
+	// time the program has to stay quiet before the bed is restored
+	duckingRelease = 500 * time.Millisecond
+)
+
+// audioBed loops a decoded audio file into the program mix, lowering it while the program has audio
+type audioBed struct {
+	logger logger.Logger
+
+	decoder *gst.Pipeline
+	sink    *app.Sink
+	src     *app.Source
+	volume  *gst.Element
+	mixer   *gst.Element
+
+	bytesPerSecond int
+	bitDepth       int
+	fullVolume     float64
+	duckedVolume   float64
+	lastLoud       time.Time
+	ducked         bool
+
+	done chan struct{}
+}
+
+// buildAudioBed adds a mixer after the program audio caps. The bed is linked to the mixer in Link
+func (b *Bin) buildAudioBed(p *params.Params, programCaps *gst.Element, capsStr string, bitDepth int) error {
+	uri, err := params.MediaURI(p.AudioBedFile)
+	if err != nil {
+		return err
+	}
+
+	decoder, err := gst.NewPipelineFromString(fmt.Sprintf(
+		"uridecodebin uri=%q ! audioconvert ! audioresample ! %s ! appsink name=bedsink sync=false", uri, capsStr,
+	))
+	if err != nil {
+		return err
+	}
+	sinkElement, err := decoder.GetElementByName("bedsink")
+	if err != nil {
+		return err
+	}
+
+	src, err := app.NewAppSrc()
+	if err != nil {
+		return err
+	}
+	src.SetCaps(gst.NewCapsFromString(capsStr))
+	src.SetArg("format", "time")
+	// block when the mixer is behind, so the bed is only decoded as fast as it's played
+	if err = src.SetProperty("block", true); err != nil {
+		return err
+	}
+
+	volume, err := gst.NewElement("volume")
+	if err != nil {
+		return err
+	}
+	if err = volume.SetProperty("volume", p.AudioBedVolume); err != nil {
+		return err
+	}
+
+	mixer, err := gst.NewElement("audiomixer")
+	if err != nil {
+		return err
+	}
+
+	bed := &audioBed{
+		logger:         p.Logger,
+		decoder:        decoder,
+		sink:           app.SinkFromElement(sinkElement),
+		src:            src,
+		volume:         volume,
+		mixer:          mixer,
+		bytesPerSecond: int(p.AudioFrequency) * 2 * bitDepth / 8,
+		bitDepth:       bitDepth,
+		fullVolume:     p.AudioBedVolume,
+		duckedVolume:   p.AudioBedDuckedVolume,
+		done:           make(chan struct{}),
+	}
+	if p.AudioCodec == params.MimeTypeOpus {
+		bed.bytesPerSecond = 48000 * 2 * bitDepth / 8
+	}
+
+	// the bed is ducked based on the program level, measured before mixing
+	programCaps.GetStaticPad("src").AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		if buffer := info.GetBuffer(); buffer != nil {
+			bed.updateDucking(buffer)
+		}
+		return gst.PadProbeOK
+	})
+
+	if err = b.bin.AddMany(src.Element, volume); err != nil {
+		return err
+	}
+	if err = src.Link(volume); err != nil {
+		return err
+	}
+
+	b.audioBed = bed
+	b.audioElements = append(b.audioElements, mixer)
+	return nil
+}
+
+// link connects the bed to the mixer, after the program audio has taken the first mixer pad
+func (a *audioBed) link() error {
+	mixerPad := a.mixer.GetRequestPad("sink_%u")
+	if linkReturn := a.volume.GetStaticPad("src").Link(mixerPad); linkReturn != gst.PadLinkOK {
+		return errors.ErrPadLinkFailed("audio bed", linkReturn.String())
+	}
+	return nil
+}
+
+func (a *audioBed) start() error {
+	if err := a.decoder.SetState(gst.StatePlaying); err != nil {
+		return err
+	}
+
+	go func() {
+		defer func() {
+			_ = a.decoder.SetState(gst.StateNull)
+			a.src.EndStream()
+		}()
+
+		var pts time.Duration
+		for {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+
+			sample := a.sink.PullSample()
+			if sample == nil {
+				if !a.sink.IsEOS() {
+					return
+				}
+
+				// loop
+				if !a.decoder.SendEvent(gst.NewSeekEvent(
+					1, gst.FormatTime, gst.SeekFlagFlush|gst.SeekFlagKeyUnit, gst.SeekTypeSet, 0, gst.SeekTypeNone, -1,
+				)) {
+					a.logger.Errorw("failed to loop audio bed", nil)
+					return
+				}
+				continue
+			}
+
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				continue
+			}
+			data := append([]byte(nil), buffer.Map(gst.MapRead).Bytes()...)
+			buffer.Unmap()
+			if len(data) == 0 {
+				continue
+			}
+
+			// timestamps continue across loops
+			duration := time.Duration(len(data)) * time.Second / time.Duration(a.bytesPerSecond)
+			out := gst.NewBufferFromBytes(data)
+			out.SetPresentationTimestamp(pts)
+			out.SetDuration(duration)
+			pts += duration
+
+			if flow := a.src.PushBuffer(out); flow != gst.FlowOK {
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (a *audioBed) stop() {
+	select {
+	case <-a.done:
+	default:
+		close(a.done)
+		_ = a.decoder.SetState(gst.StateNull)
+	}
+}
+
+func (a *audioBed) updateDucking(buffer *gst.Buffer) {
+	level := rmsLevel(buffer.Map(gst.MapRead).Bytes(), a.bitDepth)
+	buffer.Unmap()
+
+	now := time.Now()
+	if level > duckingThreshold {
+		a.lastLoud = now
+		if !a.ducked {
+			a.ducked = true
+			a.setVolume(a.duckedVolume)
+		}
+	} else if a.ducked && now.Sub(a.lastLoud) > duckingRelease {
+		a.ducked = false
+		a.setVolume(a.fullVolume)
+	}
+}
+
+func (a *audioBed) setVolume(volume float64) {
+	if err := a.volume.SetProperty("volume", volume); err != nil {
+		a.logger.Errorw("failed to set audio bed volume", err)
+	}
+}
+
+// rmsLevel returns the level of interleaved little endian pcm in dBFS
+func rmsLevel(data []byte, bitDepth int) float64 {
+	bytesPerSample := bitDepth / 8
+	count := len(data) / bytesPerSample
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	var sum float64
+	for i := 0; i < count; i++ {
+		sample := data[i*bytesPerSample : (i+1)*bytesPerSample]
+		var v float64
+		switch bytesPerSample {
+		case 2:
+			v = float64(int16(binary.LittleEndian.Uint16(sample))) / math.MaxInt16
+		case 3:
+			// sign extend 24 bit samples
+			v = float64(int32(uint32(sample[0])<<8|uint32(sample[1])<<16|uint32(sample[2])<<24)>>8) / (1 << 23)
+		case 4:
+			v = float64(int32(binary.LittleEndian.Uint32(sample))) / math.MaxInt32
+		}
+		sum += v * v
+	}
+
+	return 20 * math.Log10(math.Sqrt(sum/float64(count)))
+}
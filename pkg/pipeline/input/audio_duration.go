@@ -0,0 +1,36 @@
+package input
+
+import (
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
+)
+
+// audioDuration adds up the audio written to the output, so that reported durations match the media
+// rather than the wall clock time between the pipeline starting and stopping
+type audioDuration struct {
+	written atomic.Duration
+}
+
+func newAudioDuration(pad *gst.Pad) *audioDuration {
+	d := &audioDuration{}
+	pad.AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		if buffer := info.GetBuffer(); buffer != nil {
+			// unset durations are negative
+			if duration := buffer.Duration(); duration > 0 {
+				d.written.Add(duration)
+			}
+		}
+		return gst.PadProbeOK
+	})
+	return d
+}
+
+// AudioDuration returns the length of the audio written so far, or 0 without audio
+func (b *Bin) AudioDuration() time.Duration {
+	if b.audioDuration == nil {
+		return 0
+	}
+	return b.audioDuration.written.Load()
+}
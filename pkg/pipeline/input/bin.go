@@ -1,9 +1,12 @@
 package input
 
 import (
+	"time"
+
 	"github.com/tinyzimmer/go-gst/gst"
 
 	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
 	"github.com/livekit/egress/pkg/pipeline/source"
 )
 
@@ -14,13 +17,48 @@ type Bin struct {
 
 	audioElements []*gst.Element
 	audioQueue    *gst.Element
+	audioDuration *audioDuration
 
 	videoElements []*gst.Element
 	videoQueue    *gst.Element
 
 	mux *gst.Element
+
+	// regular segment duration, set on the mux once a shorter first segment has closed
+	segmentDuration time.Duration
+
+	// stream outputs using more than one container
+	streamMuxes map[params.StreamMux]*gst.Element
+
+	// still image shown while the video source is stalled
+	slate *gst.Element
+
+	// text set while the egress is running
+	textOverlay *gst.Element
+
+	// snapshot and preview branches, split from the video before it's encoded
+	imageTee      *gst.Element
+	imageBranches [][]*gst.Element
+	previews      *previewCollector
+
+	// background audio
+	audioBed *audioBed
+
+	// transcriptions embedded in the video
+	captions *captionEmbedder
+
+	// drops frames captured before the template starts recording
+	startGate *startGate
+
+	// room composite without a browser
+	composite *sdkComposite
+
+	// finalized segments, when segments are kept in memory
+	segments chan []byte
 }
 
+const maxPendingSegments = 8
+
 func (b *Bin) Bin() *gst.Bin {
 	return b.bin
 }
@@ -29,6 +67,96 @@ func (b *Bin) Element() *gst.Element {
 	return b.bin.Element
 }
 
+// Segments returns the contents of each finalized segment, in order. Only used when segments are kept in memory
+func (b *Bin) Segments() <-chan []byte {
+	return b.segments
+}
+
+// Previews returns the frames of each animated preview, or nil if the video isn't being encoded.
+// Closed once the video ends, or by EndPreviews
+func (b *Bin) Previews() <-chan [][]byte {
+	if b.previews == nil {
+		return nil
+	}
+	return b.previews.out
+}
+
+// EndPreviews closes the previews channel if the video never reached EOS
+func (b *Bin) EndPreviews() {
+	if b.previews != nil {
+		b.previews.close()
+	}
+}
+
+// OpenStartGate starts recording from the next captured frame, returning the running time it starts at.
+// Only used with frame accurate starts
+func (b *Bin) OpenStartGate() time.Duration {
+	if b.startGate == nil {
+		return 0
+	}
+	return b.startGate.openGate()
+}
+
+// EndGeneratedInputs stops the slate and audio bed, which would otherwise never reach EOS
+func (b *Bin) EndGeneratedInputs() {
+	if b.slate != nil {
+		b.slate.SendEvent(gst.NewEOSEvent())
+	}
+	if b.audioBed != nil {
+		b.audioBed.stop()
+	}
+	if b.captions != nil {
+		b.captions.stop()
+	}
+	if b.composite != nil {
+		b.composite.endGeneratedInputs()
+	}
+}
+
+// ForceEOS pushes EOS from the end of the input, past any elements which are stuck, so the output can still be finalized
+func (b *Bin) ForceEOS() {
+	for _, queue := range []*gst.Element{b.audioQueue, b.videoQueue} {
+		if queue != nil {
+			queue.GetStaticPad("src").PushEvent(gst.NewEOSEvent())
+		}
+	}
+}
+
+// OnEncodedVideo calls f with the caps and first keyframe of the video leaving the bin
+func (b *Bin) OnEncodedVideo(f func(caps *gst.Caps, keyframe []byte)) {
+	if b.videoQueue == nil {
+		return
+	}
+
+	b.videoQueue.GetStaticPad("src").AddProbe(gst.PadProbeTypeBuffer, func(pad *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		buffer := info.GetBuffer()
+		if buffer == nil || buffer.HasFlags(gst.BufferFlagDeltaUnit) {
+			return gst.PadProbeOK
+		}
+		f(pad.GetCurrentCaps(), buffer.Bytes())
+		return gst.PadProbeRemove
+	})
+}
+
+// OnSegmentClosed switches the mux to the regular segment duration after the first segment
+func (b *Bin) OnSegmentClosed() error {
+	if b.segmentDuration == 0 {
+		return nil
+	}
+	duration := b.segmentDuration
+	b.segmentDuration = 0
+	return b.mux.SetProperty("max-size-time", uint64(duration))
+}
+
+// UpdateLayout rearranges the video tracks of a track composite
+func (b *Bin) UpdateLayout(layout string, order []string) error {
+	if b.composite == nil {
+		return errors.ErrNotSupported("layout updates")
+	}
+	b.composite.setLayout(layout, order)
+	return nil
+}
+
 func (b *Bin) Link() error {
 	// link audio elements
 	if b.audioQueue != nil {
@@ -36,20 +164,28 @@ func (b *Bin) Link() error {
 			return err
 		}
 
-		if b.mux != nil {
-			// Different muxers use different pad naming
-			muxAudioPad := b.mux.GetRequestPad("audio")
-			if muxAudioPad == nil {
-				muxAudioPad = b.mux.GetRequestPad("audio_%u")
+		if b.streamMuxes != nil {
+			if err := b.linkStreamMuxes(b.audioQueue, getMuxAudioPad); err != nil {
+				return err
 			}
-			if muxAudioPad == nil {
-				return errors.New("no audio pad found")
+		} else if b.mux != nil {
+			muxAudioPad, err := getMuxAudioPad(b.mux)
+			if err != nil {
+				return err
 			}
-
 			if linkReturn := b.audioQueue.GetStaticPad("src").Link(muxAudioPad); linkReturn != gst.PadLinkOK {
 				return errors.ErrPadLinkFailed("audio mux", linkReturn.String())
 			}
 		}
+
+		if b.audioBed != nil {
+			if err := b.audioBed.link(); err != nil {
+				return err
+			}
+			if err := b.audioBed.start(); err != nil {
+				return err
+			}
+		}
 	}
 
 	// link video elements
@@ -58,20 +194,106 @@ func (b *Bin) Link() error {
 			return err
 		}
 
-		if b.mux != nil {
-			// Different muxers use different pad naming
-			muxVideoPad := b.mux.GetRequestPad("video")
-			if muxVideoPad == nil {
-				muxVideoPad = b.mux.GetRequestPad("video_%u")
+		if b.streamMuxes != nil {
+			if err := b.linkStreamMuxes(b.videoQueue, getMuxVideoPad); err != nil {
+				return err
 			}
-			if muxVideoPad == nil {
-				return errors.New("no video pad found")
+		} else if b.mux != nil {
+			muxVideoPad, err := getMuxVideoPad(b.mux)
+			if err != nil {
+				return err
 			}
 			if linkReturn := b.videoQueue.GetStaticPad("src").Link(muxVideoPad); linkReturn != gst.PadLinkOK {
 				return errors.ErrPadLinkFailed("video mux", linkReturn.String())
 			}
 		}
+
+		if b.captions != nil {
+			if err := b.captions.link(); err != nil {
+				return err
+			}
+			b.captions.start()
+		}
+
+		// the encoder branch is linked first, so it gets the tee's first pad
+		for _, branch := range b.imageBranches {
+			if err := gst.ElementLinkMany(append([]*gst.Element{b.imageTee}, branch...)...); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.composite != nil {
+		return b.composite.start(b.Source.(*source.SDKSource))
 	}
 
 	return nil
 }
+
+// linkStreamMuxes splits an encoded stream between the stream muxers, with a queue on each branch
+func (b *Bin) linkStreamMuxes(src *gst.Element, getMuxPad func(*gst.Element) (*gst.Pad, error)) error {
+	tee, err := gst.NewElement("tee")
+	if err != nil {
+		return err
+	}
+	if err = b.bin.Add(tee); err != nil {
+		return err
+	}
+	if err = src.Link(tee); err != nil {
+		return err
+	}
+
+	for _, mux := range b.streamMuxes {
+		queue, err := gst.NewElement("queue")
+		if err != nil {
+			return err
+		}
+		if err = b.bin.Add(queue); err != nil {
+			return err
+		}
+		if linkReturn := tee.GetRequestPad("src_%u").Link(queue.GetStaticPad("sink")); linkReturn != gst.PadLinkOK {
+			return errors.ErrPadLinkFailed("stream mux tee", linkReturn.String())
+		}
+
+		muxPad, err := getMuxPad(mux)
+		if err != nil {
+			return err
+		}
+		if linkReturn := queue.GetStaticPad("src").Link(muxPad); linkReturn != gst.PadLinkOK {
+			return errors.ErrPadLinkFailed("stream mux", linkReturn.String())
+		}
+	}
+
+	return nil
+}
+
+// Different muxers use different pad naming
+func getMuxAudioPad(mux *gst.Element) (*gst.Pad, error) {
+	pad := mux.GetRequestPad("audio")
+	if pad == nil {
+		pad = mux.GetRequestPad("audio_%u")
+	}
+	if pad == nil {
+		// audio only encoders such as wavenc
+		pad = mux.GetStaticPad("sink")
+	}
+	if pad == nil {
+		return nil, errors.New("no audio pad found")
+	}
+	return pad, nil
+}
+
+func getMuxVideoPad(mux *gst.Element) (*gst.Pad, error) {
+	pad := mux.GetRequestPad("video")
+	if pad == nil {
+		pad = mux.GetRequestPad("video_%u")
+	}
+	if pad == nil {
+		// ndisinkcombiner always has a video pad
+		pad = mux.GetStaticPad("video")
+	}
+	if pad == nil {
+		return nil, errors.New("no video pad found")
+	}
+	return pad, nil
+}
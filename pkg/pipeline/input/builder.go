@@ -3,9 +3,12 @@ package input
 import (
 	"context"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
 
 	"github.com/livekit/protocol/tracer"
 
@@ -37,6 +40,9 @@ func Build(ctx context.Context, conf *config.Config, p *params.Params) (*Bin, er
 		bin:    gst.NewBin("input"),
 		Source: src,
 	}
+	if p.FrameAccurateStart {
+		b.startGate = newStartGate()
+	}
 
 	// audio elements
 	err = b.buildAudioElements(p)
@@ -56,9 +62,15 @@ func Build(ctx context.Context, conf *config.Config, p *params.Params) (*Bin, er
 		return nil, err
 	}
 
-	// create ghost pad
+	// create ghost pads
 	var ghostPad *gst.GhostPad
-	if b.mux != nil {
+	if b.streamMuxes != nil {
+		for m, mux := range b.streamMuxes {
+			if !b.bin.AddPad(gst.NewGhostPad(fmt.Sprintf("src_%s", m), mux.GetStaticPad("src")).Pad) {
+				return nil, errors.ErrGhostPadFailed
+			}
+		}
+	} else if b.mux != nil {
 		// For HLS, there will be no 'src' pad
 		pad := b.mux.GetStaticPad("src")
 		if pad != nil {
@@ -82,7 +94,8 @@ func Build(ctx context.Context, conf *config.Config, p *params.Params) (*Bin, er
 func (b *Bin) buildMux(p *params.Params) error {
 	var err error
 	switch p.OutputType {
-	case params.OutputTypeRaw:
+	case params.OutputTypeRaw, params.OutputTypeAAC, params.OutputTypeMP3:
+		// adts and mp3 frames are written directly
 		return nil
 
 	case params.OutputTypeOGG:
@@ -100,18 +113,36 @@ func (b *Bin) buildMux(p *params.Params) error {
 
 	case params.OutputTypeTS:
 		b.mux, err = gst.NewElement("mpegtsmux")
-		// TODO: filename needs to contain %d
+
+	case params.OutputTypeWAV:
+		b.mux, err = gst.NewElement("wavenc")
 
 	case params.OutputTypeWebM:
 		b.mux, err = gst.NewElement("webmmux")
 
-	case params.OutputTypeRTMP:
-		b.mux, err = gst.NewElement("flvmux")
-		if err != nil {
-			return err
+	case params.OutputTypeMKV:
+		// clusters are written as they are completed, so the file remains playable if the egress is interrupted
+		b.mux, err = gst.NewElement("matroskamux")
+
+	case params.OutputTypeRTMP, params.OutputTypeRTSP, params.OutputTypeRIST, params.OutputTypeSRT, params.OutputTypeWHIP:
+		if len(p.StreamMuxes) > 1 {
+			return b.buildStreamMuxes(p)
 		}
-		err = b.mux.Set("streamable", true)
+		b.mux, err = buildStreamMux(p.StreamMuxes[0])
+
+	case params.OutputTypeNDI:
+		if !p.AudioEnabled || !p.VideoEnabled {
+			// ndisink takes a single raw stream directly
+			return nil
+		}
+		// audio is attached to the video frames it plays with
+		b.mux, err = gst.NewElement("ndisinkcombiner")
+
 	case params.OutputTypeHLS:
+		if p.GetSegmentOutputType() == params.OutputTypeAAC {
+			// packed audio segments don't need a muxer
+			return nil
+		}
 		b.mux, err = b.buildHlsMux(p)
 		if err != nil {
 			return err
@@ -126,6 +157,50 @@ func (b *Bin) buildMux(p *params.Params) error {
 	return b.bin.Add(b.mux)
 }
 
+func buildStreamMux(mux params.StreamMux) (*gst.Element, error) {
+	switch mux {
+	case params.StreamMuxFLV:
+		flvMux, err := gst.NewElement("flvmux")
+		if err != nil {
+			return nil, err
+		}
+		if err = flvMux.Set("streamable", true); err != nil {
+			return nil, err
+		}
+		return flvMux, nil
+
+	case params.StreamMuxMPEGTS:
+		// the transport stream is payloaded with rtpmp2tpay for rtsp and rist, and sent as is over srt
+		tsMux, err := gst.NewElement("mpegtsmux")
+		if err != nil {
+			return nil, err
+		}
+		if err = tsMux.SetProperty("alignment", 7); err != nil {
+			return nil, err
+		}
+		return tsMux, nil
+
+	default:
+		return nil, errors.ErrInvalidInput("stream mux")
+	}
+}
+
+// buildStreamMuxes creates a muxer for each container used by the stream outputs, with a source pad named after it
+func (b *Bin) buildStreamMuxes(p *params.Params) error {
+	b.streamMuxes = make(map[params.StreamMux]*gst.Element)
+	for _, m := range p.StreamMuxes {
+		mux, err := buildStreamMux(m)
+		if err != nil {
+			return err
+		}
+		if err = b.bin.Add(mux); err != nil {
+			return err
+		}
+		b.streamMuxes[m] = mux
+	}
+	return nil
+}
+
 func (b *Bin) buildHlsMux(p *params.Params) (*gst.Element, error) {
 	// Create Sink
 	sink, err := gst.NewElement("splitmuxsink")
@@ -133,24 +208,175 @@ func (b *Bin) buildHlsMux(p *params.Params) (*gst.Element, error) {
 		return nil, err
 	}
 
-	// TODO make this a request parameter?
-	// 6s segments
-	if err = sink.SetProperty("max-size-time", uint64(time.Duration(p.SegmentDuration)*time.Second)); err != nil {
+	// the first segment can be shorter, and the regular duration is set once it closes
+	if err = sink.SetProperty("max-size-time", uint64(time.Duration(p.FirstSegmentDuration)*time.Second)); err != nil {
 		return nil, err
 	}
+	if p.FirstSegmentDuration != p.SegmentDuration {
+		b.segmentDuration = time.Duration(p.SegmentDuration) * time.Second
+	}
+
+	switch p.GetSegmentOutputType() {
+	case params.OutputTypeMP4:
+		// Each segment is written as a single fragment. The init section is split out before upload
+		mux, err := gst.NewElement("mp4mux")
+		if err != nil {
+			return nil, err
+		}
+		if err = mux.SetProperty("fragment-duration", uint(p.SegmentDuration*1000)); err != nil {
+			return nil, err
+		}
+		if err = mux.SetProperty("streamable", true); err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("muxer", mux); err != nil {
+			return nil, err
+		}
+
+	default:
+		if err = sink.SetProperty("muxer-factory", "mpegtsmux"); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.SegmentsInMemory {
+		// the appsink is reused for every fragment, so finalizing has to happen in order
+		memorySink, err := b.buildSegmentMemorySink(p)
+		if err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("sink", memorySink.Element); err != nil {
+			return nil, err
+		}
+		return sink, nil
+	}
 
 	if err = sink.SetProperty("async-finalize", true); err != nil {
 		return nil, err
 	}
 
-	if err = sink.SetProperty("muxer-factory", "mpegtsmux"); err != nil {
+	if p.SpillFilePrefix != "" {
+		// the location is chosen for each segment, depending on tmpfs usage
+		if _, err = sink.Connect("format-location", func(_ *gst.Element, fragmentID uint) string {
+			return p.GetSegmentFilepath(int(fragmentID))
+		}); err != nil {
+			return nil, err
+		}
+	} else {
+		filenamePattern := fmt.Sprintf("%s_%%05d%s", p.LocalFilePrefix, p.GetSegmentFileExtension())
+		if err = sink.SetProperty("location", filenamePattern); err != nil {
+			return nil, err
+		}
+	}
+
+	return sink, err
+}
+
+// buildSegmentMemorySink collects each fragment in memory, and hands it off once the fragment is finalized
+func (b *Bin) buildSegmentMemorySink(p *params.Params) (*app.Sink, error) {
+	memorySink, err := app.NewAppSink()
+	if err != nil {
+		return nil, err
+	}
+	if err = memorySink.SetProperty("sync", false); err != nil {
 		return nil, err
 	}
 
-	filenamePattern := fmt.Sprintf("%s_%%05d.ts", p.LocalFilePrefix)
-	if err = sink.SetProperty("location", filenamePattern); err != nil {
+	b.segments = make(chan []byte, maxPendingSegments)
+	var segment []byte
+	memorySink.SetCallbacks(&app.SinkCallbacks{
+		// splitmuxsink sends EOS to its sink at the end of every fragment, before posting fragment-closed
+		EOSFunc: func(appSink *app.Sink) {
+			select {
+			case b.segments <- segment:
+			default:
+				p.Logger.Errorw("failed to hand off segment", errors.New("segment queue is full"))
+			}
+			segment = nil
+		},
+		NewSampleFunc: func(appSink *app.Sink) gst.FlowReturn {
+			sample := appSink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				return gst.FlowError
+			}
+
+			segment = append(segment, buffer.Map(gst.MapRead).Bytes()...)
+			buffer.Unmap()
+			return gst.FlowOK
+		},
+	})
+
+	return memorySink, nil
+}
+
+// buildTagInjectors creates elements adding the configured metadata to a file output stream
+func buildTagInjectors(p *params.Params, global bool) ([]*gst.Element, error) {
+	if p.EgressType != params.EgressTypeFile {
+		return nil, nil
+	}
+
+	var elements []*gst.Element
+	if p.Language != "" {
+		streamTags, err := newTagInject(fmt.Sprintf("language-code=%s", p.Language), "stream")
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, streamTags)
+	}
+
+	if !global {
+		return elements, nil
+	}
+
+	var tags []string
+	if p.Title != "" {
+		tags = append(tags, fmt.Sprintf("title=%q", p.Title))
+	}
+	if len(p.Tags) > 0 {
+		comments := make([]string, 0, len(p.Tags))
+		for k, v := range p.Tags {
+			comments = append(comments, fmt.Sprintf("%q", fmt.Sprintf("%s=%s", k, v)))
+		}
+		sort.Strings(comments)
+		tags = append(tags, fmt.Sprintf("extended-comment={ %s }", strings.Join(comments, ", ")))
+	}
+	if len(tags) > 0 {
+		globalTags, err := newTagInject(strings.Join(tags, ","), "global")
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, globalTags)
+	}
+
+	return elements, nil
+}
+
+func newTagInject(tags, scope string) (*gst.Element, error) {
+	tagInject, err := gst.NewElement("taginject")
+	if err != nil {
+		return nil, err
+	}
+	if err = tagInject.SetProperty("tags", tags); err != nil {
 		return nil, err
 	}
+	tagInject.SetArg("scope", scope)
+	return tagInject, nil
+}
 
-	return sink, err
+// applyEncoderOptions sets the properties configured for an encoder element, over every other setting. Values are parsed
+// like gst-launch arguments
+func applyEncoderOptions(enc *gst.Element, p *params.Params) error {
+	element := enc.GetFactory().GetName()
+	for name, value := range p.EncoderOptions[element] {
+		if _, err := enc.GetPropertyType(name); err != nil {
+			return errors.ErrCouldNotParseConfig(fmt.Errorf("%s has no property %s", element, name))
+		}
+		enc.SetArg(name, value)
+	}
+	return nil
 }
@@ -19,6 +19,8 @@ func (b *Bin) buildAudioElements(p *params.Params) error {
 	var err error
 	if p.IsWebSource {
 		err = b.buildWebAudioInput(p)
+	} else if p.SDKComposite {
+		err = b.buildSDKCompositeAudioInput(p)
 	} else {
 		err = b.buildSDKAudioInput(p)
 	}
@@ -26,6 +28,12 @@ func (b *Bin) buildAudioElements(p *params.Params) error {
 		return err
 	}
 
+	tagInjectors, err := buildTagInjectors(p, true)
+	if err != nil {
+		return err
+	}
+	b.audioElements = append(b.audioElements, tagInjectors...)
+
 	b.audioQueue, err = gst.NewElement("queue")
 	if err != nil {
 		return err
@@ -34,6 +42,7 @@ func (b *Bin) buildAudioElements(p *params.Params) error {
 		return err
 	}
 	b.audioElements = append(b.audioElements, b.audioQueue)
+	b.audioDuration = newAudioDuration(b.audioQueue.GetStaticPad("src"))
 
 	return b.bin.AddMany(b.audioElements...)
 }
@@ -46,13 +55,23 @@ func (b *Bin) buildWebAudioInput(p *params.Params) error {
 	if err = pulseSrc.SetProperty("device", fmt.Sprintf("%s.monitor", p.Info.EgressId)); err != nil {
 		return err
 	}
+	// pulse's clock drifts from the system clock ximagesrc captures against, which adds up to a visible
+	// desync over long recordings. The system clock is used for both, and audio is timestamped against it.
+	// audiorate then fills or drops samples wherever the captured audio drifts from its timestamps
+	if err = pulseSrc.SetProperty("provide-clock", false); err != nil {
+		return err
+	}
+	pulseSrc.SetArg("slave-method", "re-timestamp")
+
+	if b.startGate != nil {
+		b.startGate.addPad(pulseSrc.GetStaticPad("src"), false)
+	}
 
 	b.audioElements = append(b.audioElements, pulseSrc)
 
 	return b.buildAudioEncoder(p)
 }
 
-// TODO: skip decoding when possible
 func (b *Bin) buildSDKAudioInput(p *params.Params) error {
 	src, codec := b.Source.(*source.SDKSource).GetAudioSource()
 
@@ -79,6 +98,17 @@ func (b *Bin) buildSDKAudioInput(p *params.Params) error {
 
 		b.audioElements = append(b.audioElements, src.Element, rtpOpusDepay)
 
+		if p.AudioCodec == params.MimeTypeOpus && p.AudioBedFile == "" && p.LoudnessTarget == 0 {
+			// no transcoding needed, the publisher's opus packets are muxed as they are
+			opusParse, err := gst.NewElement("opusparse")
+			if err != nil {
+				return err
+			}
+
+			b.audioElements = append(b.audioElements, opusParse)
+			return nil
+		}
+
 		opusDec, err := gst.NewElement("opusdec")
 		if err != nil {
 			return err
@@ -103,6 +133,12 @@ func (b *Bin) buildAudioEncoder(p *params.Params) error {
 	if err != nil {
 		return err
 	}
+	if p.IsWebSource {
+		// re-timestamped audio starts when pulse first delivers samples, which shouldn't be preceded by silence
+		if err = audioRate.SetProperty("skip-to-first", true); err != nil {
+			return err
+		}
+	}
 
 	audioConvert, err := gst.NewElement("audioconvert")
 	if err != nil {
@@ -117,6 +153,7 @@ func (b *Bin) buildAudioEncoder(p *params.Params) error {
 
 	var capsStr string
 	var encoderName string
+	bitDepth := 16
 	switch p.AudioCodec {
 	case params.MimeTypeOpus:
 		capsStr = "audio/x-raw,format=S16LE,layout=interleaved,rate=48000,channels=2"
@@ -125,6 +162,20 @@ func (b *Bin) buildAudioEncoder(p *params.Params) error {
 	case params.MimeTypeAAC:
 		capsStr = fmt.Sprintf("audio/x-raw,format=S16LE,layout=interleaved,rate=%d,channels=2", p.AudioFrequency)
 		encoderName = "faac"
+
+	case params.MimeTypeMP3:
+		capsStr = fmt.Sprintf("audio/x-raw,format=S16LE,layout=interleaved,rate=%d,channels=2", p.AudioFrequency)
+		encoderName = "lamemp3enc"
+
+	case params.MimeTypeRaw:
+		if p.OutputType == params.OutputTypeNDI {
+			// ndi audio is 32-bit float
+			capsStr = "audio/x-raw,format=F32LE,layout=interleaved,rate=48000,channels=2"
+			break
+		}
+		// pcm is written by wavenc without encoding
+		capsStr = fmt.Sprintf("audio/x-raw,format=S%dLE,layout=interleaved,rate=%d,channels=2", p.AudioBitDepth, p.AudioFrequency)
+		bitDepth = int(p.AudioBitDepth)
 	}
 
 	audioCapsFilter, err := gst.NewElement("capsfilter")
@@ -135,14 +186,62 @@ func (b *Bin) buildAudioEncoder(p *params.Params) error {
 		return err
 	}
 
+	b.audioElements = append(b.audioElements, audioRate, audioConvert, audioResample, audioCapsFilter)
+	if p.AudioBedFile != "" && p.OutputType != params.OutputTypeRaw && p.OutputType != params.OutputTypeNDI {
+		if err = b.buildAudioBed(p, audioCapsFilter, capsStr, bitDepth); err != nil {
+			return err
+		}
+	}
+
+	if p.LoudnessTarget != 0 {
+		if err = b.buildLoudnessNormalizer(p, capsStr); err != nil {
+			return err
+		}
+	}
+
+	if encoderName == "" {
+		return nil
+	}
+
 	encoder, err := gst.NewElement(encoderName)
 	if err != nil {
 		return err
 	}
-	if err = encoder.SetProperty("bitrate", int(p.AudioBitrate*1000)); err != nil {
+	if p.AudioCodec == params.MimeTypeMP3 {
+		// lame uses kbps, and defaults to vbr
+		encoder.SetArg("target", "bitrate")
+		if err = encoder.SetProperty("bitrate", int(p.AudioBitrate)); err != nil {
+			return err
+		}
+		if err = encoder.SetProperty("cbr", true); err != nil {
+			return err
+		}
+	} else if err = encoder.SetProperty("bitrate", int(p.AudioBitrate*1000)); err != nil {
 		return err
 	}
+	if err = applyEncoderOptions(encoder, p); err != nil {
+		return err
+	}
+
+	b.audioElements = append(b.audioElements, encoder)
+
+	if p.GetSegmentOutputType() == params.OutputTypeAAC {
+		// aac files and packed audio segments are written as raw ADTS frames
+		aacParse, err := gst.NewElement("aacparse")
+		if err != nil {
+			return err
+		}
+
+		adtsCapsFilter, err := gst.NewElement("capsfilter")
+		if err != nil {
+			return err
+		}
+		if err = adtsCapsFilter.SetProperty("caps", gst.NewCapsFromString("audio/mpeg,mpegversion=4,stream-format=adts")); err != nil {
+			return err
+		}
+
+		b.audioElements = append(b.audioElements, aacParse, adtsCapsFilter)
+	}
 
-	b.audioElements = append(b.audioElements, audioRate, audioConvert, audioResample, audioCapsFilter, encoder)
 	return nil
 }
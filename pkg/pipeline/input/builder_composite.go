@@ -0,0 +1,534 @@
+package input
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/source"
+)
+
+const compositeAudioCaps = "audio/x-raw,format=S16LE,layout=interleaved,rate=48000,channels=2"
+
+// sdkComposite mixes every track in the room without a browser, or the tracks of a track composite with a layout.
+// Audio tracks are mixed, and video tracks are arranged by the layout. Generated sources keep the mix running
+// while there are no tracks
+type sdkComposite struct {
+	logger logger.Logger
+	bin    *gst.Bin
+
+	width     int32
+	height    int32
+	framerate int32
+	layout    string
+	order     []string // track composite video track IDs, in layout order
+
+	// stalled or muted video tracks are hidden after this long, showing the background
+	stallTimeout time.Duration
+
+	audioMixer *gst.Element
+	videoMixer *gst.Element
+	background *gst.Element
+	generated  []*gst.Element
+
+	mu     sync.Mutex
+	tracks map[string]*compositeTrackElements
+	videos []string // video track IDs, in grid order
+}
+
+type compositeTrackElements struct {
+	elements  []*gst.Element
+	mixerPad  *gst.Pad
+	mixer     *gst.Element
+	scaleCaps *gst.Element // video only
+	stalled   bool         // video only
+}
+
+// rect is a position in the output frame
+type rect struct {
+	x, y, width, height int
+}
+
+func (b *Bin) getComposite(p *params.Params) *sdkComposite {
+	if b.composite == nil {
+		b.composite = &sdkComposite{
+			logger:    p.Logger,
+			bin:       b.bin,
+			width:     p.Width,
+			height:    p.Height,
+			framerate: p.Framerate,
+			layout:    p.Layout,
+			order:     p.CompositeVideoTrackIDs,
+			tracks:    make(map[string]*compositeTrackElements),
+
+			stallTimeout: p.StallTimeout,
+		}
+	}
+	return b.composite
+}
+
+// buildSDKCompositeAudioInput mixes every audio track in the room, on top of silence
+func (b *Bin) buildSDKCompositeAudioInput(p *params.Params) error {
+	c := b.getComposite(p)
+
+	silence, err := gst.NewElement("audiotestsrc")
+	if err != nil {
+		return err
+	}
+	silence.SetArg("wave", "silence")
+	if err = silence.SetProperty("is-live", true); err != nil {
+		return err
+	}
+
+	silenceCaps, err := newCapsFilter(compositeAudioCaps)
+	if err != nil {
+		return err
+	}
+
+	c.audioMixer, err = gst.NewElement("audiomixer")
+	if err != nil {
+		return err
+	}
+
+	c.generated = append(c.generated, silence)
+	b.audioElements = append(b.audioElements, silence, silenceCaps, c.audioMixer)
+
+	return b.buildAudioEncoder(p)
+}
+
+// buildSDKCompositeVideoInput arranges video tracks on top of the background, a solid color or an image
+func (b *Bin) buildSDKCompositeVideoInput(p *params.Params) error {
+	c := b.getComposite(p)
+
+	argb := p.BackgroundColor
+	if argb == 0 {
+		argb = 0xff000000
+		if strings.HasSuffix(p.Layout, "-light") {
+			argb = 0xffffffff
+		}
+	}
+	background, generated, err := b.buildStillSource(p, p.BackgroundImage, argb)
+	if err != nil {
+		return err
+	}
+	c.background = background[len(background)-1]
+
+	c.videoMixer, err = gst.NewElement("compositor")
+	if err != nil {
+		return err
+	}
+
+	videoConvert, err := gst.NewElement("videoconvert")
+	if err != nil {
+		return err
+	}
+
+	decodedCaps, err := newCapsFilter(fmt.Sprintf(
+		"video/x-raw,format=I420,width=%d,height=%d,framerate=%d/1,colorimetry=bt709,chroma-site=mpeg2,pixel-aspect-ratio=1/1",
+		p.Width, p.Height, p.Framerate,
+	))
+	if err != nil {
+		return err
+	}
+
+	c.generated = append(c.generated, generated)
+	b.videoElements = append(b.videoElements, background...)
+	b.videoElements = append(b.videoElements, c.videoMixer, videoConvert, decodedCaps)
+
+	return b.buildVideoEncoder(p)
+}
+
+// start adds tracks to the pipeline as they're subscribed. Called once the mixers are linked
+func (c *sdkComposite) start(s *source.SDKSource) error {
+	if c.videoMixer != nil {
+		// the background is always drawn first
+		if err := c.background.GetStaticPad("src").GetPeer().SetProperty("zorder", uint(0)); err != nil {
+			return err
+		}
+	}
+
+	s.OnCompositeTrack(c.addTrack, c.removeTrack)
+	return nil
+}
+
+func (c *sdkComposite) addTrack(t *source.CompositeTrack) {
+	var elements []*gst.Element
+	var scaleCaps *gst.Element
+	var mixer *gst.Element
+	var err error
+
+	switch t.Kind {
+	case webrtc.RTPCodecTypeAudio:
+		mixer = c.audioMixer
+		elements, err = buildCompositeAudioElements(t)
+	case webrtc.RTPCodecTypeVideo:
+		mixer = c.videoMixer
+		elements, scaleCaps, err = buildCompositeVideoElements(t)
+	}
+	if mixer == nil {
+		return
+	}
+	if err != nil {
+		c.logger.Errorw("could not build track elements", err, "trackID", t.TrackID)
+		return
+	}
+
+	queue, err := gst.NewElement("queue")
+	if err != nil {
+		c.logger.Errorw("could not build track elements", err, "trackID", t.TrackID)
+		return
+	}
+	if err = queue.SetProperty("max-size-time", uint64(3e9)); err != nil {
+		c.logger.Errorw("could not build track elements", err, "trackID", t.TrackID)
+		return
+	}
+	elements = append(elements, queue)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err = c.bin.AddMany(elements...); err != nil {
+		c.logger.Errorw("could not add track elements", err, "trackID", t.TrackID)
+		return
+	}
+	if err = gst.ElementLinkMany(elements...); err != nil {
+		c.logger.Errorw("could not link track elements", err, "trackID", t.TrackID)
+		return
+	}
+
+	mixerPad := mixer.GetRequestPad("sink_%u")
+	if linkReturn := queue.GetStaticPad("src").Link(mixerPad); linkReturn != gst.PadLinkOK {
+		c.logger.Errorw("could not link track", errors.ErrPadLinkFailed("composite mixer", linkReturn.String()), "trackID", t.TrackID)
+		return
+	}
+
+	c.tracks[t.TrackID] = &compositeTrackElements{
+		elements:  elements,
+		mixerPad:  mixerPad,
+		mixer:     mixer,
+		scaleCaps: scaleCaps,
+	}
+	if t.Kind == webrtc.RTPCodecTypeVideo {
+		c.videos = append(c.videos, t.TrackID)
+		c.updateLayout()
+		if c.stallTimeout > 0 {
+			trackID := t.TrackID
+			t.OnStalled(c.stallTimeout, func(stalled bool) {
+				c.setStalled(trackID, stalled)
+			})
+		}
+	}
+
+	for _, e := range elements {
+		e.SyncStateWithParent()
+	}
+	t.Playing()
+
+	c.logger.Debugw("track added to composite", "trackID", t.TrackID, "kind", t.Kind.String())
+}
+
+// removeTrack is called once the track's writer has finished. Its elements are removed when the EOS reaches the mixer
+func (c *sdkComposite) removeTrack(t *source.CompositeTrack) {
+	c.mu.Lock()
+	elements := c.tracks[t.TrackID]
+	delete(c.tracks, t.TrackID)
+	if t.Kind == webrtc.RTPCodecTypeVideo {
+		for i, trackID := range c.videos {
+			if trackID == t.TrackID {
+				c.videos = append(c.videos[:i], c.videos[i+1:]...)
+				break
+			}
+		}
+		c.updateLayout()
+	}
+	c.mu.Unlock()
+
+	if elements == nil {
+		return
+	}
+
+	queue := elements.elements[len(elements.elements)-1]
+	queue.GetStaticPad("src").AddProbe(gst.PadProbeTypeEventDownstream, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		if event := info.GetEvent(); event == nil || event.Type() != gst.EventTypeEOS {
+			return gst.PadProbeOK
+		}
+
+		// the mixer should keep going, so the EOS is dropped, and the elements are removed outside the streaming thread
+		go func() {
+			for _, e := range elements.elements {
+				_ = e.SetState(gst.StateNull)
+			}
+			elements.mixer.ReleaseRequestPad(elements.mixerPad)
+			if err := c.bin.RemoveMany(elements.elements...); err != nil {
+				c.logger.Errorw("could not remove track elements", err, "trackID", t.TrackID)
+			}
+		}()
+		return gst.PadProbeDrop
+	})
+
+	c.logger.Debugw("track removed from composite", "trackID", t.TrackID, "kind", t.Kind.String())
+}
+
+// setStalled hides a video track while it's stalled or muted, instead of freezing on its last frame
+func (c *sdkComposite) setStalled(trackID string, stalled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if track := c.tracks[trackID]; track != nil {
+		track.stalled = stalled
+		c.updateLayout()
+	}
+}
+
+// setLayout changes the layout of a running track composite. A nil order keeps the current one
+func (c *sdkComposite) setLayout(layout string, order []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.layout = layout
+	if order != nil {
+		c.order = order
+	}
+	c.updateLayout()
+}
+
+// updateLayout positions video tracks with the composite's layout. Tracks left out of the layout are hidden
+func (c *sdkComposite) updateLayout() {
+	videos := c.orderedVideos()
+	shown := make(map[string]bool, len(videos))
+	for _, trackID := range videos {
+		shown[trackID] = true
+	}
+	for _, trackID := range c.videos {
+		if track := c.tracks[trackID]; track != nil && !shown[trackID] {
+			if err := track.mixerPad.SetProperty("alpha", 0.0); err != nil {
+				c.logger.Errorw("could not update layout", err, "trackID", trackID)
+			}
+		}
+	}
+
+	cells := layoutCells(c.layout, len(videos), int(c.width), int(c.height))
+	for i, trackID := range videos {
+		track := c.tracks[trackID]
+		if track == nil {
+			continue
+		}
+
+		cell := cells[i]
+		alpha := 1.0
+		if track.stalled {
+			alpha = 0.0
+		}
+		zorder := uint(1)
+		if c.layout == params.TrackLayoutPiP && i > 0 {
+			// insets are drawn over the main track
+			zorder = 2
+		}
+		if err := track.scaleCaps.SetProperty("caps", gst.NewCapsFromString(fmt.Sprintf(
+			"video/x-raw,format=I420,width=%d,height=%d,pixel-aspect-ratio=1/1", cell.width, cell.height,
+		))); err != nil {
+			c.logger.Errorw("could not update layout", err, "trackID", trackID)
+		}
+		for name, value := range map[string]interface{}{
+			"xpos":   cell.x,
+			"ypos":   cell.y,
+			"zorder": zorder,
+			"alpha":  alpha,
+		} {
+			if err := track.mixerPad.SetProperty(name, value); err != nil {
+				c.logger.Errorw("could not update layout", err, "trackID", trackID)
+			}
+		}
+	}
+}
+
+// endGeneratedInputs stops the silence and background sources, which would otherwise never reach EOS
+func (c *sdkComposite) endGeneratedInputs() {
+	for _, e := range c.generated {
+		e.SendEvent(gst.NewEOSEvent())
+	}
+}
+
+// orderedVideos returns the video tracks in layout order. Room composites show tracks in the order they were published
+func (c *sdkComposite) orderedVideos() []string {
+	if len(c.order) == 0 {
+		return c.videos
+	}
+
+	present := make(map[string]bool, len(c.videos))
+	for _, trackID := range c.videos {
+		present[trackID] = true
+	}
+	videos := make([]string, 0, len(c.videos))
+	for _, trackID := range c.order {
+		if present[trackID] {
+			videos = append(videos, trackID)
+		}
+	}
+	return videos
+}
+
+// layoutCells returns the position of each video track. Room composite layouts, such as grid-light, use the grid
+func layoutCells(layout string, count, width, height int) []rect {
+	switch layout {
+	case params.TrackLayoutSideBySide:
+		return sideBySideLayout(count, width, height)
+	case params.TrackLayoutPiP:
+		return pipLayout(count, width, height)
+	default:
+		return gridLayout(count, width, height)
+	}
+}
+
+// sideBySideLayout splits the frame into equal columns, at full height
+func sideBySideLayout(count, width, height int) []rect {
+	if count == 0 {
+		return nil
+	}
+
+	cellWidth := width / count &^ 1
+	cells := make([]rect, count)
+	for i := range cells {
+		cells[i] = rect{x: i * cellWidth, width: cellWidth, height: height &^ 1}
+	}
+	return cells
+}
+
+// pipLayout fills the frame with the first track, and stacks the others as quarter size insets in the bottom right corner
+func pipLayout(count, width, height int) []rect {
+	if count == 0 {
+		return nil
+	}
+
+	cells := []rect{{width: width &^ 1, height: height &^ 1}}
+	insetWidth := width / 4 &^ 1
+	insetHeight := height / 4 &^ 1
+	margin := height / 32 &^ 1
+	for i := 1; i < count; i++ {
+		cells = append(cells, rect{
+			x:      width - margin - insetWidth,
+			y:      height - i*(margin+insetHeight),
+			width:  insetWidth,
+			height: insetHeight,
+		})
+	}
+	return cells
+}
+
+// gridLayout splits the frame into equal cells, filled row by row. Scaled tracks keep their aspect ratio
+func gridLayout(count, width, height int) []rect {
+	if count == 0 {
+		return nil
+	}
+
+	cols := int(math.Ceil(math.Sqrt(float64(count))))
+	rows := (count + cols - 1) / cols
+
+	// i420 needs even dimensions
+	cellWidth := width / cols &^ 1
+	cellHeight := height / rows &^ 1
+
+	cells := make([]rect, count)
+	for i := range cells {
+		cells[i] = rect{
+			x:      (i % cols) * cellWidth,
+			y:      (i / cols) * cellHeight,
+			width:  cellWidth,
+			height: cellHeight,
+		}
+	}
+	return cells
+}
+
+func buildCompositeAudioElements(t *source.CompositeTrack) ([]*gst.Element, error) {
+	t.Src.Element.SetArg("format", "time")
+	if err := t.Src.Element.SetProperty("is-live", true); err != nil {
+		return nil, err
+	}
+	if err := t.Src.Element.SetProperty("caps", gst.NewCapsFromString(fmt.Sprintf(
+		"application/x-rtp,media=audio,payload=%d,encoding-name=OPUS,clock-rate=%d",
+		t.Codec.PayloadType, t.Codec.ClockRate,
+	))); err != nil {
+		return nil, err
+	}
+
+	elements := []*gst.Element{t.Src.Element}
+	for _, name := range []string{"rtpopusdepay", "opusdec", "audioconvert", "audioresample"} {
+		e, err := gst.NewElement(name)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, e)
+	}
+
+	mixCaps, err := newCapsFilter(compositeAudioCaps)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(elements, mixCaps), nil
+}
+
+func buildCompositeVideoElements(t *source.CompositeTrack) ([]*gst.Element, *gst.Element, error) {
+	t.Src.Element.SetArg("format", "time")
+	if err := t.Src.Element.SetProperty("is-live", true); err != nil {
+		return nil, nil, err
+	}
+
+	var encodingName string
+	var decoders []string
+	switch {
+	case strings.EqualFold(t.Codec.MimeType, string(params.MimeTypeVP8)):
+		encodingName = "VP8"
+		decoders = []string{"rtpvp8depay", "vp8dec"}
+	case strings.EqualFold(t.Codec.MimeType, string(params.MimeTypeH264)):
+		encodingName = "H264"
+		decoders = []string{"rtph264depay", "avdec_h264"}
+	default:
+		return nil, nil, errors.ErrNotSupported(t.Codec.MimeType)
+	}
+
+	if err := t.Src.Element.SetProperty("caps", gst.NewCapsFromString(fmt.Sprintf(
+		"application/x-rtp,media=video,payload=%d,encoding-name=%s,clock-rate=%d",
+		t.Codec.PayloadType, encodingName, t.Codec.ClockRate,
+	))); err != nil {
+		return nil, nil, err
+	}
+
+	elements := []*gst.Element{t.Src.Element}
+	for _, name := range append(decoders, "videoconvert", "videoscale") {
+		e, err := gst.NewElement(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		elements = append(elements, e)
+	}
+
+	// the cell size is set by the layout. videoscale adds borders to keep the aspect ratio
+	scaleCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(elements, scaleCaps), scaleCaps, nil
+}
+
+func newCapsFilter(caps string) (*gst.Element, error) {
+	capsFilter, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, err
+	}
+	if err = capsFilter.SetProperty("caps", gst.NewCapsFromString(caps)); err != nil {
+		return nil, err
+	}
+	return capsFilter, nil
+}
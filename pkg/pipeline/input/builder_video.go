@@ -5,7 +5,9 @@ import (
 	"strings"
 
 	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
 
+	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/errors"
 	"github.com/livekit/egress/pkg/pipeline/params"
 	"github.com/livekit/egress/pkg/pipeline/source"
@@ -19,6 +21,8 @@ func (b *Bin) buildVideoElements(p *params.Params) error {
 	var err error
 	if p.IsWebSource {
 		err = b.buildWebVideoInput(p)
+	} else if p.SDKComposite {
+		err = b.buildSDKCompositeVideoInput(p)
 	} else {
 		err = b.buildSDKVideoInput(p)
 	}
@@ -26,6 +30,13 @@ func (b *Bin) buildVideoElements(p *params.Params) error {
 		return err
 	}
 
+	// global tags are only added once, on the audio stream if there is one
+	tagInjectors, err := buildTagInjectors(p, !p.AudioEnabled)
+	if err != nil {
+		return err
+	}
+	b.videoElements = append(b.videoElements, tagInjectors...)
+
 	b.videoQueue, err = gst.NewElement("queue")
 	if err != nil {
 		return err
@@ -68,6 +79,10 @@ func (b *Bin) buildWebVideoInput(p *params.Params) error {
 		return err
 	}
 
+	if b.startGate != nil {
+		b.startGate.addPad(xImageSrc.GetStaticPad("src"), true)
+	}
+
 	b.videoElements = append(b.videoElements, xImageSrc, videoConvert, videoFramerateCaps)
 
 	return b.buildVideoEncoder(p)
@@ -98,6 +113,18 @@ func (b *Bin) buildSDKVideoInput(p *params.Params) error {
 			return err
 		}
 
+		if p.OutputType == params.OutputTypeRaw {
+			// websockets get the published frames, one access unit at a time
+			return b.buildH264Passthrough(src.Element, rtpH264Depay, "byte-stream")
+		}
+		if p.TrackID != "" {
+			// track files and segments are remuxed without transcoding
+			if p.GetSegmentOutputType() == params.OutputTypeTS {
+				return b.buildH264Passthrough(src.Element, rtpH264Depay, "byte-stream")
+			}
+			return b.buildH264Passthrough(src.Element, rtpH264Depay, "avc")
+		}
+
 		avDecH264, err := gst.NewElement("avdec_h264")
 		if err != nil {
 			return err
@@ -120,7 +147,8 @@ func (b *Bin) buildSDKVideoInput(p *params.Params) error {
 			return err
 		}
 
-		if p.OutputType == params.OutputTypeIVF {
+		if p.VideoCodec == params.MimeTypeVP8 {
+			// no transcoding needed for ivf or webm
 			b.videoElements = append(b.videoElements, src.Element, rtpVP8Depay)
 			return nil
 		}
@@ -163,30 +191,405 @@ func (b *Bin) buildSDKVideoInput(p *params.Params) error {
 
 	b.videoElements = append(b.videoElements, videoConvert, videoScale, videoRate, decodedCaps)
 
+	if p.SlateImage != "" || p.BackgroundImage != "" || p.BackgroundColor != 0 {
+		if err = b.buildSlate(p); err != nil {
+			return err
+		}
+	}
+
 	return b.buildVideoEncoder(p)
 }
 
+func (b *Bin) buildH264Passthrough(src, depay *gst.Element, streamFormat string) error {
+	h264Parse, err := gst.NewElement("h264parse")
+	if err != nil {
+		return err
+	}
+	if streamFormat == "byte-stream" {
+		// parameter sets are repeated with each keyframe, so consumers can start decoding at any of them
+		if err = h264Parse.SetProperty("config-interval", -1); err != nil {
+			return err
+		}
+	}
+
+	caps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return err
+	}
+	if err = caps.SetProperty("caps", gst.NewCapsFromString(
+		fmt.Sprintf("video/x-h264,stream-format=%s,alignment=au", streamFormat),
+	)); err != nil {
+		return err
+	}
+
+	b.videoElements = append(b.videoElements, src, depay, h264Parse, caps)
+	return nil
+}
+
+// buildSlate adds an input-selector switching between the decoded track and a still image, or the background,
+// so that a stalled or muted publisher shows the slate instead of freezing on the last frame
+func (b *Bin) buildSlate(p *params.Params) error {
+	selector, err := gst.NewElement("input-selector")
+	if err != nil {
+		return err
+	}
+
+	image := p.SlateImage
+	if image == "" {
+		image = p.BackgroundImage
+	}
+	slate, generated, err := b.buildStillSource(p, image, p.BackgroundColor)
+	if err != nil {
+		return err
+	}
+
+	// the decoded track and the selector are linked here, so that the track is always the first selector pad
+	live := b.videoElements
+	if err = b.bin.AddMany(append(append(live, selector), slate...)...); err != nil {
+		return err
+	}
+	if err = gst.ElementLinkMany(live...); err != nil {
+		return err
+	}
+	livePad := selector.GetRequestPad("sink_%u")
+	if linkReturn := live[len(live)-1].GetStaticPad("src").Link(livePad); linkReturn != gst.PadLinkOK {
+		return errors.ErrPadLinkFailed("slate selector", linkReturn.String())
+	}
+
+	if err = gst.ElementLinkMany(slate...); err != nil {
+		return err
+	}
+	slatePad := selector.GetRequestPad("sink_%u")
+	if linkReturn := slate[len(slate)-1].GetStaticPad("src").Link(slatePad); linkReturn != gst.PadLinkOK {
+		return errors.ErrPadLinkFailed("slate selector", linkReturn.String())
+	}
+
+	if err = selector.SetProperty("active-pad", livePad); err != nil {
+		return err
+	}
+
+	b.slate = generated
+	b.Source.(*source.SDKSource).OnVideoStalled(p.StallTimeout, func(stalled bool) {
+		activePad := livePad
+		if stalled {
+			activePad = slatePad
+		}
+		if err := selector.SetProperty("active-pad", activePad); err != nil {
+			p.Logger.Errorw("failed to switch slate", err)
+		}
+	})
+
+	// the remaining video elements are added to the bin as usual
+	b.videoElements = []*gst.Element{selector}
+	return nil
+}
+
+// buildStillSource returns live video of an image, scaled to fit the output, or of a solid color when there's no image.
+// The returned elements are left for the caller to add and link, and end with the output caps. The generated element
+// is the one to send EOS to
+func (b *Bin) buildStillSource(p *params.Params, image string, argb uint32) ([]*gst.Element, *gst.Element, error) {
+	stillCaps, err := newCapsFilter(fmt.Sprintf(
+		"video/x-raw,format=I420,width=%d,height=%d,framerate=%d/1,colorimetry=bt709,chroma-site=mpeg2,pixel-aspect-ratio=1/1",
+		p.Width, p.Height, p.Framerate,
+	))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if image == "" {
+		colorSrc, err := gst.NewElement("videotestsrc")
+		if err != nil {
+			return nil, nil, err
+		}
+		colorSrc.SetArg("pattern", "solid-color")
+		if err = colorSrc.SetProperty("foreground-color", uint(argb)); err != nil {
+			return nil, nil, err
+		}
+		if err = colorSrc.SetProperty("is-live", true); err != nil {
+			return nil, nil, err
+		}
+		return []*gst.Element{colorSrc, stillCaps}, colorSrc, nil
+	}
+
+	uri, err := params.MediaURI(image)
+	if err != nil {
+		return nil, nil, err
+	}
+	decodeBin, err := gst.NewElement("uridecodebin")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = decodeBin.SetProperty("uri", uri); err != nil {
+		return nil, nil, err
+	}
+
+	videoConvert, err := gst.NewElement("videoconvert")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	videoScale, err := gst.NewElement("videoscale")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	imageFreeze, err := gst.NewElement("imagefreeze")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = imageFreeze.SetProperty("is-live", true); err != nil {
+		return nil, nil, err
+	}
+
+	// the image is decoded once, and linked when its pad appears
+	if err = b.bin.Add(decodeBin); err != nil {
+		return nil, nil, err
+	}
+	if _, err = decodeBin.Connect("pad-added", func(_ *gst.Element, pad *gst.Pad) {
+		if linkReturn := pad.Link(videoConvert.GetStaticPad("sink")); linkReturn != gst.PadLinkOK {
+			p.Logger.Errorw("failed to link still image", errors.ErrPadLinkFailed("image decoder", linkReturn.String()))
+		}
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return []*gst.Element{videoConvert, videoScale, imageFreeze, stillCaps}, imageFreeze, nil
+}
+
+// buildImageBranches splits the raw video ahead of the encoder, for snapshots and previews.
+// The branches are leaky, so they drop frames instead of holding up the recording
+func (b *Bin) buildImageBranches(p *params.Params) error {
+	var err error
+	b.imageTee, err = gst.NewElement("tee")
+	if err != nil {
+		return err
+	}
+	b.videoElements = append(b.videoElements, b.imageTee)
+
+	if p.SnapshotInterval > 0 {
+		branch, err := buildSnapshotBranch(p)
+		if err != nil {
+			return err
+		}
+		b.imageBranches = append(b.imageBranches, branch)
+	}
+
+	if p.PreviewInterval > 0 {
+		branch, err := b.buildPreviewBranch(p)
+		if err != nil {
+			return err
+		}
+		b.imageBranches = append(b.imageBranches, branch)
+	}
+
+	for _, branch := range b.imageBranches {
+		if err = b.bin.AddMany(branch...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildImageScaler creates a leaky queue followed by elements scaling the video and reducing its framerate
+func buildImageScaler(width, height int32, framerate string, format string) ([]*gst.Element, error) {
+	queue, err := gst.NewElement("queue")
+	if err != nil {
+		return nil, err
+	}
+	queue.SetArg("leaky", "downstream")
+
+	videoRate, err := gst.NewElement("videorate")
+	if err != nil {
+		return nil, err
+	}
+	if err = videoRate.SetProperty("drop-only", true); err != nil {
+		return nil, err
+	}
+
+	videoScale, err := gst.NewElement("videoscale")
+	if err != nil {
+		return nil, err
+	}
+
+	videoConvert, err := gst.NewElement("videoconvert")
+	if err != nil {
+		return nil, err
+	}
+
+	caps := fmt.Sprintf("video/x-raw,width=%d,height=%d,framerate=%s,pixel-aspect-ratio=1/1", width, height, framerate)
+	if format != "" {
+		caps += fmt.Sprintf(",format=%s", format)
+	}
+	scaledCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, err
+	}
+	if err = scaledCaps.SetProperty("caps", gst.NewCapsFromString(caps)); err != nil {
+		return nil, err
+	}
+
+	return []*gst.Element{queue, videoRate, videoScale, videoConvert, scaledCaps}, nil
+}
+
+// buildSnapshotBranch writes a still image at each snapshot interval
+func buildSnapshotBranch(p *params.Params) ([]*gst.Element, error) {
+	branch, err := buildImageScaler(p.SnapshotWidth, p.SnapshotHeight, fmt.Sprintf("1000/%d", p.SnapshotInterval.Milliseconds()), "")
+	if err != nil {
+		return nil, err
+	}
+
+	var enc *gst.Element
+	if p.SnapshotType == params.OutputTypePNG {
+		enc, err = gst.NewElement("pngenc")
+	} else {
+		enc, err = gst.NewElement("jpegenc")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := gst.NewElement("multifilesink")
+	if err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("location", fmt.Sprintf("%s_%%05d%s", p.SnapshotPrefix, params.FileExtensionForOutputType[p.SnapshotType])); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("post-messages", true); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("async", false); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("sync", false); err != nil {
+		return nil, err
+	}
+
+	return append(branch, enc, sink), nil
+}
+
+// buildPreviewBranch collects small RGBA frames for each animated preview, which are encoded outside the pipeline
+func (b *Bin) buildPreviewBranch(p *params.Params) ([]*gst.Element, error) {
+	branch, err := buildImageScaler(p.PreviewWidth, p.PreviewHeight, fmt.Sprintf("%d/1", p.PreviewFramerate), "RGBA")
+	if err != nil {
+		return nil, err
+	}
+
+	sink, err := app.NewAppSink()
+	if err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("sync", false); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("async", false); err != nil {
+		return nil, err
+	}
+
+	b.previews = newPreviewCollector(p.PreviewInterval, p.PreviewDuration, p.Logger)
+	sink.SetCallbacks(&app.SinkCallbacks{
+		EOSFunc: func(_ *app.Sink) {
+			b.previews.close()
+		},
+		NewSampleFunc: func(appSink *app.Sink) gst.FlowReturn {
+			sample := appSink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				return gst.FlowError
+			}
+
+			b.previews.addFrame(buffer.PresentationTimestamp(), func() []byte {
+				defer buffer.Unmap()
+				return append([]byte(nil), buffer.Map(gst.MapRead).Bytes()...)
+			})
+			return gst.FlowOK
+		},
+	})
+
+	return append(branch, sink.Element), nil
+}
+
 func (b *Bin) buildVideoEncoder(p *params.Params) error {
+	// burned in ahead of the image branches, so that snapshots and previews show them too
+	if p.TimecodeMode != "" {
+		if err := b.buildTimecodeOverlay(p); err != nil {
+			return err
+		}
+	}
+	if p.TextOverlay {
+		if err := b.buildTextOverlay(p); err != nil {
+			return err
+		}
+	}
+
+	if p.SnapshotInterval > 0 || p.PreviewInterval > 0 {
+		if err := b.buildImageBranches(p); err != nil {
+			return err
+		}
+	}
+
 	switch p.VideoCodec {
-	// we only encode h264, the rest are too slow
 	case params.MimeTypeH264:
-		x264Enc, err := gst.NewElement("x264enc")
+		if p.EmbedCaptions {
+			if err := b.buildCaptionEmbedder(p); err != nil {
+				return err
+			}
+		}
+
+		if p.EmbedCaptions {
+			// captions are written into the stream by x264enc
+			p.VideoEncoder = config.H264EncoderX264
+		}
+		h264Enc, err := newVideoEncoder(p, config.H264EncoderX264)
 		if err != nil {
 			return err
 		}
-		if err = x264Enc.SetProperty("bitrate", uint(p.VideoBitrate)); err != nil {
+		if err = h264Enc.SetProperty("bitrate", uint(p.VideoBitrate)); err != nil {
 			return err
 		}
-		x264Enc.SetArg("speed-preset", "veryfast")
-		x264Enc.SetArg("tune", "zerolatency")
-		if p.OutputType == params.OutputTypeHLS {
-			if err = x264Enc.SetProperty("key-int-max", uint(int32(p.SegmentDuration)*p.Framerate)); err != nil {
-				return err
+
+		var options []string
+		keyFrameInterval := p.KeyFrameInterval()
+		switch p.VideoEncoder {
+		case config.H264EncoderX264:
+			h264Enc.SetArg("speed-preset", p.VideoPreset)
+			h264Enc.SetArg("tune", "zerolatency")
+			if keyFrameInterval > 0 {
+				if err = h264Enc.SetProperty("key-int-max", uint(keyFrameInterval)); err != nil {
+					return err
+				}
+				// Avoid key frames other than at the interval, as splitmuxsink can become inconsistent otherwise
+				options = append(options, "scenecut=0")
 			}
-			// Avoid key frames other than at segments boudaries as splitmuxsink can become inconsistent otherwise
-			if err = x264Enc.SetProperty("option-string", "scenecut=0"); err != nil {
+		case config.H264EncoderNVENC:
+			h264Enc.SetArg("preset", "low-latency-hq")
+			h264Enc.SetArg("rc-mode", "cbr")
+			if err = h264Enc.SetProperty("zerolatency", true); err != nil {
 				return err
 			}
+			if keyFrameInterval > 0 {
+				if err = h264Enc.SetProperty("gop-size", int(keyFrameInterval)); err != nil {
+					return err
+				}
+			}
+		case config.H264EncoderVAAPI:
+			// the bitrate is ignored by the default constant qp mode
+			h264Enc.SetArg("rate-control", "cbr")
+			if keyFrameInterval > 0 {
+				if err = h264Enc.SetProperty("keyframe-period", uint(keyFrameInterval)); err != nil {
+					return err
+				}
+			}
+		}
+		if err = applyRateControl(h264Enc, p, options); err != nil {
+			return err
+		}
+		if err = applyEncoderOptions(h264Enc, p); err != nil {
+			return err
 		}
 
 		if p.VideoProfile == "" {
@@ -198,16 +601,203 @@ func (b *Bin) buildVideoEncoder(p *params.Params) error {
 			return err
 		}
 
-		if err = encodedCaps.SetProperty("caps", gst.NewCapsFromString(
-			fmt.Sprintf("video/x-h264,profile=%s,framerate=%d/1", p.VideoProfile, p.Framerate),
+		caps := fmt.Sprintf("video/x-h264,profile=%s,framerate=%d/1", p.VideoProfile, p.Framerate)
+		if p.VideoLevel != "" {
+			caps += fmt.Sprintf(",level=(string)%s", p.VideoLevel)
+		}
+		if err = encodedCaps.SetProperty("caps", gst.NewCapsFromString(caps)); err != nil {
+			return err
+		}
+
+		b.videoElements = append(b.videoElements, h264Enc, encodedCaps)
+		return nil
+
+	case params.MimeTypeH265:
+		return b.buildH265Encoder(p)
+
+	case params.MimeTypeVP8:
+		// vp8 is only encoded for webm output, using the realtime deadline to keep up with the input
+		vp8Enc, err := gst.NewElement("vp8enc")
+		if err != nil {
+			return err
+		}
+		if err = vp8Enc.SetProperty("target-bitrate", int(p.VideoBitrate*1000)); err != nil {
+			return err
+		}
+		if err = vp8Enc.SetProperty("deadline", int64(1)); err != nil {
+			return err
+		}
+		if err = vp8Enc.SetProperty("cpu-used", 4); err != nil {
+			return err
+		}
+		keyFrameInterval := p.KeyFrameInterval()
+		if keyFrameInterval == 0 {
+			keyFrameInterval = p.Framerate * 2
+		}
+		if err = vp8Enc.SetProperty("keyframe-max-dist", int(keyFrameInterval)); err != nil {
+			return err
+		}
+		vp8Enc.SetArg("end-usage", "cbr")
+		if err = applyRateControl(vp8Enc, p, nil); err != nil {
+			return err
+		}
+		if err = applyEncoderOptions(vp8Enc, p); err != nil {
+			return err
+		}
+
+		b.videoElements = append(b.videoElements, vp8Enc)
+		return nil
+
+	case params.MimeTypeVP9:
+		vp9Enc, err := gst.NewElement("vp9enc")
+		if err != nil {
+			return err
+		}
+		if err = vp9Enc.SetProperty("target-bitrate", int(p.VideoBitrate*1000)); err != nil {
+			return err
+		}
+		if err = vp9Enc.SetProperty("deadline", int64(1)); err != nil {
+			return err
+		}
+		if err = vp9Enc.SetProperty("cpu-used", int(p.VP9CPUUsed)); err != nil {
+			return err
+		}
+		keyFrameInterval := p.KeyFrameInterval()
+		if keyFrameInterval == 0 {
+			keyFrameInterval = p.Framerate * 2
+		}
+		if err = vp9Enc.SetProperty("keyframe-max-dist", int(keyFrameInterval)); err != nil {
+			return err
+		}
+		if err = vp9Enc.SetProperty("row-mt", true); err != nil {
+			return err
+		}
+		if p.VP9Quality > 0 {
+			// the bitrate becomes a cap
+			vp9Enc.SetArg("end-usage", "cq")
+			if err = vp9Enc.SetProperty("cq-level", int(p.VP9Quality)); err != nil {
+				return err
+			}
+		} else {
+			vp9Enc.SetArg("end-usage", "cbr")
+		}
+		if err = applyRateControl(vp9Enc, p, nil); err != nil {
+			return err
+		}
+		if err = applyEncoderOptions(vp9Enc, p); err != nil {
+			return err
+		}
+
+		b.videoElements = append(b.videoElements, vp9Enc)
+		return nil
+
+	case params.MimeTypeRawVideo:
+		// ndi frames are sent uncompressed
+		videoConvert, err := gst.NewElement("videoconvert")
+		if err != nil {
+			return err
+		}
+
+		rawCaps, err := gst.NewElement("capsfilter")
+		if err != nil {
+			return err
+		}
+		if err = rawCaps.SetProperty("caps", gst.NewCapsFromString(
+			fmt.Sprintf("video/x-raw,format=UYVY,width=%d,height=%d,framerate=%d/1", p.Width, p.Height, p.Framerate),
 		)); err != nil {
 			return err
 		}
 
-		b.videoElements = append(b.videoElements, x264Enc, encodedCaps)
+		b.videoElements = append(b.videoElements, videoConvert, rawCaps)
 		return nil
 
 	default:
 		return errors.ErrNotSupported(fmt.Sprintf("%s encoding", p.VideoCodec))
 	}
 }
+
+func (b *Bin) buildH265Encoder(p *params.Params) error {
+	h265Enc, err := newVideoEncoder(p, config.H265EncoderX265)
+	if err != nil {
+		return err
+	}
+	if err = h265Enc.SetProperty("bitrate", uint(p.VideoBitrate)); err != nil {
+		return err
+	}
+
+	// same key frame placement as h264, so that segments start on key frames
+	var options []string
+	keyFrameInterval := p.KeyFrameInterval()
+	switch p.VideoEncoder {
+	case config.H265EncoderX265:
+		h265Enc.SetArg("speed-preset", "veryfast")
+		h265Enc.SetArg("tune", "zerolatency")
+		if keyFrameInterval > 0 {
+			if err = h265Enc.SetProperty("key-int-max", int(keyFrameInterval)); err != nil {
+				return err
+			}
+			options = append(options, "scenecut=0")
+		}
+	case config.H265EncoderNVENC:
+		if keyFrameInterval > 0 {
+			if err = h265Enc.SetProperty("gop-size", int(keyFrameInterval)); err != nil {
+				return err
+			}
+		}
+	case config.H265EncoderVAAPI:
+		// the bitrate is ignored by the default constant qp mode
+		h265Enc.SetArg("rate-control", "cbr")
+		if keyFrameInterval > 0 {
+			if err = h265Enc.SetProperty("keyframe-period", uint(keyFrameInterval)); err != nil {
+				return err
+			}
+		}
+	}
+	if err = applyRateControl(h265Enc, p, options); err != nil {
+		return err
+	}
+	if err = applyEncoderOptions(h265Enc, p); err != nil {
+		return err
+	}
+
+	h265Parse, err := gst.NewElement("h265parse")
+	if err != nil {
+		return err
+	}
+
+	// mpeg ts carries annex b, while mp4 and mkv need the parameter sets in the codec data
+	streamFormat := "hvc1"
+	if p.GetSegmentOutputType() == params.OutputTypeTS {
+		streamFormat = "byte-stream"
+	}
+
+	encodedCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return err
+	}
+	if err = encodedCaps.SetProperty("caps", gst.NewCapsFromString(
+		fmt.Sprintf("video/x-h265,profile=main,stream-format=%s,framerate=%d/1", streamFormat, p.Framerate),
+	)); err != nil {
+		return err
+	}
+
+	b.videoElements = append(b.videoElements, h265Enc, h265Parse, encodedCaps)
+	return nil
+}
+
+// newVideoEncoder creates the configured encoder, or the software encoder when it isn't available.
+// Hardware encoder elements are only registered on nodes with a supported gpu
+func newVideoEncoder(p *params.Params, software string) (*gst.Element, error) {
+	if p.VideoEncoder != "" && p.VideoEncoder != software {
+		if enc, err := gst.NewElement(p.VideoEncoder); err == nil {
+			return enc, nil
+		}
+		p.Logger.Warnw("hardware encoder not available, using software encoder", nil,
+			"encoder", p.VideoEncoder,
+			"fallback", software,
+		)
+	}
+
+	p.VideoEncoder = software
+	return gst.NewElement(software)
+}
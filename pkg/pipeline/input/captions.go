@@ -0,0 +1,269 @@
+package input
+
+import (
+	"math/bits"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/source"
+)
+
+const (
+	// CEA-608 captions fit two rows of 32 characters on screen
+	captionRowLength = 32
+	captionRows      = 2
+
+	// cc_data header for a CEA-608 byte pair in field 1: marker bits, cc_valid, and cc_type 0
+	ccDataField1 = 0xfc
+)
+
+// CEA-608 control codes for data channel 1, each sent twice in case one is lost
+var (
+	cea608ResumeCaptionLoading = [2]byte{0x14, 0x20}
+	cea608EraseDisplayed       = [2]byte{0x14, 0x2c}
+	cea608EraseNonDisplayed    = [2]byte{0x14, 0x2e}
+	cea608EndOfCaption         = [2]byte{0x14, 0x2f}
+	cea608PreambleRow14        = [2]byte{0x14, 0x40}
+	cea608PreambleRow15        = [2]byte{0x14, 0x60}
+	cea608Padding              = [2]byte{0x00, 0x00}
+)
+
+// cea608Characters maps characters to the CEA-608 basic character set, which replaces some ascii characters with accented ones
+var cea608Characters = map[rune]byte{
+	'á': 0x2a, 'é': 0x5c, 'í': 0x5e, 'ó': 0x5f, 'ú': 0x60, 'ç': 0x7b, '÷': 0x7c, 'Ñ': 0x7d, 'ñ': 0x7e,
+	'*': ' ', '\\': '/', '^': ' ', '_': '-', '`': '\'', '{': '(', '|': '/', '}': ')', '~': '-',
+}
+
+// captionEmbedder encodes transcriptions as CEA-608 pop-on captions, carried as CEA-708 cc_data with each video frame.
+// cccombiner attaches them to the raw frames, and x264enc writes them into the stream as SEI user data
+type captionEmbedder struct {
+	src           *app.Source
+	combiner      *gst.Element
+	frameDuration time.Duration
+
+	mu           sync.Mutex
+	queue        []captionScreen // captions waiting to be shown
+	sending      [][2]byte       // byte pairs of the caption being sent, one per frame
+	displayUntil time.Time
+
+	done chan struct{}
+}
+
+// captionScreen is as much of a transcription as fits on screen at once
+type captionScreen struct {
+	lines    []string
+	duration time.Duration
+}
+
+// buildCaptionEmbedder adds a combiner ahead of the encoder. The captions are linked to it in Link
+func (b *Bin) buildCaptionEmbedder(p *params.Params) error {
+	src, err := app.NewAppSrc()
+	if err != nil {
+		return err
+	}
+	src.SetCaps(gst.NewCapsFromString("closedcaption/x-cea-708,format=cc_data"))
+	src.SetArg("format", "time")
+	if err = src.SetProperty("is-live", true); err != nil {
+		return err
+	}
+	// captions are timestamped as they're pushed, which is once per frame
+	if err = src.SetProperty("do-timestamp", true); err != nil {
+		return err
+	}
+
+	combiner, err := gst.NewElement("cccombiner")
+	if err != nil {
+		return err
+	}
+
+	if err = b.bin.Add(src.Element); err != nil {
+		return err
+	}
+
+	e := &captionEmbedder{
+		src:           src,
+		combiner:      combiner,
+		frameDuration: time.Second / time.Duration(p.Framerate),
+		done:          make(chan struct{}),
+	}
+	b.Source.(*source.SDKSource).OnCaption(e.show)
+
+	b.captions = e
+	b.videoElements = append(b.videoElements, combiner)
+	return nil
+}
+
+// link connects the captions to the combiner, after the video has been linked to its sink pad
+func (e *captionEmbedder) link() error {
+	captionPad := e.combiner.GetRequestPad("caption")
+	if captionPad == nil {
+		return errors.ErrPadLinkFailed("caption combiner", "no caption pad")
+	}
+	if linkReturn := e.src.GetStaticPad("src").Link(captionPad); linkReturn != gst.PadLinkOK {
+		return errors.ErrPadLinkFailed("caption combiner", linkReturn.String())
+	}
+	return nil
+}
+
+func (e *captionEmbedder) start() {
+	go func() {
+		defer e.src.EndStream()
+
+		ticker := time.NewTicker(e.frameDuration)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-e.done:
+				return
+			case now := <-ticker.C:
+				pair := e.nextPair(now)
+				buffer := gst.NewBufferFromBytes([]byte{ccDataField1, oddParity(pair[0]), oddParity(pair[1])})
+				buffer.SetDuration(e.frameDuration)
+				if flow := e.src.PushBuffer(buffer); flow != gst.FlowOK {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (e *captionEmbedder) stop() {
+	select {
+	case <-e.done:
+	default:
+		close(e.done)
+	}
+}
+
+// show replaces anything waiting to be shown with a new transcription, split into screens shown for equal parts of its duration
+func (e *captionEmbedder) show(text string, duration time.Duration) {
+	lines := wrapCaption(text)
+	if len(lines) == 0 {
+		return
+	}
+
+	var screens []captionScreen
+	count := (len(lines) + captionRows - 1) / captionRows
+	for i := 0; i < len(lines); i += captionRows {
+		end := i + captionRows
+		if end > len(lines) {
+			end = len(lines)
+		}
+		screens = append(screens, captionScreen{
+			lines:    lines[i:end],
+			duration: duration / time.Duration(count),
+		})
+	}
+
+	e.mu.Lock()
+	e.queue = screens
+	// the caption on screen is replaced as soon as the next one has been sent
+	e.displayUntil = time.Time{}
+	e.mu.Unlock()
+}
+
+// nextPair returns the byte pair to send with the next frame
+func (e *captionEmbedder) nextPair(now time.Time) [2]byte {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.sending) == 0 {
+		switch {
+		case len(e.queue) > 0 && !now.Before(e.displayUntil):
+			screen := e.queue[0]
+			e.queue = e.queue[1:]
+			e.sending = encodePopOn(screen.lines)
+			// shown once the last pair has been sent
+			e.displayUntil = now.Add(time.Duration(len(e.sending))*e.frameDuration + screen.duration)
+		case !e.displayUntil.IsZero() && !now.Before(e.displayUntil):
+			e.sending = [][2]byte{cea608EraseDisplayed, cea608EraseDisplayed}
+			e.displayUntil = time.Time{}
+		default:
+			return cea608Padding
+		}
+	}
+
+	pair := e.sending[0]
+	e.sending = e.sending[1:]
+	return pair
+}
+
+// encodePopOn returns the byte pairs which load a caption off screen, then display it
+func encodePopOn(lines []string) [][2]byte {
+	pairs := [][2]byte{
+		cea608ResumeCaptionLoading, cea608ResumeCaptionLoading,
+		cea608EraseNonDisplayed, cea608EraseNonDisplayed,
+	}
+
+	// captions sit at the bottom of the screen
+	preambles := [][2]byte{cea608PreambleRow15}
+	if len(lines) == 2 {
+		preambles = [][2]byte{cea608PreambleRow14, cea608PreambleRow15}
+	}
+	for i, line := range lines {
+		pairs = append(pairs, preambles[i], preambles[i])
+		for j := 0; j < len(line); j += 2 {
+			pair := [2]byte{line[j], 0x00}
+			if j+1 < len(line) {
+				pair[1] = line[j+1]
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+
+	return append(pairs, cea608EndOfCaption, cea608EndOfCaption)
+}
+
+// wrapCaption converts text to the CEA-608 basic character set, wrapped to the row length
+func wrapCaption(text string) []string {
+	var lines []string
+	var line strings.Builder
+	for _, word := range strings.Fields(text) {
+		var encoded []byte
+		for _, r := range word {
+			encoded = append(encoded, cea608Character(r))
+		}
+		if len(encoded) > captionRowLength {
+			encoded = encoded[:captionRowLength]
+		}
+
+		if line.Len() > 0 && line.Len()+1+len(encoded) > captionRowLength {
+			lines = append(lines, line.String())
+			line.Reset()
+		}
+		if line.Len() > 0 {
+			line.WriteByte(' ')
+		}
+		line.Write(encoded)
+	}
+	if line.Len() > 0 {
+		lines = append(lines, line.String())
+	}
+	return lines
+}
+
+func cea608Character(r rune) byte {
+	if c, ok := cea608Characters[r]; ok {
+		return c
+	}
+	if r >= 0x20 && r < 0x7f {
+		return byte(r)
+	}
+	return '?'
+}
+
+// oddParity sets the high bit of a CEA-608 byte so that it has an odd number of bits set
+func oddParity(b byte) byte {
+	b &= 0x7f
+	if bits.OnesCount8(b)%2 == 0 {
+		b |= 0x80
+	}
+	return b
+}
@@ -0,0 +1,54 @@
+package input
+
+import (
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// true peak limit recommended alongside the ebu r128 target, in dBTP
+const loudnessMaxTruePeak = -1.0
+
+// buildLoudnessNormalizer normalizes the program audio to the target loudness, after any audio bed is mixed in.
+// audioloudnorm (gst-plugins-rs) works on 192kHz float samples, and looks 3s ahead, which adds as much latency
+func (b *Bin) buildLoudnessNormalizer(p *params.Params, capsStr string) error {
+	convertIn, err := gst.NewElement("audioconvert")
+	if err != nil {
+		return err
+	}
+	resampleIn, err := gst.NewElement("audioresample")
+	if err != nil {
+		return err
+	}
+
+	loudNorm, err := gst.NewElement("audioloudnorm")
+	if err != nil {
+		return err
+	}
+	if err = loudNorm.SetProperty("loudness-target", p.LoudnessTarget); err != nil {
+		return err
+	}
+	if err = loudNorm.SetProperty("max-true-peak", loudnessMaxTruePeak); err != nil {
+		return err
+	}
+
+	// back to the format of the encoder
+	convertOut, err := gst.NewElement("audioconvert")
+	if err != nil {
+		return err
+	}
+	resampleOut, err := gst.NewElement("audioresample")
+	if err != nil {
+		return err
+	}
+	capsFilter, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return err
+	}
+	if err = capsFilter.SetProperty("caps", gst.NewCapsFromString(capsStr)); err != nil {
+		return err
+	}
+
+	b.audioElements = append(b.audioElements, convertIn, resampleIn, loudNorm, convertOut, resampleOut, capsFilter)
+	return nil
+}
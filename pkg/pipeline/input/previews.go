@@ -0,0 +1,80 @@
+package input
+
+import (
+	"sync"
+	"time"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const maxPendingPreviews = 2
+
+// previewCollector keeps the frames at the start of each preview interval, handing them off once the preview is complete
+type previewCollector struct {
+	mu       sync.Mutex
+	interval time.Duration
+	duration time.Duration
+	logger   logger.Logger
+
+	started bool
+	start   time.Duration // pts of the first frame
+	frames  [][]byte
+	out     chan [][]byte
+	closed  bool
+}
+
+func newPreviewCollector(interval, duration time.Duration, logger logger.Logger) *previewCollector {
+	return &previewCollector{
+		interval: interval,
+		duration: duration,
+		logger:   logger,
+		out:      make(chan [][]byte, maxPendingPreviews),
+	}
+}
+
+// addFrame keeps a frame if it falls within a preview. Frames are only copied when they're kept
+func (c *previewCollector) addFrame(pts time.Duration, data func() []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if !c.started {
+		c.started = true
+		c.start = pts
+	}
+
+	if (pts-c.start)%c.interval < c.duration {
+		c.frames = append(c.frames, data())
+	} else if len(c.frames) > 0 {
+		c.flush()
+	}
+}
+
+// flush hands off the current preview. Must be called with the lock held
+func (c *previewCollector) flush() {
+	select {
+	case c.out <- c.frames:
+	default:
+		c.logger.Errorw("failed to hand off preview", errors.New("preview queue is full"))
+	}
+	c.frames = nil
+}
+
+// close hands off a partial preview, if any, and closes the channel
+func (c *previewCollector) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	if len(c.frames) > 0 {
+		c.flush()
+	}
+	c.closed = true
+	close(c.out)
+}
@@ -0,0 +1,146 @@
+package input
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// applyRateControl sets the rate control configured for the egress type on a video encoder, over its defaults.
+// options are x264enc and x265enc option-string entries, set along with the ones the rate control needs
+func applyRateControl(enc *gst.Element, p *params.Params, options []string) error {
+	rc := p.RateControl
+	name := enc.GetFactory().GetName()
+
+	var err error
+	if rc != nil {
+		switch name {
+		case config.H264EncoderX264:
+			options, err = applyX264RateControl(enc, rc, options)
+		case config.H265EncoderX265:
+			options = applyX265RateControl(rc, p.VideoBitrate, options)
+		case config.H264EncoderNVENC, config.H265EncoderNVENC:
+			err = applyNVENCRateControl(enc, rc, p.VideoBitrate)
+		case config.H264EncoderVAAPI, config.H265EncoderVAAPI:
+			err = applyVAAPIRateControl(enc, rc)
+		case "vp8enc", "vp9enc":
+			err = applyVPXRateControl(enc, rc)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(options) > 0 && (name == config.H264EncoderX264 || name == config.H265EncoderX265) {
+		return enc.SetProperty("option-string", strings.Join(options, ":"))
+	}
+	return nil
+}
+
+func applyX264RateControl(enc *gst.Element, rc *config.RateControlConfig, options []string) ([]string, error) {
+	if err := enc.SetProperty("vbv-buf-capacity", uint(rc.BufferSize.Milliseconds())); err != nil {
+		return nil, err
+	}
+
+	switch rc.Mode {
+	case config.RateControlCBR:
+		enc.SetArg("pass", "cbr")
+		// filler data keeps the bitrate up through static scenes, which ingest servers can read as a failing encoder
+		options = append(options, "nal-hrd=cbr")
+	case config.RateControlVBR:
+		// the bitrate is the average, with the vbv buffer as the only limit on peaks
+		enc.SetArg("pass", "cbr")
+	case config.RateControlCRF:
+		// x264enc keeps the bitrate as a ceiling
+		enc.SetArg("pass", "qual")
+		if err := enc.SetProperty("quantizer", uint(rc.Quality)); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+func applyX265RateControl(rc *config.RateControlConfig, bitrate int32, options []string) []string {
+	vbv := []string{
+		fmt.Sprintf("vbv-maxrate=%d", bitrate),
+		fmt.Sprintf("vbv-bufsize=%d", int64(bitrate)*rc.BufferSize.Milliseconds()/1000),
+	}
+
+	switch rc.Mode {
+	case config.RateControlCBR:
+		options = append(options, "strict-cbr=1")
+		options = append(options, vbv...)
+	case config.RateControlVBR:
+		options = append(options, vbv...)
+	case config.RateControlCRF:
+		options = append(options, fmt.Sprintf("crf=%d", rc.Quality))
+	}
+	return options
+}
+
+func applyNVENCRateControl(enc *gst.Element, rc *config.RateControlConfig, bitrate int32) error {
+	if err := enc.SetProperty("vbv-buffer-size", uint(int64(bitrate)*rc.BufferSize.Milliseconds()/1000)); err != nil {
+		return err
+	}
+
+	switch rc.Mode {
+	case config.RateControlCBR:
+		enc.SetArg("rc-mode", "cbr")
+	case config.RateControlVBR:
+		enc.SetArg("rc-mode", "vbr")
+	case config.RateControlCRF:
+		// without a target bitrate, vbr encodes to the quality
+		enc.SetArg("rc-mode", "vbr")
+		if err := enc.SetProperty("bitrate", uint(0)); err != nil {
+			return err
+		}
+		if err := enc.SetProperty("const-quality", float64(rc.Quality)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyVAAPIRateControl(enc *gst.Element, rc *config.RateControlConfig) error {
+	if err := enc.SetProperty("cpb-length", uint(rc.BufferSize.Milliseconds())); err != nil {
+		return err
+	}
+
+	switch rc.Mode {
+	case config.RateControlCBR:
+		enc.SetArg("rate-control", "cbr")
+	case config.RateControlVBR:
+		enc.SetArg("rate-control", "vbr")
+	case config.RateControlCRF:
+		// constant qp is the closest vaapi has on every driver
+		enc.SetArg("rate-control", "cqp")
+		if err := enc.SetProperty("init-qp", uint(rc.Quality)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyVPXRateControl(enc *gst.Element, rc *config.RateControlConfig) error {
+	if err := enc.SetProperty("buffer-size", int(rc.BufferSize.Milliseconds())); err != nil {
+		return err
+	}
+
+	switch rc.Mode {
+	case config.RateControlCBR:
+		enc.SetArg("end-usage", "cbr")
+	case config.RateControlVBR:
+		enc.SetArg("end-usage", "vbr")
+	case config.RateControlCRF:
+		// the bitrate is ignored in constant quality mode
+		enc.SetArg("end-usage", "q")
+		if err := enc.SetProperty("cq-level", int(rc.Quality)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
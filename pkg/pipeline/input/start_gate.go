@@ -0,0 +1,63 @@
+package input
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+)
+
+// startGate drops captured buffers until the template starts recording. Once it does, buffers captured
+// after the last video frame are let through, offset so that the recording starts at zero
+type startGate struct {
+	mu       sync.Mutex
+	pads     []*gst.Pad
+	open     bool
+	start    time.Duration
+	hasVideo bool
+	lastPTS  time.Duration // latest captured video frame, or audio buffer for audio only recordings
+}
+
+func newStartGate() *startGate {
+	return &startGate{}
+}
+
+// addPad drops buffers from a source pad until the gate is opened
+func (g *startGate) addPad(pad *gst.Pad, video bool) {
+	g.pads = append(g.pads, pad)
+	g.hasVideo = g.hasVideo || video
+	pad.AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		buffer := info.GetBuffer()
+		if buffer == nil {
+			return gst.PadProbeOK
+		}
+		pts := buffer.PresentationTimestamp()
+
+		g.mu.Lock()
+		defer g.mu.Unlock()
+
+		if !g.open {
+			if video || !g.hasVideo {
+				g.lastPTS = pts
+			}
+			return gst.PadProbeDrop
+		}
+		if pts <= g.start {
+			return gst.PadProbeDrop
+		}
+		return gst.PadProbeOK
+	})
+}
+
+// openGate starts the recording after the frame on screen when the template started recording
+func (g *startGate) openGate() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.open = true
+	g.start = g.lastPTS
+	for _, pad := range g.pads {
+		pad.SetOffset(-int64(g.start))
+	}
+	return g.start
+}
@@ -0,0 +1,55 @@
+package input
+
+import (
+	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// buildTextOverlay adds a text overlay ahead of the encoder, which stays hidden until text is set
+func (b *Bin) buildTextOverlay(p *params.Params) error {
+	overlay, err := gst.NewElement("textoverlay")
+	if err != nil {
+		return err
+	}
+	if err = overlay.SetProperty("silent", true); err != nil {
+		return err
+	}
+	if err = overlay.SetProperty("font-desc", p.TextOverlayFont); err != nil {
+		return err
+	}
+	if err = overlay.SetProperty("shaded-background", true); err != nil {
+		return err
+	}
+	setOverlayPosition(overlay, p.TextOverlayPosition)
+
+	b.textOverlay = overlay
+	b.videoElements = append(b.videoElements, overlay)
+	return nil
+}
+
+// SetTextOverlay shows text over the video, or hides the overlay if the text is empty.
+// An empty position keeps the current one
+func (b *Bin) SetTextOverlay(text, position string) error {
+	if b.textOverlay == nil {
+		return errors.ErrNoTextOverlay
+	}
+
+	if position != "" {
+		setOverlayPosition(b.textOverlay, position)
+	}
+	if err := b.textOverlay.SetProperty("text", text); err != nil {
+		return err
+	}
+	return b.textOverlay.SetProperty("silent", text == "")
+}
+
+// setOverlayPosition aligns an overlay element with a position validated by the config, such as bottom-right
+func setOverlayPosition(overlay *gst.Element, position string) {
+	alignment := strings.Split(position, "-")
+	overlay.SetArg("valignment", alignment[0])
+	overlay.SetArg("halignment", alignment[1])
+}
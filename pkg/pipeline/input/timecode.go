@@ -0,0 +1,47 @@
+package input
+
+import (
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// buildTimecodeOverlay draws the wall clock, or the running time of the recording, over the raw video ahead of the encoder
+func (b *Bin) buildTimecodeOverlay(p *params.Params) error {
+	var overlay *gst.Element
+	var err error
+	switch p.TimecodeMode {
+	case config.TimecodeModeWallClock:
+		overlay, err = gst.NewElement("clockoverlay")
+		if err != nil {
+			return err
+		}
+		if err = overlay.SetProperty("time-format", p.TimecodeFormat); err != nil {
+			return err
+		}
+
+	case config.TimecodeModeRunning:
+		// starts at zero with the pipeline, and keeps counting through gaps in the input
+		overlay, err = gst.NewElement("timeoverlay")
+		if err != nil {
+			return err
+		}
+		overlay.SetArg("time-mode", "running-time")
+
+	default:
+		return nil
+	}
+
+	if err = overlay.SetProperty("font-desc", p.TimecodeFont); err != nil {
+		return err
+	}
+	if err = overlay.SetProperty("shaded-background", true); err != nil {
+		return err
+	}
+
+	setOverlayPosition(overlay, p.TimecodePosition)
+
+	b.videoElements = append(b.videoElements, overlay)
+	return nil
+}
@@ -0,0 +1,63 @@
+package pipeline
+
+import (
+	"sort"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+)
+
+// PipelineState describes the running pipeline, for local inspection
+type PipelineState struct {
+	State  string       `json:"state"`
+	Queues []QueueLevel `json:"queues"`
+}
+
+// QueueLevel is the current fill of a queue element
+type QueueLevel struct {
+	Name    string        `json:"name"`
+	Buffers uint          `json:"buffers"`
+	Bytes   uint          `json:"bytes"`
+	Time    time.Duration `json:"time"`
+}
+
+// Inspect returns the pipeline's state and the levels of its queues
+func (p *Pipeline) Inspect() *PipelineState {
+	state := &PipelineState{
+		State:  p.pipeline.GetState().String(),
+		Queues: make([]QueueLevel, 0),
+	}
+
+	elements, err := p.pipeline.GetElementsRecursive()
+	if err != nil {
+		return state
+	}
+	for _, e := range elements {
+		if e.GetFactory().GetName() != "queue" {
+			continue
+		}
+
+		q := QueueLevel{Name: e.GetName()}
+		if buffers, err := e.GetProperty("current-level-buffers"); err == nil {
+			q.Buffers, _ = buffers.(uint)
+		}
+		if bytes, err := e.GetProperty("current-level-bytes"); err == nil {
+			q.Bytes, _ = bytes.(uint)
+		}
+		if levelTime, err := e.GetProperty("current-level-time"); err == nil {
+			t, _ := levelTime.(uint64)
+			q.Time = time.Duration(t)
+		}
+		state.Queues = append(state.Queues, q)
+	}
+	sort.Slice(state.Queues, func(i, j int) bool {
+		return state.Queues[i].Name < state.Queues[j].Name
+	})
+
+	return state
+}
+
+// GetDotData returns the pipeline graph in graphviz dot format
+func (p *Pipeline) GetDotData() string {
+	return p.pipeline.DebugBinToDotData(gst.DebugGraphShowAll)
+}
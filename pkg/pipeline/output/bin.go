@@ -2,12 +2,18 @@ package output
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
 
 	"github.com/tinyzimmer/go-gst/gst"
+	"go.uber.org/atomic"
 
 	"github.com/livekit/protocol/logger"
 	"github.com/livekit/protocol/tracer"
 
+	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/errors"
 	"github.com/livekit/egress/pkg/pipeline/params"
 )
@@ -16,17 +22,78 @@ type Bin struct {
 	bin *gst.Bin
 
 	// stream
-	protocol params.OutputType
-	tee      *gst.Element
-	sinks    map[string]*streamSink
+	tees    map[params.StreamMux]*gst.Element
+	sinksMu sync.Mutex
+	sinks   map[string]*streamSink
+
+	// rist
+	ristSenderBuffer     time.Duration
+	ristMinRTCPInterval  time.Duration
+	ristMaxRTCPBandwidth float64
+
+	// rtmps
+	rtmpsCAFile             string
+	rtmpsInsecureSkipVerify bool
+	rtmpsServerNames        map[string]string
+	proxies                 map[string]*tlsProxy
+	rtmpConnect             map[string]*config.RTMPConnectConfig
+	secretReferences        []string // allowed in stream urls
+
+	// encoding, for outputs which decode or re-encode the stream
+	audioEnabled     bool
+	videoEnabled     bool
+	width            int32
+	height           int32
+	framerate        int32
+	videoBitrate     int32
+	audioBitrate     int32
+	keyFrameInterval int32
+	videoPreset      string
+	videoProfile     params.Profile
+
+	// whip
+	whips map[string]*whipClient
+
+	// encoding limits, by ingest host
+	streamCaps map[string]*config.StreamCapConfig
 
 	logger logger.Logger
 }
 
 type streamSink struct {
-	pad   string
-	queue *gst.Element
-	sink  *gst.Element
+	mux       params.StreamMux
+	pad       string
+	queue     *gst.Element
+	transrate *gst.Element // limited destinations only
+	pay       *gst.Element // rist only
+	sink      *gst.Element
+
+	bitrate int32 // kbps encoded for this output
+	bytes   atomic.Uint64
+}
+
+// StreamStats describes what a stream output has sent so far
+type StreamStats struct {
+	Bytes           uint64  // sent since the output was added
+	TargetBitrate   int32   // kbps encoded for the output
+	BufferOccupancy float64 // how full its queue is, from 0 to 1
+}
+
+func (s *streamSink) elements() []*gst.Element {
+	elements := []*gst.Element{s.queue}
+	if s.transrate != nil {
+		elements = append(elements, s.transrate)
+	}
+	if s.pay != nil {
+		elements = append(elements, s.pay)
+	}
+	return append(elements, s.sink)
+}
+
+// owns returns true if the element is part of this output, or is inside one of its bins
+func (s *streamSink) owns(name string) bool {
+	return s.queue.GetName() == name || s.sink.GetName() == name ||
+		s.transrate != nil && s.transrate.GetName() == name
 }
 
 func Build(ctx context.Context, p *params.Params) (*Bin, error) {
@@ -41,6 +108,10 @@ func Build(ctx context.Context, p *params.Params) (*Bin, error) {
 	case params.EgressTypeWebsocket:
 		return buildWebsocketOutputBin(p)
 	case params.EgressTypeSegmentedFile:
+		if p.GetSegmentOutputType() == params.OutputTypeAAC {
+			// packed audio segments are written by an appsink
+			return buildPackedAudioOutputBin(p)
+		}
 		// In the case of segmented output, the muxer and the sink are embedded in the same object.
 		return nil, nil
 	default:
@@ -55,12 +126,12 @@ func (b *Bin) Element() *gst.Element {
 func (b *Bin) Link() error {
 	// stream tee and sinks
 	for _, sink := range b.sinks {
-		// link queue to rtmp sink
-		if err := sink.queue.Link(sink.sink); err != nil {
+		// link queue to sink
+		if err := gst.ElementLinkMany(sink.elements()...); err != nil {
 			return err
 		}
 
-		pad := b.tee.GetRequestPad("src_%u")
+		pad := b.tees[sink.mux].GetRequestPad("src_%u")
 		sink.pad = pad.GetName()
 
 		// link tee to queue
@@ -73,27 +144,34 @@ func (b *Bin) Link() error {
 }
 
 func (b *Bin) AddSink(url string) error {
-	if _, ok := b.sinks[url]; ok {
+	b.sinksMu.Lock()
+	_, ok := b.sinks[url]
+	b.sinksMu.Unlock()
+	if ok {
 		return errors.ErrStreamAlreadyExists
 	}
 
-	sink, err := buildStreamSink(b.protocol, url)
+	sink, err := b.buildStreamSink(url)
 	if err != nil {
 		return err
 	}
+	tee := b.tees[sink.mux]
+	if tee == nil {
+		return errors.ErrNotSupported(fmt.Sprintf("adding %s outputs to this egress", sink.mux))
+	}
 
 	// add to bin
-	if err = b.bin.AddMany(sink.queue, sink.sink); err != nil {
+	if err = b.bin.AddMany(sink.elements()...); err != nil {
 		return err
 	}
 
 	// link queue to sink
-	if err = sink.queue.Link(sink.sink); err != nil {
-		_ = b.bin.RemoveMany(sink.queue, sink.sink)
+	if err = gst.ElementLinkMany(sink.elements()...); err != nil {
+		_ = b.bin.RemoveMany(sink.elements()...)
 		return err
 	}
 
-	teeSrcPad := b.tee.GetRequestPad("src_%u")
+	teeSrcPad := tee.GetRequestPad("src_%u")
 	sink.pad = teeSrcPad.GetName()
 
 	teeSrcPad.AddProbe(gst.PadProbeTypeBlockDownstream, func(pad *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
@@ -103,23 +181,30 @@ func (b *Bin) AddSink(url string) error {
 		}
 
 		// sync state
-		sink.queue.SyncStateWithParent()
-		sink.sink.SyncStateWithParent()
+		for _, e := range sink.elements() {
+			e.SyncStateWithParent()
+		}
 
 		return gst.PadProbeRemove
 	})
 
+	b.sinksMu.Lock()
 	b.sinks[url] = sink
+	b.sinksMu.Unlock()
 	return nil
 }
 
 func (b *Bin) RemoveSink(url string) error {
+	b.sinksMu.Lock()
 	sink, ok := b.sinks[url]
+	delete(b.sinks, url)
+	b.sinksMu.Unlock()
 	if !ok {
 		return errors.ErrStreamNotFound
 	}
 
-	srcPad := b.tee.GetStaticPad(sink.pad)
+	tee := b.tees[sink.mux]
+	srcPad := tee.GetStaticPad(sink.pad)
 	srcPad.AddProbe(gst.PadProbeTypeBlockDownstream, func(pad *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
 		// remove probe
 		pad.RemoveProbe(uint64(info.ID()))
@@ -131,32 +216,99 @@ func (b *Bin) RemoveSink(url string) error {
 		sink.queue.GetStaticPad("sink").SendEvent(gst.NewEOSEvent())
 
 		// remove from bin
-		if err := b.bin.RemoveMany(sink.queue, sink.sink); err != nil {
-			b.logger.Errorw("failed to remove rtmp queue", err)
+		if err := b.bin.RemoveMany(sink.elements()...); err != nil {
+			b.logger.Errorw("failed to remove stream sink", err)
 		}
-		if err := sink.queue.SetState(gst.StateNull); err != nil {
-			b.logger.Errorw("failed stop rtmp queue", err)
-		}
-		if err := sink.sink.SetState(gst.StateNull); err != nil {
-			b.logger.Errorw("failed to stop rtmp sink", err)
+		for _, e := range sink.elements() {
+			if err := e.SetState(gst.StateNull); err != nil {
+				b.logger.Errorw("failed to stop stream sink", err, "element", e.GetName())
+			}
 		}
 
 		// release tee src pad
-		b.tee.ReleaseRequestPad(pad)
+		tee.ReleaseRequestPad(pad)
 
 		return gst.PadProbeOK
 	})
 
-	delete(b.sinks, url)
+	if proxy := b.proxies[url]; proxy != nil {
+		proxy.close()
+		delete(b.proxies, url)
+	}
+	if whip := b.whips[url]; whip != nil {
+		whip.close()
+		delete(b.whips, url)
+	}
 	return nil
 }
 
 func (b *Bin) RemoveSinkByName(name string) (string, error) {
+	url, _ := b.getSinkByName(name)
+	if url == "" {
+		return "", errors.ErrStreamNotFound
+	}
+	return url, b.RemoveSink(url)
+}
+
+// HasStreamSink returns true if the element belongs to one of the stream outputs, whatever its protocol
+func (b *Bin) HasStreamSink(name string) bool {
+	_, sink := b.getSinkByName(name)
+	return sink != nil
+}
+
+// StreamError returns the error to report for a failed stream sink
+func (b *Bin) StreamError(name, debug string, err error) error {
+	if url, _ := b.getSinkByName(name); url != "" {
+		return b.tlsError(url, debug, err)
+	}
+	return err
+}
+
+// StreamStats returns the stats of every stream output, by url
+func (b *Bin) StreamStats() map[string]*StreamStats {
+	b.sinksMu.Lock()
+	defer b.sinksMu.Unlock()
+
+	stats := make(map[string]*StreamStats, len(b.sinks))
 	for url, sink := range b.sinks {
-		if sink.queue.GetName() == name || sink.sink.GetName() == name {
-			return url, b.RemoveSink(url)
+		s := &StreamStats{
+			Bytes:         sink.bytes.Load(),
+			TargetBitrate: sink.bitrate,
 		}
+		level, levelErr := sink.queue.GetProperty("current-level-time")
+		maxLevel, maxErr := sink.queue.GetProperty("max-size-time")
+		if levelErr == nil && maxErr == nil {
+			l, _ := level.(uint64)
+			if m, _ := maxLevel.(uint64); m > 0 {
+				s.BufferOccupancy = math.Min(float64(l)/float64(m), 1)
+			}
+		}
+		stats[url] = s
 	}
+	return stats
+}
 
-	return "", errors.ErrStreamNotFound
+// getSinkByName returns the stream output an element belongs to
+func (b *Bin) getSinkByName(name string) (string, *streamSink) {
+	b.sinksMu.Lock()
+	defer b.sinksMu.Unlock()
+
+	for url, sink := range b.sinks {
+		if sink.owns(name) {
+			return url, sink
+		}
+	}
+	return "", nil
+}
+
+// Close stops any rtmps proxies still running, and ends any whip sessions
+func (b *Bin) Close() {
+	for url, proxy := range b.proxies {
+		proxy.close()
+		delete(b.proxies, url)
+	}
+	for url, whip := range b.whips {
+		whip.close()
+		delete(b.whips, url)
+	}
 }
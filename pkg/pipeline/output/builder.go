@@ -3,6 +3,9 @@ package output
 import (
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/tinyzimmer/go-gst/gst"
 	"github.com/tinyzimmer/go-gst/gst/app"
@@ -11,6 +14,7 @@ import (
 
 	"github.com/livekit/egress/pkg/errors"
 	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/secrets"
 )
 
 func buildFileOutputBin(p *params.Params) (*Bin, error) {
@@ -45,48 +49,79 @@ func buildFileOutputBin(p *params.Params) (*Bin, error) {
 }
 
 func buildStreamOutputBin(p *params.Params) (*Bin, error) {
-	// create elements
-	tee, err := gst.NewElement("tee")
-	if err != nil {
-		return nil, err
-	}
-
 	bin := gst.NewBin("output")
-	if err = bin.Add(tee); err != nil {
-		return nil, err
+
+	// one tee for each container, named after it when there's more than one
+	tees := make(map[params.StreamMux]*gst.Element)
+	for _, m := range p.StreamMuxes {
+		tee, err := gst.NewElement("tee")
+		if err != nil {
+			return nil, err
+		}
+		if err = bin.Add(tee); err != nil {
+			return nil, err
+		}
+
+		padName := "sink"
+		if len(p.StreamMuxes) > 1 {
+			// the other containers keep flowing while this one has no outputs
+			if err = tee.SetProperty("allow-not-linked", true); err != nil {
+				return nil, err
+			}
+			padName = fmt.Sprintf("sink_%s", m)
+		}
+		ghostPad := gst.NewGhostPad(padName, tee.GetStaticPad("sink"))
+		if !bin.AddPad(ghostPad.Pad) {
+			return nil, errors.ErrGhostPadFailed
+		}
+		tees[m] = tee
 	}
 
 	b := &Bin{
-		bin:      bin,
-		protocol: p.OutputType,
-		tee:      tee,
-		sinks:    make(map[string]*streamSink),
-		logger:   p.Logger,
+		bin:                     bin,
+		tees:                    tees,
+		sinks:                   make(map[string]*streamSink),
+		ristSenderBuffer:        p.RistSenderBuffer,
+		ristMinRTCPInterval:     p.RistMinRTCPInterval,
+		ristMaxRTCPBandwidth:    p.RistMaxRTCPBandwidth,
+		rtmpsCAFile:             p.RtmpsCAFile,
+		rtmpsInsecureSkipVerify: p.RtmpsInsecureSkipVerify,
+		rtmpsServerNames:        p.RtmpsServerNames,
+		proxies:                 make(map[string]*tlsProxy),
+		rtmpConnect:             p.RtmpConnect,
+		secretReferences:        p.SecretReferences,
+		audioEnabled:            p.AudioEnabled,
+		videoEnabled:            p.VideoEnabled,
+		width:                   p.Width,
+		height:                  p.Height,
+		framerate:               p.Framerate,
+		videoBitrate:            p.VideoBitrate,
+		audioBitrate:            p.AudioBitrate,
+		keyFrameInterval:        p.KeyFrameInterval(),
+		videoPreset:             p.VideoPreset,
+		videoProfile:            p.VideoProfile,
+		whips:                   make(map[string]*whipClient),
+		streamCaps:              p.StreamCaps,
+		logger:                  p.Logger,
 	}
 
 	for _, url := range p.StreamUrls {
-		sink, err := buildStreamSink(b.protocol, url)
+		sink, err := b.buildStreamSink(url)
 		if err != nil {
 			return nil, err
 		}
 
-		if err = bin.AddMany(sink.queue, sink.sink); err != nil {
+		if err = bin.AddMany(sink.elements()...); err != nil {
 			return nil, err
 		}
 
 		b.sinks[url] = sink
 	}
 
-	// add ghost pad
-	ghostPad := gst.NewGhostPad("sink", tee.GetStaticPad("sink"))
-	if !bin.AddPad(ghostPad.Pad) {
-		return nil, errors.ErrGhostPadFailed
-	}
-
 	return b, nil
 }
 
-func buildStreamSink(protocol params.OutputType, url string) (*streamSink, error) {
+func (b *Bin) buildStreamSink(url string) (*streamSink, error) {
 	id := utils.NewGuid("")
 
 	queue, err := gst.NewElementWithName("queue", fmt.Sprintf("queue_%s", id))
@@ -95,7 +130,25 @@ func buildStreamSink(protocol params.OutputType, url string) (*streamSink, error
 	}
 	queue.SetArg("leaky", "downstream")
 
-	var sink *gst.Element
+	protocol := params.GetStreamOutputType(url)
+
+	// stream keys can be ${secret} references, resolved here so that they never leave the handler. The url is from the
+	// request, so only the references allowed for requests are resolved
+	location, err := secrets.ResolveEmbeddedRequest(url, b.secretReferences)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := params.GetStreamMux(protocol)
+	transrate, videoBitrate, err := b.buildTransrateBin(fmt.Sprintf("transrate_%s", id), url, location, mux)
+	if err != nil {
+		return nil, err
+	}
+	if transrate == nil {
+		videoBitrate = b.videoBitrate
+	}
+
+	var pay, sink *gst.Element
 	switch protocol {
 	case params.OutputTypeRTMP:
 		sink, err = gst.NewElementWithName("rtmp2sink", fmt.Sprintf("sink_%s", id))
@@ -105,19 +158,135 @@ func buildStreamSink(protocol params.OutputType, url string) (*streamSink, error
 		if err = sink.SetProperty("sync", false); err != nil {
 			return nil, err
 		}
-		if err = sink.Set("location", url); err != nil {
+		if err = b.setRtmpConnect(sink, url, location); err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(url, rtmpsSchemePrefix) {
+			if location, err = b.buildRtmpsLocation(sink, url, location); err != nil {
+				return nil, err
+			}
+		}
+		if err = sink.Set("location", location); err != nil {
+			return nil, err
+		}
+
+	case params.OutputTypeRTSP:
+		// pushes to an rtsp server using ANNOUNCE/RECORD, where it can be pulled by other clients
+		sink, err = gst.NewElementWithName("rtspclientsink", fmt.Sprintf("sink_%s", id))
+		if err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("location", location); err != nil {
+			return nil, err
+		}
+
+	case params.OutputTypeSRT:
+		sink, err = gst.NewElementWithName("srtsink", fmt.Sprintf("sink_%s", id))
+		if err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("sync", false); err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("uri", location); err != nil {
+			return nil, err
+		}
+
+	case params.OutputTypeNDI:
+		// announced on the local network, where switchers such as vMix and OBS can pick it up
+		sink, err = gst.NewElementWithName("ndisink", fmt.Sprintf("sink_%s", id))
+		if err != nil {
+			return nil, err
+		}
+		if err = sink.SetProperty("ndi-name", params.GetNDIName(url)); err != nil {
+			return nil, err
+		}
+
+	case params.OutputTypeWHIP:
+		// published over WebRTC, from the same transport stream as rtsp, rist and srt
+		sink, err = b.buildWhipSink(fmt.Sprintf("sink_%s", id), url, location)
+		if err != nil {
+			return nil, err
+		}
+
+	case params.OutputTypeRIST:
+		pay, err = gst.NewElementWithName("rtpmp2tpay", fmt.Sprintf("pay_%s", id))
+		if err != nil {
+			return nil, err
+		}
+		sink, err = b.buildRistSink(fmt.Sprintf("sink_%s", id), url)
+		if err != nil {
 			return nil, err
 		}
 	}
 
-	return &streamSink{
-		queue: queue,
-		sink:  sink,
-	}, nil
+	s := &streamSink{
+		mux:       mux,
+		queue:     queue,
+		transrate: transrate,
+		pay:       pay,
+		sink:      sink,
+	}
+	if b.videoEnabled {
+		s.bitrate += videoBitrate
+	}
+	if b.audioEnabled {
+		s.bitrate += b.audioBitrate
+	}
+
+	// counts what leaves the queue, for the stream's health
+	queue.GetStaticPad("src").AddProbe(gst.PadProbeTypeBuffer, func(_ *gst.Pad, info *gst.PadProbeInfo) gst.PadProbeReturn {
+		if buffer := info.GetBuffer(); buffer != nil {
+			s.bytes.Add(uint64(buffer.GetSize()))
+		}
+		return gst.PadProbeOK
+	})
+
+	return s, nil
+}
+
+// buildRistSink sends to a rist receiver using the simple profile, retransmitting lost packets from its sender buffer
+func (b *Bin) buildRistSink(name, rawUrl string) (*gst.Element, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, errors.ErrInvalidUrl(rawUrl, "rist")
+	}
+
+	sink, err := gst.NewElementWithName("ristsink", name)
+	if err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("address", u.Hostname()); err != nil {
+		return nil, err
+	}
+	if port := u.Port(); port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, errors.ErrInvalidUrl(rawUrl, "rist")
+		}
+		if err = sink.SetProperty("port", uint(p)); err != nil {
+			return nil, err
+		}
+	}
+	if err = sink.SetProperty("sender-buffer", uint(b.ristSenderBuffer.Milliseconds())); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("min-rtcp-interval", uint(b.ristMinRTCPInterval.Milliseconds())); err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("max-rtcp-bandwidth", b.ristMaxRTCPBandwidth); err != nil {
+		return nil, err
+	}
+	return sink, nil
 }
 
 func buildWebsocketOutputBin(p *params.Params) (*Bin, error) {
-	writer, err := newWebSocketSink(p.WebsocketUrl, params.MimeTypeRaw, p.Logger, p.MutedChan)
+	// video tracks are forwarded as published, one frame per message
+	mimeType := params.MimeTypeRaw
+	if p.VideoEnabled {
+		mimeType = p.VideoCodec
+	}
+	writer, err := newWebSocketSink(p, mimeType)
 	if err != nil {
 		return nil, err
 	}
@@ -151,7 +320,7 @@ func buildWebsocketOutputBin(p *params.Params) (*Bin, error) {
 			samples := buffer.Map(gst.MapRead).Bytes()
 
 			// From the extracted bytes, send to writer
-			_, err = writer.Write(samples)
+			err = writer.WriteSample(sample.GetCaps(), buffer, samples)
 			if err != nil && !errors.Is(err, io.EOF) {
 				p.Logger.Errorw("cannot read AppSink samples", err)
 				return gst.FlowError
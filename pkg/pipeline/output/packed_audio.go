@@ -0,0 +1,195 @@
+package output
+
+import (
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	// messages posted by splitmuxsink, reused so that the pipeline handles both segmenters the same way
+	fragmentOpenedMessage = "splitmuxsink-fragment-opened"
+	fragmentClosedMessage = "splitmuxsink-fragment-closed"
+	fragmentLocation      = "location"
+	fragmentRunningTime   = "running-time"
+
+	// https://datatracker.ietf.org/doc/html/rfc8216#section-3.4
+	transportStreamTimestampOwner = "com.apple.streaming.transportStreamTimestamp"
+)
+
+// packedAudioWriter splits an ADTS stream into packed audio segments.
+// Each segment starts with an ID3 tag carrying the MPEG-2 timestamp of its first frame.
+type packedAudioWriter struct {
+	sink *app.Sink
+	p    *params.Params
+
+	segmentDuration      time.Duration
+	firstSegmentDuration time.Duration
+	index                int
+	file                 *os.File
+	filename             string
+	startTime            time.Duration
+	endTime              time.Duration
+}
+
+func buildPackedAudioOutputBin(p *params.Params) (*Bin, error) {
+	sink, err := app.NewAppSink()
+	if err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("sync", false); err != nil {
+		return nil, err
+	}
+
+	w := &packedAudioWriter{
+		sink:                 sink,
+		p:                    p,
+		segmentDuration:      time.Duration(p.SegmentDuration) * time.Second,
+		firstSegmentDuration: time.Duration(p.FirstSegmentDuration) * time.Second,
+	}
+
+	sink.SetCallbacks(&app.SinkCallbacks{
+		EOSFunc: func(appSink *app.Sink) {
+			if err := w.closeSegment(w.endTime); err != nil {
+				p.Logger.Errorw("failed to close segment", err)
+			}
+		},
+		NewSampleFunc: func(appSink *app.Sink) gst.FlowReturn {
+			sample := appSink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				return gst.FlowError
+			}
+
+			if err := w.write(buffer); err != nil {
+				p.Logger.Errorw("failed to write segment", err)
+				return gst.FlowError
+			}
+			return gst.FlowOK
+		},
+	})
+
+	bin := gst.NewBin("output")
+	if err = bin.Add(sink.Element); err != nil {
+		return nil, err
+	}
+
+	ghostPad := gst.NewGhostPad("sink", sink.GetStaticPad("sink"))
+	if !bin.AddPad(ghostPad.Pad) {
+		return nil, errors.ErrGhostPadFailed
+	}
+
+	return &Bin{
+		bin:    bin,
+		logger: p.Logger,
+	}, nil
+}
+
+func (w *packedAudioWriter) write(buffer *gst.Buffer) error {
+	pts := buffer.PresentationTimestamp()
+	segmentDuration := w.segmentDuration
+	if w.index == 1 {
+		segmentDuration = w.firstSegmentDuration
+	}
+	if w.file == nil || pts-w.startTime >= segmentDuration {
+		if err := w.closeSegment(pts); err != nil {
+			return err
+		}
+		if err := w.openSegment(pts); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.file.Write(buffer.Map(gst.MapRead).Bytes())
+	buffer.Unmap()
+	if err != nil {
+		return err
+	}
+
+	w.endTime = pts + buffer.Duration()
+	return nil
+}
+
+func (w *packedAudioWriter) openSegment(pts time.Duration) error {
+	w.filename = w.p.GetSegmentFilepath(w.index)
+	w.index++
+
+	f, err := os.Create(w.filename)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(transportStreamTimestampTag(pts)); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.file = f
+	w.startTime = pts
+	return w.postFragmentMessage(fragmentOpenedMessage, pts)
+}
+
+func (w *packedAudioWriter) closeSegment(pts time.Duration) error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+
+	return w.postFragmentMessage(fragmentClosedMessage, pts)
+}
+
+func (w *packedAudioWriter) postFragmentMessage(name string, pts time.Duration) error {
+	s := gst.NewStructure(name)
+	if err := s.SetValue(fragmentLocation, w.filename); err != nil {
+		return err
+	}
+	if err := s.SetValue(fragmentRunningTime, uint64(pts)); err != nil {
+		return err
+	}
+
+	if !w.sink.GetBus().Post(gst.NewElementMessage(w.sink.Element, s)) {
+		return errors.New("failed to post fragment message")
+	}
+	return nil
+}
+
+// transportStreamTimestampTag creates the ID3v2.4 PRIV frame required at the start of every packed audio segment
+func transportStreamTimestampTag(pts time.Duration) []byte {
+	// 33-bit timestamp in 90kHz units
+	ts := uint64(pts.Nanoseconds()*9/100000) & 0x1ffffffff
+
+	payload := make([]byte, len(transportStreamTimestampOwner)+9)
+	copy(payload, transportStreamTimestampOwner)
+	binary.BigEndian.PutUint64(payload[len(transportStreamTimestampOwner)+1:], ts)
+
+	frame := append([]byte("PRIV"), syncSafe(len(payload))...)
+	frame = append(frame, 0, 0)
+	frame = append(frame, payload...)
+
+	tag := append([]byte("ID3"), 4, 0, 0)
+	tag = append(tag, syncSafe(len(frame))...)
+	return append(tag, frame...)
+}
+
+func syncSafe(n int) []byte {
+	return []byte{
+		byte(n>>21) & 0x7f,
+		byte(n>>14) & 0x7f,
+		byte(n>>7) & 0x7f,
+		byte(n) & 0x7f,
+	}
+}
@@ -0,0 +1,55 @@
+package output
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+// setRtmpConnect sets the connect command values required by some ingest servers. rtmp2sink sends its own
+// pageUrl and swfUrl, which can't be changed
+func (b *Bin) setRtmpConnect(sink *gst.Element, rawUrl, location string) error {
+	if len(b.rtmpConnect) == 0 {
+		return nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return errors.ErrInvalidUrl(rawUrl, "rtmp")
+	}
+	connect := b.rtmpConnect[u.Hostname()]
+	if connect == nil {
+		return nil
+	}
+
+	if connect.FlashVersion != "" {
+		if err = sink.SetProperty("flash-version", connect.FlashVersion); err != nil {
+			return err
+		}
+	}
+
+	if len(connect.Args) > 0 {
+		// serialized as a structure, with numbers sent as amf doubles
+		fields := []string{"args"}
+		for name, value := range connect.Args {
+			switch v := value.(type) {
+			case bool:
+				fields = append(fields, fmt.Sprintf("%s=(boolean)%t", name, v))
+			case int:
+				fields = append(fields, fmt.Sprintf("%s=(double)%d", name, v))
+			case float64:
+				fields = append(fields, fmt.Sprintf("%s=(double)%v", name, v))
+			default:
+				escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fmt.Sprint(v))
+				fields = append(fields, fmt.Sprintf(`%s=(string)"%s"`, name, escaped))
+			}
+		}
+		sink.SetArg("extra-connect-args", strings.Join(fields, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,190 @@
+package output
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const (
+	defaultRtmpsPort  = "443"
+	tlsDialTimeout    = 10 * time.Second
+	rtmpsSchemePrefix = "rtmps://"
+)
+
+// tlsProxy forwards rtmp2sink's connection over TLS, for the settings GIO can't take per connection:
+// a custom CA bundle and a server name which differs from the ingest host
+type tlsProxy struct {
+	listener net.Listener
+	remote   string
+	config   *tls.Config
+	logger   logger.Logger
+
+	mu           sync.Mutex
+	handshakeErr error
+}
+
+// buildRtmpsLocation returns the location rtmp2sink connects to for an rtmps url, which is a
+// local proxy when the connection needs a custom CA bundle or server name
+func (b *Bin) buildRtmpsLocation(sink *gst.Element, rawUrl, location string) (string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", errors.ErrInvalidUrl(rawUrl, "rtmps")
+	}
+
+	serverName := b.rtmpsServerNames[u.Hostname()]
+	if b.rtmpsCAFile == "" && serverName == "" {
+		// GIO handles everything else
+		if b.rtmpsInsecureSkipVerify {
+			sink.SetArg("tls-validation-flags", "0")
+		}
+		return location, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: b.rtmpsInsecureSkipVerify,
+	}
+	if serverName != "" {
+		config.ServerName = serverName
+	}
+	if b.rtmpsCAFile != "" {
+		if config.RootCAs, err = loadCertPool(b.rtmpsCAFile); err != nil {
+			return "", err
+		}
+	}
+
+	port := u.Port()
+	if port == "" {
+		port = defaultRtmpsPort
+	}
+	proxy, err := newTLSProxy(net.JoinHostPort(u.Hostname(), port), config, b.logger)
+	if err != nil {
+		return "", err
+	}
+	b.proxies[rawUrl] = proxy
+
+	// rtmp2sink sends the local address as its tcUrl, which most ingest servers ignore
+	local := *u
+	local.Scheme = "rtmp"
+	local.Host = proxy.listener.Addr().String()
+	return local.String(), nil
+}
+
+// loadCertPool adds a pem bundle to the system roots
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+func newTLSProxy(remote string, config *tls.Config, logger logger.Logger) (*tlsProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &tlsProxy{
+		listener: listener,
+		remote:   remote,
+		config:   config,
+		logger:   logger,
+	}
+	go p.serve()
+	return p, nil
+}
+
+func (p *tlsProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			// closed
+			return
+		}
+		go p.forward(conn)
+	}
+}
+
+func (p *tlsProxy) forward(conn net.Conn) {
+	defer conn.Close()
+
+	remote, err := tls.DialWithDialer(&net.Dialer{Timeout: tlsDialTimeout}, "tcp", p.remote, p.config)
+	if err != nil {
+		// recorded before rtmp2sink sees its connection close, so the error can be reported as a tls failure
+		p.mu.Lock()
+		p.handshakeErr = err
+		p.mu.Unlock()
+		p.logger.Warnw("rtmps handshake failed", err, "host", p.remote)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(remote, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(conn, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+func (p *tlsProxy) getHandshakeError() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.handshakeErr
+}
+
+func (p *tlsProxy) close() {
+	_ = p.listener.Close()
+}
+
+// tlsError returns TLS failures on rtmps outputs as their own error, since rtmp2sink only reports a failed connection
+func (b *Bin) tlsError(rawUrl, debug string, err error) error {
+	if !strings.HasPrefix(rawUrl, rtmpsSchemePrefix) {
+		return err
+	}
+
+	host := rawUrl
+	if u, parseErr := url.Parse(rawUrl); parseErr == nil {
+		// without the stream key
+		host = u.Host
+	}
+
+	if proxy := b.proxies[rawUrl]; proxy != nil {
+		if handshakeErr := proxy.getHandshakeError(); handshakeErr != nil {
+			return errors.ErrTLSHandshakeFailed(host, handshakeErr)
+		}
+		return err
+	}
+
+	// GIO's tls errors, such as "Unacceptable TLS certificate"
+	if strings.Contains(err.Error(), "TLS") || strings.Contains(debug, "TLS") {
+		return errors.ErrTLSHandshakeFailed(host, err)
+	}
+	return err
+}
@@ -0,0 +1,203 @@
+package output
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// buildTransrateBin returns a bin re-encoding the video for destinations with an encoding limit, and its video bitrate,
+// or nil when the stream is already within the limit. The other destinations, and any file output, keep the full quality encode
+func (b *Bin) buildTransrateBin(name, rawUrl, location string, mux params.StreamMux) (*gst.Element, int32, error) {
+	if len(b.streamCaps) == 0 || !b.videoEnabled || mux == params.StreamMuxRaw {
+		return nil, 0, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, 0, errors.ErrInvalidUrl(rawUrl, string(params.GetStreamOutputType(rawUrl)))
+	}
+	limit := b.streamCaps[u.Hostname()]
+	if limit == nil {
+		return nil, 0, nil
+	}
+
+	width, height, bitrate := b.width, b.height, b.videoBitrate
+	if limit.MaxWidth > 0 && width > limit.MaxWidth {
+		height = height * limit.MaxWidth / width
+		width = limit.MaxWidth
+	}
+	if limit.MaxHeight > 0 && height > limit.MaxHeight {
+		width = width * limit.MaxHeight / height
+		height = limit.MaxHeight
+	}
+	// h264 needs even dimensions
+	width, height = width&^1, height&^1
+	if limit.MaxBitrate > 0 && bitrate > limit.MaxBitrate {
+		bitrate = limit.MaxBitrate
+	}
+	if width == b.width && height == b.height && bitrate == b.videoBitrate {
+		return nil, 0, nil
+	}
+
+	b.logger.Debugw("transrating stream output",
+		"host", u.Hostname(),
+		"width", width,
+		"height", height,
+		"bitrate", bitrate,
+	)
+
+	bin := gst.NewBin(name)
+
+	var demux, muxer *gst.Element
+	switch mux {
+	case params.StreamMuxFLV:
+		if demux, err = gst.NewElement("flvdemux"); err != nil {
+			return nil, 0, err
+		}
+		if muxer, err = gst.NewElement("flvmux"); err != nil {
+			return nil, 0, err
+		}
+		if err = muxer.Set("streamable", true); err != nil {
+			return nil, 0, err
+		}
+	case params.StreamMuxMPEGTS:
+		if demux, err = gst.NewElement("tsdemux"); err != nil {
+			return nil, 0, err
+		}
+		if muxer, err = gst.NewElement("mpegtsmux"); err != nil {
+			return nil, 0, err
+		}
+		if err = muxer.SetProperty("alignment", 7); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err = bin.AddMany(demux, muxer); err != nil {
+		return nil, 0, err
+	}
+
+	videoSink, err := b.buildTransrateVideoBranch(bin, muxer, width, height, bitrate)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var audioSink *gst.Element
+	if b.audioEnabled {
+		// the audio is passed through
+		aacParse, err := gst.NewElement("aacparse")
+		if err != nil {
+			return nil, 0, err
+		}
+		audioQueue, err := gst.NewElement("queue")
+		if err != nil {
+			return nil, 0, err
+		}
+		if err = bin.AddMany(aacParse, audioQueue); err != nil {
+			return nil, 0, err
+		}
+		if err = gst.ElementLinkMany(aacParse, audioQueue, muxer); err != nil {
+			return nil, 0, err
+		}
+		audioSink = aacParse
+	}
+
+	if _, err = demux.Connect("pad-added", func(_ *gst.Element, pad *gst.Pad) {
+		var sink *gst.Element
+		switch {
+		case strings.HasPrefix(pad.GetName(), "audio"):
+			sink = audioSink
+		case strings.HasPrefix(pad.GetName(), "video"):
+			sink = videoSink
+		}
+		if sink == nil {
+			return
+		}
+		if linkReturn := pad.Link(sink.GetStaticPad("sink")); linkReturn != gst.PadLinkOK {
+			b.logger.Errorw("failed to link transrate branch", errors.ErrPadLinkFailed(demux.GetName(), linkReturn.String()))
+		}
+	}); err != nil {
+		return nil, 0, err
+	}
+
+	sinkPad := gst.NewGhostPad("sink", demux.GetStaticPad("sink"))
+	srcPad := gst.NewGhostPad("src", muxer.GetStaticPad("src"))
+	if !bin.AddPad(sinkPad.Pad) || !bin.AddPad(srcPad.Pad) {
+		return nil, 0, errors.ErrGhostPadFailed
+	}
+
+	return bin.Element, bitrate, nil
+}
+
+func (b *Bin) buildTransrateVideoBranch(bin *gst.Bin, muxer *gst.Element, width, height, bitrate int32) (*gst.Element, error) {
+	h264Parse, err := gst.NewElement("h264parse")
+	if err != nil {
+		return nil, err
+	}
+	h264Dec, err := gst.NewElement("avdec_h264")
+	if err != nil {
+		return nil, err
+	}
+	videoScale, err := gst.NewElement("videoscale")
+	if err != nil {
+		return nil, err
+	}
+	rawCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, err
+	}
+	if err = rawCaps.SetProperty("caps", gst.NewCapsFromString(
+		fmt.Sprintf("video/x-raw,width=%d,height=%d,pixel-aspect-ratio=1/1", width, height),
+	)); err != nil {
+		return nil, err
+	}
+
+	h264Enc, err := gst.NewElement("x264enc")
+	if err != nil {
+		return nil, err
+	}
+	if err = h264Enc.SetProperty("bitrate", uint(bitrate)); err != nil {
+		return nil, err
+	}
+	h264Enc.SetArg("speed-preset", b.videoPreset)
+	h264Enc.SetArg("tune", "zerolatency")
+	if b.keyFrameInterval > 0 {
+		if err = h264Enc.SetProperty("key-int-max", uint(b.keyFrameInterval)); err != nil {
+			return nil, err
+		}
+		if err = h264Enc.SetProperty("option-string", "scenecut=0"); err != nil {
+			return nil, err
+		}
+	}
+
+	encodedCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, err
+	}
+	if err = encodedCaps.SetProperty("caps", gst.NewCapsFromString(
+		fmt.Sprintf("video/x-h264,profile=%s", b.videoProfile),
+	)); err != nil {
+		return nil, err
+	}
+	encodedParse, err := gst.NewElement("h264parse")
+	if err != nil {
+		return nil, err
+	}
+	videoQueue, err := gst.NewElement("queue")
+	if err != nil {
+		return nil, err
+	}
+
+	elements := []*gst.Element{h264Parse, h264Dec, videoScale, rawCaps, h264Enc, encodedCaps, encodedParse, videoQueue, muxer}
+	if err = bin.AddMany(elements[:len(elements)-1]...); err != nil {
+		return nil, err
+	}
+	if err = gst.ElementLinkMany(elements...); err != nil {
+		return nil, err
+	}
+	return h264Parse, nil
+}
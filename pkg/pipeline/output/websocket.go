@@ -1,101 +1,399 @@
 package output
 
 import (
+	"crypto/tls"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/tinyzimmer/go-gst/gst"
 
 	"github.com/livekit/protocol/logger"
 
+	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/errors"
 	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/secrets"
 )
 
 type websocketState string
 
 const (
-	WebSocketActive websocketState = "active"
-	WebSocketClosed websocketState = "closed"
+	WebSocketActive       websocketState = "active"
+	WebSocketReconnecting websocketState = "reconnecting"
+	WebSocketClosed       websocketState = "closed"
+)
+
+const (
+	// offered when connecting. Servers which select it receive framed binary messages
+	FramedSubprotocol = "livekit-egress-framed-v1"
+
+	framedVersion      = 1
+	framedHeaderSize   = 14
+	framedFlagKeyframe = 0x01
 )
 
 type websocketSink struct {
+	mu     sync.Mutex // the connection supports one writer at a time
 	conn   *websocket.Conn
+	url    string
 	logger logger.Logger
 	muted  chan bool
 	closed chan struct{}
 	state  websocketState
+	framed bool
+
+	hosts    map[string]*config.WebsocketHostConfig
+	egressID string
+	trackID  string
+	codec    params.MimeType
+	video    bool
+	header   *headerPayload
+
+	// url refresh
+	refreshUrl      string
+	refreshInterval time.Duration
+	pending         *websocket.Conn // connected with a refreshed url, and used from the next keyframe
+	pendingUrl      string
+
+	// reconnection
+	reconnectTimeout time.Duration
+	buffer           *websocketBuffer // messages written while reconnecting
+	reconnectErr     error            // set once reconnecting has failed
 }
 
-func newWebSocketSink(url string, mimeType params.MimeType, logger logger.Logger, muted chan bool) (io.WriteCloser, error) {
-	// set Content-Type header
-	header := http.Header{}
-	header.Set("Content-Type", string(mimeType))
+func newWebSocketSink(p *params.Params, mimeType params.MimeType) (*websocketSink, error) {
+	s := &websocketSink{
+		logger:          p.Logger,
+		muted:           p.MutedChan,
+		closed:          make(chan struct{}),
+		state:           WebSocketActive,
+		hosts:           p.WebsocketHosts,
+		egressID:        p.Info.EgressId,
+		trackID:         p.TrackID,
+		codec:           mimeType,
+		video:           strings.HasPrefix(string(mimeType), "video/"),
+		refreshUrl:      p.WebsocketRefreshUrl,
+		refreshInterval: p.WebsocketRefreshInterval,
 
-	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		reconnectTimeout: p.WebsocketReconnectTimeout,
+	}
+	s.buffer = newWebsocketBuffer(p.WebsocketBufferSize, s.video)
+
+	conn, err := s.dial(p.WebsocketUrl)
 	if err != nil {
 		return nil, err
 	}
+	s.conn = conn
+	s.url = p.WebsocketUrl
+	s.framed = conn.Subprotocol() == FramedSubprotocol
 
-	s := &websocketSink{
-		conn:   conn,
-		logger: logger,
-		muted:  muted,
-		closed: make(chan struct{}),
-		state:  WebSocketActive,
-	}
 	go s.listenToMutedChan()
+	if s.refreshUrl != "" {
+		go s.refreshUrls()
+	}
 
 	return s, nil
 }
 
+func (s *websocketSink) dial(rawUrl string) (*websocket.Conn, error) {
+	// set Content-Type header
+	header := http.Header{}
+	header.Set("Content-Type", string(s.codec))
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{FramedSubprotocol}
+
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, errors.ErrInvalidUrl(rawUrl, "websocket")
+	}
+	if host := s.hosts[u.Hostname()]; host != nil {
+		// auth gateways in front of the destination
+		for name, value := range host.Headers {
+			resolved, err := secrets.ResolveEmbedded(value)
+			if err != nil {
+				return nil, err
+			}
+			header.Set(name, resolved)
+		}
+		if dialer.TLSClientConfig, err = getWebsocketTLSConfig(host); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, res, err := dialer.Dial(rawUrl, header)
+	if err != nil && res != nil {
+		// rejected by the server, such as a 401 from an auth gateway
+		return nil, fmt.Errorf("%v: %s", err, res.Status)
+	}
+	return conn, err
+}
+
+func getWebsocketTLSConfig(host *config.WebsocketHostConfig) (*tls.Config, error) {
+	if host.CAFile == "" && host.CertFile == "" && !host.InsecureSkipVerify {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		InsecureSkipVerify: host.InsecureSkipVerify,
+	}
+	if host.CAFile != "" {
+		pool, err := loadCertPool(host.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if host.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(host.CertFile, host.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
 func (s *websocketSink) Write(p []byte) (n int, err error) {
-	if s.state == WebSocketClosed {
-		return 0, errors.ErrWebSocketClosed(s.conn.RemoteAddr().String())
+	return len(p), s.send(websocket.BinaryMessage, p, false)
+}
+
+// send writes a message, or buffers it while reconnecting. Keyframes, and their markers, are where
+// the buffer can start again once it's full
+func (s *websocketSink) send(messageType int, data []byte, keyframe bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch s.state {
+	case WebSocketClosed:
+		return errors.ErrWebSocketClosed(s.url)
+	case WebSocketReconnecting:
+		if s.reconnectErr != nil {
+			return s.reconnectErr
+		}
+		s.buffer.push(messageType, data, keyframe)
+		return nil
 	}
 
-	return len(p), s.conn.WriteMessage(websocket.BinaryMessage, p)
+	err := s.conn.WriteMessage(messageType, data)
+	if err != nil && s.reconnectTimeout > 0 {
+		s.logger.Warnw("websocket write failed, reconnecting", err)
+		s.state = WebSocketReconnecting
+		s.buffer.push(messageType, data, keyframe)
+		go s.reconnect(s.url)
+		return nil
+	}
+	return err
 }
 
 func (s *websocketSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if s.state == WebSocketClosed {
 		return nil
 	}
 
 	// write close message for graceful disconnection
-	err := s.conn.WriteMessage(websocket.CloseMessage, nil)
-	if err != nil && !errors.Is(err, io.EOF) {
-		s.logger.Errorw("cannot write WS close message", err)
+	if s.state == WebSocketActive {
+		err := s.conn.WriteMessage(websocket.CloseMessage, nil)
+		if err != nil && !errors.Is(err, io.EOF) {
+			s.logger.Errorw("cannot write WS close message", err)
+		}
+	}
+
+	if s.pending != nil {
+		_ = s.pending.Close()
+		s.pending = nil
 	}
+	s.buffer.reset()
 
 	// terminate connection and close the `closed` channel
-	err = s.conn.Close()
+	err := s.conn.Close()
 	close(s.closed)
 	s.state = WebSocketClosed
 	return err
 }
 
 type textMessagePayload struct {
-	Muted bool `json:"muted"`
+	Type  string `json:"type,omitempty"` // "muted", with the framed protocol
+	Muted bool   `json:"muted"`
+}
+
+// headerPayload describes the media that follows. It's sent before the first buffer, and again when the format changes.
+// Without the framed protocol, it's only sent for video
+type headerPayload struct {
+	Type       string `json:"type"` // "header"
+	TrackID    string `json:"track_id,omitempty"`
+	Kind       string `json:"kind"` // "audio" or "video"
+	Codec      string `json:"codec"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	SampleRate int    `json:"sample_rate,omitempty"`
+	Channels   int    `json:"channels,omitempty"`
+	Format     string `json:"format,omitempty"` // raw audio sample format, such as S16LE
+}
+
+// keyframePayload is sent before each video keyframe without the framed protocol, where consumers can start decoding
+type keyframePayload struct {
+	Type string `json:"type"` // "keyframe"
+	PTS  int64  `json:"pts"`  // in nanoseconds
 }
 
 func (s *websocketSink) writeMutedMessage(muted bool) error {
-	// If the socket is closed, return error
-	if s.state == WebSocketClosed {
-		return errors.ErrWebSocketClosed(s.conn.RemoteAddr().String())
-	}
+	s.mu.Lock()
+	framed := s.framed
+	s.mu.Unlock()
 
-	// Marshal `muted` payload
-	data, err := json.Marshal(&textMessagePayload{
+	payload := &textMessagePayload{
 		Muted: muted,
-	})
+	}
+	if framed {
+		payload.Type = "muted"
+	}
+	return s.writeText(payload)
+}
+
+// WriteSample sends a buffer as a single binary message. Video frames are preceded by a header when the stream starts
+// or its resolution changes. With the framed protocol, each message starts with the buffer's timestamp and flags
+func (s *websocketSink) WriteSample(caps *gst.Caps, buffer *gst.Buffer, data []byte) error {
+	pts := buffer.PresentationTimestamp()
+	keyframe := s.video && !buffer.HasFlags(gst.BufferFlagDeltaUnit)
+	if !s.video || keyframe {
+		// consumers can start decoding from here
+		s.switchConnection()
+	}
+
+	if err := s.updateHeader(caps, data); err != nil {
+		return err
+	}
+
+	if s.framed {
+		return s.writeFrame(pts, keyframe, data)
+	}
+
+	if keyframe {
+		if err := s.writeJSON(&keyframePayload{
+			Type: "keyframe",
+			PTS:  int64(pts / time.Nanosecond),
+		}, true); err != nil {
+			return err
+		}
+	}
+
+	return s.send(websocket.BinaryMessage, data, false)
+}
+
+// writeFrame sends a framed binary message: a version byte, a flags byte, the pts in nanoseconds as a
+// big endian int64, and the payload length as a big endian uint32, followed by the payload
+func (s *websocketSink) writeFrame(pts time.Duration, keyframe bool, data []byte) error {
+	frame := make([]byte, framedHeaderSize+len(data))
+	frame[0] = framedVersion
+	if keyframe {
+		frame[1] |= framedFlagKeyframe
+	}
+	binary.BigEndian.PutUint64(frame[2:10], uint64(pts))
+	binary.BigEndian.PutUint32(frame[10:14], uint32(len(data)))
+	copy(frame[framedHeaderSize:], data)
+
+	return s.send(websocket.BinaryMessage, frame, keyframe)
+}
+
+func (s *websocketSink) updateHeader(caps *gst.Caps, data []byte) error {
+	if !s.video && !s.framed {
+		return nil
+	}
+
+	header := &headerPayload{
+		Type:    "header",
+		TrackID: s.trackID,
+		Codec:   string(s.codec),
+	}
+	if s.video {
+		header.Kind = "video"
+		header.Width, header.Height = getFrameSize(caps, s.codec, data)
+		if header.Width == 0 && s.header != nil {
+			// only vp8 keyframes have it
+			return nil
+		}
+	} else {
+		header.Kind = "audio"
+		header.SampleRate, header.Channels, header.Format = getAudioFormat(caps)
+	}
+
+	s.mu.Lock()
+	if s.header != nil && *s.header == *header {
+		s.mu.Unlock()
+		return nil
+	}
+	s.header = header
+	s.mu.Unlock()
+
+	// buffered headers are a keyframe, since the frames before them don't match the header
+	return s.writeJSON(header, true)
+}
+
+func (s *websocketSink) writeText(payload interface{}) error {
+	return s.writeJSON(payload, false)
+}
+
+func (s *websocketSink) writeJSON(payload interface{}, keyframe bool) error {
+	data, err := json.Marshal(payload)
 	if err != nil {
 		return err
 	}
 
 	// Write message
-	return s.conn.WriteMessage(websocket.TextMessage, data)
+	return s.send(websocket.TextMessage, data, keyframe)
+}
+
+// getFrameSize reads the resolution from the parser's caps, or from the frame itself for vp8 keyframes.
+// It returns zeros when neither has it
+func getFrameSize(caps *gst.Caps, codec params.MimeType, frame []byte) (int, int) {
+	if width, height := getCapsInt(caps, "width"), getCapsInt(caps, "height"); width != 0 && height != 0 {
+		return width, height
+	}
+
+	// vp8 keyframes have a 3 byte frame tag with the keyframe bit cleared, a start code, then 14 bit dimensions
+	if codec == params.MimeTypeVP8 && len(frame) >= 10 && frame[0]&0x01 == 0 &&
+		frame[3] == 0x9d && frame[4] == 0x01 && frame[5] == 0x2a {
+		width := int(frame[6]) | int(frame[7]&0x3f)<<8
+		height := int(frame[8]) | int(frame[9]&0x3f)<<8
+		return width, height
+	}
+
+	return 0, 0
+}
+
+func getAudioFormat(caps *gst.Caps) (sampleRate, channels int, format string) {
+	sampleRate = getCapsInt(caps, "rate")
+	channels = getCapsInt(caps, "channels")
+	if caps != nil && caps.GetSize() > 0 {
+		if v, err := caps.GetStructureAt(0).GetValue("format"); err == nil {
+			format, _ = v.(string)
+		}
+	}
+	return
+}
+
+func getCapsInt(caps *gst.Caps, field string) int {
+	if caps == nil || caps.GetSize() == 0 {
+		return 0
+	}
+	v, err := caps.GetStructureAt(0).GetValue(field)
+	if err != nil {
+		return 0
+	}
+	i, _ := v.(int)
+	return i
 }
 
 func (s *websocketSink) listenToMutedChan() {
@@ -0,0 +1,151 @@
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	websocketReconnectMinDelay = 250 * time.Millisecond
+	websocketReconnectMaxDelay = 5 * time.Second
+)
+
+type websocketMessage struct {
+	messageType int
+	data        []byte
+	keyframe    bool
+}
+
+// websocketBuffer keeps the latest messages while reconnecting, up to a size in bytes. Once it's full,
+// the oldest messages are dropped, and for video, everything up to the next keyframe
+type websocketBuffer struct {
+	messages []websocketMessage
+	size     int
+	limit    int
+	video    bool
+}
+
+func newWebsocketBuffer(limit int, video bool) *websocketBuffer {
+	return &websocketBuffer{
+		limit: limit,
+		video: video,
+	}
+}
+
+func (b *websocketBuffer) push(messageType int, data []byte, keyframe bool) {
+	b.messages = append(b.messages, websocketMessage{
+		messageType: messageType,
+		data:        data,
+		keyframe:    keyframe,
+	})
+	b.size += len(data)
+
+	if b.size <= b.limit {
+		return
+	}
+	for len(b.messages) > 0 && b.size > b.limit {
+		b.drop()
+	}
+	for b.video && len(b.messages) > 0 && !b.messages[0].keyframe {
+		b.drop()
+	}
+}
+
+func (b *websocketBuffer) drop() {
+	b.size -= len(b.messages[0].data)
+	b.messages = b.messages[1:]
+}
+
+func (b *websocketBuffer) reset() {
+	b.messages = nil
+	b.size = 0
+}
+
+// reconnect connects again with exponential backoff, then sends the current header and everything buffered.
+// Once the reconnect timeout has passed, writes fail and the egress ends
+func (s *websocketSink) reconnect(url string) {
+	deadline := time.Now().Add(s.reconnectTimeout)
+	delay := websocketReconnectMinDelay
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case <-time.After(delay):
+		}
+
+		s.mu.Lock()
+		if s.pendingUrl != "" {
+			url = s.pendingUrl
+		}
+		s.mu.Unlock()
+
+		conn, err := s.dial(url)
+		if err == nil {
+			if err = s.resume(conn, url); err == nil {
+				s.logger.Infow("websocket reconnected")
+				return
+			}
+		}
+
+		if time.Now().After(deadline) {
+			s.mu.Lock()
+			s.reconnectErr = fmt.Errorf("could not reconnect websocket: %v", err)
+			s.buffer.reset()
+			s.mu.Unlock()
+			s.logger.Errorw("websocket reconnect failed", err)
+			return
+		}
+
+		s.logger.Debugw("websocket reconnect attempt failed", "error", err, "retryIn", delay)
+		if delay *= 2; delay > websocketReconnectMaxDelay {
+			delay = websocketReconnectMaxDelay
+		}
+	}
+}
+
+// resume flushes the buffer to the new connection, and uses it from then on
+func (s *websocketSink) resume(conn *websocket.Conn, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.state == WebSocketClosed {
+		_ = conn.Close()
+		return nil
+	}
+
+	// the new connection needs a header first. If one was buffered, consumers get it twice
+	if s.header != nil {
+		data, err := json.Marshal(s.header)
+		if err == nil {
+			err = conn.WriteMessage(websocket.TextMessage, data)
+		}
+		if err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+	for _, msg := range s.buffer.messages {
+		if err := conn.WriteMessage(msg.messageType, msg.data); err != nil {
+			_ = conn.Close()
+			return err
+		}
+	}
+
+	_ = s.conn.Close()
+	if s.pending != nil && s.pendingUrl == url {
+		// already in use
+		_ = s.pending.Close()
+		s.pending = nil
+		s.pendingUrl = ""
+	}
+	s.conn = conn
+	s.url = url
+	s.framed = conn.Subprotocol() == FramedSubprotocol
+	s.state = WebSocketActive
+	s.buffer.reset()
+	return nil
+}
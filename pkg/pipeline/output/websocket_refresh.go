@@ -0,0 +1,130 @@
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	websocketRefreshTimeout    = 10 * time.Second
+	websocketRefreshMargin     = 30 * time.Second // before the url's expiry
+	websocketRefreshRetryDelay = 10 * time.Second
+)
+
+type refreshRequest struct {
+	EgressID string `json:"egress_id"`
+	TrackID  string `json:"track_id"`
+}
+
+type refreshResponse struct {
+	Url       string `json:"url"`
+	ExpiresAt int64  `json:"expires_at,omitempty"` // unix seconds
+}
+
+// refreshUrls connects with a new url from the refresh endpoint before the current one expires.
+// The new connection is used from the next keyframe, so the stream continues without a gap
+func (s *websocketSink) refreshUrls() {
+	timer := time.NewTimer(s.refreshInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			timer.Reset(s.refresh())
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// refresh returns the time until the next refresh
+func (s *websocketSink) refresh() time.Duration {
+	res, err := s.fetchUrl()
+	if err != nil {
+		s.logger.Warnw("could not refresh websocket url", err)
+		return websocketRefreshRetryDelay
+	}
+
+	conn, err := s.dial(res.Url)
+	if err != nil {
+		s.logger.Warnw("could not connect with refreshed websocket url", err)
+		return websocketRefreshRetryDelay
+	}
+
+	s.mu.Lock()
+	if s.state == WebSocketClosed {
+		_ = conn.Close()
+	} else {
+		if s.pending != nil {
+			// never used, since no keyframe arrived
+			_ = s.pending.Close()
+		}
+		s.pending = conn
+		s.pendingUrl = res.Url
+	}
+	s.mu.Unlock()
+
+	if res.ExpiresAt > 0 {
+		if next := time.Until(time.Unix(res.ExpiresAt, 0)) - websocketRefreshMargin; next > 0 {
+			return next
+		}
+		return websocketRefreshRetryDelay
+	}
+	return s.refreshInterval
+}
+
+func (s *websocketSink) fetchUrl() (*refreshResponse, error) {
+	body, err := json.Marshal(&refreshRequest{
+		EgressID: s.egressID,
+		TrackID:  s.trackID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: websocketRefreshTimeout}
+	r, err := client.Post(s.refreshUrl, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("refresh endpoint returned %s", r.Status)
+	}
+
+	res := &refreshResponse{}
+	if err = json.NewDecoder(r.Body).Decode(res); err != nil {
+		return nil, err
+	}
+	if res.Url == "" {
+		return nil, fmt.Errorf("refresh endpoint returned no url")
+	}
+	return res, nil
+}
+
+// switchConnection moves to the refreshed connection, closing the current one
+func (s *websocketSink) switchConnection() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil || s.state != WebSocketActive {
+		// while reconnecting, the refreshed url is used for the next attempt
+		return
+	}
+
+	old := s.conn
+	s.conn = s.pending
+	s.url = s.pendingUrl
+	s.framed = s.conn.Subprotocol() == FramedSubprotocol
+	s.pending = nil
+	// the new connection needs its own header
+	s.header = nil
+
+	_ = old.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "url refreshed"))
+	_ = old.Close()
+}
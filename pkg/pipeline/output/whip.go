@@ -0,0 +1,391 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const (
+	whipTimeout          = 10 * time.Second
+	defaultAudioDuration = 20 * time.Millisecond
+)
+
+// whipClient publishes to a WHIP endpoint over WebRTC. The session is created when the sink is built,
+// so that a rejected or unreachable endpoint fails like any other stream url
+type whipClient struct {
+	endpoint string
+	token    string
+	resource string // the session's url, deleted when the client is closed
+	host     string
+
+	pc     *webrtc.PeerConnection
+	logger logger.Logger
+}
+
+// whipTrack writes encoded buffers to a local track. Buffers without a duration, such as h264 access
+// units out of tsdemux, use the time since the previous buffer
+type whipTrack struct {
+	track    *webrtc.TrackLocalStaticSample
+	pts      time.Duration
+	duration time.Duration
+}
+
+// buildWhipSink returns a bin taking the mpeg transport stream, which demuxes it into appsinks feeding the WebRTC
+// tracks. WebRTC doesn't carry aac, so the audio is transcoded to opus
+func (b *Bin) buildWhipSink(name, rawUrl, location string) (*gst.Element, error) {
+	endpoint, token, err := parseWhipUrl(location)
+	if err != nil {
+		return nil, errors.ErrInvalidUrl(rawUrl, "whip")
+	}
+
+	bin := gst.NewBin(name)
+	demux, err := gst.NewElement("tsdemux")
+	if err != nil {
+		return nil, err
+	}
+	if err = bin.Add(demux); err != nil {
+		return nil, err
+	}
+
+	var tracks []*whipTrack
+	var audioSink, videoSink *gst.Element
+	if b.audioEnabled {
+		track, sink, err := b.buildWhipAudioBranch(bin)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		audioSink = sink
+	}
+	if b.videoEnabled {
+		track, sink, err := b.buildWhipVideoBranch(bin)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, track)
+		videoSink = sink
+	}
+
+	if _, err = demux.Connect("pad-added", func(_ *gst.Element, pad *gst.Pad) {
+		var sink *gst.Element
+		switch {
+		case strings.HasPrefix(pad.GetName(), "audio"):
+			sink = audioSink
+		case strings.HasPrefix(pad.GetName(), "video"):
+			sink = videoSink
+		}
+		if sink == nil {
+			return
+		}
+		if linkReturn := pad.Link(sink.GetStaticPad("sink")); linkReturn != gst.PadLinkOK {
+			b.logger.Errorw("failed to link whip branch", errors.ErrPadLinkFailed("tsdemux", linkReturn.String()))
+		}
+	}); err != nil {
+		return nil, err
+	}
+
+	ghostPad := gst.NewGhostPad("sink", demux.GetStaticPad("sink"))
+	if !bin.AddPad(ghostPad.Pad) {
+		return nil, errors.ErrGhostPadFailed
+	}
+
+	client, err := newWhipClient(endpoint, token, tracks, b.logger)
+	if err != nil {
+		return nil, err
+	}
+	client.pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateFailed {
+			// reported on the bus, so the url is removed like any other failed stream output
+			bin.Element.ErrorMessage(gst.DomainResource, gst.ResourceErrorWrite,
+				"WHIP connection failed", fmt.Sprintf("connection to %s failed", client.host))
+		}
+	})
+	b.whips[rawUrl] = client
+
+	return bin.Element, nil
+}
+
+func (b *Bin) buildWhipAudioBranch(bin *gst.Bin) (*whipTrack, *gst.Element, error) {
+	aacParse, err := gst.NewElement("aacparse")
+	if err != nil {
+		return nil, nil, err
+	}
+	aacDec, err := gst.NewElement("faad")
+	if err != nil {
+		return nil, nil, err
+	}
+	audioConvert, err := gst.NewElement("audioconvert")
+	if err != nil {
+		return nil, nil, err
+	}
+	audioResample, err := gst.NewElement("audioresample")
+	if err != nil {
+		return nil, nil, err
+	}
+	audioCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = audioCaps.SetProperty("caps", gst.NewCapsFromString("audio/x-raw,rate=48000,channels=2")); err != nil {
+		return nil, nil, err
+	}
+	opusEnc, err := gst.NewElement("opusenc")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus}, "audio", "egress")
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &whipTrack{track: track, pts: gst.ClockTimeNone, duration: defaultAudioDuration}
+	appSink, err := b.buildWhipAppSink(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	elements := []*gst.Element{aacParse, aacDec, audioConvert, audioResample, audioCaps, opusEnc, appSink}
+	if err = bin.AddMany(elements...); err != nil {
+		return nil, nil, err
+	}
+	if err = gst.ElementLinkMany(elements...); err != nil {
+		return nil, nil, err
+	}
+	return t, aacParse, nil
+}
+
+func (b *Bin) buildWhipVideoBranch(bin *gst.Bin) (*whipTrack, *gst.Element, error) {
+	h264Parse, err := gst.NewElement("h264parse")
+	if err != nil {
+		return nil, nil, err
+	}
+	// parameter sets are repeated on every keyframe, for receivers joining mid-stream
+	if err = h264Parse.SetProperty("config-interval", -1); err != nil {
+		return nil, nil, err
+	}
+	videoCaps, err := gst.NewElement("capsfilter")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = videoCaps.SetProperty("caps", gst.NewCapsFromString("video/x-h264,stream-format=byte-stream,alignment=au")); err != nil {
+		return nil, nil, err
+	}
+
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", "egress")
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &whipTrack{track: track, pts: gst.ClockTimeNone, duration: time.Second / time.Duration(b.framerate)}
+	appSink, err := b.buildWhipAppSink(t)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	elements := []*gst.Element{h264Parse, videoCaps, appSink}
+	if err = bin.AddMany(elements...); err != nil {
+		return nil, nil, err
+	}
+	if err = gst.ElementLinkMany(elements...); err != nil {
+		return nil, nil, err
+	}
+	return t, h264Parse, nil
+}
+
+func (b *Bin) buildWhipAppSink(t *whipTrack) (*gst.Element, error) {
+	sink, err := app.NewAppSink()
+	if err != nil {
+		return nil, err
+	}
+	if err = sink.SetProperty("sync", false); err != nil {
+		return nil, err
+	}
+
+	sink.SetCallbacks(&app.SinkCallbacks{
+		NewSampleFunc: func(appSink *app.Sink) gst.FlowReturn {
+			sample := appSink.PullSample()
+			if sample == nil {
+				return gst.FlowEOS
+			}
+			buffer := sample.GetBuffer()
+			if buffer == nil {
+				return gst.FlowError
+			}
+
+			if err := t.writeBuffer(buffer); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				b.logger.Errorw("failed to write whip sample", err)
+				return gst.FlowError
+			}
+			return gst.FlowOK
+		},
+	})
+
+	return sink.Element, nil
+}
+
+func (t *whipTrack) writeBuffer(buffer *gst.Buffer) error {
+	pts := buffer.PresentationTimestamp()
+	duration := buffer.Duration()
+	if duration == gst.ClockTimeNone {
+		if pts != gst.ClockTimeNone && t.pts != gst.ClockTimeNone && pts > t.pts {
+			t.duration = pts - t.pts
+		}
+		duration = t.duration
+	}
+	t.pts = pts
+
+	// packetized before WriteSample returns, so the mapped memory isn't copied
+	defer buffer.Unmap()
+	return t.track.WriteSample(media.Sample{
+		Data:     buffer.Map(gst.MapRead).Bytes(),
+		Duration: duration,
+	})
+}
+
+// parseWhipUrl returns the endpoint for a whip:// (http) or whips:// (https) url, and the bearer token,
+// which is sent as the url's user
+func parseWhipUrl(location string) (endpoint, token string, err error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return "", "", err
+	}
+	switch u.Scheme {
+	case "whip":
+		u.Scheme = "http"
+	case "whips":
+		u.Scheme = "https"
+	default:
+		return "", "", errors.New("invalid scheme")
+	}
+	if u.Host == "" {
+		return "", "", errors.New("missing host")
+	}
+	if u.User != nil {
+		token = u.User.Username()
+		u.User = nil
+	}
+	return u.String(), token, nil
+}
+
+func newWhipClient(endpoint, token string, tracks []*whipTrack, logger logger.Logger) (*whipClient, error) {
+	u, _ := url.Parse(endpoint)
+	c := &whipClient{
+		endpoint: endpoint,
+		token:    token,
+		host:     u.Host,
+		logger:   logger,
+	}
+
+	var err error
+	c.pc, err = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range tracks {
+		transceiver, err := c.pc.AddTransceiverFromTrack(t.track, webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionSendonly,
+		})
+		if err != nil {
+			_ = c.pc.Close()
+			return nil, err
+		}
+		// rtcp needs to be read for the interceptors to handle nacks
+		go func(sender *webrtc.RTPSender) {
+			buf := make([]byte, 1500)
+			for {
+				if _, _, err := sender.Read(buf); err != nil {
+					return
+				}
+			}
+		}(transceiver.Sender())
+	}
+
+	if err = c.connect(); err != nil {
+		_ = c.pc.Close()
+		return nil, errors.ErrWHIPFailed(c.host, err)
+	}
+	return c, nil
+}
+
+// connect sends the offer with every ice candidate, since the session is never updated with trickled candidates
+func (c *whipClient) connect() error {
+	offer, err := c.pc.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(c.pc)
+	if err = c.pc.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	select {
+	case <-gathered:
+	case <-time.After(whipTimeout):
+		return errors.New("ice gathering timed out")
+	}
+
+	resp, err := c.do(http.MethodPost, c.endpoint, []byte(c.pc.LocalDescription().SDP))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if location, err := resp.Location(); err == nil {
+		c.resource = location.String()
+	}
+
+	return c.pc.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+}
+
+func (c *whipClient) do(method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/sdp")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return (&http.Client{Timeout: whipTimeout}).Do(req)
+}
+
+// close ends the session, and deletes it from the endpoint
+func (c *whipClient) close() {
+	if err := c.pc.Close(); err != nil {
+		c.logger.Warnw("failed to close whip connection", err, "host", c.host)
+	}
+	if c.resource == "" {
+		return
+	}
+	resp, err := c.do(http.MethodDelete, c.resource, nil)
+	if err != nil {
+		c.logger.Warnw("failed to delete whip session", err, "host", c.host)
+		return
+	}
+	_ = resp.Body.Close()
+}
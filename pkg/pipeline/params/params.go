@@ -3,12 +3,19 @@ package params
 import (
 	"context"
 	"fmt"
+	"math"
 	"math/rand"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"google.golang.org/protobuf/proto"
+
 	"github.com/livekit/protocol/egress"
 	"github.com/livekit/protocol/livekit"
 	"github.com/livekit/protocol/logger"
@@ -16,6 +23,7 @@ import (
 
 	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/secrets"
 )
 
 type Params struct {
@@ -24,6 +32,24 @@ type Params struct {
 	Info     *livekit.EgressInfo
 	GstReady chan struct{}
 
+	// only the storage config is used, so no local directories are created
+	uploadOnly bool
+
+	// write a performance report next to the recording
+	PerfReport bool
+
+	// files uploaded at once when the egress ends
+	UploadConcurrency int
+
+	// content encoding for playlists and json reports
+	UploadCompression string
+
+	// properties set on encoder elements, by element name
+	EncoderOptions map[string]map[string]string
+
+	// prefixes of the secret references requests can use
+	SecretReferences []string
+
 	SourceParams
 	AudioParams
 	VideoParams
@@ -37,6 +63,16 @@ type Params struct {
 	SegmentedFileParams
 
 	FileUpload interface{}
+
+	// expiry hints for uploaded objects
+	Retention config.RetentionConfig
+
+	// diagnostics and recovery when the pipeline freezes while ending
+	Watchdog config.WatchdogConfig
+
+	// session limit of the storage profile or ingest hosts the request uses, applied if it's lower than session_limits
+	RequestMaxDuration       time.Duration
+	RequestMaxDurationSource string
 }
 
 type SourceParams struct {
@@ -51,10 +87,35 @@ type SourceParams struct {
 	Layout     string
 	CustomBase string
 
+	// capture before the template starts recording, dropping frames until it does
+	FrameAccurateStart bool
+
+	// ends the egress if the template hasn't started recording, or no track has produced media, by then
+	StartTimeout time.Duration
+
+	// room composite mixed by the pipeline, without a browser. Also used by track composites with a layout
+	SDKComposite bool
+
 	// sdk source
 	TrackID      string
 	AudioTrackID string
 	VideoTrackID string
+
+	// video tracks arranged by a track composite layout, in layout order
+	CompositeVideoTrackIDs []string
+
+	// complete when a track ends or its publisher leaves, after the linger
+	StopOnTrackEnd bool
+	TrackEndLinger time.Duration
+
+	// data messages received by the sdk source are stored next to the recording
+	DataCapture bool
+
+	// transcription data messages are written to a caption file, vtt or srt
+	CaptionsFormat string
+
+	// transcription data messages are embedded in the encoded video as CEA-608 captions
+	EmbedCaptions bool
 }
 
 type AudioParams struct {
@@ -62,37 +123,158 @@ type AudioParams struct {
 	AudioCodec     MimeType
 	AudioBitrate   int32
 	AudioFrequency int32
+	AudioBitDepth  int32 // wav only
+
+	// pauses in dtx audio tracks are filled with opus silence, instead of left as timestamp gaps
+	DTXSilence bool
+
+	// background audio mixed into the program
+	AudioBedFile         string
+	AudioBedVolume       float64
+	AudioBedDuckedVolume float64
+
+	// ebu r128 normalization target in LUFS, or 0 to leave the loudness as it is
+	LoudnessTarget float64
 }
 
 type VideoParams struct {
 	VideoEnabled bool
 	VideoCodec   MimeType
 	VideoProfile Profile
+	VideoEncoder string // gstreamer element used for h264 and h265
+	VideoPreset  string // x264enc speed preset
+	VideoLevel   string // h264 level, or empty to let the encoder choose
+	VP9CPUUsed   int32
+	VP9Quality   int32 // constrained quality level, or 0 for constant bitrate
 	Width        int32
 	Height       int32
 	Depth        int32
 	Framerate    int32
 	VideoBitrate int32
+
+	// rate control configured for the egress type, or nil to keep each encoder's default
+	RateControl *config.RateControlConfig
+
+	// slate shown while the video source is stalled
+	SlateImage   string
+	StallTimeout time.Duration
+
+	// drawn behind composited video, and used as the slate when there's no slate image
+	BackgroundImage string
+	BackgroundColor uint32 // argb, or 0 for the layout's default
+
+	// a clock burned into encoded video
+	TimecodeMode     string
+	TimecodePosition string
+	TimecodeFormat   string
+	TimecodeFont     string
+
+	// text set while the egress is running
+	TextOverlay         bool
+	TextOverlayPosition string
+	TextOverlayFont     string
+
+	// still images captured alongside file and segment outputs
+	SnapshotInterval time.Duration
+	SnapshotType     OutputType
+	SnapshotWidth    int32
+	SnapshotHeight   int32
+	SnapshotPrefix   string // local path, followed by the image number and extension
+
+	// animated gifs captured alongside file and segment outputs
+	PreviewInterval  time.Duration
+	PreviewDuration  time.Duration
+	PreviewFramerate int32
+	PreviewWidth     int32
+	PreviewHeight    int32
+	PreviewPrefix    string // local path, followed by the preview number and extension
 }
 
 type StreamParams struct {
 	WebsocketUrl string
 	StreamUrls   []string
 	StreamInfo   map[string]*livekit.StreamInfo
+	StreamMuxes  []StreamMux // one for each container used by the urls, in order of first use
+
+	// websocket destinations with expiring urls
+	WebsocketRefreshUrl      string
+	WebsocketRefreshInterval time.Duration
+
+	// websocket reconnection, disabled when the timeout isn't positive
+	WebsocketReconnectTimeout time.Duration
+	WebsocketBufferSize       int // in bytes
+
+	// websocket headers and tls settings, by host
+	WebsocketHosts map[string]*config.WebsocketHostConfig
+
+	// rist retransmission
+	RistSenderBuffer     time.Duration
+	RistMinRTCPInterval  time.Duration
+	RistMaxRTCPBandwidth float64
+
+	// rtmps
+	RtmpsCAFile             string
+	RtmpsInsecureSkipVerify bool
+	RtmpsServerNames        map[string]string
+
+	// rtmp connect command, by ingest host
+	RtmpConnect map[string]*config.RTMPConnectConfig
+
+	// encoding limits, by ingest host
+	StreamCaps map[string]*config.StreamCapConfig
+
+	// how often the health of each output is reported, disabled unless positive
+	StreamHealthInterval time.Duration
 }
 
 type FileParams struct {
 	FileInfo        *livekit.FileInfo
 	LocalFilepath   string
 	StorageFilepath string
+
+	// bumpers
+	IntroClip string
+	OutroClip string
+
+	// validation of mp4 files before they're uploaded
+	FileCheck config.FileCheckConfig
+
+	// container metadata
+	Title    string
+	Language string
+	Tags     map[string]string
 }
 
 type SegmentedFileParams struct {
-	SegmentsInfo      *livekit.SegmentsInfo
-	LocalFilePrefix   string
-	StoragePathPrefix string
-	PlaylistFilename  string
-	SegmentDuration   int
+	SegmentsInfo           *livekit.SegmentsInfo
+	LocalFilePrefix        string
+	SpillFilePrefix        string
+	SegmentsInMemory       bool
+	StoragePathPrefix      string
+	PlaylistFilename       string
+	MasterPlaylistFilename string
+	InitSegmentFilename    string
+	SegmentDuration        int
+	FirstSegmentDuration   int
+	SegmentOutputType      OutputType
+	PlaylistWindow         int    // number of segments in a live playlist, 0 for an event playlist
+	PlaylistVOD            bool   // event playlists become vod playlists once complete
+	SingleFileFilename     string // set when segments are byte ranges of a single media file
+	ContentAddressed       bool   // segments are named by the hash of their contents
+	TimedMetadata          bool   // ID3 timed metadata is added to ts segments
+
+	// legacy players get ts segments and an older playlist version, without newer tags or attributes
+	PlaylistCompatibility bool
+	PlaylistVersion       int
+
+	// AES-128 segment encryption
+	SegmentEncryption bool
+	KeyURI            string
+	KeyRotation       int
+
+	// secondary storage used once segment uploads keep failing
+	FailoverUpload    interface{}
+	FailoverThreshold int
 }
 
 func ValidateRequest(ctx context.Context, conf *config.Config, request *livekit.StartEgressRequest) (*livekit.EgressInfo, error) {
@@ -110,8 +292,21 @@ func GetPipelineParams(ctx context.Context, conf *config.Config, request *liveki
 	return getPipelineParams(conf, request)
 }
 
-// getPipelineParams must always return params with valid info, even on error
-func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest) (p *Params, err error) {
+// GetUploadParams returns the params of a request for their storage config, with storage profiles and secrets
+// resolved. Unlike GetPipelineParams, the local directories the handler writes to aren't created
+func GetUploadParams(ctx context.Context, conf *config.Config, request *livekit.StartEgressRequest) (*Params, error) {
+	ctx, span := tracer.Start(ctx, "Params.GetUploadParams")
+	defer span.End()
+
+	return getParams(conf, request, true)
+}
+
+func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest) (*Params, error) {
+	return getParams(conf, request, false)
+}
+
+// getParams must always return params with valid info, even on error
+func getParams(conf *config.Config, request *livekit.StartEgressRequest, uploadOnly bool) (p *Params, err error) {
 	// start with defaults
 	p = &Params{
 		Logger: logger.Logger(logger.GetLogger().WithValues("egressID", request.EgressId)),
@@ -120,20 +315,65 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 			RoomId:   request.RoomId,
 			Status:   livekit.EgressStatus_EGRESS_STARTING,
 		},
-		GstReady: make(chan struct{}),
+		GstReady:          make(chan struct{}),
+		PerfReport:        conf.PerfReport,
+		UploadConcurrency: conf.UploadConcurrency,
+		UploadCompression: conf.UploadCompression,
+		EncoderOptions:    conf.EncoderOptions,
+		SecretReferences:  conf.Secrets.RequestReferences,
+		Retention:         conf.Retention,
+		Watchdog:          conf.Watchdog,
+		SourceParams: SourceParams{
+			StopOnTrackEnd: conf.TrackEnd.Stop,
+			TrackEndLinger: conf.TrackEnd.Linger,
+			DataCapture:    conf.DataCapture,
+			CaptionsFormat: getCaptionsFormat(conf),
+			StartTimeout:   conf.StartTimeout,
+		},
 		AudioParams: AudioParams{
 			AudioBitrate:   128,
 			AudioFrequency: 44100,
+			AudioBitDepth:  conf.Wav.BitDepth,
+			DTXSilence:     conf.OpusDTX == config.OpusDTXSilence,
+
+			AudioBedFile:         conf.AudioBed.File,
+			AudioBedVolume:       conf.AudioBed.Volume,
+			AudioBedDuckedVolume: conf.AudioBed.DuckedVolume,
+
+			LoudnessTarget: getLoudnessTarget(conf),
 		},
 		VideoParams: VideoParams{
-			VideoProfile: ProfileMain,
-			Width:        1920,
-			Height:       1080,
-			Depth:        24,
-			Framerate:    30,
-			VideoBitrate: 4500,
+			VideoProfile:        ProfileMain,
+			Width:               1920,
+			Height:              1080,
+			Depth:               24,
+			Framerate:           30,
+			VideoBitrate:        4500,
+			SlateImage:          conf.Slate.Image,
+			StallTimeout:        conf.Slate.StallTimeout,
+			BackgroundImage:     conf.Background.Image,
+			BackgroundColor:     conf.Background.ARGB,
+			TimecodeMode:        conf.Timecode.Mode,
+			TimecodePosition:    conf.Timecode.Position,
+			TimecodeFormat:      conf.Timecode.Format,
+			TimecodeFont:        conf.Timecode.Font,
+			TextOverlay:         conf.TextOverlay.Enabled,
+			TextOverlayPosition: conf.TextOverlay.Position,
+			TextOverlayFont:     conf.TextOverlay.Font,
+		},
+		StreamParams: StreamParams{
+			RistSenderBuffer:        conf.Rist.SenderBuffer,
+			RistMinRTCPInterval:     conf.Rist.MinRTCPInterval,
+			RistMaxRTCPBandwidth:    conf.Rist.MaxRTCPBandwidth,
+			RtmpsCAFile:             conf.RTMPS.CAFile,
+			RtmpsInsecureSkipVerify: conf.RTMPS.InsecureSkipVerify,
+			RtmpsServerNames:        conf.RTMPS.ServerNames,
+			RtmpConnect:             conf.RTMPConnect,
+			StreamCaps:              conf.StreamCaps,
+			StreamHealthInterval:    conf.StreamHealthInterval,
 		},
-		conf: conf,
+		conf:       conf,
+		uploadOnly: uploadOnly,
 	}
 
 	switch req := request.Request.(type) {
@@ -156,6 +396,12 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 		}
 		p.AudioEnabled = !req.RoomComposite.VideoOnly
 		p.VideoEnabled = !req.RoomComposite.AudioOnly
+		if UsesSDKComposite(req.RoomComposite) {
+			p.IsWebSource = false
+			p.SDKComposite = true
+		}
+		// the audio bed starts with the pipeline, so it can't be offset along with the captured audio
+		p.FrameAccurateStart = p.IsWebSource && conf.FrameAccurateStart && conf.AudioBed.File == ""
 
 		// encoding options
 		switch opts := req.RoomComposite.Options.(type) {
@@ -170,12 +416,15 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 		switch o := req.RoomComposite.Output.(type) {
 		case *livekit.RoomCompositeEgressRequest_File:
 			p.updateOutputType(o.File.FileType)
+			if o.File.FileType == livekit.EncodedFileType_DEFAULT_FILETYPE {
+				p.updateOutputTypeFromFilepath(o.File.Filepath)
+			}
 			if err = p.updateFileParams(o.File.Filepath, o.File.Output); err != nil {
 				return
 			}
 
 		case *livekit.RoomCompositeEgressRequest_Stream:
-			if err = p.updateStreamParams(OutputTypeRTMP, o.Stream.Urls); err != nil {
+			if err = p.updateStreamParams(getStreamOutputType(o.Stream.Urls), o.Stream.Urls); err != nil {
 				return
 			}
 
@@ -216,19 +465,28 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 			err = errors.ErrInvalidInput("TrackIDs")
 			return
 		}
+		if err = p.updateTrackLayout(); err != nil {
+			return
+		}
 
 		// output params
 		switch o := req.TrackComposite.Output.(type) {
 		case *livekit.TrackCompositeEgressRequest_File:
 			if o.File.FileType != livekit.EncodedFileType_DEFAULT_FILETYPE {
 				p.updateOutputType(o.File.FileType)
+			} else {
+				p.updateOutputTypeFromFilepath(o.File.Filepath)
+			}
+			if p.SDKComposite && p.OutputType == "" {
+				// there's no single published codec to choose the container from
+				p.updateOutputType(o.File.FileType)
 			}
 			if err = p.updateFileParams(o.File.Filepath, o.File.Output); err != nil {
 				return
 			}
 
 		case *livekit.TrackCompositeEgressRequest_Stream:
-			if err = p.updateStreamParams(OutputTypeRTMP, o.Stream.Urls); err != nil {
+			if err = p.updateStreamParams(getStreamOutputType(o.Stream.Urls), o.Stream.Urls); err != nil {
 				return
 			}
 
@@ -257,9 +515,23 @@ func getPipelineParams(conf *config.Config, request *livekit.StartEgressRequest)
 			return
 		}
 
+		// track egress records the track as it was published
+		p.AudioBedFile = ""
+		p.LoudnessTarget = 0
+
 		// output params
 		switch o := req.Track.Output.(type) {
 		case *livekit.TrackEgressRequest_File:
+			if FileExtension(path.Ext(o.File.Filepath)) == FileExtensionM3U8 {
+				// a playlist filepath writes segments next to it, named after the playlist
+				p.OutputType = OutputTypeHLS
+				prefix := strings.TrimSuffix(o.File.Filepath, string(FileExtensionM3U8))
+				if err = p.updateSegmentsParams(prefix, path.Base(o.File.Filepath), 0, o.File.Output); err != nil {
+					return
+				}
+				break
+			}
+			p.updateOutputTypeFromFilepath(o.File.Filepath)
 			if err = p.updateFileParams(o.File.Filepath, o.File.Output); err != nil {
 				return
 			}
@@ -382,6 +654,13 @@ func (p *Params) updateOutputType(fileType interface{}) {
 	}
 }
 
+// updateOutputTypeFromFilepath selects file types which can't be requested with livekit.EncodedFileType
+func (p *Params) updateOutputTypeFromFilepath(filepath string) {
+	if outputType, ok := outputTypeForFileExtension[FileExtension(path.Ext(filepath))]; ok {
+		p.OutputType = outputType
+	}
+}
+
 func (p *Params) updateFileParams(storageFilepath string, output interface{}) error {
 	p.EgressType = EgressTypeFile
 	p.StorageFilepath = storageFilepath
@@ -405,6 +684,40 @@ func (p *Params) updateFileParams(storageFilepath string, output interface{}) er
 	default:
 		p.FileUpload = p.conf.FileUpload
 	}
+	requested := p.FileUpload
+	metadata := p.conf.FileMetadata
+	profile, err := p.getStorageProfile(p.FileUpload)
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		p.FileUpload = profile.Upload
+		p.StorageFilepath = withPathPrefix(profile.PathPrefix, p.StorageFilepath)
+		p.Retention = *profile.Retention
+		p.limitDuration(profile.MaxDuration, "storage profile "+profile.Name)
+		metadata = profile.FileMetadata
+	} else {
+		p.FileUpload = withDefaultCredentials(p.FileUpload, p.conf.FileUpload)
+	}
+	if p.FileUpload, err = p.resolveSecrets(p.FileUpload, requested); err != nil {
+		return err
+	}
+
+	// metadata
+	p.Title = strings.NewReplacer(
+		"{room_name}", p.Info.RoomName,
+		"{egress_id}", p.Info.EgressId,
+		"{track_id}", p.TrackID,
+	).Replace(metadata.Title)
+	p.Language = metadata.Language
+	p.Tags = metadata.Tags
+
+	// bumpers are only added to composite recordings, which are already being encoded
+	if p.TrackID == "" {
+		p.IntroClip = p.conf.Bumpers.Intro
+		p.OutroClip = p.conf.Bumpers.Outro
+	}
+	p.FileCheck = p.conf.FileCheck
 
 	// filename
 	if p.OutputType != "" {
@@ -421,16 +734,41 @@ func (p *Params) updateStreamParams(outputType OutputType, urls []string) error
 	p.OutputType = outputType
 
 	switch p.OutputType {
-	case OutputTypeRTMP:
+	case OutputTypeRTMP, OutputTypeRTSP, OutputTypeRIST, OutputTypeSRT, OutputTypeWHIP:
+		// protocols can be mixed, since they all carry h264 and aac
 		p.EgressType = EgressTypeStream
 		p.AudioCodec = MimeTypeAAC
 		p.VideoCodec = MimeTypeH264
 		p.StreamUrls = urls
+		// web sources don't receive data messages
+		p.EmbedCaptions = p.conf.Captions.Embed && !p.IsWebSource
+		for _, url := range urls {
+			mux := GetStreamMux(GetStreamOutputType(url))
+			if mux == StreamMuxRaw {
+				return errors.ErrNotSupported("mixing ndi with other stream protocols")
+			}
+			if !p.hasStreamMux(mux) {
+				p.StreamMuxes = append(p.StreamMuxes, mux)
+			}
+		}
+
+	case OutputTypeNDI:
+		// ndi carries uncompressed audio and video
+		p.EgressType = EgressTypeStream
+		p.AudioCodec = MimeTypeRaw
+		p.VideoCodec = MimeTypeRawVideo
+		p.StreamUrls = urls
+		p.StreamMuxes = []StreamMux{StreamMuxRaw}
 
 	case OutputTypeRaw:
 		p.EgressType = EgressTypeWebsocket
 		p.AudioCodec = MimeTypeRaw
 		p.WebsocketUrl = urls[0]
+		p.WebsocketRefreshUrl = p.conf.Websocket.RefreshUrl
+		p.WebsocketRefreshInterval = p.conf.Websocket.RefreshInterval
+		p.WebsocketReconnectTimeout = p.conf.Websocket.ReconnectTimeout
+		p.WebsocketBufferSize = p.conf.Websocket.BufferSize << 20
+		p.WebsocketHosts = p.conf.Websocket.Hosts
 		p.MutedChan = make(chan bool, 1)
 	}
 
@@ -444,20 +782,204 @@ func (p *Params) updateStreamParams(outputType OutputType, urls []string) error
 		info := &livekit.StreamInfo{Url: url}
 		p.StreamInfo[url] = info
 		streamInfoList = append(streamInfoList, info)
+		p.limitStreamDuration(url)
 	}
 
 	p.Info.Result = &livekit.EgressInfo_Stream{Stream: &livekit.StreamInfoList{Info: streamInfoList}}
 	return nil
 }
 
+// withDefaultCredentials fills in credentials left out of a request from the service's upload config, so that
+// requests can choose a bucket without sending secrets. Credentials are only used with the storage account or
+// endpoint they were configured for. The request's upload is copied, since it's returned as part of EgressInfo
+func withDefaultCredentials(upload, defaults interface{}) interface{} {
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		d, ok := defaults.(*livekit.S3Upload)
+		if !ok || u == d || u.AccessKey != "" || u.Secret != "" || (u.Endpoint != "" && u.Endpoint != d.Endpoint) {
+			return upload
+		}
+		merged := proto.Clone(u).(*livekit.S3Upload)
+		merged.AccessKey = d.AccessKey
+		merged.Secret = d.Secret
+		merged.Endpoint = d.Endpoint
+		if merged.Region == "" {
+			merged.Region = d.Region
+		}
+		if merged.Bucket == "" {
+			merged.Bucket = d.Bucket
+		}
+		return merged
+
+	case *livekit.AzureBlobUpload:
+		d, ok := defaults.(*livekit.AzureBlobUpload)
+		if !ok || u == d || u.AccountKey != "" || (u.AccountName != "" && u.AccountName != d.AccountName) {
+			return upload
+		}
+		merged := proto.Clone(u).(*livekit.AzureBlobUpload)
+		merged.AccountName = d.AccountName
+		merged.AccountKey = d.AccountKey
+		if merged.ContainerName == "" {
+			merged.ContainerName = d.ContainerName
+		}
+		return merged
+
+	case *livekit.GCPUpload:
+		d, ok := defaults.(*livekit.GCPUpload)
+		if !ok || u == d || len(u.Credentials) > 0 {
+			return upload
+		}
+		merged := proto.Clone(u).(*livekit.GCPUpload)
+		merged.Credentials = d.Credentials
+		if merged.Bucket == "" {
+			merged.Bucket = d.Bucket
+		}
+		return merged
+
+	default:
+		return upload
+	}
+}
+
+// resolveSecrets replaces secret references in upload credentials, such as aws-ssm:///egress/s3_secret.
+// The upload is copied if anything was resolved, so that secrets are never returned as part of EgressInfo.
+// Credentials sent with the request, which are the requested upload's own, can only use the allowed references
+func (p *Params) resolveSecrets(upload, requested interface{}) (interface{}, error) {
+	resolve := secrets.Resolve
+	if upload != nil && upload == requested && upload != p.conf.FileUpload {
+		resolve = func(value string) (string, error) {
+			return secrets.ResolveRequest(value, p.SecretReferences)
+		}
+	}
+
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		accessKey, err := resolve(u.AccessKey)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := resolve(u.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if accessKey == u.AccessKey && secret == u.Secret {
+			return upload, nil
+		}
+		resolved := proto.Clone(u).(*livekit.S3Upload)
+		resolved.AccessKey = accessKey
+		resolved.Secret = secret
+		return resolved, nil
+
+	case *livekit.AzureBlobUpload:
+		accountKey, err := resolve(u.AccountKey)
+		if err != nil {
+			return nil, err
+		}
+		if accountKey == u.AccountKey {
+			return upload, nil
+		}
+		resolved := proto.Clone(u).(*livekit.AzureBlobUpload)
+		resolved.AccountKey = accountKey
+		return resolved, nil
+
+	case *livekit.GCPUpload:
+		credentials, err := resolve(string(u.Credentials))
+		if err != nil {
+			return nil, err
+		}
+		if credentials == string(u.Credentials) {
+			return upload, nil
+		}
+		resolved := proto.Clone(u).(*livekit.GCPUpload)
+		resolved.Credentials = []byte(credentials)
+		return resolved, nil
+
+	default:
+		return upload, nil
+	}
+}
+
+// getStorageProfile returns the storage profile named by an upload's bucket or container, if any
+func (p *Params) getStorageProfile(upload interface{}) (*config.StorageProfileConfig, error) {
+	var name string
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		name = u.Bucket
+	case *livekit.AzureBlobUpload:
+		name = u.ContainerName
+	case *livekit.GCPUpload:
+		name = u.Bucket
+	}
+	if !strings.HasPrefix(name, StorageProfilePrefix) {
+		return nil, nil
+	}
+
+	name = strings.TrimPrefix(name, StorageProfilePrefix)
+	profile, ok := p.conf.StorageProfiles[name]
+	if !ok {
+		return nil, errors.ErrInvalidInput(fmt.Sprintf("storage profile %s", name))
+	}
+	return profile, nil
+}
+
+// KeyFrameInterval returns the keyframe interval in frames, or 0 to leave keyframe placement to the encoder
+func (p *Params) KeyFrameInterval() int32 {
+	if p.conf.KeyFrameInterval > 0 {
+		frames := int32(math.Round(p.conf.KeyFrameInterval.Seconds() * float64(p.Framerate)))
+		if frames < 1 {
+			frames = 1
+		}
+		return frames
+	}
+	if p.OutputType == OutputTypeHLS {
+		return p.segmentKeyFrameInterval()
+	}
+	return 0
+}
+
+// segmentKeyFrameInterval returns the longest keyframe interval in frames for encoded segments. Every segment has to start
+// on a keyframe, so the interval divides both the first and the regular segment durations
+func (p *Params) segmentKeyFrameInterval() int32 {
+	a, b := p.SegmentDuration, p.FirstSegmentDuration
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return int32(a) * p.Framerate
+}
+
+// withPathPrefix prepends a storage profile's path prefix, keeping a trailing slash which marks a directory
+func withPathPrefix(prefix, filepath string) string {
+	if prefix == "" {
+		return filepath
+	}
+	joined := path.Join(prefix, filepath)
+	if filepath == "" || strings.HasSuffix(filepath, "/") {
+		joined += "/"
+	}
+	return joined
+}
+
 func (p *Params) updateSegmentsParams(filePrefix string, playlistFilename string, segmentDuration uint32, output interface{}) error {
 	p.EgressType = EgressTypeSegmentedFile
 	p.LocalFilePrefix = filePrefix
 	p.PlaylistFilename = playlistFilename
+	if p.conf.Segments.Compatibility.Enabled {
+		p.PlaylistCompatibility = true
+		p.PlaylistVersion = p.conf.Segments.Compatibility.Version
+	}
 	p.SegmentDuration = int(segmentDuration)
 	if p.SegmentDuration == 0 {
-		p.SegmentDuration = 6
+		p.SegmentDuration = p.conf.Segments.SegmentDuration
+	} else if p.SegmentDuration > config.MaxSegmentDuration {
+		return errors.ErrInvalidInput("SegmentDuration")
 	}
+	// a first segment longer than the rest would only delay playback
+	p.FirstSegmentDuration = p.conf.Segments.FirstSegmentDuration
+	if p.FirstSegmentDuration == 0 || p.FirstSegmentDuration > p.SegmentDuration {
+		p.FirstSegmentDuration = p.SegmentDuration
+	}
+	p.PlaylistWindow = p.conf.Segments.PlaylistWindow
+	p.PlaylistVOD = p.conf.Segments.PlaylistType == config.PlaylistTypeVOD
 	p.SegmentsInfo = &livekit.SegmentsInfo{}
 	p.Info.Result = &livekit.EgressInfo_Segments{Segments: p.SegmentsInfo}
 
@@ -469,12 +991,40 @@ func (p *Params) updateSegmentsParams(filePrefix string, playlistFilename string
 		p.FileUpload = o.Azure
 	case *livekit.SegmentedFileOutput_Gcp:
 		p.FileUpload = o.Gcp
+	case *livekit.DirectFileOutput_S3:
+		p.FileUpload = o.S3
+	case *livekit.DirectFileOutput_Azure:
+		p.FileUpload = o.Azure
+	case *livekit.DirectFileOutput_Gcp:
+		p.FileUpload = o.Gcp
 	default:
 		p.FileUpload = p.conf.FileUpload
 	}
+	requested := p.FileUpload
+	profile, err := p.getStorageProfile(p.FileUpload)
+	if err != nil {
+		return err
+	}
+	if profile != nil {
+		p.FileUpload = profile.Upload
+		p.LocalFilePrefix = withPathPrefix(profile.PathPrefix, p.LocalFilePrefix)
+		p.Retention = *profile.Retention
+		p.limitDuration(profile.MaxDuration, "storage profile "+profile.Name)
+	} else {
+		p.FileUpload = withDefaultCredentials(p.FileUpload, p.conf.FileUpload)
+	}
+	if p.FileUpload, err = p.resolveSecrets(p.FileUpload, requested); err != nil {
+		return err
+	}
+	if p.FileUpload != nil && p.conf.Segments.Failover.Upload != nil {
+		if p.FailoverUpload, err = p.resolveSecrets(p.conf.Segments.Failover.Upload, nil); err != nil {
+			return err
+		}
+		p.FailoverThreshold = p.conf.Segments.Failover.Threshold
+	}
 
 	// filename
-	err := p.updatePrefixAndPlaylist(p.Info.RoomName)
+	err = p.updatePrefixAndPlaylist(p.Info.RoomName)
 	if err != nil {
 		return err
 	}
@@ -512,7 +1062,9 @@ func (p *Params) updateConnectionInfo(request *livekit.StartEgressRequest) error
 func (p *Params) updateCodecsFromOutputType() error {
 	// check audio codec
 	if p.AudioEnabled {
-		if p.AudioCodec == "" {
+		if p.AudioCodec == "" && p.usePassthroughAudio() {
+			p.AudioCodec = MimeTypeOpus
+		} else if p.AudioCodec == "" {
 			p.AudioCodec = DefaultAudioCodecs[p.OutputType]
 		} else if !codecCompatibility[p.OutputType][p.AudioCodec] {
 			return errors.ErrIncompatible(p.OutputType, p.AudioCodec)
@@ -521,16 +1073,81 @@ func (p *Params) updateCodecsFromOutputType() error {
 
 	// check video codec
 	if p.VideoEnabled {
-		if p.VideoCodec == "" {
+		if p.VideoCodec == "" && p.useVP9() {
+			p.VideoCodec = MimeTypeVP9
+			p.VP9CPUUsed = p.conf.VP9.CPUUsed
+			p.VP9Quality = p.conf.VP9.Quality
+		} else if p.VideoCodec == "" && p.useH265() {
+			p.VideoCodec = MimeTypeH265
+			p.VideoEncoder = p.conf.H265.Encoder
+		} else if p.VideoCodec == "" {
 			p.VideoCodec = DefaultVideoCodecs[p.OutputType]
+			if p.VideoCodec == "" {
+				// audio only output type
+				return errors.ErrIncompatible(p.OutputType, "video")
+			}
 		} else if !codecCompatibility[p.OutputType][p.VideoCodec] {
 			return errors.ErrIncompatible(p.OutputType, p.VideoCodec)
 		}
+		if p.OutputType == OutputTypeHLS && p.conf.KeyFrameInterval > 0 && p.segmentKeyFrameInterval()%p.KeyFrameInterval() != 0 {
+			// segments wouldn't start on keyframes
+			return errors.ErrInvalidInput("SegmentDuration, as a multiple of the keyframe interval")
+		}
+		p.RateControl = p.conf.RateControl[string(p.EgressType)]
+		if p.VideoCodec == MimeTypeH264 {
+			p.VideoEncoder = p.conf.H264.Encoder
+			p.VideoPreset = p.conf.H264.Preset
+			p.VideoLevel = p.conf.H264.Level
+		}
 	}
 
 	return nil
 }
 
+// h265 replaces the default codec for files and segments, when enabled
+func (p *Params) useH265() bool {
+	if !p.conf.H265.Enabled || p.TrackID != "" || p.PlaylistCompatibility {
+		return false
+	}
+	if p.EgressType != EgressTypeFile && p.EgressType != EgressTypeSegmentedFile {
+		return false
+	}
+	return codecCompatibility[p.OutputType][MimeTypeH265]
+}
+
+// track composites keep the published opus audio when enabled, instead of transcoding it to the default codec
+func (p *Params) usePassthroughAudio() bool {
+	if !p.conf.PassthroughAudio || p.AudioTrackID == "" || p.AudioBedFile != "" || p.LoudnessTarget != 0 || p.SDKComposite {
+		return false
+	}
+	return codecCompatibility[p.OutputType][MimeTypeOpus]
+}
+
+// vp9 replaces the default codec for webm and mkv files, when enabled
+func (p *Params) useVP9() bool {
+	if !p.conf.VP9.Enabled || p.TrackID != "" || p.EgressType != EgressTypeFile {
+		return false
+	}
+	return p.OutputType == OutputTypeWebM || p.OutputType == OutputTypeMKV
+}
+
+// GetTrackOutputType returns the container for a video track file, when its filepath didn't select one
+func (p *Params) GetTrackOutputType(codec MimeType) OutputType {
+	switch p.conf.TrackContainer {
+	case config.TrackContainerMKV:
+		return OutputTypeMKV
+	case config.TrackContainerWebM:
+		if codec == MimeTypeVP8 {
+			return OutputTypeWebM
+		}
+	}
+
+	if codec == MimeTypeVP8 {
+		return OutputTypeIVF
+	}
+	return OutputTypeMP4
+}
+
 // used for sdk input source
 func (p *Params) UpdateOutputTypeFromCodecs(fileIdentifier string) error {
 	if p.OutputType == "" {
@@ -583,7 +1200,7 @@ func (p *Params) updateFilepath(identifier string) error {
 	if p.FileUpload == nil {
 		if dir != "" {
 			// create local directory
-			if err := os.MkdirAll(dir, 0755); err != nil {
+			if err := p.mkdirAll(dir); err != nil {
 				return err
 			}
 		}
@@ -594,7 +1211,7 @@ func (p *Params) updateFilepath(identifier string) error {
 		tempDir := path.Join(p.conf.LocalOutputDirectory, p.Info.EgressId)
 
 		// create temporary directory
-		if err := os.MkdirAll(tempDir, 0755); err != nil {
+		if err := p.mkdirAll(tempDir); err != nil {
 			return err
 		}
 
@@ -602,6 +1219,8 @@ func (p *Params) updateFilepath(identifier string) error {
 		p.LocalFilepath = path.Join(tempDir, filename)
 	}
 
+	p.updateImageParams(strings.TrimSuffix(p.LocalFilepath, string(ext)))
+
 	p.Logger.Debugw("writing to file", "filename", p.LocalFilepath)
 	return nil
 }
@@ -623,7 +1242,7 @@ func (p *Params) updatePrefixAndPlaylist(identifier string) error {
 	p.StoragePathPrefix, filePrefix = path.Split(p.LocalFilePrefix)
 	if p.FileUpload == nil {
 		if p.StoragePathPrefix != "" {
-			if err := os.MkdirAll(p.StoragePathPrefix, 0755); err != nil {
+			if err := p.mkdirAll(p.StoragePathPrefix); err != nil {
 				return err
 			}
 		}
@@ -632,26 +1251,272 @@ func (p *Params) updatePrefixAndPlaylist(identifier string) error {
 		// Prepend the configuration base directory and the egress Id
 		// os.ModeDir creates a directory with mode 000 when mapping the directory outside the container
 		tmpDir := path.Join(p.conf.LocalOutputDirectory, p.Info.EgressId)
-		if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		if err := p.mkdirAll(tmpDir); err != nil {
 			return err
 		}
 
+		if p.conf.Tmpfs.Directory != "" && !p.conf.Segments.InMemory {
+			// segments are written to tmpfs, and spill over to the local directory when it's full
+			p.SpillFilePrefix = path.Join(tmpDir, filePrefix)
+			tmpDir = path.Join(p.conf.Tmpfs.Directory, p.Info.EgressId)
+			if err := p.mkdirAll(tmpDir); err != nil {
+				return err
+			}
+		}
+
 		p.PlaylistFilename = path.Join(tmpDir, p.PlaylistFilename)
 		p.LocalFilePrefix = path.Join(tmpDir, filePrefix)
 	}
 	p.Logger.Debugw("writing to path", "prefix", p.LocalFilePrefix)
 
+	// the master playlist is the entry point for players, and references the media playlist
+	p.MasterPlaylistFilename = fmt.Sprintf("%s-master%s", strings.TrimSuffix(p.PlaylistFilename, string(ext)), ext)
+
+	p.UpdateSegmentOutputType()
+	p.ContentAddressed = p.conf.Segments.ContentAddressed
+
+	if p.conf.Segments.Encryption.Enabled {
+		p.SegmentEncryption = true
+		p.KeyURI = p.conf.Segments.Encryption.KeyURI
+		p.KeyRotation = p.conf.Segments.Encryption.KeyRotation
+	}
+
+	p.updateImageParams(p.LocalFilePrefix)
+
 	p.SegmentsInfo.PlaylistName = p.GetStorageFilepath(p.PlaylistFilename)
 	return nil
 }
 
+// UpdateSegmentOutputType picks the segment container, which depends on whether the egress has video, along with the
+// files named after it. Track egress only knows once it has subscribed to its track, so it's updated again then
+func (p *Params) UpdateSegmentOutputType() {
+	container := p.conf.Segments.Container
+	if !p.VideoEnabled {
+		container = p.conf.Segments.AudioOnlyContainer
+	}
+	if p.PlaylistCompatibility {
+		// legacy players only support ts segments
+		container = config.SegmentContainerTS
+	}
+	switch container {
+	case config.SegmentContainerFMP4:
+		p.SegmentOutputType = OutputTypeMP4
+	case config.SegmentContainerAAC:
+		// packed audio
+		p.SegmentOutputType = OutputTypeAAC
+	default:
+		p.SegmentOutputType = OutputTypeTS
+	}
+
+	// segments are uploaded straight from memory, except packed audio segments, which are always written to disk
+	p.SegmentsInMemory = p.FileUpload != nil && p.conf.Segments.InMemory && p.SegmentOutputType != OutputTypeAAC
+
+	p.InitSegmentFilename = ""
+	if p.SegmentOutputType == OutputTypeMP4 {
+		// fragmented mp4 segments share a single initialization section, referenced by EXT-X-MAP
+		p.InitSegmentFilename = fmt.Sprintf("%s_init%s", p.LocalFilePrefix, FileExtensionMP4)
+	}
+
+	p.SingleFileFilename = ""
+	if p.conf.Segments.SingleFile && !p.PlaylistCompatibility {
+		// the media file keeps growing, so it stays out of tmpfs
+		prefix := p.LocalFilePrefix
+		if p.SpillFilePrefix != "" {
+			prefix = p.SpillFilePrefix
+		}
+		singleFileExt := FileExtensionForOutputType[p.SegmentOutputType]
+		p.SingleFileFilename = prefix + string(singleFileExt)
+	}
+
+	p.TimedMetadata = p.conf.Segments.TimedMetadata && p.SegmentOutputType == OutputTypeTS
+}
+
+// updateImageParams sets up snapshots and previews, which are stored next to the file or segments
+func (p *Params) updateImageParams(localPrefix string) {
+	if !p.VideoEnabled {
+		return
+	}
+
+	if p.conf.Snapshots.Interval > 0 {
+		p.SnapshotInterval = p.conf.Snapshots.Interval
+		p.SnapshotType = OutputTypeJPEG
+		if p.conf.Snapshots.Format == config.SnapshotFormatPNG {
+			p.SnapshotType = OutputTypePNG
+		}
+		p.SnapshotWidth, p.SnapshotHeight = p.getScaledSize(p.conf.Snapshots.Width)
+		p.SnapshotPrefix = localPrefix + "_snapshot"
+	}
+
+	if p.conf.Previews.Interval > 0 {
+		p.PreviewInterval = p.conf.Previews.Interval
+		p.PreviewDuration = p.conf.Previews.Duration
+		p.PreviewFramerate = p.conf.Previews.Framerate
+		if p.PreviewFramerate > p.Framerate {
+			p.PreviewFramerate = p.Framerate
+		}
+		p.PreviewWidth, p.PreviewHeight = p.getScaledSize(p.conf.Previews.Width)
+		p.PreviewPrefix = localPrefix + "_preview"
+	}
+}
+
+// getScaledSize returns an even video size with the given width, or the output size if it's larger
+func (p *Params) getScaledSize(width int32) (int32, int32) {
+	if width == 0 || width > p.Width {
+		return p.Width, p.Height
+	}
+	height := width * p.Height / p.Width
+	return width - width%2, height - height%2
+}
+
+func getCaptionsFormat(conf *config.Config) string {
+	if !conf.Captions.Enabled {
+		return ""
+	}
+	return conf.Captions.Format
+}
+
+func getLoudnessTarget(conf *config.Config) float64 {
+	if !conf.Loudness.Enabled {
+		return 0
+	}
+	return conf.Loudness.Target
+}
+
+// GetSidecarFilepaths returns the local and storage paths for a file stored next to the recording, such as a report.
+// Stream outputs have nowhere to store them, and return empty paths
+func (p *Params) GetSidecarFilepaths(suffix string) (string, string) {
+	switch p.EgressType {
+	case EgressTypeFile:
+		localFilepath := strings.TrimSuffix(p.LocalFilepath, path.Ext(p.LocalFilepath)) + suffix
+		storageFilepath := strings.TrimSuffix(p.StorageFilepath, path.Ext(p.StorageFilepath)) + suffix
+		return localFilepath, storageFilepath
+	case EgressTypeSegmentedFile:
+		localFilepath := strings.TrimSuffix(p.PlaylistFilename, path.Ext(p.PlaylistFilename)) + suffix
+		return localFilepath, p.GetStorageFilepath(localFilepath)
+	default:
+		return "", ""
+	}
+}
+
+// GetImageStorageFilepath returns the storage path for a snapshot or preview, next to the file or segments
+func (p *Params) GetImageStorageFilepath(localFilepath string) string {
+	if p.EgressType == EgressTypeSegmentedFile {
+		return p.GetStorageFilepath(localFilepath)
+	}
+
+	dir, _ := path.Split(p.StorageFilepath)
+	_, filename := path.Split(localFilepath)
+	return path.Join(dir, filename)
+}
+
+// getStreamOutputType chooses the stream protocol based on the first url, since StreamProtocol only includes rtmp
+func getStreamOutputType(urls []string) OutputType {
+	if len(urls) > 0 {
+		return GetStreamOutputType(urls[0])
+	}
+	return OutputTypeRTMP
+}
+
+// GetStreamOutputType returns the protocol used for a stream url
+func GetStreamOutputType(url string) OutputType {
+	switch {
+	case strings.HasPrefix(url, "rtsp"):
+		return OutputTypeRTSP
+	case strings.HasPrefix(url, "rist"):
+		return OutputTypeRIST
+	case strings.HasPrefix(url, "srt"):
+		return OutputTypeSRT
+	case strings.HasPrefix(url, "ndi"):
+		return OutputTypeNDI
+	case strings.HasPrefix(url, "whip"):
+		return OutputTypeWHIP
+	default:
+		return OutputTypeRTMP
+	}
+}
+
+// GetStreamMux returns the container a stream protocol carries. Outputs using the same container share a muxer
+func GetStreamMux(outputType OutputType) StreamMux {
+	switch outputType {
+	case OutputTypeRTMP:
+		return StreamMuxFLV
+	case OutputTypeNDI:
+		return StreamMuxRaw
+	default:
+		return StreamMuxMPEGTS
+	}
+}
+
+func (p *Params) hasStreamMux(mux StreamMux) bool {
+	for _, m := range p.StreamMuxes {
+		if m == mux {
+			return true
+		}
+	}
+	return false
+}
+
+// isValidRistUrl checks for a host and an even port, since rist sends rtp and rtcp on adjacent ports
+func isValidRistUrl(rawUrl string) bool {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Scheme != "rist" || u.Hostname() == "" {
+		return false
+	}
+	if port := u.Port(); port != "" {
+		if n, err := strconv.Atoi(port); err != nil || n%2 != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// GetNDIName returns the name an ndi:// url is announced as on the network, such as "LiveKit Studio" for ndi://LiveKit%20Studio
+func GetNDIName(rawUrl string) string {
+	if !strings.HasPrefix(rawUrl, "ndi://") {
+		return ""
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(rawUrl, "ndi://"))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(name)
+}
+
 func (p *Params) VerifyUrl(url string) error {
 	var protocol, prefix string
 
-	switch p.OutputType {
+	outputType := p.OutputType
+	if p.EgressType == EgressTypeStream {
+		// urls added later need a muxer that's already running
+		outputType = GetStreamOutputType(url)
+		if !p.hasStreamMux(GetStreamMux(outputType)) {
+			return errors.ErrNotSupported(fmt.Sprintf("adding %s outputs to this egress", outputType))
+		}
+	}
+
+	switch outputType {
 	case OutputTypeRTMP:
 		protocol = "rtmp"
 		prefix = "rtmp"
+	case OutputTypeRTSP:
+		protocol = "rtsp"
+		prefix = "rtsp"
+	case OutputTypeSRT:
+		protocol = "srt"
+		prefix = "srt"
+	case OutputTypeWHIP:
+		protocol = "whip"
+		prefix = "whip"
+	case OutputTypeRIST:
+		if !isValidRistUrl(url) {
+			return errors.ErrInvalidUrl(url, "rist")
+		}
+		return nil
+	case OutputTypeNDI:
+		if GetNDIName(url) == "" {
+			return errors.ErrInvalidUrl(url, "ndi")
+		}
+		return nil
 	case OutputTypeRaw:
 		protocol = "websocket"
 		prefix = "ws"
@@ -667,13 +1532,54 @@ func (p *Params) VerifyUrl(url string) error {
 func (p *Params) GetSegmentOutputType() OutputType {
 	switch p.OutputType {
 	case OutputTypeHLS:
-		// HLS is always mpeg ts for now. We may implement fmp4 in the future
-		return OutputTypeTS
+		// HLS segments are either mpeg ts or fragmented mp4
+		return p.SegmentOutputType
 	default:
 		return p.OutputType
 	}
 }
 
+// GetSegmentFilepath returns the local path for a new segment
+func (p *Params) GetSegmentFilepath(index int) string {
+	prefix := p.LocalFilePrefix
+	if p.SpillFilePrefix != "" && p.tmpfsFull() {
+		prefix = p.SpillFilePrefix
+	}
+	return fmt.Sprintf("%s_%05d%s", prefix, index, p.GetSegmentFileExtension())
+}
+
+// GetKeyFilepath returns the local path for a segment encryption key
+func (p *Params) GetKeyFilepath(index int) string {
+	return fmt.Sprintf("%s_key_%05d.key", p.LocalFilePrefix, index)
+}
+
+func (p *Params) GetSegmentFileExtension() FileExtension {
+	if p.GetSegmentOutputType() == OutputTypeMP4 {
+		// fragmented mp4 media segments
+		return FileExtensionM4S
+	}
+	return FileExtensionForOutputType[p.GetSegmentOutputType()]
+}
+
+func (p *Params) tmpfsFull() bool {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(p.conf.Tmpfs.Directory, &stat); err != nil {
+		p.Logger.Errorw("could not read tmpfs usage", err)
+		return true
+	}
+
+	bsize := uint64(stat.Bsize)
+	used := (uint64(stat.Blocks) - uint64(stat.Bfree)) * bsize
+	available := uint64(stat.Bavail) * bsize
+
+	// leave room for the next segment
+	margin := uint64(64 << 20)
+	if p.conf.Tmpfs.SizeLimit > 0 && used+margin > uint64(p.conf.Tmpfs.SizeLimit)<<20 {
+		return true
+	}
+	return available < margin
+}
+
 func (p *SegmentedFileParams) GetStorageFilepath(filename string) string {
 	// Remove any path prepended to the filename
 	_, filename = path.Split(filename)
@@ -681,15 +1587,115 @@ func (p *SegmentedFileParams) GetStorageFilepath(filename string) string {
 	return path.Join(p.StoragePathPrefix, filename)
 }
 
-func (p *Params) GetSessionTimeout() time.Duration {
+// GetSessionTimeout returns how long the egress can run, and where the limit comes from.
+// The request's limit is used if it's lower than the session limit for the egress type
+func (p *Params) GetSessionTimeout() (time.Duration, string) {
+	var timeout time.Duration
 	switch p.EgressType {
 	case EgressTypeFile:
-		return p.conf.FileOutputMaxDuration
+		timeout = p.conf.FileOutputMaxDuration
 	case EgressTypeStream, EgressTypeWebsocket:
-		return p.conf.StreamOutputMaxDuration
+		timeout = p.conf.StreamOutputMaxDuration
 	case EgressTypeSegmentedFile:
-		return p.conf.SegmentOutputMaxDuration
+		timeout = p.conf.SegmentOutputMaxDuration
 	}
 
-	return 0
+	if p.RequestMaxDuration > 0 && (timeout == 0 || p.RequestMaxDuration < timeout) {
+		return p.RequestMaxDuration, p.RequestMaxDurationSource
+	}
+	return timeout, "session_limits"
+}
+
+// limitStreamDuration applies the session limit of a stream url's host
+func (p *Params) limitStreamDuration(rawUrl string) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return
+	}
+	if limit := p.StreamCaps[u.Hostname()]; limit != nil {
+		p.limitDuration(limit.MaxDuration, "stream host "+u.Hostname())
+	}
+}
+
+// limitDuration sets the request's session limit, keeping the lowest one
+func (p *Params) limitDuration(maxDuration time.Duration, source string) {
+	if maxDuration > 0 && (p.RequestMaxDuration == 0 || maxDuration < p.RequestMaxDuration) {
+		p.RequestMaxDuration = maxDuration
+		p.RequestMaxDurationSource = source
+	}
+}
+
+// MediaURI converts a local path to a file uri, leaving urls as they are
+func MediaURI(location string) (string, error) {
+	if strings.Contains(location, "://") {
+		return location, nil
+	}
+
+	abs, err := filepath.Abs(location)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: "file", Path: abs}).String(), nil
+}
+
+// updateTrackLayout reads a track composite's video track id, which can arrange several video tracks with the
+// pipeline's compositor when track layouts are enabled. The first track is the main one in pip and the leftmost in
+// side-by-side. The protocol has one video track id, so the layout is only read from it on nodes which opt in
+func (p *Params) updateTrackLayout() error {
+	if !p.conf.TrackLayouts || !strings.ContainsAny(p.VideoTrackID, ":,") {
+		return nil
+	}
+
+	layout, trackIDs, err := ParseTrackLayout(p.VideoTrackID)
+	if err != nil {
+		return err
+	}
+
+	p.Layout = layout
+	p.SDKComposite = true
+	p.CompositeVideoTrackIDs = trackIDs
+	p.VideoTrackID = trackIDs[0]
+	return nil
+}
+
+// ParseTrackLayout reads a track composite layout, "<layout>:<track id>,<track id>..." (e.g. pip:TR_main,TR_inset).
+// A list without a layout is shown in a grid
+func ParseTrackLayout(s string) (layout string, trackIDs []string, err error) {
+	layout = TrackLayoutGrid
+	if i := strings.Index(s, ":"); i >= 0 {
+		layout, s = s[:i], s[i+1:]
+	}
+	switch layout {
+	case TrackLayoutGrid, TrackLayoutSideBySide, TrackLayoutPiP:
+	default:
+		return "", nil, errors.ErrInvalidInput("layout")
+	}
+
+	seen := make(map[string]bool)
+	for _, trackID := range strings.Split(s, ",") {
+		trackID = strings.TrimSpace(trackID)
+		if trackID == "" || seen[trackID] {
+			return "", nil, errors.ErrInvalidInput("VideoTrackID")
+		}
+		seen[trackID] = true
+		trackIDs = append(trackIDs, trackID)
+	}
+	return layout, trackIDs, nil
+}
+
+// UsesSDKComposite returns true for room composites that don't need a browser. Audio-only composites are mixed,
+// and video-only grid layouts are composited by the pipeline. Custom templates always use a browser
+func UsesSDKComposite(req *livekit.RoomCompositeEgressRequest) bool {
+	if req.CustomBaseUrl != "" {
+		return false
+	}
+	return req.AudioOnly || (req.VideoOnly && strings.HasPrefix(req.Layout, "grid"))
+}
+
+// mkdirAll creates a local directory for the output, unless the params are only used for their storage config
+func (p *Params) mkdirAll(dir string) error {
+	if p.uploadOnly {
+		return nil
+	}
+	return os.MkdirAll(dir, 0755)
 }
@@ -0,0 +1,202 @@
+package params
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/livekit/protocol/livekit"
+
+	"github.com/livekit/egress/pkg/config"
+)
+
+func TestParseTrackLayout(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		value    string
+		layout   string
+		trackIDs []string
+		err      bool
+	}{
+		{name: "pip", value: "pip:TR_main,TR_inset", layout: TrackLayoutPiP, trackIDs: []string{"TR_main", "TR_inset"}},
+		{name: "side by side", value: "side-by-side:TR_a,TR_b,TR_c", layout: TrackLayoutSideBySide, trackIDs: []string{"TR_a", "TR_b", "TR_c"}},
+		{name: "grid", value: "grid:TR_a", layout: TrackLayoutGrid, trackIDs: []string{"TR_a"}},
+		{name: "no layout", value: "TR_a,TR_b", layout: TrackLayoutGrid, trackIDs: []string{"TR_a", "TR_b"}},
+		{name: "spaces", value: "pip: TR_a , TR_b", layout: TrackLayoutPiP, trackIDs: []string{"TR_a", "TR_b"}},
+		{name: "unknown layout", value: "mosaic:TR_a,TR_b", err: true},
+		{name: "empty track", value: "pip:TR_a,,TR_b", err: true},
+		{name: "no tracks", value: "pip:", err: true},
+		{name: "duplicate", value: "grid:TR_a,TR_a", err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			layout, trackIDs, err := ParseTrackLayout(test.value)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.layout, layout)
+			require.Equal(t, test.trackIDs, trackIDs)
+		})
+	}
+}
+
+func TestUpdateTrackLayout(t *testing.T) {
+	for _, test := range []struct {
+		name         string
+		enabled      bool
+		videoTrackID string
+		sdkComposite bool
+		trackIDs     []string
+	}{
+		{name: "disabled", videoTrackID: "pip:TR_a,TR_b"},
+		{name: "single track", enabled: true, videoTrackID: "TR_a"},
+		{name: "enabled", enabled: true, videoTrackID: "pip:TR_a,TR_b", sdkComposite: true, trackIDs: []string{"TR_a", "TR_b"}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Params{conf: &config.Config{TrackLayouts: test.enabled}, SourceParams: SourceParams{VideoTrackID: test.videoTrackID}}
+			require.NoError(t, p.updateTrackLayout())
+			require.Equal(t, test.sdkComposite, p.SDKComposite)
+			require.Equal(t, test.trackIDs, p.CompositeVideoTrackIDs)
+			if !test.sdkComposite {
+				require.Equal(t, test.videoTrackID, p.VideoTrackID)
+			}
+		})
+	}
+}
+
+func TestWithDefaultCredentials(t *testing.T) {
+	s3Defaults := &livekit.S3Upload{
+		AccessKey: "default-key",
+		Secret:    "default-secret",
+		Region:    "us-east-1",
+		Endpoint:  "https://s3.example.com",
+		Bucket:    "default-bucket",
+	}
+	azureDefaults := &livekit.AzureBlobUpload{
+		AccountName:   "default-account",
+		AccountKey:    "default-account-key",
+		ContainerName: "default-container",
+	}
+	gcpDefaults := &livekit.GCPUpload{
+		Credentials: []byte("default-credentials"),
+		Bucket:      "default-bucket",
+	}
+
+	for _, test := range []struct {
+		name     string
+		upload   interface{}
+		defaults interface{}
+		expected interface{}
+	}{
+		{
+			name:     "s3 bucket only",
+			upload:   &livekit.S3Upload{Bucket: "bucket"},
+			defaults: s3Defaults,
+			expected: &livekit.S3Upload{
+				AccessKey: "default-key",
+				Secret:    "default-secret",
+				Region:    "us-east-1",
+				Endpoint:  "https://s3.example.com",
+				Bucket:    "bucket",
+			},
+		},
+		{
+			name:     "s3 same endpoint",
+			upload:   &livekit.S3Upload{Endpoint: "https://s3.example.com", Region: "eu-west-1"},
+			defaults: s3Defaults,
+			expected: &livekit.S3Upload{
+				AccessKey: "default-key",
+				Secret:    "default-secret",
+				Region:    "eu-west-1",
+				Endpoint:  "https://s3.example.com",
+				Bucket:    "default-bucket",
+			},
+		},
+		{
+			name:     "s3 endpoint mismatch",
+			upload:   &livekit.S3Upload{Endpoint: "https://attacker.example", Bucket: "bucket"},
+			defaults: s3Defaults,
+			expected: &livekit.S3Upload{Endpoint: "https://attacker.example", Bucket: "bucket"},
+		},
+		{
+			name:     "s3 request credentials",
+			upload:   &livekit.S3Upload{AccessKey: "key", Secret: "secret", Bucket: "bucket"},
+			defaults: s3Defaults,
+			expected: &livekit.S3Upload{AccessKey: "key", Secret: "secret", Bucket: "bucket"},
+		},
+		{
+			name:     "s3 no defaults",
+			upload:   &livekit.S3Upload{Bucket: "bucket"},
+			expected: &livekit.S3Upload{Bucket: "bucket"},
+		},
+		{
+			name:     "s3 other defaults",
+			upload:   &livekit.S3Upload{Bucket: "bucket"},
+			defaults: gcpDefaults,
+			expected: &livekit.S3Upload{Bucket: "bucket"},
+		},
+		{
+			name:     "azure container only",
+			upload:   &livekit.AzureBlobUpload{ContainerName: "container"},
+			defaults: azureDefaults,
+			expected: &livekit.AzureBlobUpload{
+				AccountName:   "default-account",
+				AccountKey:    "default-account-key",
+				ContainerName: "container",
+			},
+		},
+		{
+			name:     "azure account mismatch",
+			upload:   &livekit.AzureBlobUpload{AccountName: "attacker", ContainerName: "container"},
+			defaults: azureDefaults,
+			expected: &livekit.AzureBlobUpload{AccountName: "attacker", ContainerName: "container"},
+		},
+		{
+			name:     "gcp bucket only",
+			upload:   &livekit.GCPUpload{Bucket: "bucket"},
+			defaults: gcpDefaults,
+			expected: &livekit.GCPUpload{Credentials: []byte("default-credentials"), Bucket: "bucket"},
+		},
+		{
+			name:     "gcp request credentials",
+			upload:   &livekit.GCPUpload{Credentials: []byte("credentials")},
+			defaults: gcpDefaults,
+			expected: &livekit.GCPUpload{Credentials: []byte("credentials")},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			// the request's upload is returned as part of EgressInfo, so it's never modified
+			requested := proto.Clone(test.upload.(proto.Message))
+			merged := withDefaultCredentials(test.upload, test.defaults)
+			require.True(t, proto.Equal(test.expected.(proto.Message), merged.(proto.Message)), "got %v", merged)
+			require.True(t, proto.Equal(requested, test.upload.(proto.Message)))
+		})
+	}
+}
+
+func TestSegmentKeyFrameInterval(t *testing.T) {
+	for _, test := range []struct {
+		name                 string
+		segmentDuration      int
+		firstSegmentDuration int
+		framerate            int32
+		expected             int32
+	}{
+		{name: "no first segment", segmentDuration: 6, framerate: 30, expected: 180},
+		{name: "same duration", segmentDuration: 6, firstSegmentDuration: 6, framerate: 30, expected: 180},
+		{name: "shorter first segment", segmentDuration: 6, firstSegmentDuration: 2, framerate: 30, expected: 60},
+		{name: "common divisor", segmentDuration: 6, firstSegmentDuration: 4, framerate: 25, expected: 50},
+		{name: "coprime", segmentDuration: 3, firstSegmentDuration: 2, framerate: 60, expected: 60},
+		{name: "longer first segment", segmentDuration: 4, firstSegmentDuration: 10, framerate: 30, expected: 60},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			p := &Params{}
+			p.SegmentDuration = test.segmentDuration
+			p.FirstSegmentDuration = test.firstSegmentDuration
+			p.Framerate = test.framerate
+			require.Equal(t, test.expected, p.segmentKeyFrameInterval())
+		})
+	}
+}
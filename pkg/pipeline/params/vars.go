@@ -5,14 +5,21 @@ type Profile string
 type EgressType string
 type OutputType string
 type FileExtension string
+type StreamMux string
 
 const (
 	// input types
 	MimeTypeAAC  MimeType = "audio/aac"
 	MimeTypeOpus MimeType = "audio/opus"
+	MimeTypeMP3  MimeType = "audio/mpeg"
 	MimeTypeRaw  MimeType = "audio/x-raw"
 	MimeTypeH264 MimeType = "video/h264"
+	MimeTypeH265 MimeType = "video/h265"
 	MimeTypeVP8  MimeType = "video/vp8"
+	MimeTypeVP9  MimeType = "video/vp9"
+
+	// uncompressed video, for ndi
+	MimeTypeRawVideo MimeType = "video/x-raw"
 
 	// video profiles
 	ProfileBaseline Profile = "baseline"
@@ -26,33 +33,81 @@ const (
 	EgressTypeSegmentedFile EgressType = "segments"
 
 	// output types
-	OutputTypeRaw  OutputType = "audio/x-raw"
-	OutputTypeOGG  OutputType = "audio/ogg"
-	OutputTypeIVF  OutputType = "video/x-ivf"
-	OutputTypeMP4  OutputType = "video/mp4"
-	OutputTypeTS   OutputType = "video/mp2t"
-	OutputTypeWebM OutputType = "video/webm"
-	OutputTypeRTMP OutputType = "rtmp"
-	OutputTypeHLS  OutputType = "application/x-mpegurl"
+	OutputTypeRaw    OutputType = "audio/x-raw"
+	OutputTypeOGG    OutputType = "audio/ogg"
+	OutputTypeAAC    OutputType = "audio/aac"
+	OutputTypeMP3    OutputType = "audio/mpeg"
+	OutputTypeWAV    OutputType = "audio/x-wav"
+	OutputTypeIVF    OutputType = "video/x-ivf"
+	OutputTypeMP4    OutputType = "video/mp4"
+	OutputTypeTS     OutputType = "video/mp2t"
+	OutputTypeWebM   OutputType = "video/webm"
+	OutputTypeMKV    OutputType = "video/x-matroska"
+	OutputTypeRTMP   OutputType = "rtmp"
+	OutputTypeRTSP   OutputType = "rtsp"
+	OutputTypeRIST   OutputType = "rist"
+	OutputTypeSRT    OutputType = "srt"
+	OutputTypeWHIP   OutputType = "whip"
+	OutputTypeNDI    OutputType = "ndi"
+	OutputTypeHLS    OutputType = "application/x-mpegurl"
+	OutputTypeKey    OutputType = "application/octet-stream" // hls segment keys
+	OutputTypeJSON   OutputType = "application/json"         // perf reports
+	OutputTypeJSONL  OutputType = "application/x-ndjson"     // data message captures
+	OutputTypeVTT    OutputType = "text/vtt"                 // captions
+	OutputTypeSubRip OutputType = "application/x-subrip"     // captions
+	OutputTypeTXT    OutputType = "text/plain"               // frozen pipeline diagnostics
+	OutputTypeJPEG   OutputType = "image/jpeg"               // snapshots
+	OutputTypePNG    OutputType = "image/png"                // snapshots
+	OutputTypeGIF    OutputType = "image/gif"                // previews
+
+	// containers shared by stream outputs
+	StreamMuxFLV    StreamMux = "flv"
+	StreamMuxMPEGTS StreamMux = "mpegts"
+	StreamMuxRaw    StreamMux = "raw"
+
+	// bucket or container name prefix selecting a configured storage profile
+	StorageProfilePrefix = "profile:"
+
+	// track composite layouts, selected by a "<layout>:" prefix on the video track id
+	TrackLayoutGrid       = "grid"
+	TrackLayoutSideBySide = "side-by-side"
+	TrackLayoutPiP        = "pip"
 
 	// file extensions
 	FileExtensionRaw  = ".raw"
 	FileExtensionOGG  = ".ogg"
+	FileExtensionAAC  = ".aac"
+	FileExtensionMP3  = ".mp3"
+	FileExtensionWAV  = ".wav"
 	FileExtensionIVF  = ".ivf"
 	FileExtensionMP4  = ".mp4"
 	FileExtensionTS   = ".ts"
 	FileExtensionWebM = ".webm"
+	FileExtensionMKV  = ".mkv"
 	FileExtensionM3U8 = ".m3u8"
+	FileExtensionM4S  = ".m4s"
+	FileExtensionJPEG = ".jpg"
+	FileExtensionPNG  = ".png"
+	FileExtensionGIF  = ".gif"
 )
 
 var (
 	DefaultAudioCodecs = map[OutputType]MimeType{
 		OutputTypeRaw:  MimeTypeRaw,
 		OutputTypeOGG:  MimeTypeOpus,
+		OutputTypeAAC:  MimeTypeAAC,
+		OutputTypeMP3:  MimeTypeMP3,
+		OutputTypeWAV:  MimeTypeRaw,
 		OutputTypeMP4:  MimeTypeAAC,
 		OutputTypeTS:   MimeTypeAAC,
 		OutputTypeWebM: MimeTypeOpus,
+		OutputTypeMKV:  MimeTypeAAC,
 		OutputTypeRTMP: MimeTypeAAC,
+		OutputTypeRTSP: MimeTypeAAC,
+		OutputTypeRIST: MimeTypeAAC,
+		OutputTypeSRT:  MimeTypeAAC,
+		OutputTypeWHIP: MimeTypeAAC,
+		OutputTypeNDI:  MimeTypeRaw,
 		OutputTypeHLS:  MimeTypeAAC,
 	}
 
@@ -61,37 +116,76 @@ var (
 		OutputTypeMP4:  MimeTypeH264,
 		OutputTypeTS:   MimeTypeH264,
 		OutputTypeWebM: MimeTypeVP8,
+		OutputTypeMKV:  MimeTypeH264,
 		OutputTypeRTMP: MimeTypeH264,
+		OutputTypeRTSP: MimeTypeH264,
+		OutputTypeRIST: MimeTypeH264,
+		OutputTypeSRT:  MimeTypeH264,
+		OutputTypeWHIP: MimeTypeH264,
+		OutputTypeNDI:  MimeTypeRawVideo,
 		OutputTypeHLS:  MimeTypeH264,
 	}
 
 	FileExtensions = map[FileExtension]struct{}{
 		FileExtensionRaw:  {},
 		FileExtensionOGG:  {},
+		FileExtensionAAC:  {},
+		FileExtensionMP3:  {},
+		FileExtensionWAV:  {},
 		FileExtensionIVF:  {},
 		FileExtensionMP4:  {},
 		FileExtensionTS:   {},
 		FileExtensionWebM: {},
+		FileExtensionMKV:  {},
 		FileExtensionM3U8: {},
+		FileExtensionM4S:  {},
 	}
 
 	FileExtensionForOutputType = map[OutputType]FileExtension{
 		OutputTypeRaw:  FileExtensionRaw,
 		OutputTypeOGG:  FileExtensionOGG,
+		OutputTypeAAC:  FileExtensionAAC,
+		OutputTypeMP3:  FileExtensionMP3,
+		OutputTypeWAV:  FileExtensionWAV,
 		OutputTypeIVF:  FileExtensionIVF,
 		OutputTypeMP4:  FileExtensionMP4,
 		OutputTypeTS:   FileExtensionTS,
 		OutputTypeWebM: FileExtensionWebM,
+		OutputTypeMKV:  FileExtensionMKV,
 		OutputTypeHLS:  FileExtensionM3U8,
+		OutputTypeJPEG: FileExtensionJPEG,
+		OutputTypePNG:  FileExtensionPNG,
+		OutputTypeGIF:  FileExtensionGIF,
+	}
+
+	// file types without a livekit.EncodedFileType, selected using the requested filepath
+	outputTypeForFileExtension = map[FileExtension]OutputType{
+		FileExtensionWebM: OutputTypeWebM,
+		FileExtensionMKV:  OutputTypeMKV,
+		FileExtensionAAC:  OutputTypeAAC,
+		FileExtensionMP3:  OutputTypeMP3,
+		FileExtensionWAV:  OutputTypeWAV,
+		FileExtensionTS:   OutputTypeTS,
 	}
 
 	codecCompatibility = map[OutputType]map[MimeType]bool{
 		OutputTypeRaw: {
-			MimeTypeRaw: true,
+			MimeTypeRaw:  true,
+			MimeTypeVP8:  true,
+			MimeTypeH264: true,
 		},
 		OutputTypeOGG: {
 			MimeTypeOpus: true,
 		},
+		OutputTypeAAC: {
+			MimeTypeAAC: true,
+		},
+		OutputTypeMP3: {
+			MimeTypeMP3: true,
+		},
+		OutputTypeWAV: {
+			MimeTypeRaw: true,
+		},
 		OutputTypeIVF: {
 			MimeTypeVP8: true,
 		},
@@ -99,15 +193,26 @@ var (
 			MimeTypeAAC:  true,
 			MimeTypeOpus: true,
 			MimeTypeH264: true,
+			MimeTypeH265: true,
 		},
 		OutputTypeTS: {
 			MimeTypeAAC:  true,
 			MimeTypeOpus: true,
 			MimeTypeH264: true,
+			MimeTypeH265: true,
 		},
 		OutputTypeWebM: {
 			MimeTypeOpus: true,
 			MimeTypeVP8:  true,
+			MimeTypeVP9:  true,
+		},
+		OutputTypeMKV: {
+			MimeTypeAAC:  true,
+			MimeTypeOpus: true,
+			MimeTypeH264: true,
+			MimeTypeH265: true,
+			MimeTypeVP8:  true,
+			MimeTypeVP9:  true,
 		},
 
 		OutputTypeRTMP: {
@@ -115,9 +220,36 @@ var (
 			MimeTypeH264: true,
 		},
 
+		OutputTypeRTSP: {
+			MimeTypeAAC:  true,
+			MimeTypeH264: true,
+		},
+
+		OutputTypeRIST: {
+			MimeTypeAAC:  true,
+			MimeTypeH264: true,
+		},
+
+		OutputTypeSRT: {
+			MimeTypeAAC:  true,
+			MimeTypeH264: true,
+		},
+
+		// aac is transcoded to opus by the whip sink
+		OutputTypeWHIP: {
+			MimeTypeAAC:  true,
+			MimeTypeH264: true,
+		},
+
+		OutputTypeNDI: {
+			MimeTypeRaw:      true,
+			MimeTypeRawVideo: true,
+		},
+
 		OutputTypeHLS: {
 			MimeTypeAAC:  true,
 			MimeTypeH264: true,
+			MimeTypeH265: true,
 		},
 	}
 )
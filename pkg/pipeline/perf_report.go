@@ -0,0 +1,280 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/mackerelio/go-osstat/cpu"
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/stats"
+)
+
+const (
+	perfSampleInterval = time.Second
+	perfReportSuffix   = ".perf.json"
+)
+
+// perfReport collects pipeline health over the course of an egress, to be stored alongside the recording
+type perfReport struct {
+	mu       sync.Mutex
+	done     chan struct{}
+	stopOnce sync.Once
+
+	EgressID    string                `json:"egress_id"`
+	StartedAt   time.Time             `json:"started_at"`
+	EndedAt     time.Time             `json:"ended_at"`
+	CPU         []perfCPUSample       `json:"cpu"`
+	Queues      map[string]*perfQueue `json:"queues"`
+	Frames      perfFrames            `json:"frames"`
+	Samples     perfSamples           `json:"audio_samples"`
+	Uploads     []perfUpload          `json:"uploads"`
+	UploadTotal perfUploadTotal       `json:"upload_total"`
+	Tracks      []perfTrack           `json:"tracks,omitempty"`
+	Error       string                `json:"error,omitempty"`
+	EndedReason string                `json:"ended_reason,omitempty"`
+}
+
+type perfCPUSample struct {
+	Time       time.Time `json:"time"`
+	Process    float64   `json:"process"` // cores used by the handler
+	SystemIdle float64   `json:"system_idle"`
+}
+
+// perfQueue tracks the high-water marks of a queue element
+type perfQueue struct {
+	MaxBuffers uint          `json:"max_buffers"`
+	MaxTime    time.Duration `json:"max_time"`
+}
+
+type perfFrames struct {
+	Dropped    uint64 `json:"dropped"`
+	Duplicated uint64 `json:"duplicated"`
+}
+
+// perfSamples counts the audio samples audiorate added and dropped, correcting drift between the audio and its timestamps
+type perfSamples struct {
+	Added   uint64 `json:"added"`
+	Dropped uint64 `json:"dropped"`
+}
+
+// perfTrack records when a track first produced media, relative to the start of the recording
+type perfTrack struct {
+	TrackID   string        `json:"track_id"`
+	StartedAt time.Time     `json:"started_at"`
+	Offset    time.Duration `json:"offset"`
+}
+
+type perfUpload struct {
+	Time       time.Time     `json:"time"`
+	Location   string        `json:"location"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	Retries    int           `json:"retries"`
+	ErrorClass string        `json:"error_class,omitempty"`
+}
+
+// perfUploadTotal is the egress's upload summary
+type perfUploadTotal struct {
+	Uploads  int32         `json:"uploads"`
+	Failures int32         `json:"failures"`
+	Bytes    int64         `json:"bytes"`
+	Duration time.Duration `json:"duration"`
+}
+
+func newPerfReport(egressID string) *perfReport {
+	return &perfReport{
+		done:     make(chan struct{}),
+		EgressID: egressID,
+		Queues:   make(map[string]*perfQueue),
+	}
+}
+
+// monitor samples cpu and queue levels until stop is called
+func (r *perfReport) monitor(pipeline *gst.Pipeline) {
+	r.mu.Lock()
+	r.StartedAt = time.Now()
+	r.mu.Unlock()
+
+	lastUsage, lastTime := processCPUTime(), time.Now()
+	lastSystem, _ := cpu.Get()
+
+	ticker := time.NewTicker(perfSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.done:
+			return
+		case now := <-ticker.C:
+			sample := perfCPUSample{Time: now}
+
+			usage := processCPUTime()
+			sample.Process = float64(usage-lastUsage) / float64(now.Sub(lastTime))
+			lastUsage, lastTime = usage, now
+
+			if system, err := cpu.Get(); err == nil && lastSystem != nil {
+				if total := float64(system.Total - lastSystem.Total); total > 0 {
+					sample.SystemIdle = float64(system.Idle-lastSystem.Idle) / total
+				}
+				lastSystem = system
+			}
+
+			r.mu.Lock()
+			r.CPU = append(r.CPU, sample)
+			r.mu.Unlock()
+
+			r.sampleQueues(pipeline)
+		}
+	}
+}
+
+func (r *perfReport) sampleQueues(pipeline *gst.Pipeline) {
+	elements, err := pipeline.GetElementsRecursive()
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, e := range elements {
+		if e.GetFactory().GetName() != "queue" {
+			continue
+		}
+
+		q := r.Queues[e.GetName()]
+		if q == nil {
+			q = &perfQueue{}
+			r.Queues[e.GetName()] = q
+		}
+		if buffers, err := e.GetProperty("current-level-buffers"); err == nil {
+			if b, ok := buffers.(uint); ok && b > q.MaxBuffers {
+				q.MaxBuffers = b
+			}
+		}
+		if levelTime, err := e.GetProperty("current-level-time"); err == nil {
+			if t, ok := levelTime.(uint64); ok && time.Duration(t) > q.MaxTime {
+				q.MaxTime = time.Duration(t)
+			}
+		}
+	}
+}
+
+// stop ends sampling and reads dropped and duplicated frames from any videorate elements, and added and dropped
+// samples from any audiorate elements
+func (r *perfReport) stop(pipeline *gst.Pipeline) {
+	r.stopOnce.Do(func() {
+		close(r.done)
+
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		r.EndedAt = time.Now()
+		elements, err := pipeline.GetElementsRecursive()
+		if err != nil {
+			return
+		}
+		for _, e := range elements {
+			switch e.GetFactory().GetName() {
+			case "videorate":
+				if dropped, err := e.GetProperty("drop"); err == nil {
+					if d, ok := dropped.(uint64); ok {
+						r.Frames.Dropped += d
+					}
+				}
+				if duplicated, err := e.GetProperty("duplicate"); err == nil {
+					if d, ok := duplicated.(uint64); ok {
+						r.Frames.Duplicated += d
+					}
+				}
+			case "audiorate":
+				if added, err := e.GetProperty("add"); err == nil {
+					if a, ok := added.(uint64); ok {
+						r.Samples.Added += a
+					}
+				}
+				if dropped, err := e.GetProperty("drop"); err == nil {
+					if d, ok := dropped.(uint64); ok {
+						r.Samples.Dropped += d
+					}
+				}
+			}
+		}
+	})
+}
+
+func (r *perfReport) addUpload(metrics *stats.UploadMetrics) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Uploads = append(r.Uploads, perfUpload{
+		Time:       time.Now(),
+		Location:   metrics.Location,
+		Bytes:      metrics.Bytes,
+		Duration:   metrics.Duration,
+		Retries:    metrics.Retries,
+		ErrorClass: metrics.ErrorClass,
+	})
+}
+
+func (r *perfReport) setTracks(tracks []perfTrack) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Tracks = tracks
+}
+
+func (r *perfReport) marshal() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return json.MarshalIndent(r, "", "  ")
+}
+
+// processCPUTime returns user and system time used by the handler and its children
+func processCPUTime() time.Duration {
+	var total time.Duration
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var usage syscall.Rusage
+		if err := syscall.Getrusage(who, &usage); err == nil {
+			total += time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+		}
+	}
+	return total
+}
+
+// storePerfReport writes the report next to the recording. Stream outputs have nowhere to store it, so it's logged instead
+func (p *Pipeline) storePerfReport(ctx context.Context) {
+	p.perf.stop(p.pipeline)
+	p.perf.mu.Lock()
+	p.perf.Error = p.Info.Error
+	p.perf.EndedReason = p.EndedReason()
+	p.perf.UploadTotal = p.uploadTotal()
+	p.perf.mu.Unlock()
+
+	report, err := p.perf.marshal()
+	if err != nil {
+		p.Logger.Errorw("could not marshal perf report", err)
+		return
+	}
+
+	localFilepath, storageFilepath := p.GetSidecarFilepaths(perfReportSuffix)
+	if localFilepath == "" {
+		p.Logger.Infow("perf report", "report", string(report))
+		return
+	}
+
+	if err = os.WriteFile(localFilepath, report, 0644); err != nil {
+		p.Logger.Errorw("could not write perf report", err)
+		return
+	}
+	if _, _, err = p.storeFile(ctx, localFilepath, storageFilepath, params.OutputTypeJSON); err != nil {
+		p.Logger.Errorw("could not store perf report", err)
+	}
+}
@@ -1,10 +1,16 @@
 package pipeline
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -23,20 +29,33 @@ import (
 	"github.com/livekit/egress/pkg/pipeline/params"
 	"github.com/livekit/egress/pkg/pipeline/sink"
 	"github.com/livekit/egress/pkg/pipeline/source"
+	"github.com/livekit/egress/pkg/stats"
 )
 
 const (
 	pipelineSource    = "pipeline"
 	fileKey           = "file"
-	eosTimeout        = time.Second * 15
 	maxPendingUploads = 100
 
 	fragmentOpenedMessage = "splitmuxsink-fragment-opened"
 	fragmentClosedMessage = "splitmuxsink-fragment-closed"
 	fragmentLocation      = "location"
 	fragmentRunningTime   = "running-time"
+)
 
-	elementGstRtmp2Sink = "GstRtmp2Sink"
+// Reasons an egress ended, distinct from any error text.
+// Sources can also end a recording with their own reason, such as source.EndReasonTrackEnded
+const (
+	EndReasonAPIStop        = "API_STOP"
+	EndReasonShutdown       = "SHUTDOWN"
+	EndReasonRoomClosed     = "ROOM_CLOSED"
+	EndReasonSessionLimit   = "SESSION_LIMIT"
+	EndReasonStreamsRemoved = "STREAMS_REMOVED"
+	EndReasonError          = "ERROR"
+	EndReasonNotStarted     = "NOT_STARTED"
+	EndReasonAborted        = "ABORTED"
+	EndReasonHandlerExited  = "HANDLER_EXITED"
+	EndReasonAdminStop      = "ADMIN_STOP"
 )
 
 type Pipeline struct {
@@ -49,26 +68,59 @@ type Pipeline struct {
 	loop     *glib.MainLoop
 
 	// internal
-	mu                  sync.Mutex
-	playing             bool
-	startedAt           map[string]int64
-	streamErrors        map[string]chan error
-	closed              chan struct{}
-	closedOnce          sync.Once
-	eosTimer            *time.Timer
-	sessionTimeoutTimer *time.Timer
-	timedOut            atomic.Bool
-	playlistWriter      *sink.PlaylistWriter
-	endedSegments       chan segmentUpdate
-	segmentsWg          sync.WaitGroup
+	mu                   sync.Mutex
+	playing              bool
+	startedAt            map[string]int64
+	streamErrors         map[string]chan error
+	failedStreams        map[string]bool // urls which failed while streaming
+	streamReconnects     map[string]int  // times each url was added again after failing
+	closed               chan struct{}
+	closedOnce           sync.Once
+	eosTimer             *time.Timer // guarded by mu, with eosReceived
+	eosReceived          bool
+	sessionTimeoutTimer  *time.Timer
+	timedOut             atomic.Bool
+	endedReasonMu        sync.Mutex
+	endedReason          string
+	playlistWriter       *sink.PlaylistWriter
+	endedSegments        chan segmentUpdate
+	segmentsWg           sync.WaitGroup
+	segmentsOpened       int
+	segmentsClosed       int
+	initSegmentStored    bool
+	singleFileSize       int64
+	masterPlaylistStored bool
+	perf                 *perfReport
+	failover             *segmentFailover
+	timedMetadata        *timedMetadata
+	imagesWg             sync.WaitGroup
+	snapshotCount        atomic.Int32
+	previewCount         atomic.Int32
+	deferUpload          bool // leave the file upload to the service
+	uploadDeferred       bool
+	aborted              atomic.Bool
+	finalizing           atomic.Bool // frozen, but finishing what was written
+	storedMu             sync.Mutex
+	stored               []storedFile
+	panicMu              sync.Mutex
+	panicErr             string // from a panic recovered outside of Run
+
+	// upload summary
+	uploadCount    atomic.Int32
+	uploadFailures atomic.Int32
+	uploadBytes    atomic.Int64
+	uploadDuration atomic.Duration
 
 	// callbacks
 	onStatusUpdate func(context.Context, *livekit.EgressInfo)
+	onUpload       func(*stats.UploadMetrics)
+	onStreamHealth func(string, []*stats.StreamHealth)
 }
 
 type segmentUpdate struct {
 	endTime   int64
 	localPath string
+	data      []byte // segment contents, when segments are kept in memory
 }
 
 func New(ctx context.Context, conf *config.Config, p *params.Params) (*Pipeline, error) {
@@ -122,7 +174,16 @@ func New(ctx context.Context, conf *config.Config, p *params.Params) (*Pipeline,
 			return nil, err
 		}
 		// link bins
-		if err = in.Bin().Link(out.Element()); err != nil {
+		if len(p.StreamMuxes) > 1 {
+			// each container has its own pads
+			for _, m := range p.StreamMuxes {
+				srcPad := in.Element().GetStaticPad(fmt.Sprintf("src_%s", m))
+				sinkPad := out.Element().GetStaticPad(fmt.Sprintf("sink_%s", m))
+				if linkReturn := srcPad.Link(sinkPad); linkReturn != gst.PadLinkOK {
+					return nil, errors.ErrPadLinkFailed(string(m), linkReturn.String())
+				}
+			}
+		} else if err = in.Bin().Link(out.Element()); err != nil {
 			return nil, err
 		}
 	}
@@ -133,17 +194,44 @@ func New(ctx context.Context, conf *config.Config, p *params.Params) (*Pipeline,
 		if err != nil {
 			return nil, err
 		}
+
+		// the master playlist describes the video as it was encoded
+		in.OnEncodedVideo(func(caps *gst.Caps, keyframe []byte) {
+			if err := playlistWriter.SetVideoFormat(getVideoFormat(p.VideoCodec, caps, keyframe)); err != nil {
+				p.Logger.Errorw("could not update master playlist", err)
+			}
+		})
+	}
+
+	var perf *perfReport
+	if p.PerfReport {
+		perf = newPerfReport(p.Info.EgressId)
+	}
+
+	var failover *segmentFailover
+	if p.FailoverUpload != nil {
+		failover = newSegmentFailover(p)
+	}
+
+	var metadata *timedMetadata
+	if p.TimedMetadata {
+		metadata = newTimedMetadata()
 	}
 
 	return &Pipeline{
-		Params:         p,
-		pipeline:       pipeline,
-		in:             in,
-		out:            out,
-		playlistWriter: playlistWriter,
-		startedAt:      make(map[string]int64),
-		streamErrors:   make(map[string]chan error),
-		closed:         make(chan struct{}),
+		Params:           p,
+		pipeline:         pipeline,
+		in:               in,
+		out:              out,
+		playlistWriter:   playlistWriter,
+		perf:             perf,
+		failover:         failover,
+		timedMetadata:    metadata,
+		startedAt:        make(map[string]int64),
+		streamErrors:     make(map[string]chan error),
+		failedStreams:    make(map[string]bool),
+		streamReconnects: make(map[string]int),
+		closed:           make(chan struct{}),
 	}, nil
 }
 
@@ -151,11 +239,39 @@ func (p *Pipeline) GetInfo() *livekit.EgressInfo {
 	return p.Info
 }
 
+// EndedReason returns why the egress ended, or an empty string if it hasn't
+func (p *Pipeline) EndedReason() string {
+	p.endedReasonMu.Lock()
+	defer p.endedReasonMu.Unlock()
+
+	return p.endedReason
+}
+
+// setEndedReason records the first reason given, since anything after it is a consequence of the egress ending
+func (p *Pipeline) setEndedReason(reason string) {
+	p.endedReasonMu.Lock()
+	defer p.endedReasonMu.Unlock()
+
+	if p.endedReason == "" {
+		p.endedReason = reason
+		p.Logger.Debugw("egress ending", "reason", reason)
+	}
+}
+
 func (p *Pipeline) OnStatusUpdate(f func(context.Context, *livekit.EgressInfo)) {
 	p.onStatusUpdate = f
 }
 
-func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
+func (p *Pipeline) OnUpload(f func(*stats.UploadMetrics)) {
+	p.onUpload = f
+}
+
+// OnStreamHealth is called with the health of every stream output, at the configured interval
+func (p *Pipeline) OnStreamHealth(f func(string, []*stats.StreamHealth)) {
+	p.onStreamHealth = f
+}
+
+func (p *Pipeline) Run(ctx context.Context) (info *livekit.EgressInfo) {
 	ctx, span := tracer.Start(ctx, "Pipeline.Run")
 	defer span.End()
 
@@ -164,103 +280,341 @@ func (p *Pipeline) Run(ctx context.Context) *livekit.EgressInfo {
 		p.Info.EndedAt = time.Now().UnixNano()
 
 		// update status
+		if err := p.panicError(); err != "" {
+			p.Info.Error = err
+		}
 		if p.Info.Error != "" {
+			p.setEndedReason(EndReasonError)
 			p.Info.Status = livekit.EgressStatus_EGRESS_FAILED
 		} else if p.Info.Status != livekit.EgressStatus_EGRESS_ABORTED {
 			p.Info.Status = livekit.EgressStatus_EGRESS_COMPLETE
 		}
 
-		// Cleanup temporary files even if we fail
-		p.deleteTempDir()
+		// the report is most useful when something went wrong, so it's stored even if the egress failed
+		if p.perf != nil && !p.aborted.Load() {
+			p.storePerfReport(ctx)
+		}
+
+		if p.out != nil {
+			p.out.Close()
+		}
+
+		// Cleanup temporary files even if we fail. A deferred upload is cleaned up by the service
+		if !p.uploadDeferred {
+			p.deleteTempDir()
+		}
+	}()
+	defer func() {
+		// runs ahead of the status update, which reports the panic
+		if r := recover(); r != nil {
+			p.recoverRun(ctx, r)
+			info = p.Info
+		}
 	}()
 
-	// wait until room is ready
+	var startDeadline <-chan time.Time
+	if p.StartTimeout > 0 {
+		startDeadline = time.After(p.StartTimeout)
+	}
+
+	// wait until room is ready. With frame accurate starts, the pipeline is already capturing by then
 	start := p.in.StartRecording()
-	if start != nil {
+	if start != nil && !p.FrameAccurateStart {
 		select {
 		case <-p.closed:
 			p.in.Close()
 			p.Info.Status = livekit.EgressStatus_EGRESS_ABORTED
 			return p.Info
+		case <-startDeadline:
+			p.Logger.Infow("room never became active")
+			p.in.Close()
+			p.setEndedReason(EndReasonNotStarted)
+			p.Info.Status = livekit.EgressStatus_EGRESS_ABORTED
+			return p.Info
 		case <-start:
 			// continue
 		}
+	} else if startDeadline != nil {
+		go p.endIfNotStarted(ctx, start, startDeadline)
 	}
 
 	// close when room ends
 	go func() {
+		defer p.recoverPanic()
+
 		<-p.in.EndRecording()
-		p.SendEOS(ctx)
+		reason := EndReasonRoomClosed
+		if s, ok := p.in.Source.(*source.SDKSource); ok && s.EndedReason() != "" {
+			reason = s.EndedReason()
+		}
+		p.SendEOS(ctx, reason)
 	}()
 
 	p.startSessionTimeoutTimer(ctx)
+	if s, ok := p.in.Source.(*source.WebSource); ok {
+		p.startTemplateChannel(s)
+	}
+	if s, ok := p.in.Source.(*source.SDKSource); ok && p.timedMetadata != nil {
+		s.OnTimedMetadata(p.addTimedMetadata)
+	}
 
 	// add watch
 	p.loop = glib.NewMainLoop(glib.MainContextDefault(), false)
 	p.pipeline.GetPipelineBus().AddWatch(p.messageWatch)
 
+	if p.discardIfAborted(ctx) {
+		// aborted before the pipeline started
+		p.in.Close()
+		return p.Info
+	}
+
 	// set state to playing (this does not start the pipeline)
 	if err := p.pipeline.SetState(gst.StatePlaying); err != nil {
 		span.RecordError(err)
 		p.Logger.Errorw("failed to set pipeline state", err)
 		p.Info.Error = err.Error()
+		p.setEndedReason(EndReasonError)
 		return p.Info
 	}
 
+	if start != nil && p.FrameAccurateStart {
+		go p.waitForStart(start)
+	}
+
+	if p.perf != nil {
+		go p.perf.monitor(p.pipeline)
+	}
+
+	var streamHealthDone chan struct{}
+	if p.EgressType == params.EgressTypeStream && p.StreamHealthInterval > 0 {
+		streamHealthDone = make(chan struct{})
+		go p.monitorStreamHealth(streamHealthDone)
+	}
+
 	if p.EgressType == params.EgressTypeSegmentedFile {
 		p.startSegmentWorker()
 		defer close(p.endedSegments)
 	}
 
+	if p.in.Previews() != nil {
+		p.startPreviewWorker()
+	}
+
 	// run main loop
 	p.loop.Run()
 
+	if streamHealthDone != nil {
+		close(streamHealthDone)
+	}
+
 	// close input source
 	p.in.Close()
 
+	// pending image uploads finish alongside the final uploads
+	imagesDone := make(chan struct{})
+	go func() {
+		if p.SnapshotInterval > 0 || p.PreviewInterval > 0 {
+			p.waitForImages()
+		}
+		close(imagesDone)
+	}()
+	defer func() {
+		<-imagesDone
+	}()
+
+	if p.perf != nil {
+		p.perf.stop(p.pipeline)
+	}
+
 	timedOut := p.stopSessionTimeoutTimer()
 
+	if p.discardIfAborted(ctx) {
+		return p.Info
+	}
+
+	if start != nil && p.FrameAccurateStart {
+		select {
+		case <-start:
+		default:
+			// stopped before the template started recording, so there's nothing to upload
+			p.Info.Error = ""
+			p.Info.Status = livekit.EgressStatus_EGRESS_ABORTED
+			return p.Info
+		}
+	}
+
+	if p.EndedReason() == EndReasonNotStarted {
+		// nothing was recorded, so there's nothing to upload
+		p.Info.Error = ""
+		p.Info.Status = livekit.EgressStatus_EGRESS_ABORTED
+		return p.Info
+	}
+
 	// update endedAt from sdk source
 	switch s := p.in.Source.(type) {
 	case *source.SDKSource:
 		p.updateDuration(s.GetEndTime())
+		p.recordTrackStarts(s)
 	}
 
 	// return if there was an error
-	if p.Info.Error != "" && !timedOut {
-		// We want to upload the file if the egress timed out
+	if p.Info.Error != "" && !timedOut && !p.finalizing.Load() {
+		// We want to upload the file if the egress timed out, or if it was finalized after freezing
 		return p.Info
 	}
 
-	// upload file
+	// upload files, concurrently when there are several. The uploads only return their locations, which are set on the
+	// egress info once they've all ended, and any failure fails the egress
+	uploads := newUploadGroup(p.UploadConcurrency)
+	var fileLocation, playlistLocation string
+	var fileSize int64
 	switch p.EgressType {
 	case params.EgressTypeFile:
-		var err error
-		p.FileInfo.Location, p.FileInfo.Size, err = p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType)
-		if err != nil {
-			p.Info.Error = err.Error()
+		if p.IntroClip != "" || p.OutroClip != "" {
+			// the recording is still uploaded without bumpers if they can't be added
+			if err := p.addBumpers(ctx); err != nil {
+				p.Logger.Errorw("could not add bumpers", err)
+			}
+		}
+
+		if p.FileCheck.Enabled && p.OutputType == params.OutputTypeMP4 {
+			// a file which fails isn't uploaded, and the egress fails with the reason
+			if err := p.checkFile(ctx); err != nil {
+				p.Logger.Errorw("file check failed", err)
+				p.Info.Error = errors.ErrFileCheckFailed(err).Error()
+				break
+			}
 		}
 
+		if p.deferUpload && p.FileUpload != nil {
+			p.uploadDeferred = true
+			break
+		}
+
+		uploads.Go(func() error {
+			var err error
+			fileLocation, fileSize, err = p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType)
+			return err
+		})
+
 	case params.EgressTypeSegmentedFile:
 		// wait for all pending upload jobs to finish
 		if p.endedSegments != nil {
 			p.segmentsWg.Wait()
 		}
 
+		if p.SingleFileFilename != "" {
+			uploads.Go(func() error {
+				singleFileStoragePath := p.GetStorageFilepath(p.SingleFileFilename)
+				_, _, err := p.storeFile(ctx, p.SingleFileFilename, singleFileStoragePath, p.GetSegmentOutputType())
+				return err
+			})
+		}
+
 		if p.playlistWriter != nil {
 			if err := p.playlistWriter.EOS(); err != nil {
 				p.Logger.Errorw("failed to send EOS to playlist writer", err)
 			}
+			if p.playlistWriter.MasterPlaylistUpdated() {
+				// with the final bandwidth
+				p.masterPlaylistStored = false
+			}
+			if peak, average := p.playlistWriter.Bandwidth(); average > 0 {
+				p.Logger.Infow("measured segment bandwidth", "peak", peak, "average", average)
+			}
 
 			// upload the finalized playlist
-			playlistStoragePath := p.GetStorageFilepath(p.PlaylistFilename)
-			p.SegmentsInfo.PlaylistLocation, _, _ = p.storeFile(ctx, p.PlaylistFilename, playlistStoragePath, p.OutputType)
+			uploads.Go(func() error {
+				playlistStoragePath := p.GetStorageFilepath(p.PlaylistFilename)
+				var err error
+				playlistLocation, _, err = p.storeFile(ctx, p.PlaylistFilename, playlistStoragePath, p.OutputType)
+				return err
+			})
+			if !p.masterPlaylistStored {
+				uploads.Go(p.storeMasterPlaylist)
+			}
 		}
 	}
+	if p.DataCapture {
+		uploads.Go(func() error {
+			return p.storeSidecar(ctx, source.DataCaptureSuffix, params.OutputTypeJSONL)
+		})
+	}
+	switch p.CaptionsFormat {
+	case config.CaptionsFormatVTT:
+		uploads.Go(func() error {
+			return p.storeSidecar(ctx, source.CaptionsSuffix(p.CaptionsFormat), params.OutputTypeVTT)
+		})
+	case config.CaptionsFormatSRT:
+		uploads.Go(func() error {
+			return p.storeSidecar(ctx, source.CaptionsSuffix(p.CaptionsFormat), params.OutputTypeSubRip)
+		})
+	}
+	err := uploads.Wait()
+	switch p.EgressType {
+	case params.EgressTypeFile:
+		if fileLocation != "" || fileSize != 0 {
+			p.FileInfo.Location, p.FileInfo.Size = fileLocation, fileSize
+		}
+	case params.EgressTypeSegmentedFile:
+		if playlistLocation != "" {
+			p.SegmentsInfo.PlaylistLocation = playlistLocation
+		}
+	}
+	if err != nil {
+		p.Logger.Errorw("final uploads failed", err)
+		if p.Info.Error == "" {
+			p.Info.Error = err.Error()
+		}
+	}
+
+	// aborted while the final uploads were running
+	if p.discardIfAborted(ctx) {
+		return p.Info
+	}
 
+	p.logUploadSummary()
 	return p.Info
 }
 
+// recordTrackStarts logs when each track first produced media, and adds it to the perf report.
+// EgressInfo has no field for them
+func (p *Pipeline) recordTrackStarts(s *source.SDKSource) {
+	startTime := s.GetStartTime()
+	var tracks []perfTrack
+	for trackID, startedAt := range s.GetTrackStartTimes() {
+		offset := time.Duration(startedAt - startTime)
+		p.Logger.Infow("track started", "trackID", trackID, "startedAt", startedAt, "offset", offset)
+		tracks = append(tracks, perfTrack{
+			TrackID:   trackID,
+			StartedAt: time.Unix(0, startedAt),
+			Offset:    offset,
+		})
+	}
+
+	if p.perf != nil {
+		sort.Slice(tracks, func(i, j int) bool { return tracks[i].Offset < tracks[j].Offset })
+		p.perf.setTracks(tracks)
+	}
+}
+
+// storeSidecar uploads a file written by the sdk source next to the recording, such as captured data messages
+func (p *Pipeline) storeSidecar(ctx context.Context, suffix string, outputType params.OutputType) error {
+	localFilepath, storageFilepath := p.GetSidecarFilepaths(suffix)
+	if localFilepath == "" {
+		return nil
+	}
+	if _, err := os.Stat(localFilepath); err != nil {
+		// web sources don't receive data messages, and captions are only written if something was transcribed
+		return nil
+	}
+	_, _, err := p.storeFile(ctx, localFilepath, storageFilepath, outputType)
+	if err != nil {
+		p.Logger.Errorw("could not store sidecar file", err, "suffix", suffix)
+	}
+	return err
+}
+
 func (p *Pipeline) deleteTempDir() {
 	if p.FileUpload != nil {
 		switch p.EgressType {
@@ -274,26 +628,70 @@ func (p *Pipeline) deleteTempDir() {
 			}
 
 		case params.EgressTypeSegmentedFile:
-			dir, _ := path.Split(p.PlaylistFilename)
-			if dir != "" {
-				p.Logger.Debugw("removing temporary directory", "path", dir)
-				if err := os.RemoveAll(dir); err != nil {
-					p.Logger.Errorw("could not delete temp dir", err)
+			for _, filepath := range []string{p.PlaylistFilename, p.SpillFilePrefix} {
+				dir, _ := path.Split(filepath)
+				if dir != "" {
+					p.Logger.Debugw("removing temporary directory", "path", dir)
+					if err := os.RemoveAll(dir); err != nil {
+						p.Logger.Errorw("could not delete temp dir", err)
+					}
 				}
 			}
 		}
 	}
 }
 
+// endIfNotStarted ends the egress if the room hasn't become active by the deadline
+func (p *Pipeline) endIfNotStarted(ctx context.Context, start chan struct{}, deadline <-chan time.Time) {
+	defer p.recoverPanic()
+
+	select {
+	case <-p.closed:
+		return
+	case <-deadline:
+	}
+
+	started := true
+	if start != nil {
+		select {
+		case <-start:
+		default:
+			started = false
+		}
+	} else if s, ok := p.in.Source.(*source.SDKSource); ok {
+		// set once a track produces media
+		started = s.GetStartTime() != 0
+	}
+
+	if !started {
+		p.Logger.Infow("room never became active")
+		p.SendEOS(ctx, EndReasonNotStarted)
+	}
+}
+
+// waitForStart lets captured frames through once the template starts recording
+func (p *Pipeline) waitForStart(start chan struct{}) {
+	defer p.recoverPanic()
+
+	select {
+	case <-p.closed:
+	case <-start:
+		startTime := p.in.OpenStartGate()
+		p.Logger.Debugw("template started recording", "runningTime", startTime)
+	}
+}
+
 func (p *Pipeline) startSessionTimeoutTimer(ctx context.Context) {
-	timeout := p.GetSessionTimeout()
+	timeout, source := p.GetSessionTimeout()
 
 	if timeout > 0 {
+		p.Logger.Debugw("session limit set", "maxDuration", timeout, "source", source)
 		p.sessionTimeoutTimer = time.AfterFunc(timeout, func() {
 			p.timedOut.Store(true)
-			p.SendEOS(ctx)
+			p.SendEOS(ctx, EndReasonSessionLimit)
 
-			p.Info.Error = "max egress duration reached"
+			// EgressInfo has no field for the limit, so it's given with the error
+			p.Info.Error = fmt.Sprintf("max egress duration of %s reached (%s)", timeout, source)
 		})
 	}
 }
@@ -312,6 +710,10 @@ func (p *Pipeline) storeFile(ctx context.Context, localFilepath, storageFilepath
 	ctx, span := tracer.Start(ctx, "Pipeline.storeFile")
 	defer span.End()
 
+	if p.aborted.Load() {
+		return "", 0, errors.ErrEgressAborted
+	}
+
 	fileInfo, err := os.Stat(localFilepath)
 	if err == nil {
 		size = fileInfo.Size()
@@ -319,43 +721,130 @@ func (p *Pipeline) storeFile(ctx context.Context, localFilepath, storageFilepath
 		p.Logger.Errorw("could not read file size", err)
 	}
 
-	var location string
-	switch u := p.FileUpload.(type) {
-	case *livekit.S3Upload:
-		location = "S3"
-		p.Logger.Debugw("uploading to s3")
-		destinationUrl, err = sink.UploadS3(u, localFilepath, storageFilepath, mime)
+	if p.FileUpload == nil {
+		p.recordStored(nil, localFilepath)
+		return storageFilepath, size, nil
+	}
 
-	case *livekit.GCPUpload:
-		location = "GCP"
-		p.Logger.Debugw("uploading to gcp")
-		destinationUrl, err = sink.UploadGCP(u, localFilepath, storageFilepath, mime)
+	file, err := os.Open(localFilepath)
+	if err != nil {
+		p.Logger.Errorw("could not open file", err)
+		span.RecordError(err)
+		return "", size, err
+	}
+	defer file.Close()
 
-	case *livekit.AzureBlobUpload:
-		location = "Azure"
-		p.Logger.Debugw("uploading to azure")
-		destinationUrl, err = sink.UploadAzure(u, localFilepath, storageFilepath, mime)
+	destinationUrl, err = p.upload(file, size, storageFilepath, mime)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return destinationUrl, size, err
+}
 
-	default:
-		destinationUrl = storageFilepath
+// storeData uploads data that was never written to disk
+func (p *Pipeline) storeData(ctx context.Context, data []byte, storageFilepath string, mime params.OutputType) (destinationUrl string, size int64, err error) {
+	ctx, span := tracer.Start(ctx, "Pipeline.storeData")
+	defer span.End()
+
+	if p.aborted.Load() {
+		return "", 0, errors.ErrEgressAborted
+	}
+
+	size = int64(len(data))
+	destinationUrl, err = p.upload(bytes.NewReader(data), size, storageFilepath, mime)
+	if err != nil {
+		span.RecordError(err)
+	}
+	return destinationUrl, size, err
+}
+
+func (p *Pipeline) upload(body io.ReadSeeker, size int64, storageFilepath string, mime params.OutputType) (destinationUrl string, err error) {
+	if p.FileUpload == nil {
+		return storageFilepath, nil
+	}
+
+	encoding := ""
+	if p.UploadCompression != "" && sink.Compressible(mime) {
+		compressed, err := sink.Gzip(body)
+		if err != nil {
+			return "", err
+		}
+		body, size, encoding = bytes.NewReader(compressed), int64(len(compressed)), p.UploadCompression
 	}
 
+	start := time.Now()
+	upload := p.getUpload()
+	location, destinationUrl, retries, err := sink.Upload(upload, body, size, storageFilepath, mime, encoding, p.Retention)
+	if location == "" {
+		return destinationUrl, nil
+	}
+
+	p.uploadCompleted(&stats.UploadMetrics{
+		EgressID:   p.Info.EgressId,
+		Location:   location,
+		Bytes:      size,
+		Duration:   time.Since(start),
+		Retries:    retries,
+		ErrorClass: sink.UploadErrorClass(err),
+	})
+
 	if err != nil {
 		p.Logger.Errorw("could not upload file", err, "location", location)
 		err = errors.ErrUploadFailed(location, err)
-		span.RecordError(err)
+	} else {
+		p.recordStored(upload, storageFilepath)
+		if p.failover != nil {
+			p.failover.uploaded(storageFilepath, destinationUrl)
+		}
 	}
 
-	return destinationUrl, size, err
+	return destinationUrl, err
 }
 
-func (p *Pipeline) onSegmentEnded(segmentPath string, endTime int64) error {
+func (p *Pipeline) uploadCompleted(metrics *stats.UploadMetrics) {
+	p.uploadCount.Inc()
+	if metrics.ErrorClass != "" {
+		p.uploadFailures.Inc()
+	} else {
+		p.uploadBytes.Add(metrics.Bytes)
+	}
+	p.uploadDuration.Add(metrics.Duration)
+	if p.perf != nil {
+		p.perf.addUpload(metrics)
+	}
+
+	if onUpload := p.onUpload; onUpload != nil {
+		onUpload(metrics)
+	}
+}
+
+func (p *Pipeline) uploadTotal() perfUploadTotal {
+	return perfUploadTotal{
+		Uploads:  p.uploadCount.Load(),
+		Failures: p.uploadFailures.Load(),
+		Bytes:    p.uploadBytes.Load(),
+		Duration: p.uploadDuration.Load(),
+	}
+}
+
+func (p *Pipeline) logUploadSummary() {
+	if total := p.uploadTotal(); total.Uploads > 0 {
+		p.Logger.Infow("upload summary",
+			"uploads", total.Uploads,
+			"failures", total.Failures,
+			"bytes", total.Bytes,
+			"duration", total.Duration,
+		)
+	}
+}
+
+func (p *Pipeline) onSegmentEnded(segmentPath string, endTime int64, data []byte) error {
 	if p.EgressType == params.EgressTypeSegmentedFile {
 		// We need to dispatch to a queue to:
 		// 1. Avoid concurrent access to the SegmentsInfo structure
 		// 2. Ensure that playlists are uploaded in the same order they are enqueued to avoid an older playlist overwriting a newre one
 
-		if err := p.enqueueSegmentUpload(segmentPath, endTime); err != nil {
+		if err := p.enqueueSegmentUpload(segmentPath, endTime, data); err != nil {
 			p.Logger.Errorw("failed to queue segment upload", err)
 		}
 	}
@@ -370,32 +859,318 @@ func (p *Pipeline) startSegmentWorker() {
 		for update := range p.endedSegments {
 			func() {
 				defer p.segmentsWg.Done()
+				defer p.recoverPanic()
 
 				p.SegmentsInfo.SegmentCount++
 
-				segmentStoragePath := p.GetStorageFilepath(update.localPath)
-				// Ignore error. storeFile will log it.
-				_, size, _ := p.storeFile(context.Background(), update.localPath, segmentStoragePath, p.GetSegmentOutputType())
-				p.SegmentsInfo.Size += size
+				if p.timedMetadata != nil {
+					update = p.insertTimedMetadata(update)
+				}
+
+				if p.SingleFileFilename != "" {
+					p.appendSegment(update)
+				} else if p.SegmentsInMemory {
+					p.storeSegmentData(update)
+				} else {
+					p.storeSegmentFile(update)
+				}
 
 				if p.playlistWriter != nil {
-					err := p.playlistWriter.EndSegment(update.localPath, update.endTime)
+					expired, err := p.playlistWriter.EndSegment(update.localPath, update.endTime)
 					if err != nil {
 						p.Logger.Errorw("failed to end segment", err, "path", update.localPath)
 						return
 					}
+					if p.SingleFileFilename != "" {
+						// the media file and playlist are stored together once complete
+						return
+					}
+
 					playlistStoragePath := p.GetStorageFilepath(p.PlaylistFilename)
 					p.SegmentsInfo.PlaylistLocation, _, _ = p.storeFile(context.Background(), p.PlaylistFilename, playlistStoragePath, p.OutputType)
+
+					// only delete segments once the playlist referencing them has been replaced
+					for _, localPath := range expired {
+						p.deleteExpiredFile(localPath)
+					}
+
+					if p.playlistWriter.MasterPlaylistUpdated() {
+						p.masterPlaylistStored = false
+					}
+					if !p.masterPlaylistStored {
+						p.storeMasterPlaylist()
+					}
 				}
 			}()
 		}
 	}()
 }
 
-func (p *Pipeline) enqueueSegmentUpload(segmentPath string, endTime int64) error {
+func (p *Pipeline) storeSegmentFile(update segmentUpdate) {
+	if p.GetSegmentOutputType() == params.OutputTypeMP4 {
+		initCreated, err := sink.SplitInitSegment(update.localPath, p.InitSegmentFilename)
+		if err != nil {
+			p.Logger.Errorw("failed to split init segment", err, "path", update.localPath)
+		} else if initCreated {
+			initStoragePath := p.GetStorageFilepath(p.InitSegmentFilename)
+			_, size, _ := p.storeFile(context.Background(), p.InitSegmentFilename, initStoragePath, params.OutputTypeMP4)
+			p.SegmentsInfo.Size += size
+		}
+	}
+
+	if p.SegmentEncryption {
+		if err := p.encryptSegmentFile(update.localPath); err != nil {
+			// never upload segments in the clear
+			p.Logger.Errorw("failed to encrypt segment", err, "path", update.localPath)
+			return
+		}
+	}
+
+	localPath := update.localPath
+	if p.ContentAddressed {
+		var err error
+		if localPath, err = p.renameSegmentFile(update.localPath); err != nil {
+			p.Logger.Errorw("failed to rename segment", err, "path", update.localPath)
+			return
+		}
+	}
+
+	if fileInfo, err := os.Stat(localPath); err == nil && p.playlistWriter != nil {
+		p.playlistWriter.SetSegmentSize(update.localPath, fileInfo.Size())
+	}
+
+	segmentStoragePath := p.GetStorageFilepath(localPath)
+	// storeFile will log the error
+	_, size, err := p.storeFile(context.Background(), localPath, segmentStoragePath, p.GetSegmentOutputType())
+	p.SegmentsInfo.Size += size
+	p.segmentStored(localPath, segmentStoragePath, nil, err)
+}
+
+func (p *Pipeline) storeSegmentData(update segmentUpdate) {
+	data := update.data
+	if p.GetSegmentOutputType() == params.OutputTypeMP4 {
+		init, media, err := sink.SplitInitSection(data)
+		if err != nil {
+			p.Logger.Errorw("failed to split init segment", err, "path", update.localPath)
+		} else {
+			if !p.initSegmentStored {
+				initStoragePath := p.GetStorageFilepath(p.InitSegmentFilename)
+				_, size, err := p.storeData(context.Background(), init, initStoragePath, params.OutputTypeMP4)
+				p.SegmentsInfo.Size += size
+				p.initSegmentStored = err == nil
+			}
+			data = media
+		}
+	}
+
+	if p.SegmentEncryption {
+		var err error
+		if data, err = p.encryptSegment(data); err != nil {
+			// never upload segments in the clear
+			p.Logger.Errorw("failed to encrypt segment", err, "path", update.localPath)
+			return
+		}
+	}
+
+	localPath := update.localPath
+	if p.ContentAddressed {
+		localPath = contentAddressedPath(update.localPath, data)
+		if p.playlistWriter != nil {
+			p.playlistWriter.SetSegmentPath(update.localPath, localPath)
+		}
+	}
+
+	if p.playlistWriter != nil {
+		p.playlistWriter.SetSegmentSize(update.localPath, int64(len(data)))
+	}
+
+	segmentStoragePath := p.GetStorageFilepath(localPath)
+	// storeData will log the error
+	_, size, err := p.storeData(context.Background(), data, segmentStoragePath, p.GetSegmentOutputType())
+	p.SegmentsInfo.Size += size
+	p.segmentStored(localPath, segmentStoragePath, data, err)
+}
+
+// renameSegmentFile names a segment by its contents once they're final, so that it's referenced by that name in the playlist
+func (p *Pipeline) renameSegmentFile(localPath string) (string, error) {
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		return "", err
+	}
+
+	renamed := contentAddressedPath(localPath, data)
+	if err = os.Rename(localPath, renamed); err != nil {
+		return "", err
+	}
+	if p.playlistWriter != nil {
+		p.playlistWriter.SetSegmentPath(localPath, renamed)
+	}
+	return renamed, nil
+}
+
+// contentAddressedPath returns the path of a segment named by the sha-256 of its contents. Storing it again,
+// after a retry or a handler restart, overwrites it with the same file, and caches can keep it forever
+func contentAddressedPath(localPath string, data []byte) string {
+	sum := sha256.Sum256(data)
+	dir, filename := path.Split(localPath)
+	return path.Join(dir, hex.EncodeToString(sum[:])+path.Ext(filename))
+}
+
+// appendSegment writes the segment to the end of the single media file, and registers its byte range with the playlist
+func (p *Pipeline) appendSegment(update segmentUpdate) {
+	data := update.data
+	if !p.SegmentsInMemory {
+		var err error
+		if data, err = os.ReadFile(update.localPath); err != nil {
+			p.Logger.Errorw("failed to read segment", err, "path", update.localPath)
+			return
+		}
+		defer func() {
+			_ = os.Remove(update.localPath)
+		}()
+	}
+
+	if p.GetSegmentOutputType() == params.OutputTypeMP4 {
+		init, media, err := sink.SplitInitSection(data)
+		if err != nil {
+			p.Logger.Errorw("failed to split init segment", err, "path", update.localPath)
+		} else {
+			if p.singleFileSize == 0 {
+				if err = p.appendToSingleFile(init); err != nil {
+					p.Logger.Errorw("failed to write init segment", err, "path", p.SingleFileFilename)
+					return
+				}
+				p.playlistWriter.SetInitRange(int64(len(init)))
+			}
+			data = media
+		}
+	}
+
+	if p.SegmentEncryption {
+		var err error
+		if data, err = p.encryptSegment(data); err != nil {
+			p.Logger.Errorw("failed to encrypt segment", err, "path", update.localPath)
+			return
+		}
+	}
+
+	offset := p.singleFileSize
+	if err := p.appendToSingleFile(data); err != nil {
+		p.Logger.Errorw("failed to write segment", err, "path", p.SingleFileFilename)
+		return
+	}
+	p.playlistWriter.SetSegmentRange(update.localPath, offset, int64(len(data)))
+}
+
+func (p *Pipeline) appendToSingleFile(data []byte) error {
+	f, err := os.OpenFile(p.SingleFileFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := f.Write(data)
+	p.singleFileSize += int64(n)
+	p.SegmentsInfo.Size += int64(n)
+	return err
+}
+
+// deleteExpiredFile removes a file that has aged out of a live playlist, locally and from storage
+func (p *Pipeline) deleteExpiredFile(localFilepath string) {
+	if p.FileUpload != nil {
+		storageFilepath := p.GetStorageFilepath(localFilepath)
+		upload := p.getUpload()
+		if p.failover != nil {
+			upload = p.failover.expire(path.Base(storageFilepath), upload)
+		}
+		if err := sink.DeleteUploaded(context.Background(), upload, storageFilepath); err != nil {
+			p.Logger.Warnw("failed to delete expired file", err, "location", storageFilepath)
+		}
+	}
+
+	// in-memory segments were never written
+	if err := os.Remove(localFilepath); err != nil && !os.IsNotExist(err) {
+		p.Logger.Warnw("failed to delete expired file", err, "path", localFilepath)
+	}
+}
+
+func (p *Pipeline) encryptSegmentFile(localFilepath string) error {
+	data, err := os.ReadFile(localFilepath)
+	if err != nil {
+		return err
+	}
+	if data, err = p.encryptSegment(data); err != nil {
+		return err
+	}
+	return os.WriteFile(localFilepath, data, 0644)
+}
+
+// encryptSegment encrypts segment contents with the playlist's current key, storing the key first when it's new.
+// fMP4 init sections are left in the clear, since EXT-X-MAP comes before the first EXT-X-KEY
+func (p *Pipeline) encryptSegment(data []byte) ([]byte, error) {
+	key, sequence, keyFilepath, err := p.playlistWriter.NextSegmentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	if keyFilepath != "" {
+		keyStoragePath := p.GetStorageFilepath(keyFilepath)
+		if _, _, err = p.storeFile(context.Background(), keyFilepath, keyStoragePath, params.OutputTypeKey); err != nil {
+			return nil, err
+		}
+	}
+
+	return sink.EncryptSegment(key, sequence, data)
+}
+
+// getVideoFormat reads the resolution, frame rate and codec parameters of encoded video
+func getVideoFormat(codec params.MimeType, caps *gst.Caps, keyframe []byte) *sink.VideoFormat {
+	format := &sink.VideoFormat{}
+	var codecData []byte
+	if caps != nil && caps.GetSize() > 0 {
+		s := caps.GetStructureAt(0)
+		if v, err := s.GetValue("width"); err == nil {
+			format.Width, _ = v.(int)
+		}
+		if v, err := s.GetValue("height"); err == nil {
+			format.Height, _ = v.(int)
+		}
+		if v, err := s.GetValue("framerate"); err == nil {
+			if f, ok := v.(interface {
+				Num() int
+				Denom() int
+			}); ok && f.Denom() > 0 {
+				format.FrameRate = float64(f.Num()) / float64(f.Denom())
+			}
+		}
+		if v, err := s.GetValue("codec_data"); err == nil {
+			if b, ok := v.(interface{ Bytes() []byte }); ok {
+				codecData = b.Bytes()
+			}
+		}
+	}
+	format.Codecs = sink.VideoCodecs(codec, codecData, keyframe)
+	return format
+}
+
+// storeMasterPlaylist uploads the master playlist once the media playlist it references exists.
+// SegmentsInfo has no field for its location, so it is logged
+func (p *Pipeline) storeMasterPlaylist() error {
+	masterStoragePath := p.GetStorageFilepath(p.MasterPlaylistFilename)
+	location, _, err := p.storeFile(context.Background(), p.MasterPlaylistFilename, masterStoragePath, p.OutputType)
+	if err != nil {
+		return err
+	}
+
+	p.masterPlaylistStored = true
+	p.Logger.Infow("master playlist stored", "location", location)
+	return nil
+}
+
+func (p *Pipeline) enqueueSegmentUpload(segmentPath string, endTime int64, data []byte) error {
 	p.segmentsWg.Add(1)
 	select {
-	case p.endedSegments <- segmentUpdate{localPath: segmentPath, endTime: endTime}:
+	case p.endedSegments <- segmentUpdate{localPath: segmentPath, endTime: endTime, data: data}:
 		return nil
 	default:
 		err := errors.New("segment upload job queue is full")
@@ -420,6 +1195,17 @@ func (p *Pipeline) UpdateStream(ctx context.Context, req *livekit.UpdateStreamRe
 		}
 	}
 
+	if len(req.AddOutputUrls) == 1 && len(req.RemoveOutputUrls) == 1 {
+		// a request removing an active url and adding another swaps them. Unknown, pending or failed urls are
+		// removed on their own, after the new url is added
+		p.mu.Lock()
+		_, active := p.startedAt[req.RemoveOutputUrls[0]]
+		p.mu.Unlock()
+		if active {
+			return p.replaceStream(req.RemoveOutputUrls[0], req.AddOutputUrls[0])
+		}
+	}
+
 	var wg sync.WaitGroup
 	var errMu sync.Mutex
 	errs := make([]string, 0)
@@ -455,6 +1241,7 @@ func (p *Pipeline) UpdateStream(ctx context.Context, req *livekit.UpdateStreamRe
 			case <-time.After(time.Second):
 				p.mu.Lock()
 				delete(p.streamErrors, url)
+				p.streamAdded(url)
 				streamInfo := &livekit.StreamInfo{Url: url}
 				p.startedAt[url] = now
 				p.StreamInfo[url] = streamInfo
@@ -466,10 +1253,12 @@ func (p *Pipeline) UpdateStream(ctx context.Context, req *livekit.UpdateStreamRe
 
 	for _, url := range req.RemoveOutputUrls {
 		p.mu.Lock()
-		sendEOS := len(p.startedAt) == 1
+		// only end the egress when removing the last active output, not an unknown or pending url
+		_, active := p.startedAt[url]
+		sendEOS := active && len(p.startedAt) == 1
 		p.mu.Unlock()
 		if sendEOS {
-			p.SendEOS(ctx)
+			p.SendEOS(ctx, EndReasonStreamsRemoved)
 			continue
 		}
 
@@ -481,8 +1270,9 @@ func (p *Pipeline) UpdateStream(ctx context.Context, req *livekit.UpdateStreamRe
 		}
 
 		p.mu.Lock()
-		startedAt := p.startedAt[url]
-		p.StreamInfo[url].Duration = now - startedAt
+		if streamInfo := p.StreamInfo[url]; streamInfo != nil {
+			streamInfo.Duration = now - p.startedAt[url]
+		}
 		delete(p.startedAt, url)
 		delete(p.StreamInfo, url)
 		p.mu.Unlock()
@@ -495,10 +1285,124 @@ func (p *Pipeline) UpdateStream(ctx context.Context, req *livekit.UpdateStreamRe
 	return nil
 }
 
-func (p *Pipeline) SendEOS(ctx context.Context) {
+// replaceStream swaps an output url for another. The new url is connected before the old one is removed, so the
+// stream continues under the same StreamInfo, and the egress doesn't end when it was the last url. The old url is
+// one which was streaming
+func (p *Pipeline) replaceStream(oldUrl, newUrl string) error {
+	if err := p.out.AddSink(newUrl); err != nil {
+		return err
+	}
+
+	errChan := make(chan error, 1)
+	p.mu.Lock()
+	p.streamErrors[newUrl] = errChan
+	p.mu.Unlock()
+
+	select {
+	case err := <-errChan:
+		// the old url keeps streaming
+		return err
+	case <-time.After(time.Second):
+		p.mu.Lock()
+		delete(p.streamErrors, newUrl)
+		p.mu.Unlock()
+	}
+
+	if err := p.out.RemoveSink(oldUrl); err != nil && !errors.Is(err, errors.ErrStreamNotFound) {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.streamAdded(newUrl)
+	streamInfo := p.StreamInfo[oldUrl]
+	if streamInfo == nil {
+		// the old url failed while the new one was connecting
+		streamInfo = &livekit.StreamInfo{}
+		p.startedAt[oldUrl] = time.Now().UnixNano()
+		p.Info.GetStream().Info = append(p.Info.GetStream().Info, streamInfo)
+	}
+	streamInfo.Url = newUrl
+	p.StreamInfo[newUrl] = streamInfo
+	p.startedAt[newUrl] = p.startedAt[oldUrl]
+	delete(p.StreamInfo, oldUrl)
+	delete(p.startedAt, oldUrl)
+
+	p.Logger.Infow("stream url replaced", "url", newUrl)
+	return nil
+}
+
+// streamAdded counts a reconnect when the url failed before. Called with the lock held
+func (p *Pipeline) streamAdded(url string) {
+	if p.failedStreams[url] {
+		p.streamReconnects[url]++
+		delete(p.failedStreams, url)
+	}
+}
+
+// UpdateLayout rearranges the video tracks of a track composite with a layout. The update takes the same form as the
+// request's video track id, or is a layout name alone, which keeps the current order. Tracks can be left out, but
+// not added
+func (p *Pipeline) UpdateLayout(ctx context.Context, layout string) error {
+	_, span := tracer.Start(ctx, "Pipeline.UpdateLayout")
+	defer span.End()
+
+	if len(p.CompositeVideoTrackIDs) == 0 {
+		return errors.ErrNoTrackLayout
+	}
+
+	var order []string
+	if strings.ContainsAny(layout, ":,") {
+		var err error
+		if layout, order, err = params.ParseTrackLayout(layout); err != nil {
+			return err
+		}
+		requested := make(map[string]bool, len(p.CompositeVideoTrackIDs))
+		for _, trackID := range p.CompositeVideoTrackIDs {
+			requested[trackID] = true
+		}
+		for _, trackID := range order {
+			if !requested[trackID] {
+				return errors.ErrInvalidInput("layout")
+			}
+		}
+	} else {
+		switch layout {
+		case params.TrackLayoutGrid, params.TrackLayoutSideBySide, params.TrackLayoutPiP:
+		default:
+			return errors.ErrInvalidInput("layout")
+		}
+	}
+
+	if err := p.in.UpdateLayout(layout, order); err != nil {
+		return err
+	}
+	p.Logger.Infow("layout updated", "layout", layout, "trackIDs", order)
+	return nil
+}
+
+// UpdateTextOverlay shows text over the video, or hides it if the text is empty. An empty position keeps the current one
+func (p *Pipeline) UpdateTextOverlay(ctx context.Context, text, position string) error {
+	_, span := tracer.Start(ctx, "Pipeline.UpdateTextOverlay")
+	defer span.End()
+
+	if position != "" && !config.IsOverlayPosition(position) {
+		return errors.ErrInvalidInput("position")
+	}
+	if err := p.in.SetTextOverlay(text, position); err != nil {
+		return err
+	}
+	p.Logger.Infow("text overlay updated", "text", text, "position", position)
+	return nil
+}
+
+// SendEOS ends the egress. The reason is reported with the result, unless the egress was already ending
+func (p *Pipeline) SendEOS(ctx context.Context, reason string) {
 	ctx, span := tracer.Start(ctx, "Pipeline.SendEOS")
 	defer span.End()
 
+	p.setEndedReason(reason)
 	p.closedOnce.Do(func() {
 		close(p.closed)
 		p.Info.Status = livekit.EgressStatus_EGRESS_ENDING
@@ -507,17 +1411,18 @@ func (p *Pipeline) SendEOS(ctx context.Context) {
 		}
 
 		go func() {
+			defer p.recoverPanic()
+
 			p.Logger.Debugw("sending EOS to pipeline")
-			p.eosTimer = time.AfterFunc(eosTimeout, func() {
-				p.Logger.Errorw("pipeline frozen", nil)
-				p.Info.Error = "pipeline frozen"
-				p.stop()
-			})
+			p.setEOSTimer(p.onFrozen)
 
 			switch s := p.in.Source.(type) {
 			case *source.SDKSource:
 				s.SendEOS()
+				p.in.EndGeneratedInputs()
 			case *source.WebSource:
+				p.sendTemplateMessage(s, templateMessageEnding, map[string]string{"reason": reason})
+				p.in.EndGeneratedInputs()
 				p.pipeline.SendEvent(gst.NewEOSEvent())
 			}
 		}()
@@ -557,13 +1462,13 @@ func (p *Pipeline) updateDuration(endedAt int64) {
 		}
 
 	case params.EgressTypeFile:
-		duration := p.getDuration(fileKey, endedAt)
+		duration := p.getMediaDuration(endedAt)
 		if duration > 0 {
 			p.FileInfo.Duration = duration
 		}
 
 	case params.EgressTypeSegmentedFile:
-		duration := p.getDuration(fileKey, endedAt)
+		duration := p.getMediaDuration(endedAt)
 		if duration > 0 {
 			p.SegmentsInfo.Duration = duration
 		}
@@ -571,6 +1476,15 @@ func (p *Pipeline) updateDuration(endedAt int64) {
 	}
 }
 
+// getMediaDuration returns the length of the recorded audio, which leaves out time spent starting or stalled.
+// Video only recordings use the wall clock
+func (p *Pipeline) getMediaDuration(endedAt int64) int64 {
+	if duration := p.in.AudioDuration(); duration > 0 {
+		return int64(duration)
+	}
+	return p.getDuration(fileKey, endedAt)
+}
+
 func (p *Pipeline) getDuration(k string, endedAt int64) int64 {
 	startedAt := p.startedAt[k]
 	duration := endedAt - startedAt
@@ -584,13 +1498,20 @@ func (p *Pipeline) getDuration(k string, endedAt int64) int64 {
 	return duration
 }
 
-func (p *Pipeline) messageWatch(msg *gst.Message) bool {
+// messageWatch handles the bus messages on the main loop. A panic keeps the watch, so that the EOS sent on recovery
+// still ends the loop
+func (p *Pipeline) messageWatch(msg *gst.Message) (keep bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.Recover(context.Background(), r)
+			keep = true
+		}
+	}()
+
 	switch msg.Type() {
 	case gst.MessageEOS:
 		// EOS received - close and return
-		if p.eosTimer != nil {
-			p.eosTimer.Stop()
-		}
+		p.stopEOSTimer()
 
 		p.Logger.Debugw("EOS received, stopping pipeline")
 		p.stop()
@@ -601,6 +1522,7 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 		err, handled := p.handleError(msg.ParseError())
 		if !handled {
 			p.Info.Error = err.Error()
+			p.setEndedReason(EndReasonError)
 			p.loop.Quit()
 			return false
 		}
@@ -624,6 +1546,9 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 
 		case pipelineSource:
 			p.playing = true
+			if p.timedMetadata != nil {
+				p.timedMetadata.playing()
+			}
 			switch s := p.in.Source.(type) {
 			case *source.SDKSource:
 				p.updateStartTime(s.GetStartTime())
@@ -637,7 +1562,7 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 		if s != nil {
 			switch s.Name() {
 			case fragmentOpenedMessage:
-				filepath, t, err := getSegmentParamsFromGstStructure(s)
+				filepath, t, err := p.getSegmentParams(s, &p.segmentsOpened)
 				if err != nil {
 					p.Logger.Errorw("failed retrieving parameters from fragment event structure", err)
 					return true
@@ -645,6 +1570,10 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 
 				p.Logger.Debugw("fragment opened event", "location", filepath, "running time", t)
 
+				if p.timedMetadata != nil {
+					p.timedMetadata.segmentOpened(filepath, t)
+				}
+
 				if p.playlistWriter != nil {
 					if err = p.playlistWriter.StartSegment(filepath, t); err != nil {
 						p.Logger.Errorw("failed registering new segment with playlist writer", err, "location", filepath, "running time", t)
@@ -653,7 +1582,7 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 				}
 
 			case fragmentClosedMessage:
-				filepath, t, err := getSegmentParamsFromGstStructure(s)
+				filepath, t, err := p.getSegmentParams(s, &p.segmentsClosed)
 				if err != nil {
 					p.Logger.Errorw("failed registering new segment with playlist writer", err, "location", filepath, "running time", t)
 					return true
@@ -661,11 +1590,28 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 
 				p.Logger.Debugw("fragment closed event", "location", filepath, "running time", t)
 
-				err = p.onSegmentEnded(filepath, t)
+				if err = p.in.OnSegmentClosed(); err != nil {
+					p.Logger.Errorw("could not set segment duration", err)
+				}
+
+				var data []byte
+				if p.SegmentsInMemory {
+					select {
+					case data = <-p.in.Segments():
+					default:
+						p.Logger.Errorw("segment data missing", nil, "location", filepath)
+						return true
+					}
+				}
+
+				err = p.onSegmentEnded(filepath, t, data)
 				if err != nil {
 					p.Logger.Errorw("failed ending segment with playlist writer", err, "running time", t)
 					return true
 				}
+
+			case snapshotMessage:
+				p.storeSnapshot(s)
 			}
 		}
 
@@ -676,6 +1622,20 @@ func (p *Pipeline) messageWatch(msg *gst.Message) bool {
 	return true
 }
 
+// getSegmentParams reads the segment location and running time from a fragment message.
+// In-memory segments have no location, so they are named from the count of fragment messages instead
+func (p *Pipeline) getSegmentParams(s *gst.Structure, count *int) (filepath string, time int64, err error) {
+	if p.SegmentsInMemory {
+		filepath = p.GetSegmentFilepath(*count)
+		*count++
+
+		t, err := getSegmentRunningTime(s)
+		return filepath, t, err
+	}
+
+	return getSegmentParamsFromGstStructure(s)
+}
+
 func getSegmentParamsFromGstStructure(s *gst.Structure) (filepath string, time int64, err error) {
 	loc, err := s.GetValue(fragmentLocation)
 	if err != nil {
@@ -686,16 +1646,25 @@ func getSegmentParamsFromGstStructure(s *gst.Structure) (filepath string, time i
 		return "", 0, errors.New("invalid type for location")
 	}
 
-	t, err := s.GetValue(fragmentRunningTime)
+	t, err := getSegmentRunningTime(s)
 	if err != nil {
 		return "", 0, err
 	}
+
+	return filepath, t, nil
+}
+
+func getSegmentRunningTime(s *gst.Structure) (int64, error) {
+	t, err := s.GetValue(fragmentRunningTime)
+	if err != nil {
+		return 0, err
+	}
 	ti, ok := t.(uint64)
 	if !ok {
-		return "", 0, errors.New("invalid type for time")
+		return 0, errors.New("invalid type for time")
 	}
 
-	return filepath, int64(ti), nil
+	return int64(ti), nil
 }
 
 func (p *Pipeline) stop() {
@@ -722,17 +1691,19 @@ func (p *Pipeline) stop() {
 
 // handleError returns true if the error has been handled, false if the pipeline should quit
 func (p *Pipeline) handleError(gErr *gst.GError) (error, bool) {
-	element, name, _ := parseDebugInfo(gErr)
+	_, name, _ := parseDebugInfo(gErr)
 	err := errors.New(gErr.Error())
 
 	switch {
-	case element == elementGstRtmp2Sink:
+	case p.EgressType == params.EgressTypeStream && p.out.HasStreamSink(name):
+		// each url fails on its own, whatever its protocol
+		err = p.out.StreamError(name, gErr.DebugString(), err)
 		if !p.playing {
-			p.Logger.Errorw("could not connect to rtmp output", err)
+			p.Logger.Errorw("could not connect to stream output", err)
 			return err, false
 		}
 
-		// bad URI or could not connect. Remove rtmp output
+		// bad URI or could not connect. Remove stream output
 		url, removalErr := p.out.RemoveSinkByName(name)
 		if removalErr != nil {
 			p.Logger.Errorw("failed to remove sink", removalErr)
@@ -744,8 +1715,10 @@ func (p *Pipeline) handleError(gErr *gst.GError) (error, bool) {
 			errChan <- err
 			delete(p.streamErrors, url)
 		} else {
-			startedAt := p.startedAt[url]
-			p.StreamInfo[url].Duration = time.Now().UnixNano() - startedAt
+			p.failedStreams[url] = true
+			if info, ok := p.StreamInfo[url]; ok {
+				info.Duration = time.Now().UnixNano() - p.startedAt[url]
+			}
 			delete(p.startedAt, url)
 			delete(p.StreamInfo, url)
 		}
@@ -771,7 +1744,8 @@ func parseDebugInfo(gErr *gst.GError) (element, name, message string) {
 	match := regExp.FindStringSubmatch(gErr.DebugString())
 
 	element = match[3]
-	name = match[4]
+	// errors from inside a sink bin, such as ristsink's udpsink, are attributed to the sink
+	name = strings.SplitN(match[4], "/", 2)[0]
 	message = match[6]
 	return
 }
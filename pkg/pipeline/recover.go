@@ -0,0 +1,111 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	panicStacksSuffix = ".panic.txt"
+	panicError        = "handler panic"
+
+	// the stack trace is cut short in the egress error, and stored in full next to the recording
+	maxPanicErrorStack = 4096
+)
+
+// Recover is called when the handler panics while the pipeline is still running. The egress fails with the panic,
+// but is finalized first, so that what was recorded is still uploaded
+func (p *Pipeline) Recover(ctx context.Context, r interface{}) {
+	p.setPanicError(p.recordPanic(r, debug.Stack()))
+
+	// the watchdog stops the pipeline if the EOS doesn't make it through
+	p.finalizing.Store(true)
+	p.SendEOS(ctx, EndReasonError)
+}
+
+// RecoverResult is called when Run panics after it has already recovered, while cleaning up. The egress fails with
+// the panic, and only the info which doesn't change while Run is running is reported
+func (p *Pipeline) RecoverResult(r interface{}) *livekit.EgressInfo {
+	p.setPanicError(p.recordPanic(r, debug.Stack()))
+	return p.PanicInfo()
+}
+
+// PanicInfo is the failed egress info reported when Run hasn't returned after a panic. It's built from the fields
+// which are set when the pipeline is created, since Run may still be writing to the rest
+func (p *Pipeline) PanicInfo() *livekit.EgressInfo {
+	return &livekit.EgressInfo{
+		EgressId: p.Info.EgressId,
+		RoomId:   p.Info.RoomId,
+		RoomName: p.Info.RoomName,
+		Status:   livekit.EgressStatus_EGRESS_FAILED,
+		Error:    p.panicError(),
+		EndedAt:  time.Now().UnixNano(),
+	}
+}
+
+// recoverPanic is deferred by the goroutines and bus callbacks of the pipeline, where a panic would crash the handler
+// without finalizing the egress
+func (p *Pipeline) recoverPanic() {
+	if r := recover(); r != nil {
+		p.Recover(context.Background(), r)
+	}
+}
+
+// recoverRun is called when Run panics. The main loop has already returned or never started, so the pipeline is
+// stopped, and a file which was already written is uploaded before the egress fails
+func (p *Pipeline) recoverRun(ctx context.Context, r interface{}) {
+	p.setPanicError(p.recordPanic(r, debug.Stack()))
+	p.stop()
+
+	if p.EgressType != params.EgressTypeFile || p.FileInfo.Location != "" || p.uploadDeferred {
+		return
+	}
+	if _, err := os.Stat(p.LocalFilepath); err != nil {
+		return
+	}
+	location, size, err := p.storeFile(ctx, p.LocalFilepath, p.StorageFilepath, p.OutputType)
+	if err != nil {
+		p.Logger.Errorw("could not upload file after panic", err)
+		return
+	}
+	p.FileInfo.Location = location
+	p.FileInfo.Size = size
+}
+
+// recordPanic logs the panic and stores its stack trace next to the recording. It returns the egress error, with the
+// stack trace cut short
+func (p *Pipeline) recordPanic(r interface{}, stack []byte) string {
+	p.Logger.Errorw(panicError, fmt.Errorf("%v", r), "stack", string(stack))
+
+	truncated := stack
+	if len(truncated) > maxPanicErrorStack {
+		truncated = truncated[:maxPanicErrorStack]
+	}
+	p.storeDiagnostic(panicStacksSuffix, stack)
+	return fmt.Sprintf("%s: %v\n%s", panicError, r, truncated)
+}
+
+// setPanicError keeps the first panic, which Run reports once it returns. Panics are recovered on other goroutines,
+// so the egress info is only written by Run
+func (p *Pipeline) setPanicError(err string) {
+	p.panicMu.Lock()
+	defer p.panicMu.Unlock()
+
+	if p.panicErr == "" {
+		p.panicErr = err
+	}
+}
+
+func (p *Pipeline) panicError() string {
+	p.panicMu.Lock()
+	defer p.panicMu.Unlock()
+
+	return p.panicErr
+}
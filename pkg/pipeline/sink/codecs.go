@@ -0,0 +1,118 @@
+package sink
+
+import (
+	"bytes"
+	"fmt"
+	"math/bits"
+	"strings"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	h264NALTypeSPS = 7
+	h265NALTypeSPS = 33
+
+	// general_profile_space through general_level_idc, the same in an h265 sps and hvcC
+	h265ProfileTierLevelSize = 12
+)
+
+// VideoFormat is the encoded video as it was written, read from its caps and first access unit
+type VideoFormat struct {
+	Codecs    string // RFC 6381, empty if the parameter sets couldn't be read
+	Width     int
+	Height    int
+	FrameRate float64
+}
+
+// VideoCodecs returns the RFC 6381 codecs string of h264 or h265 video, read from the decoder configuration record
+// in the caps' codec_data, or from the sequence parameter set of a byte-stream access unit
+func VideoCodecs(codec params.MimeType, codecData, au []byte) string {
+	switch codec {
+	case params.MimeTypeH264:
+		if len(codecData) >= 4 && codecData[0] == 1 {
+			// avcC: version, then profile_idc, constraint flags and level_idc
+			return h264Codecs(codecData[1:4])
+		}
+		if sps := findNAL(au, func(header []byte) bool { return header[0]&0x1f == h264NALTypeSPS }); len(sps) >= 4 {
+			return h264Codecs(sps[1:4])
+		}
+
+	case params.MimeTypeH265:
+		if len(codecData) > h265ProfileTierLevelSize && codecData[0] == 1 {
+			// hvcC: version, then the general profile, tier and level
+			return h265Codecs(codecData[1 : 1+h265ProfileTierLevelSize])
+		}
+		sps := findNAL(au, func(header []byte) bool { return len(header) > 1 && (header[0]>>1)&0x3f == h265NALTypeSPS })
+		// two byte header, then the vps id, max sub layers and temporal id nesting flag in one byte
+		if rbsp := removeEmulationPrevention(sps); len(rbsp) >= 3+h265ProfileTierLevelSize {
+			return h265Codecs(rbsp[3 : 3+h265ProfileTierLevelSize])
+		}
+	}
+	return ""
+}
+
+func h264Codecs(profileLevel []byte) string {
+	return fmt.Sprintf("avc1.%02x%02x%02x", profileLevel[0], profileLevel[1], profileLevel[2])
+}
+
+// h265Codecs formats the general profile, tier and level as described by ISO/IEC 14496-15 annex E
+func h265Codecs(ptl []byte) string {
+	profileSpace := []string{"", "A", "B", "C"}[ptl[0]>>6]
+	tier := "L"
+	if ptl[0]&0x20 != 0 {
+		tier = "H"
+	}
+	profileIDC := ptl[0] & 0x1f
+	compatibility := bits.Reverse32(uint32(ptl[1])<<24 | uint32(ptl[2])<<16 | uint32(ptl[3])<<8 | uint32(ptl[4]))
+	level := ptl[11]
+
+	codecs := fmt.Sprintf("hvc1.%s%d.%X.%s%d", profileSpace, profileIDC, compatibility, tier, level)
+
+	// constraint flags, without trailing zero bytes
+	constraints := bytes.TrimRight(ptl[5:11], "\x00")
+	for _, b := range constraints {
+		codecs += fmt.Sprintf(".%X", b)
+	}
+	return codecs
+}
+
+// findNAL returns the first NAL unit in an annex b byte-stream whose header matches
+func findNAL(au []byte, match func(header []byte) bool) []byte {
+	for _, nal := range bytes.Split(au, []byte{0, 0, 1}) {
+		// a four byte start code leaves a zero at the end of the previous unit
+		nal = bytes.TrimRight(nal, "\x00")
+		if len(nal) > 1 && match(nal) {
+			return nal
+		}
+	}
+	return nil
+}
+
+// removeEmulationPrevention returns a NAL unit's payload without the bytes which prevent start codes
+func removeEmulationPrevention(nal []byte) []byte {
+	rbsp := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+	return rbsp
+}
+
+// joinCodecs adds the audio codec to a measured video codecs string
+func joinCodecs(video string, audio bool) string {
+	codecs := []string{video}
+	if audio {
+		codecs = append(codecs, "mp4a.40.2")
+	}
+	return strings.Join(codecs, ",")
+}
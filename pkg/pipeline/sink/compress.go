@@ -0,0 +1,33 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// Compressible returns true for the small text files which players and dashboards fetch repeatedly,
+// such as live playlists. Media is already compressed
+func Compressible(mime params.OutputType) bool {
+	switch mime {
+	case params.OutputTypeHLS, params.OutputTypeJSON:
+		return true
+	default:
+		return false
+	}
+}
+
+// Gzip compresses body, to be stored with a gzip content encoding
+func Gzip(body io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := io.Copy(w, body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
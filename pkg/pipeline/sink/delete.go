@@ -0,0 +1,93 @@
+package sink
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/option"
+
+	"github.com/livekit/protocol/livekit"
+)
+
+// DeleteUploaded removes a previously uploaded object
+func DeleteUploaded(ctx context.Context, upload interface{}, storageFilepath string) error {
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		return deleteS3(ctx, u, storageFilepath)
+	case *livekit.GCPUpload:
+		return deleteGCP(ctx, u, storageFilepath)
+	case *livekit.AzureBlobUpload:
+		return deleteAzure(ctx, u, storageFilepath)
+	default:
+		return nil
+	}
+}
+
+func deleteS3(ctx context.Context, conf *livekit.S3Upload, storageFilepath string) error {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
+		Endpoint:    aws.String(conf.Endpoint),
+		Region:      aws.String(conf.Region),
+		MaxRetries:  aws.Int(maxRetries),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:       aws.String(conf.Bucket),
+		Key:          aws.String(storageFilepath),
+		RequestPayer: s3RequestPayer(conf.Bucket),
+	})
+	return err
+}
+
+func deleteAzure(ctx context.Context, conf *livekit.AzureBlobUpload, storageFilepath string) error {
+	credential, err := azblob.NewSharedKeyCredential(
+		conf.AccountName,
+		conf.AccountKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
+		Retry: azblob.RetryOptions{
+			Policy:        azblob.RetryPolicyExponential,
+			MaxTries:      maxRetries,
+			RetryDelay:    minDelay,
+			MaxRetryDelay: maxDelay,
+		},
+	})
+	azUrl, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", conf.AccountName, conf.ContainerName))
+	if err != nil {
+		return err
+	}
+
+	blobURL := azblob.NewContainerURL(*azUrl, pipeline).NewBlockBlobURL(storageFilepath)
+	_, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	return err
+}
+
+func deleteGCP(ctx context.Context, conf *livekit.GCPUpload, storageFilepath string) error {
+	var client *storage.Client
+	var err error
+	if conf.Credentials != nil {
+		client, err = storage.NewClient(ctx, option.WithCredentialsJSON(conf.Credentials))
+	} else {
+		client, err = storage.NewClient(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Bucket(conf.Bucket).Object(storageFilepath).Delete(ctx)
+}
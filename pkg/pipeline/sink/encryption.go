@@ -0,0 +1,56 @@
+package sink
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"os"
+	"strings"
+)
+
+const segmentKeySize = 16
+
+// segmentKey is an AES-128 key shared by a run of segments
+type segmentKey struct {
+	key      []byte
+	filepath string
+	uri      string
+}
+
+func newSegmentKey(filepath, uriTemplate string) (*segmentKey, error) {
+	key := make([]byte, segmentKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath, key, 0600); err != nil {
+		return nil, err
+	}
+
+	return &segmentKey{
+		key:      key,
+		filepath: filepath,
+		uri:      strings.ReplaceAll(uriTemplate, "{filename}", getFilenameFromFilePath(filepath)),
+	}, nil
+}
+
+// EncryptSegment encrypts a whole segment with AES-128-CBC and PKCS7 padding.
+// EXT-X-KEY tags are written without an IV, so players use the media sequence number
+func EncryptSegment(key []byte, sequence uint64, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], sequence)
+
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	encrypted := make([]byte, len(data)+padding)
+	copy(encrypted, data)
+	copy(encrypted[len(data):], bytes.Repeat([]byte{byte(padding)}, padding))
+
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+	return encrypted, nil
+}
@@ -0,0 +1,244 @@
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+type mp4Box struct {
+	boxType string
+	offset  int64
+	size    int64
+}
+
+// CheckMP4 reads the duration of a finalized mp4 file, which fails if it has no moov box. If the moov box follows the
+// media data, as it does when the muxer couldn't finish faststart, it's moved ahead of it so that playback can start
+// before the whole file is downloaded
+func CheckMP4(localFilepath string) (duration time.Duration, moved bool, err error) {
+	f, err := os.Open(localFilepath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, false, err
+	}
+
+	boxes, err := readTopLevelBoxes(f, stat.Size())
+	if err != nil {
+		return 0, false, err
+	}
+
+	moovIndex, mdatIndex := -1, -1
+	for i, box := range boxes {
+		switch box.boxType {
+		case "moov":
+			moovIndex = i
+		case "mdat":
+			if mdatIndex == -1 {
+				mdatIndex = i
+			}
+		}
+	}
+	if moovIndex == -1 {
+		return 0, false, fmt.Errorf("no moov box found")
+	}
+	if mdatIndex == -1 {
+		return 0, false, fmt.Errorf("no mdat box found")
+	}
+
+	moov := make([]byte, boxes[moovIndex].size)
+	if _, err = f.ReadAt(moov, boxes[moovIndex].offset); err != nil {
+		return 0, false, err
+	}
+	headerLen := boxHeaderLen(moov)
+	if duration, err = readMovieDuration(moov[headerLen:]); err != nil {
+		return 0, false, err
+	}
+
+	if moovIndex < mdatIndex {
+		return duration, false, nil
+	}
+
+	// media data ahead of the moov box moves back by its size
+	if err = shiftChunkOffsets(moov[headerLen:], boxes[moovIndex].offset, boxes[moovIndex].size); err != nil {
+		return 0, false, err
+	}
+	tmpFilepath := localFilepath + ".faststart"
+	if err = writeFaststart(f, tmpFilepath, boxes, moovIndex, mdatIndex, moov); err != nil {
+		_ = os.Remove(tmpFilepath)
+		return 0, false, err
+	}
+	return duration, true, os.Rename(tmpFilepath, localFilepath)
+}
+
+func readTopLevelBoxes(f *os.File, fileSize int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	header := make([]byte, 16)
+	for offset := int64(0); offset < fileSize; {
+		n, err := f.ReadAt(header, offset)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		size, boxType, err := readBoxHeader(header[:n])
+		if err != nil {
+			return nil, err
+		}
+
+		boxSize := int64(size)
+		if size == 0 {
+			// box extends to the end of the file
+			boxSize = fileSize - offset
+		}
+		if offset+boxSize > fileSize {
+			return nil, fmt.Errorf("truncated %s box", boxType)
+		}
+
+		boxes = append(boxes, mp4Box{boxType: boxType, offset: offset, size: boxSize})
+		offset += boxSize
+	}
+	return boxes, nil
+}
+
+func boxHeaderLen(b []byte) int {
+	if binary.BigEndian.Uint32(b[:4]) == 1 {
+		return 16
+	}
+	return 8
+}
+
+// forEachBox calls f with the type and contents of each box in b
+func forEachBox(b []byte, f func(boxType string, payload []byte) error) error {
+	for offset := 0; offset < len(b); {
+		size, boxType, err := readBoxHeader(b[offset:])
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			size = len(b) - offset
+		}
+		if offset+size > len(b) {
+			return fmt.Errorf("truncated %s box", boxType)
+		}
+
+		if err = f(boxType, b[offset+boxHeaderLen(b[offset:]):offset+size]); err != nil {
+			return err
+		}
+		offset += size
+	}
+	return nil
+}
+
+// readMovieDuration reads the duration from the mvhd box of a moov box's contents
+func readMovieDuration(moov []byte) (time.Duration, error) {
+	var duration time.Duration
+	found := false
+	err := forEachBox(moov, func(boxType string, payload []byte) error {
+		if boxType != "mvhd" {
+			return nil
+		}
+
+		var timescale uint32
+		var units uint64
+		if len(payload) >= 32 && payload[0] == 1 {
+			// 64 bit creation and modification times
+			timescale = binary.BigEndian.Uint32(payload[20:24])
+			units = binary.BigEndian.Uint64(payload[24:32])
+		} else if len(payload) >= 20 && payload[0] == 0 {
+			timescale = binary.BigEndian.Uint32(payload[12:16])
+			units = uint64(binary.BigEndian.Uint32(payload[16:20]))
+		} else {
+			return fmt.Errorf("invalid mvhd box")
+		}
+		if timescale == 0 {
+			return fmt.Errorf("invalid mvhd timescale")
+		}
+
+		duration = time.Duration(float64(units) / float64(timescale) * float64(time.Second))
+		found = true
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !found {
+		return 0, fmt.Errorf("no mvhd box found")
+	}
+	return duration, nil
+}
+
+// shiftChunkOffsets adds shift to the file offsets before end in the stco and co64 boxes of every track
+func shiftChunkOffsets(b []byte, end, shift int64) error {
+	return forEachBox(b, func(boxType string, payload []byte) error {
+		switch boxType {
+		case "trak", "mdia", "minf", "stbl":
+			return shiftChunkOffsets(payload, end, shift)
+
+		case "stco":
+			if len(payload) < 8 {
+				return fmt.Errorf("invalid stco box")
+			}
+			count := int(binary.BigEndian.Uint32(payload[4:8]))
+			if len(payload) < 8+count*4 {
+				return fmt.Errorf("truncated stco box")
+			}
+			for i := 0; i < count; i++ {
+				entry := payload[8+i*4 : 12+i*4]
+				offset := int64(binary.BigEndian.Uint32(entry))
+				if offset >= end {
+					continue
+				}
+				if offset += shift; offset > math.MaxUint32 {
+					return fmt.Errorf("chunk offset overflows stco box")
+				}
+				binary.BigEndian.PutUint32(entry, uint32(offset))
+			}
+
+		case "co64":
+			if len(payload) < 8 {
+				return fmt.Errorf("invalid co64 box")
+			}
+			count := int(binary.BigEndian.Uint32(payload[4:8]))
+			if len(payload) < 8+count*8 {
+				return fmt.Errorf("truncated co64 box")
+			}
+			for i := 0; i < count; i++ {
+				entry := payload[8+i*8 : 16+i*8]
+				if offset := binary.BigEndian.Uint64(entry); offset < uint64(end) {
+					binary.BigEndian.PutUint64(entry, offset+uint64(shift))
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// writeFaststart copies the file with its moov box ahead of the first mdat box
+func writeFaststart(f *os.File, tmpFilepath string, boxes []mp4Box, moovIndex, mdatIndex int, moov []byte) error {
+	out, err := os.Create(tmpFilepath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for i, box := range boxes {
+		if i == mdatIndex {
+			if _, err = out.Write(moov); err != nil {
+				return err
+			}
+		}
+		if i == moovIndex {
+			continue
+		}
+		if _, err = io.Copy(out, io.NewSectionReader(f, box.offset, box.size)); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
@@ -0,0 +1,85 @@
+package sink
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// SplitInitSegment moves the initialization section (ftyp and moov boxes) out of a fragmented mp4 segment.
+// splitmuxsink creates a new muxer for every fragment, so every segment starts with its own copy of the init section.
+// The init section is only written to initPath once, and the segment is rewritten to contain media fragments only.
+func SplitInitSegment(segmentPath, initPath string) (initCreated bool, err error) {
+	b, err := os.ReadFile(segmentPath)
+	if err != nil {
+		return false, err
+	}
+
+	init, media, err := SplitInitSection(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", segmentPath, err)
+	}
+
+	if _, err = os.Stat(initPath); os.IsNotExist(err) {
+		if err = os.WriteFile(initPath, init, 0644); err != nil {
+			return false, err
+		}
+		initCreated = true
+	}
+
+	return initCreated, os.WriteFile(segmentPath, media, 0644)
+}
+
+// SplitInitSection separates the initialization section of a fragmented mp4 segment from its media fragments
+func SplitInitSection(b []byte) (init, media []byte, err error) {
+	for offset := 0; offset < len(b); {
+		size, boxType, err := readBoxHeader(b[offset:])
+		if err != nil {
+			return nil, nil, err
+		}
+		if size == 0 {
+			// box extends to the end of the file
+			size = len(b) - offset
+		}
+		if offset+size > len(b) {
+			return nil, nil, fmt.Errorf("truncated %s box", boxType)
+		}
+
+		box := b[offset : offset+size]
+		switch boxType {
+		case "ftyp", "moov":
+			init = append(init, box...)
+		case "mfra":
+			// random access info for the whole file is meaningless once split into segments
+		default:
+			media = append(media, box...)
+		}
+		offset += size
+	}
+
+	if len(init) == 0 {
+		return nil, nil, fmt.Errorf("no init section found")
+	}
+
+	return init, media, nil
+}
+
+func readBoxHeader(b []byte) (size int, boxType string, err error) {
+	if len(b) < 8 {
+		return 0, "", fmt.Errorf("invalid box header")
+	}
+
+	size = int(binary.BigEndian.Uint32(b[:4]))
+	boxType = string(b[4:8])
+	if size == 1 {
+		// 64 bit largesize follows the box type
+		if len(b) < 16 {
+			return 0, "", fmt.Errorf("invalid box header")
+		}
+		size = int(binary.BigEndian.Uint64(b[8:16]))
+	} else if size != 0 && size < 8 {
+		return 0, "", fmt.Errorf("invalid %s box size %d", boxType, size)
+	}
+
+	return size, boxType, nil
+}
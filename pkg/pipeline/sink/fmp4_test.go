@@ -0,0 +1,119 @@
+package sink
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func box(boxType, payload string) []byte {
+	b := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(8+len(payload)))
+	copy(b[4:], boxType)
+	return append(b, payload...)
+}
+
+func largeBox(boxType, payload string) []byte {
+	b := make([]byte, 16, 16+len(payload))
+	binary.BigEndian.PutUint32(b, 1)
+	copy(b[4:], boxType)
+	binary.BigEndian.PutUint64(b[8:], uint64(16+len(payload)))
+	return append(b, payload...)
+}
+
+func TestSplitInitSegment(t *testing.T) {
+	ftyp := box("ftyp", "iso6")
+	moov := box("moov", "tracks")
+	moof := box("moof", "fragment")
+	mdat := box("mdat", "media")
+
+	for _, test := range []struct {
+		name    string
+		segment []byte
+		init    []byte
+		media   []byte
+		err     bool
+	}{
+		{
+			name:    "init and fragment",
+			segment: bytes.Join([][]byte{ftyp, moov, moof, mdat}, nil),
+			init:    bytes.Join([][]byte{ftyp, moov}, nil),
+			media:   bytes.Join([][]byte{moof, mdat}, nil),
+		},
+		{
+			name:    "several fragments",
+			segment: bytes.Join([][]byte{ftyp, moov, moof, mdat, moof, mdat}, nil),
+			init:    bytes.Join([][]byte{ftyp, moov}, nil),
+			media:   bytes.Join([][]byte{moof, mdat, moof, mdat}, nil),
+		},
+		{
+			name:    "random access info",
+			segment: bytes.Join([][]byte{ftyp, moov, moof, mdat, box("mfra", "offsets")}, nil),
+			init:    bytes.Join([][]byte{ftyp, moov}, nil),
+			media:   bytes.Join([][]byte{moof, mdat}, nil),
+		},
+		{
+			name:    "large box",
+			segment: bytes.Join([][]byte{ftyp, moov, moof, largeBox("mdat", "media")}, nil),
+			init:    bytes.Join([][]byte{ftyp, moov}, nil),
+			media:   bytes.Join([][]byte{moof, largeBox("mdat", "media")}, nil),
+		},
+		{
+			name:    "box to end of file",
+			segment: append(bytes.Join([][]byte{ftyp, moov, moof}, nil), 0, 0, 0, 0, 'm', 'd', 'a', 't', 'x'),
+			init:    bytes.Join([][]byte{ftyp, moov}, nil),
+			media:   append(append([]byte{}, moof...), 0, 0, 0, 0, 'm', 'd', 'a', 't', 'x'),
+		},
+		{
+			name:    "no init section",
+			segment: bytes.Join([][]byte{moof, mdat}, nil),
+			err:     true,
+		},
+		{
+			name:    "truncated",
+			segment: bytes.Join([][]byte{ftyp, moov, moof, mdat[:len(mdat)-1]}, nil),
+			err:     true,
+		},
+		{
+			name:    "invalid size",
+			segment: append(bytes.Join([][]byte{ftyp, moov}, nil), 0, 0, 0, 4, 'm', 'd', 'a', 't'),
+			err:     true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			segmentPath := path.Join(dir, "segment_00000.m4s")
+			initPath := path.Join(dir, "init.mp4")
+			require.NoError(t, os.WriteFile(segmentPath, test.segment, 0644))
+
+			initCreated, err := SplitInitSegment(segmentPath, initPath)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.True(t, initCreated)
+
+			b, err := os.ReadFile(initPath)
+			require.NoError(t, err)
+			require.Equal(t, test.init, b)
+			b, err = os.ReadFile(segmentPath)
+			require.NoError(t, err)
+			require.Equal(t, test.media, b)
+
+			// the init section is only written for the first segment
+			nextPath := path.Join(dir, "segment_00001.m4s")
+			require.NoError(t, os.WriteFile(nextPath, test.segment, 0644))
+			initCreated, err = SplitInitSegment(nextPath, initPath)
+			require.NoError(t, err)
+			require.False(t, initCreated)
+			b, err = os.ReadFile(nextPath)
+			require.NoError(t, err)
+			require.Equal(t, test.media, b)
+		})
+	}
+}
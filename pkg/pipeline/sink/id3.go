@@ -0,0 +1,279 @@
+package sink
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const (
+	tsPacketSize    = 188
+	tsSyncByte      = 0x47
+	tsPATPID        = 0x0000
+	tsMaxPayload    = tsPacketSize - 4
+	pmtTableID      = 0x02
+	id3StreamType   = 0x15 // metadata carried in PES packets
+	id3StreamID     = 0xbd // private_stream_1
+	id3PID          = 0x1f00
+	ptsClockRate    = 90000
+	ptsWrap         = 1 << 33
+	metadataPointer = 0x25
+	metadataTag     = 0x26
+)
+
+// TimedID3 is an ID3 tag shown at an offset from the start of a segment
+type TimedID3 struct {
+	Offset time.Duration
+	Tag    []byte
+}
+
+// ID3Inserter adds timed ID3 metadata to mpeg ts segments, as described by Apple's "Timed Metadata for HTTP Live Streaming".
+// The metadata stream is declared in the PMT of every segment, and tags are sent as PES packets timed against the segment's media
+type ID3Inserter struct {
+	continuity byte
+}
+
+func NewID3Inserter() *ID3Inserter {
+	return &ID3Inserter{}
+}
+
+// ID3Tag returns an ID3v2.4 tag with a single TXXX frame, which players expose as a key and value
+func ID3Tag(key, value string) []byte {
+	body := append([]byte{0x03}, key...) // utf-8
+	body = append(body, 0x00)
+	body = append(body, value...)
+
+	frame := append([]byte("TXXX"), syncsafe(len(body))...)
+	frame = append(frame, 0x00, 0x00)
+	frame = append(frame, body...)
+
+	tag := append([]byte{'I', 'D', '3', 0x04, 0x00, 0x00}, syncsafe(len(frame))...)
+	return append(tag, frame...)
+}
+
+func syncsafe(size int) []byte {
+	return []byte{byte(size>>21) & 0x7f, byte(size>>14) & 0x7f, byte(size>>7) & 0x7f, byte(size) & 0x7f}
+}
+
+// Insert declares the metadata stream in the segment's PMT, and adds the tags after its first PMT
+func (i *ID3Inserter) Insert(segment []byte, tags []TimedID3) ([]byte, error) {
+	if len(segment)%tsPacketSize != 0 {
+		return nil, errors.New("segment is not a whole number of ts packets")
+	}
+
+	pmtPID := -1
+	firstPMT := -1
+	var firstPTS int64 = -1
+	out := make([]byte, len(segment))
+	copy(out, segment)
+
+	for offset := 0; offset < len(out); offset += tsPacketSize {
+		packet := out[offset : offset+tsPacketSize]
+		if packet[0] != tsSyncByte {
+			return nil, errors.New("lost ts sync")
+		}
+		pid := int(binary.BigEndian.Uint16(packet[1:3]) & 0x1fff)
+		unitStart := packet[1]&0x40 != 0
+		payload := tsPayload(packet)
+		if payload == nil || !unitStart {
+			continue
+		}
+
+		switch {
+		case pid == tsPATPID:
+			if pmtPID < 0 {
+				pmtPID = readPMTPID(payload)
+			}
+		case pid == pmtPID:
+			if err := addMetadataStream(packet); err != nil {
+				return nil, err
+			}
+			if firstPMT < 0 {
+				firstPMT = offset
+			}
+		case pid == id3PID:
+			return nil, errors.New("segment already uses the metadata pid")
+		case firstPTS < 0:
+			firstPTS = readPTS(payload)
+		}
+	}
+
+	if firstPMT < 0 {
+		return nil, errors.New("segment has no pmt")
+	}
+	if len(tags) == 0 {
+		return out, nil
+	}
+	if firstPTS < 0 {
+		return nil, errors.New("segment has no timestamps")
+	}
+
+	var packets []byte
+	for _, tag := range tags {
+		pts := (firstPTS + int64(tag.Offset)*ptsClockRate/int64(time.Second)) % ptsWrap
+		packets = append(packets, i.packetize(buildID3PES(tag.Tag, pts))...)
+	}
+
+	insertAt := firstPMT + tsPacketSize
+	res := make([]byte, 0, len(out)+len(packets))
+	res = append(res, out[:insertAt]...)
+	res = append(res, packets...)
+	return append(res, out[insertAt:]...), nil
+}
+
+// tsPayload returns the payload of a packet, after its adaptation field
+func tsPayload(packet []byte) []byte {
+	control := (packet[3] >> 4) & 0x03
+	switch control {
+	case 0x01:
+		return packet[4:]
+	case 0x03:
+		start := 5 + int(packet[4])
+		if start >= tsPacketSize {
+			return nil
+		}
+		return packet[start:]
+	default:
+		return nil
+	}
+}
+
+// readPMTPID returns the PMT pid of the first program in a PAT
+func readPMTPID(payload []byte) int {
+	section := payload[1+int(payload[0]):]
+	if len(section) < 16 {
+		return -1
+	}
+	sectionLength := int(binary.BigEndian.Uint16(section[1:3]) & 0x0fff)
+	for i := 8; i+4 <= 3+sectionLength-4 && i+4 <= len(section); i += 4 {
+		program := binary.BigEndian.Uint16(section[i : i+2])
+		if program != 0 {
+			return int(binary.BigEndian.Uint16(section[i+2:i+4]) & 0x1fff)
+		}
+	}
+	return -1
+}
+
+// readPTS returns the PTS of a PES packet header, or -1 if it has none
+func readPTS(payload []byte) int64 {
+	if len(payload) < 14 || payload[0] != 0 || payload[1] != 0 || payload[2] != 1 || payload[7]&0x80 == 0 {
+		return -1
+	}
+	p := payload[9:14]
+	return int64(p[0]>>1&0x07)<<30 | int64(p[1])<<22 | int64(p[2]>>1)<<15 | int64(p[3])<<7 | int64(p[4]>>1)
+}
+
+// addMetadataStream rewrites a PMT section in place, adding the metadata pointer and the metadata stream.
+// mpegtsmux writes the PMT in a single packet, so the section has to stay within it
+func addMetadataStream(packet []byte) error {
+	payloadStart := tsPacketSize - len(tsPayload(packet))
+	sectionStart := payloadStart + 1 + int(packet[payloadStart])
+	section := packet[sectionStart:]
+	if len(section) < 12 || section[0] != pmtTableID {
+		return errors.New("invalid pmt")
+	}
+
+	sectionLength := int(binary.BigEndian.Uint16(section[1:3]) & 0x0fff)
+	if 3+sectionLength > len(section) {
+		return errors.New("pmt spans packets")
+	}
+	programNumber := binary.BigEndian.Uint16(section[3:5])
+	programInfoLength := int(binary.BigEndian.Uint16(section[10:12]) & 0x0fff)
+
+	pointer := []byte{metadataPointer, 15, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x1f, 0, 0}
+	binary.BigEndian.PutUint16(pointer[15:], programNumber)
+	descriptor := []byte{metadataTag, 13, 0xff, 0xff, 'I', 'D', '3', ' ', 0xff, 'I', 'D', '3', ' ', 0x00, 0x0f}
+	stream := []byte{id3StreamType, 0xe0 | byte(id3PID>>8), byte(id3PID & 0xff), 0xf0, byte(len(descriptor))}
+	stream = append(stream, descriptor...)
+
+	programInfoEnd := 12 + programInfoLength
+	streamsEnd := 3 + sectionLength - 4
+	updated := make([]byte, 0, sectionLength+3+len(pointer)+len(stream))
+	updated = append(updated, section[:programInfoEnd]...)
+	updated = append(updated, pointer...)
+	updated = append(updated, section[programInfoEnd:streamsEnd]...)
+	updated = append(updated, stream...)
+	if len(updated)+4 > len(section) {
+		return errors.New("pmt too long for metadata")
+	}
+
+	binary.BigEndian.PutUint16(updated[1:3], 0xb000|uint16(len(updated)+4-3))
+	binary.BigEndian.PutUint16(updated[10:12], 0xf000|uint16(programInfoLength+len(pointer)))
+	crc := make([]byte, 4)
+	binary.BigEndian.PutUint32(crc, crc32MPEG2(updated))
+	updated = append(updated, crc...)
+
+	n := copy(section, updated)
+	for i := n; i < len(section); i++ {
+		// stuffing after the section
+		section[i] = 0xff
+	}
+	return nil
+}
+
+// buildID3PES wraps a tag in a PES packet with a presentation timestamp
+func buildID3PES(tag []byte, pts int64) []byte {
+	pes := []byte{0x00, 0x00, 0x01, id3StreamID, 0, 0, 0x84, 0x80, 0x05,
+		0x21 | byte(pts>>29)&0x0e, byte(pts >> 22), 0x01 | byte(pts>>14)&0xfe, byte(pts >> 7), 0x01 | byte(pts<<1)&0xfe,
+	}
+	binary.BigEndian.PutUint16(pes[4:6], uint16(len(pes)-6+len(tag)))
+	return append(pes, tag...)
+}
+
+// packetize splits a PES packet into ts packets, stuffing the adaptation field of the last one
+func (i *ID3Inserter) packetize(pes []byte) []byte {
+	var packets []byte
+	for first := true; len(pes) > 0; first = false {
+		header := []byte{tsSyncByte, byte(id3PID >> 8), byte(id3PID & 0xff), 0x10 | i.continuity}
+		if first {
+			header[1] |= 0x40
+		}
+		i.continuity = (i.continuity + 1) & 0x0f
+
+		n := len(pes)
+		if n >= tsMaxPayload {
+			n = tsMaxPayload
+			packets = append(packets, header...)
+		} else {
+			// adaptation field, then payload
+			header[3] |= 0x20
+			stuffing := tsMaxPayload - n - 1
+			packets = append(packets, header...)
+			packets = append(packets, byte(stuffing))
+			if stuffing > 0 {
+				packets = append(packets, 0x00)
+				for j := 1; j < stuffing; j++ {
+					packets = append(packets, 0xff)
+				}
+			}
+		}
+		packets = append(packets, pes[:n]...)
+		pes = pes[n:]
+	}
+	return packets
+}
+
+var crc32MPEG2Table = func() [256]uint32 {
+	var table [256]uint32
+	for i := range table {
+		crc := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if crc&0x80000000 != 0 {
+				crc = crc<<1 ^ 0x04c11db7
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+func crc32MPEG2(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ crc32MPEG2Table[byte(crc>>24)^b]
+	}
+	return crc
+}
@@ -3,8 +3,11 @@ package sink
 import (
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -18,9 +21,53 @@ type PlaylistWriter struct {
 	currentItemStartTimestamp int64
 	currentItemFilename       string
 	playlistPath              string
+	masterPlaylistPath        string
 
 	openSegmentsStartTime map[string]int64
 	openSegmentsLock      sync.Mutex
+
+	// event playlists become vod playlists on EOS
+	vod bool
+
+	// byte range playlists point into a single media file
+	singleFile    string
+	segmentRanges map[string]byteRange
+
+	// segments stored under another name, such as the hash of their contents
+	segmentPaths map[string]string
+
+	// live playlists only list the latest segments
+	window         int
+	windowSegments []windowSegment
+
+	// the master playlist is rewritten once the stream has been measured
+	master        m3u8.VariantParams
+	audio         bool
+	segmentSizes  map[string]int64
+	peakBandwidth uint32
+	totalBits     float64
+	totalDuration float64
+	masterUpdated bool
+	compatibility bool
+
+	// AES-128 encryption
+	encrypted      bool
+	keyURI         string
+	keyRotation    int
+	getKeyFilepath func(int) string
+	key            *segmentKey
+	keyIndex       int
+	keyChanged     bool
+}
+
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+type windowSegment struct {
+	filepath string
+	key      *segmentKey
 }
 
 func NewPlaylistWriter(p *params.Params) (*PlaylistWriter, error) {
@@ -28,19 +75,62 @@ func NewPlaylistWriter(p *params.Params) (*PlaylistWriter, error) {
 	// "github.com/grafov/m3u8" is fairly inefficient for frequent serializations of long playlists and
 	// doesn't implement recent additions to the HLS spec, but I'm not aware of anything better, short of
 	// writing one.
-	playlist, err := m3u8.NewMediaPlaylist(0, 15000) // 15,000 -> about 24h with 6s segments
+	var playlist *m3u8.MediaPlaylist
+	var err error
+	if p.PlaylistWindow > 0 {
+		// live playlists have no playlist type, and drop their oldest segment as new ones are added
+		playlist, err = m3u8.NewMediaPlaylist(uint(p.PlaylistWindow), uint(p.PlaylistWindow))
+	} else {
+		playlist, err = m3u8.NewMediaPlaylist(0, 15000) // 15,000 -> about 24h with 6s segments
+		if err == nil {
+			playlist.MediaType = m3u8.EVENT
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	playlist.MediaType = m3u8.EVENT
 	playlist.SetVersion(4) // Needed because we have float segment durations
 
-	return &PlaylistWriter{
+	if p.PlaylistCompatibility {
+		// segment durations are only floats from version 3
+		playlist.SetVersion(uint8(p.PlaylistVersion))
+		playlist.DurationAsInt(p.PlaylistVersion < 3)
+	} else if p.GetSegmentOutputType() == params.OutputTypeMP4 {
+		// fragmented mp4 segments require an EXT-X-MAP init section, and version 7 for full fmp4 support.
+		// In a single media file, the init section is at the start of the file, and is set once it's written
+		if p.SingleFileFilename == "" {
+			playlist.SetDefaultMap(getFilenameFromFilePath(p.InitSegmentFilename), 0, 0)
+		}
+		playlist.SetVersion(7)
+	}
+
+	w := &PlaylistWriter{
 		playlist:              playlist,
 		playlistPath:          p.PlaylistFilename,
+		masterPlaylistPath:    p.MasterPlaylistFilename,
 		openSegmentsStartTime: make(map[string]int64),
-	}, nil
+		encrypted:             p.SegmentEncryption,
+		keyURI:                p.KeyURI,
+		keyRotation:           p.KeyRotation,
+		getKeyFilepath:        p.GetKeyFilepath,
+		window:                p.PlaylistWindow,
+		vod:                   p.PlaylistVOD,
+		singleFile:            getFilenameFromFilePath(p.SingleFileFilename),
+		segmentRanges:         make(map[string]byteRange),
+		segmentPaths:          make(map[string]string),
+		master:                getVariantParams(p),
+		audio:                 p.AudioEnabled,
+		segmentSizes:          make(map[string]int64),
+		compatibility:         p.PlaylistCompatibility,
+	}
+
+	// written from the encoding settings, until the stream has been measured
+	if err = w.writeMasterPlaylist(); err != nil {
+		return nil, err
+	}
+
+	return w, nil
 }
 
 func (w *PlaylistWriter) StartSegment(filepath string, startTime int64) error {
@@ -65,13 +155,76 @@ func (w *PlaylistWriter) StartSegment(filepath string, startTime int64) error {
 	return nil
 }
 
-func (w *PlaylistWriter) EndSegment(filepath string, endTime int64) error {
+// SetInitRange points EXT-X-MAP at the init section written at the start of the single media file
+func (w *PlaylistWriter) SetInitRange(length int64) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	w.playlist.SetDefaultMap(w.singleFile, length, 0)
+}
+
+// SetSegmentRange sets the location of a segment within the single media file. It must be called before EndSegment
+func (w *PlaylistWriter) SetSegmentRange(filepath string, offset, length int64) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	w.segmentRanges[getFilenameFromFilePath(filepath)] = byteRange{offset: offset, length: length}
+}
+
+// SetSegmentPath sets the path a segment was renamed to before being stored. It must be called before EndSegment
+func (w *PlaylistWriter) SetSegmentPath(filepath, storedPath string) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	w.segmentPaths[getFilenameFromFilePath(filepath)] = storedPath
+}
+
+// SetSegmentSize sets the size of a segment as stored, for the master playlist's bandwidth. It must be called before EndSegment
+func (w *PlaylistWriter) SetSegmentSize(filepath string, size int64) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	w.segmentSizes[getFilenameFromFilePath(filepath)] = size
+}
+
+// SetVideoFormat updates the master playlist with the video as it was encoded
+func (w *PlaylistWriter) SetVideoFormat(format *VideoFormat) error {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	if format.Codecs != "" {
+		w.master.Codecs = joinCodecs(format.Codecs, w.audio)
+	}
+	if format.Width > 0 && format.Height > 0 {
+		w.master.Resolution = fmt.Sprintf("%dx%d", format.Width, format.Height)
+	}
+	if format.FrameRate > 0 {
+		w.master.FrameRate = format.FrameRate
+	}
+
+	w.masterUpdated = true
+	return w.writeMasterPlaylist()
+}
+
+// MasterPlaylistUpdated returns true if the master playlist has been rewritten since it was last checked
+func (w *PlaylistWriter) MasterPlaylistUpdated() bool {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	updated := w.masterUpdated
+	w.masterUpdated = false
+	return updated
+}
+
+// EndSegment adds the segment to the playlist. For live playlists, it returns the local paths of
+// the segment and key files which are no longer referenced, so that they can be deleted
+func (w *PlaylistWriter) EndSegment(filepath string, endTime int64) ([]string, error) {
 	if filepath == "" {
-		return fmt.Errorf("invalid filepath")
+		return nil, fmt.Errorf("invalid filepath")
 	}
 
 	if endTime <= w.currentItemStartTimestamp {
-		return fmt.Errorf("segment end time before start time")
+		return nil, fmt.Errorf("segment end time before start time")
 	}
 
 	k := getFilenameFromFilePath(filepath)
@@ -81,24 +234,215 @@ func (w *PlaylistWriter) EndSegment(filepath string, endTime int64) error {
 
 	t, ok := w.openSegmentsStartTime[k]
 	if !ok {
-		return fmt.Errorf("no open segment with the name %s", k)
+		return nil, fmt.Errorf("no open segment with the name %s", k)
 	}
 	delete(w.openSegmentsStartTime, k)
 
 	duration := float64(endTime-t) / float64(time.Second)
 
+	var expired []string
+	if w.window > 0 && w.playlist.Count() >= uint(w.window) {
+		var err error
+		if expired, err = w.removeOldestSegment(); err != nil {
+			return nil, err
+		}
+	}
+
+	uri := k
+	if w.singleFile != "" {
+		uri = w.singleFile
+	} else if storedPath, ok := w.segmentPaths[k]; ok {
+		delete(w.segmentPaths, k)
+		filepath = storedPath
+		uri = getFilenameFromFilePath(storedPath)
+	}
+
 	// This assumes EndSegment will be called in the same order as StartSegment
-	err := w.playlist.Append(k, duration, "")
+	err := w.playlist.Append(uri, duration, "")
 	if err != nil {
-		return err
+		return expired, err
+	}
+
+	size := w.segmentSizes[k]
+	delete(w.segmentSizes, k)
+	if r, ok := w.segmentRanges[k]; ok {
+		delete(w.segmentRanges, k)
+		size = r.length
+		if err = w.playlist.SetRange(r.length, r.offset); err != nil {
+			return expired, err
+		}
+	}
+	if err = w.measureSegment(size, duration); err != nil {
+		return expired, err
+	}
+
+	// EXT-X-KEY applies to every following segment, so it's only written when the key changes
+	if w.keyChanged {
+		if err = w.playlist.SetKey("AES-128", w.key.uri, "", "", ""); err != nil {
+			return expired, err
+		}
+		w.keyChanged = false
+	}
+
+	if w.window > 0 {
+		w.windowSegments = append(w.windowSegments, windowSegment{filepath: filepath, key: w.key})
 	}
 
 	// Write playlist for every segment. This allows better crash recovery and to use
 	// it as an Event playlist, at the cost of extra I/O
-	return w.writePlaylist()
+	return expired, w.writePlaylist()
+}
+
+// removeOldestSegment slides the live playlist window, returning the files that aged out
+func (w *PlaylistWriter) removeOldestSegment() ([]string, error) {
+	if err := w.playlist.Remove(); err != nil {
+		return nil, err
+	}
+
+	oldest := w.windowSegments[0]
+	w.windowSegments = w.windowSegments[1:]
+	expired := []string{oldest.filepath}
+
+	if oldest.key == nil {
+		return expired, nil
+	}
+
+	// the key is still needed by the next segment, which should be tagged with it
+	// if the removed segment was carrying the tag
+	next := w.key
+	if len(w.windowSegments) > 0 {
+		next = w.windowSegments[0].key
+		// the playlist is a ring buffer whose head moves forward with each removal
+		head := w.playlist.Segments[w.playlist.SeqNo%uint64(w.window)]
+		if head.Key == nil {
+			head.Key = &m3u8.Key{Method: "AES-128", URI: next.uri}
+		}
+	} else {
+		// the segment being added will be the only one
+		w.keyChanged = true
+	}
+	if next != oldest.key {
+		expired = append(expired, oldest.key.filepath)
+	}
+
+	return expired, nil
+}
+
+// NextSegmentKey returns the key and media sequence number for the next segment to end.
+// A new key is generated at each rotation, and its file path is returned so that it can be stored
+func (w *PlaylistWriter) NextSegmentKey() (key []byte, sequence uint64, keyFilepath string, err error) {
+	if !w.encrypted {
+		return nil, 0, "", fmt.Errorf("segment encryption not enabled")
+	}
+
+	sequence = w.playlist.SeqNo + uint64(w.playlist.Count())
+	index := 0
+	if w.keyRotation > 0 {
+		index = int(sequence) / w.keyRotation
+	}
+
+	if w.key == nil || index != w.keyIndex {
+		k, err := newSegmentKey(w.getKeyFilepath(index), w.keyURI)
+		if err != nil {
+			return nil, 0, "", err
+		}
+		w.key = k
+		w.keyIndex = index
+		w.keyChanged = true
+		keyFilepath = k.filepath
+	}
+
+	return w.key.key, sequence, keyFilepath, nil
+}
+
+// Rebase points segments and keys already in the playlist at the absolute locations they were stored at,
+// keyed by filename. It's used when the files that follow are stored somewhere else. The init section applies
+// to every segment, so it needs to be stored again instead. The current key is tagged again on the next segment,
+// and its path is returned so it can be stored with it
+func (w *PlaylistWriter) Rebase(locations map[string]string) (keyFilepath string, err error) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	rebase := func(uri string) string {
+		if location, ok := locations[uri]; ok {
+			return location
+		}
+		return uri
+	}
+
+	for _, segment := range w.playlist.Segments {
+		if segment == nil {
+			continue
+		}
+		segment.URI = rebase(segment.URI)
+		if segment.Key != nil {
+			segment.Key.URI = rebase(segment.Key.URI)
+		}
+	}
+
+	if w.key != nil {
+		w.keyChanged = true
+		keyFilepath = w.key.filepath
+	}
+
+	w.playlist.ResetCache()
+	return keyFilepath, w.writePlaylist()
+}
+
+// measureSegment updates the master playlist's bandwidth with a segment's bitrate. It's rewritten when the peak
+// exceeds the advertised bandwidth by more than the 10% players and validators allow
+func (w *PlaylistWriter) measureSegment(size int64, duration float64) error {
+	if size <= 0 || duration <= 0 {
+		return nil
+	}
+
+	bitrate := uint32(float64(size*8) / duration)
+	if bitrate > w.peakBandwidth {
+		w.peakBandwidth = bitrate
+	}
+	w.totalBits += float64(size * 8)
+	w.totalDuration += duration
+
+	if w.master.AverageBandwidth != 0 && float64(w.peakBandwidth) <= float64(w.master.Bandwidth)*1.1 {
+		return nil
+	}
+	return w.updateBandwidth()
+}
+
+// Bandwidth returns the peak and average bitrate of the segments written so far, in bits per second
+func (w *PlaylistWriter) Bandwidth() (peak, average uint32) {
+	w.openSegmentsLock.Lock()
+	defer w.openSegmentsLock.Unlock()
+
+	if w.totalDuration == 0 {
+		return 0, 0
+	}
+	return w.peakBandwidth, uint32(w.totalBits / w.totalDuration)
+}
+
+func (w *PlaylistWriter) updateBandwidth() error {
+	w.master.Bandwidth = w.peakBandwidth
+	w.master.AverageBandwidth = uint32(w.totalBits / w.totalDuration)
+	w.masterUpdated = true
+	return w.writeMasterPlaylist()
 }
 
 func (w *PlaylistWriter) EOS() error {
+	w.openSegmentsLock.Lock()
+	if w.totalDuration > 0 {
+		// the final peak and average
+		if err := w.updateBandwidth(); err != nil {
+			w.openSegmentsLock.Unlock()
+			return err
+		}
+	}
+	w.openSegmentsLock.Unlock()
+
+	if w.vod {
+		// the recording is complete, so players can treat it as a static file
+		w.playlist.MediaType = m3u8.VOD
+		w.playlist.ResetCache()
+	}
 	w.playlist.Close()
 
 	return w.writePlaylist()
@@ -121,6 +465,84 @@ func (w *PlaylistWriter) writePlaylist() error {
 	return nil
 }
 
+// writeMasterPlaylist writes a master playlist with a single variant, pointing to the media playlist.
+// Every segment starts with a keyframe, which is left out in compatibility mode along with FRAME-RATE
+func (w *PlaylistWriter) writeMasterPlaylist() error {
+	master := m3u8.NewMasterPlaylist()
+	variant := w.master
+	if w.compatibility {
+		variant.FrameRate = 0
+	} else {
+		master.SetIndependentSegments(true)
+	}
+	master.Append(getFilenameFromFilePath(w.playlistPath), nil, variant)
+
+	return os.WriteFile(w.masterPlaylistPath, master.Encode().Bytes(), 0644)
+}
+
+// getVariantParams returns the variant attributes expected from the encoding settings, before anything is measured
+func getVariantParams(p *params.Params) m3u8.VariantParams {
+	variant := m3u8.VariantParams{
+		Codecs: getCodecs(p),
+	}
+	if p.AudioEnabled {
+		variant.Bandwidth += uint32(p.AudioBitrate) * 1000
+	}
+	if p.VideoEnabled {
+		variant.Bandwidth += uint32(p.VideoBitrate) * 1000
+		variant.Resolution = fmt.Sprintf("%dx%d", p.Width, p.Height)
+		variant.FrameRate = float64(p.Framerate)
+	}
+	return variant
+}
+
+// getCodecs returns the RFC 6381 codecs string for the variant
+func getCodecs(p *params.Params) string {
+	var codecs []string
+	if p.VideoEnabled && p.VideoCodec == params.MimeTypeH265 {
+		// main profile, main tier, followed by level_idc (level * 30)
+		level := 93 // 3.1
+		switch {
+		case p.Width*p.Height > 1280*720 && p.Framerate > 30:
+			level = 123 // 4.1
+		case p.Width*p.Height > 1280*720 || p.Framerate > 30:
+			level = 120 // 4.0
+		}
+		codecs = append(codecs, fmt.Sprintf("hvc1.1.6.L%d.B0", level))
+	} else if p.VideoEnabled {
+		// profile_idc and constraint flags, followed by level_idc
+		var profile string
+		switch p.VideoProfile {
+		case params.ProfileBaseline:
+			profile = "42e0"
+		case params.ProfileHigh:
+			profile = "6400"
+		default:
+			profile = "4d40"
+		}
+
+		level := 0x1f // 3.1
+		switch {
+		case p.VideoLevel == "1b":
+			level = 0x09
+		case p.VideoLevel != "":
+			// configured levels are validated, so they always parse
+			l, _ := strconv.ParseFloat(p.VideoLevel, 64)
+			level = int(math.Round(l * 10))
+		case p.Width*p.Height > 1280*720 && p.Framerate > 30:
+			level = 0x2a // 4.2
+		case p.Width*p.Height > 1280*720 || p.Framerate > 30:
+			level = 0x28 // 4.0
+		}
+		codecs = append(codecs, fmt.Sprintf("avc1.%s%02x", profile, level))
+	}
+	if p.AudioEnabled {
+		codecs = append(codecs, "mp4a.40.2")
+	}
+
+	return strings.Join(codecs, ",")
+}
+
 func getFilenameFromFilePath(filepath string) string {
 	_, filename := path.Split(filepath)
 
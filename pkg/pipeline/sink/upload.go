@@ -2,15 +2,20 @@ package sink
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"net/http"
 	"net/url"
 	"os"
+	"strconv"
 	"time"
 
 	"cloud.google.com/go/storage"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
@@ -20,6 +25,7 @@ import (
 
 	"github.com/livekit/protocol/livekit"
 
+	"github.com/livekit/egress/pkg/config"
 	"github.com/livekit/egress/pkg/pipeline/params"
 )
 
@@ -27,11 +33,65 @@ const (
 	maxRetries = 5
 	minDelay   = 100 * time.Millisecond
 	maxDelay   = 5 * time.Second
+
+	// metadata key holding the time an object expires, readable by tools that don't know the ttl tag
+	retainUntilKey = "retain_until"
 )
 
+// s3Buckets has settings for uploads to specific buckets, which requests can't set themselves
+var s3Buckets map[string]*config.S3BucketConfig
+
+// SetS3Buckets sets the settings used for uploads to each bucket
+func SetS3Buckets(buckets map[string]*config.S3BucketConfig) {
+	s3Buckets = buckets
+}
+
+// s3RequestPayer returns "requester" for requester pays buckets
+func s3RequestPayer(bucket string) *string {
+	if b := s3Buckets[bucket]; b != nil && b.RequesterPays {
+		return aws.String(s3.RequestPayerRequester)
+	}
+	return nil
+}
+
+// s3ACL returns the canned acl for objects stored in the bucket, if there is one
+func s3ACL(bucket string) *string {
+	if b := s3Buckets[bucket]; b != nil && b.ACL != "" {
+		return aws.String(b.ACL)
+	}
+	return nil
+}
+
+// retentionHints returns the ttl in whole days, rounded up since lifecycle rules count in days, and the time the object expires
+func retentionHints(retention config.RetentionConfig) (days, retainUntil string, expiry time.Time) {
+	day := 24 * time.Hour
+	expiry = time.Now().Add(retention.TTL).UTC()
+	return strconv.Itoa(int((retention.TTL + day - 1) / day)), expiry.Format(time.RFC3339), expiry
+}
+
 // FIXME Should we use a Context to allow for an overall operation timeout?
 
-func UploadS3(conf *livekit.S3Upload, localFilepath, storageFilepath string, mime params.OutputType) (location string, err error) {
+// Upload stores body with the given upload config, returning the storage type ("" without one), the file's
+// location, and the number of retries needed. The content encoding is empty unless body is compressed.
+// Objects are tagged with their ttl when retention has one, for bucket lifecycle rules to expire them
+func Upload(upload interface{}, body io.ReadSeeker, size int64, storageFilepath string, mime params.OutputType, encoding string, retention config.RetentionConfig) (storage, location string, retries int, err error) {
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		location, retries, err = UploadS3(u, body, size, storageFilepath, mime, encoding, retention)
+		return "S3", location, retries, err
+	case *livekit.GCPUpload:
+		location, retries, err = UploadGCP(u, body, size, storageFilepath, mime, encoding, retention)
+		return "GCP", location, retries, err
+	case *livekit.AzureBlobUpload:
+		location, retries, err = UploadAzure(u, body, storageFilepath, mime, encoding, retention)
+		return "Azure", location, retries, err
+	default:
+		return "", storageFilepath, 0, nil
+	}
+}
+
+// UploadS3 uploads to S3, returning the location and the number of retries needed
+func UploadS3(conf *livekit.S3Upload, body io.ReadSeeker, size int64, storageFilepath string, mime params.OutputType, encoding string, retention config.RetentionConfig) (location string, retries int, err error) {
 	sess, err := session.NewSession(&aws.Config{
 		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
 		Endpoint:    aws.String(conf.Endpoint),
@@ -39,41 +99,43 @@ func UploadS3(conf *livekit.S3Upload, localFilepath, storageFilepath string, mim
 		MaxRetries:  aws.Int(maxRetries), // Switching to v2 of the aws Go SDK would allow to set a maxDelay as well.
 	})
 	if err != nil {
-		return "", err
-	}
-
-	file, err := os.Open(localFilepath)
-	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	defer file.Close()
 
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return "", err
-	}
-
-	_, err = s3.New(sess).PutObject(&s3.PutObjectInput{
+	input := &s3.PutObjectInput{
 		Bucket:        aws.String(conf.Bucket),
 		Key:           aws.String(storageFilepath),
-		Body:          file,
-		ContentLength: aws.Int64(fileInfo.Size()),
+		Body:          body,
+		ContentLength: aws.Int64(size),
 		ContentType:   aws.String(string(mime)),
-	})
-	if err != nil {
-		return "", err
+		ACL:           s3ACL(conf.Bucket),
+		RequestPayer:  s3RequestPayer(conf.Bucket),
+	}
+	if encoding != "" {
+		input.ContentEncoding = aws.String(encoding)
+	}
+	if retention.TTL > 0 {
+		// lifecycle rules can filter on object tags
+		days, retainUntil, _ := retentionHints(retention)
+		input.Tagging = aws.String(url.Values{retention.TagKey: {days}}.Encode())
+		input.Metadata = map[string]*string{retainUntilKey: aws.String(retainUntil)}
+	}
+	req, _ := s3.New(sess).PutObjectRequest(input)
+	if err = req.Send(); err != nil {
+		return "", req.RetryCount, err
 	}
 
-	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", conf.Bucket, conf.Region, storageFilepath), nil
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", conf.Bucket, conf.Region, storageFilepath), req.RetryCount, nil
 }
 
-func UploadAzure(conf *livekit.AzureBlobUpload, localFilepath, storageFilepath string, mime params.OutputType) (location string, err error) {
+// UploadAzure uploads to Azure. Retries are handled by the azblob pipeline and are not reported
+func UploadAzure(conf *livekit.AzureBlobUpload, body io.ReadSeeker, storageFilepath string, mime params.OutputType, encoding string, retention config.RetentionConfig) (location string, retries int, err error) {
 	credential, err := azblob.NewSharedKeyCredential(
 		conf.AccountName,
 		conf.AccountKey,
 	)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{
@@ -87,33 +149,49 @@ func UploadAzure(conf *livekit.AzureBlobUpload, localFilepath, storageFilepath s
 	sUrl := fmt.Sprintf("https://%s.blob.core.windows.net/%s", conf.AccountName, conf.ContainerName)
 	azUrl, err := url.Parse(sUrl)
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	containerURL := azblob.NewContainerURL(*azUrl, pipeline)
 	blobURL := containerURL.NewBlockBlobURL(storageFilepath)
 
-	file, err := os.Open(localFilepath)
-	if err != nil {
-		return "", err
+	headers := azblob.BlobHTTPHeaders{ContentType: string(mime), ContentEncoding: encoding}
+	var metadata azblob.Metadata
+	var tags azblob.BlobTagsMap
+	if retention.TTL > 0 {
+		// lifecycle management rules can filter on blob index tags
+		days, retainUntil, _ := retentionHints(retention)
+		tags = azblob.BlobTagsMap{retention.TagKey: days}
+		metadata = azblob.Metadata{retainUntilKey: retainUntil}
+	}
+	if file, ok := body.(*os.File); ok {
+		// upload blocks in parallel for optimal performance
+		// it calls PutBlock/PutBlockList for files larger than 256 MBs and PutBlob for smaller files
+		_, err = azblob.UploadFileToBlockBlob(context.Background(), file, blobURL, azblob.UploadToBlockBlobOptions{
+			BlobHTTPHeaders: headers,
+			Metadata:        metadata,
+			BlobTagsMap:     tags,
+			BlockSize:       4 * 1024 * 1024,
+			Parallelism:     16,
+		})
+	} else {
+		_, err = azblob.UploadStreamToBlockBlob(context.Background(), body, blobURL, azblob.UploadStreamToBlockBlobOptions{
+			BufferSize:      4 * 1024 * 1024,
+			MaxBuffers:      16,
+			BlobHTTPHeaders: headers,
+			Metadata:        metadata,
+			BlobTagsMap:     tags,
+		})
 	}
-	defer file.Close()
-
-	// upload blocks in parallel for optimal performance
-	// it calls PutBlock/PutBlockList for files larger than 256 MBs and PutBlob for smaller files
-	_, err = azblob.UploadFileToBlockBlob(context.Background(), file, blobURL, azblob.UploadToBlockBlobOptions{
-		BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: string(mime)},
-		BlockSize:       4 * 1024 * 1024,
-		Parallelism:     16,
-	})
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	return sUrl, nil
+	return sUrl, 0, nil
 }
 
-func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string, mime params.OutputType) (location string, err error) {
+// UploadGCP uploads to GCP. Retries are handled by the storage client and are not reported
+func UploadGCP(conf *livekit.GCPUpload, body io.Reader, size int64, storageFilepath string, mime params.OutputType, encoding string, retention config.RetentionConfig) (location string, retries int, err error) {
 	ctx := context.Background()
 	var client *storage.Client
 
@@ -123,26 +201,15 @@ func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string, m
 		client, err = storage.NewClient(ctx)
 	}
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 	defer client.Close()
 
-	file, err := os.Open(localFilepath)
-	if err != nil {
-		return "", err
-	}
-	defer file.Close()
-
 	// In case where the total amount of data to upload is larger than googleapi.DefaultUploadChunkSize, each upload request will have a timeout of
 	// ChunkRetryDeadline, which is 32s by default. If the request payload is smaller than googleapi.DefaultUploadChunkSize, use a context deadline
 	// to apply the same timeouit
-	fileInfo, err := file.Stat()
-	if err != nil {
-		return "", err
-	}
-
 	var wctx context.Context
-	if fileInfo.Size() <= googleapi.DefaultUploadChunkSize {
+	if size <= googleapi.DefaultUploadChunkSize {
 		var cancel context.CancelFunc
 		wctx, cancel = context.WithTimeout(ctx, 32*time.Second)
 		defer cancel()
@@ -157,14 +224,66 @@ func UploadGCP(conf *livekit.GCPUpload, localFilepath, storageFilepath string, m
 	}),
 		storage.WithPolicy(storage.RetryAlways),
 	).NewWriter(wctx)
+	wc.ContentEncoding = encoding
+	if retention.TTL > 0 {
+		// lifecycle rules can't filter on metadata, but daysSinceCustomTime can expire objects from their custom time
+		days, retainUntil, expiry := retentionHints(retention)
+		wc.CustomTime = expiry
+		wc.Metadata = map[string]string{retention.TagKey: days, retainUntilKey: retainUntil}
+	}
 
-	if _, err = io.Copy(wc, file); err != nil {
-		return "", err
+	if _, err = io.Copy(wc, body); err != nil {
+		return "", 0, err
 	}
 
 	if err = wc.Close(); err != nil {
-		return "", err
+		return "", 0, err
 	}
 
-	return fmt.Sprintf("https://%s.storage.googleapis.com/%s", conf.Bucket, storageFilepath), nil
+	return fmt.Sprintf("https://%s.storage.googleapis.com/%s", conf.Bucket, storageFilepath), 0, nil
+}
+
+// UploadErrorClass groups upload errors for metrics
+func UploadErrorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+
+	var statusCode int
+	var awsErr awserr.RequestFailure
+	var azureErr azblob.StorageError
+	var gcpErr *googleapi.Error
+	var netErr net.Error
+	switch {
+	case errors.As(err, &awsErr):
+		statusCode = awsErr.StatusCode()
+	case errors.As(err, &azureErr):
+		if res := azureErr.Response(); res != nil {
+			statusCode = res.StatusCode
+		}
+	case errors.As(err, &gcpErr):
+		statusCode = gcpErr.Code
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	}
+
+	switch {
+	case statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden:
+		return "auth"
+	case statusCode == http.StatusNotFound:
+		return "not_found"
+	case statusCode == http.StatusTooManyRequests || statusCode == http.StatusServiceUnavailable:
+		return "throttled"
+	case statusCode >= 500:
+		return "server"
+	case statusCode >= 400:
+		return "client"
+	default:
+		return "other"
+	}
 }
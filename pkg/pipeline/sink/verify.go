@@ -0,0 +1,151 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"google.golang.org/api/option"
+
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/logger"
+	"github.com/livekit/protocol/utils"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const UploadVerificationTimeout = 5 * time.Second
+
+// VerifyUpload checks upload credentials by writing and deleting a small object in the output directory,
+// so that a misconfigured request fails before recording instead of after.
+func VerifyUpload(ctx context.Context, upload interface{}, dir string) error {
+	storageFilepath := path.Join(dir, fmt.Sprintf(".egress-verify-%s", utils.NewGuid("")))
+
+	var location string
+	var err error
+	switch u := upload.(type) {
+	case *livekit.S3Upload:
+		location = "S3"
+		err = verifyS3(ctx, u, storageFilepath)
+	case *livekit.GCPUpload:
+		location = "GCP"
+		err = verifyGCP(ctx, u, storageFilepath)
+	case *livekit.AzureBlobUpload:
+		location = "Azure"
+		err = verifyAzure(ctx, u, storageFilepath)
+	default:
+		return nil
+	}
+
+	if err != nil {
+		return errors.ErrUploadFailed(location, err)
+	}
+	return nil
+}
+
+func verifyS3(ctx context.Context, conf *livekit.S3Upload, storageFilepath string) error {
+	sess, err := session.NewSession(&aws.Config{
+		Credentials: credentials.NewStaticCredentials(conf.AccessKey, conf.Secret, ""),
+		Endpoint:    aws.String(conf.Endpoint),
+		Region:      aws.String(conf.Region),
+		MaxRetries:  aws.Int(1),
+	})
+	if err != nil {
+		return err
+	}
+
+	svc := s3.New(sess)
+	if _, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(conf.Bucket),
+		Key:          aws.String(storageFilepath),
+		Body:         bytes.NewReader(nil),
+		ACL:          s3ACL(conf.Bucket),
+		RequestPayer: s3RequestPayer(conf.Bucket),
+	}); err != nil {
+		return err
+	}
+
+	// credentials may be allowed to write without being allowed to delete
+	if _, err = svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket:       aws.String(conf.Bucket),
+		Key:          aws.String(storageFilepath),
+		RequestPayer: s3RequestPayer(conf.Bucket),
+	}); err != nil {
+		logger.Warnw("could not delete upload verification object", err, "key", storageFilepath)
+	}
+
+	return nil
+}
+
+func verifyAzure(ctx context.Context, conf *livekit.AzureBlobUpload, storageFilepath string) error {
+	credential, err := azblob.NewSharedKeyCredential(
+		conf.AccountName,
+		conf.AccountKey,
+	)
+	if err != nil {
+		return err
+	}
+
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	azUrl, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", conf.AccountName, conf.ContainerName))
+	if err != nil {
+		return err
+	}
+
+	blobURL := azblob.NewContainerURL(*azUrl, pipeline).NewBlockBlobURL(storageFilepath)
+
+	file, err := os.CreateTemp("", "egress-verify")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+		_ = os.Remove(file.Name())
+	}()
+
+	if _, err = azblob.UploadFileToBlockBlob(ctx, file, blobURL, azblob.UploadToBlockBlobOptions{}); err != nil {
+		return err
+	}
+
+	if _, err = blobURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{}); err != nil {
+		logger.Warnw("could not delete upload verification object", err, "key", storageFilepath)
+	}
+
+	return nil
+}
+
+func verifyGCP(ctx context.Context, conf *livekit.GCPUpload, storageFilepath string) error {
+	var client *storage.Client
+	var err error
+	if conf.Credentials != nil {
+		client, err = storage.NewClient(ctx, option.WithCredentialsJSON(conf.Credentials))
+	} else {
+		client, err = storage.NewClient(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	obj := client.Bucket(conf.Bucket).Object(storageFilepath)
+	wc := obj.NewWriter(ctx)
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	if err = obj.Delete(ctx); err != nil {
+		logger.Warnw("could not delete upload verification object", err, "key", storageFilepath)
+	}
+
+	return nil
+}
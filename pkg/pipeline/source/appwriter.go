@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"io"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -29,6 +30,9 @@ const (
 	videoTimeout = time.Second * 2
 	maxAudioLate = 200 // 4s for audio
 	audioTimeout = time.Second * 4
+
+	// rtp duration of opusSilenceFrame
+	opusSilenceDuration = 960
 )
 
 var (
@@ -39,6 +43,9 @@ var (
 	H264KeyFrame2x2IDR = []byte{0x65, 0x88, 0x84, 0x0a, 0xf2, 0x62, 0x80, 0x00, 0xa7, 0xbe}
 
 	H264KeyFrame2x2 = [][]byte{H264KeyFrame2x2SPS, H264KeyFrame2x2PPS, H264KeyFrame2x2IDR}
+
+	// 20ms of fullband celt silence
+	opusSilenceFrame = []byte{0xf8, 0xff, 0xfe}
 )
 
 type appWriter struct {
@@ -49,6 +56,7 @@ type appWriter struct {
 	src         *app.Source
 	startTime   time.Time
 	writeBlanks bool
+	dtxSilence  bool
 
 	newSampleBuilder func() *samplebuilder.SampleBuilder
 	writePLI         func()
@@ -73,6 +81,13 @@ type appWriter struct {
 	force        chan struct{}
 	finished     chan struct{}
 
+	// stall detection
+	stallMu      sync.Mutex
+	stallTimeout time.Duration
+	onStall      func(stalled bool)
+	stalled      atomic.Bool
+	lastPacket   time.Time
+
 	// vp8
 	firstPktPushed bool
 	vp8Munger      *sfu.VP8Munger
@@ -87,6 +102,7 @@ func newAppWriter(
 	cs *clockSync,
 	playing chan struct{},
 	writeBlanks bool,
+	dtxSilence bool,
 ) (*appWriter, error) {
 
 	w := &appWriter{
@@ -95,6 +111,7 @@ func newAppWriter(
 		codec:       codec,
 		src:         src,
 		writeBlanks: writeBlanks,
+		dtxSilence:  dtxSilence && codec == params.MimeTypeOpus,
 		cs:          cs,
 		conversion:  1e9 / float64(track.Codec().ClockRate),
 		playing:     playing,
@@ -180,6 +197,7 @@ func (w *appWriter) start() {
 
 				// continue if read timeout
 				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					w.checkStalled()
 					continue
 				}
 
@@ -193,11 +211,17 @@ func (w *appWriter) start() {
 				return
 			}
 
+			w.lastPacket = time.Now()
+			if w.stalled.Load() {
+				w.setStalled(false)
+			}
+
 			// sync offsets after first packet read
 			// see comment in writeRTP below
 			if !w.clockSynced {
 				now := time.Now().UnixNano()
 				startTime := w.cs.GetOrSetStartTime(now)
+				w.cs.SetTrackStartTime(w.track.ID(), now)
 				w.ptsOffset = now - startTime
 				w.rtpOffset = int64(pkt.Timestamp)
 				w.clockSynced = true
@@ -373,6 +397,13 @@ func (w *appWriter) push(packets []*rtp.Packet, blankFrame bool) error {
 			w.tsStep = pkt.Timestamp - w.lastTS
 		}
 
+		if w.dtxSilence && !blankFrame && w.tsStep != 0 && pkt.SequenceNumber == w.lastSN+1 {
+			// dtx pauses keep sequence numbers contiguous, unlike packet loss
+			if err := w.pushSilence(pkt.Timestamp); err != nil {
+				return err
+			}
+		}
+
 		// record SN and TS
 		w.lastSN = pkt.SequenceNumber
 		w.lastTS = pkt.Timestamp
@@ -408,6 +439,33 @@ func (w *appWriter) push(packets []*rtp.Packet, blankFrame bool) error {
 	return nil
 }
 
+// pushSilence fills a dtx pause before the packet with opus silence, so that the audio
+// keeps its exact duration instead of relying on the muxer or player to handle the gap
+func (w *appWriter) pushSilence(timestamp uint32) error {
+	sn := w.lastSN + w.snOffset
+	for ts := w.lastTS + w.tsStep; int32(timestamp-ts) >= opusSilenceDuration; ts += opusSilenceDuration {
+		sn++
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         false,
+				PayloadType:    uint8(w.track.PayloadType()),
+				SequenceNumber: sn,
+				Timestamp:      ts,
+				SSRC:           uint32(w.track.SSRC()),
+				CSRC:           []uint32{},
+			},
+			Payload: opusSilenceFrame,
+		}
+		w.snOffset++
+
+		if err := w.push([]*rtp.Packet{pkt}, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (w *appWriter) translatePacket(pkt *rtp.Packet) {
 	switch w.codec {
 	case params.MimeTypeVP8:
@@ -489,6 +547,7 @@ func (w *appWriter) isDraining() bool {
 func (w *appWriter) trackMuted() {
 	w.logger.Debugw("track muted", "timestamp", time.Since(w.startTime).Seconds())
 	w.muted.Store(true)
+	w.setStalled(true)
 }
 
 func (w *appWriter) trackUnmuted() {
@@ -499,6 +558,38 @@ func (w *appWriter) trackUnmuted() {
 	}
 }
 
+// setStallHandler registers a callback for when the track stops and resumes sending media
+func (w *appWriter) setStallHandler(timeout time.Duration, onStall func(stalled bool)) {
+	w.stallMu.Lock()
+	defer w.stallMu.Unlock()
+
+	w.stallTimeout = timeout
+	w.onStall = onStall
+}
+
+func (w *appWriter) checkStalled() {
+	w.stallMu.Lock()
+	timeout := w.stallTimeout
+	w.stallMu.Unlock()
+
+	// only a track that has already sent media can stall
+	if timeout > 0 && !w.lastPacket.IsZero() && time.Since(w.lastPacket) > timeout {
+		w.setStalled(true)
+	}
+}
+
+func (w *appWriter) setStalled(stalled bool) {
+	w.stallMu.Lock()
+	defer w.stallMu.Unlock()
+
+	if w.onStall == nil || w.stalled.Swap(stalled) == stalled {
+		return
+	}
+
+	w.logger.Debugw("track stalled", "stalled", stalled, "timestamp", time.Since(w.startTime).Seconds())
+	w.onStall(stalled)
+}
+
 // sendEOS blocks until finished
 func (w *appWriter) sendEOS() {
 	select {
@@ -0,0 +1,174 @@
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	lksdk "github.com/livekit/server-sdk-go"
+
+	"github.com/livekit/egress/pkg/config"
+)
+
+const (
+	// data messages with this type are written as captions
+	transcriptionMessageType = "transcription"
+
+	// used when a transcription doesn't say when it ends
+	defaultCueDuration = 3 * time.Second
+)
+
+// transcriptionMessage is sent as a data message by a speech to text agent, or any participant transcribing the room
+type transcriptionMessage struct {
+	Type                string `json:"type"`
+	Text                string `json:"text"`
+	Final               *bool  `json:"final,omitempty"`                // interim results are skipped. Defaults to true
+	StartTime           int64  `json:"start_time,omitempty"`           // unix milliseconds. Defaults to when the message was received
+	EndTime             int64  `json:"end_time,omitempty"`             // unix milliseconds
+	ParticipantIdentity string `json:"participant_identity,omitempty"` // speaker. Defaults to the sender
+}
+
+type caption struct {
+	start   time.Duration
+	end     time.Duration
+	speaker string
+	text    string
+}
+
+// captionWriter collects transcriptions received during the recording, and writes them as a vtt or srt file
+// once it ends. Cue times are relative to the start of the recording, which is also the start of the first segment
+type captionWriter struct {
+	cs     *clockSync
+	format string
+
+	mu       sync.Mutex
+	filepath string
+	captions []*caption
+}
+
+// CaptionsSuffix is added to the recording's name for its caption file
+func CaptionsSuffix(format string) string {
+	return "." + format
+}
+
+func newCaptionWriter(cs *clockSync, format string) *captionWriter {
+	return &captionWriter{
+		cs:     cs,
+		format: format,
+	}
+}
+
+// open starts collecting captions. Transcriptions received before then are dropped
+func (c *captionWriter) open(filepath string) {
+	c.mu.Lock()
+	c.filepath = filepath
+	c.mu.Unlock()
+}
+
+func (c *captionWriter) write(data []byte, rp *lksdk.RemoteParticipant) {
+	cue := parseTranscription(data, rp, time.Now().UnixNano(), c.cs.GetStartTime())
+	if cue == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.filepath != "" {
+		c.captions = append(c.captions, cue)
+	}
+}
+
+// parseTranscription returns a final transcription as a caption timed from the start of the recording,
+// or nil if the data message isn't one
+func parseTranscription(data []byte, rp *lksdk.RemoteParticipant, receivedAt, startTime int64) *caption {
+	msg := &transcriptionMessage{}
+	if err := json.Unmarshal(data, msg); err != nil || msg.Type != transcriptionMessageType {
+		return nil
+	}
+	if msg.Text == "" || (msg.Final != nil && !*msg.Final) {
+		return nil
+	}
+
+	if startTime == 0 {
+		// nothing recorded yet
+		return nil
+	}
+
+	cue := &caption{
+		start:   time.Duration(receivedAt - startTime),
+		speaker: msg.ParticipantIdentity,
+		text:    msg.Text,
+	}
+	if msg.StartTime != 0 {
+		cue.start = time.Duration(msg.StartTime*int64(time.Millisecond) - startTime)
+	}
+	if cue.start < 0 {
+		cue.start = 0
+	}
+	cue.end = cue.start + defaultCueDuration
+	if msg.EndTime != 0 {
+		cue.end = time.Duration(msg.EndTime*int64(time.Millisecond) - startTime)
+	}
+	if cue.end <= cue.start {
+		return nil
+	}
+	if cue.speaker == "" && rp != nil {
+		cue.speaker = rp.Identity()
+	}
+	return cue
+}
+
+// close writes the caption file, if anything was transcribed
+func (c *captionWriter) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.filepath == "" || len(c.captions) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(c.captions, func(i, j int) bool {
+		return c.captions[i].start < c.captions[j].start
+	})
+
+	var b strings.Builder
+	if c.format == config.CaptionsFormatVTT {
+		b.WriteString("WEBVTT\n\n")
+	}
+	for i, cue := range c.captions {
+		fmt.Fprintf(&b, "%d\n", i+1)
+		if c.format == config.CaptionsFormatSRT {
+			fmt.Fprintf(&b, "%s --> %s\n", formatCueTime(cue.start, ","), formatCueTime(cue.end, ","))
+			if cue.speaker != "" {
+				fmt.Fprintf(&b, "%s: ", cue.speaker)
+			}
+			b.WriteString(strings.ReplaceAll(cue.text, "\n\n", "\n"))
+		} else {
+			fmt.Fprintf(&b, "%s --> %s\n", formatCueTime(cue.start, "."), formatCueTime(cue.end, "."))
+			if cue.speaker != "" {
+				fmt.Fprintf(&b, "<v %s>", escapeCueText(cue.speaker))
+			}
+			b.WriteString(escapeCueText(cue.text))
+		}
+		b.WriteString("\n\n")
+	}
+
+	err := os.WriteFile(c.filepath, []byte(b.String()), 0644)
+	c.filepath = ""
+	return err
+}
+
+// formatCueTime returns hh:mm:ss.ttt, with a comma before the milliseconds for srt
+func formatCueTime(d time.Duration, separator string) string {
+	ms := d.Milliseconds()
+	return fmt.Sprintf("%02d:%02d:%02d%s%03d", ms/3600000, ms/60000%60, ms/1000%60, separator, ms%1000)
+}
+
+func escapeCueText(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\n\n", "\n").Replace(text)
+}
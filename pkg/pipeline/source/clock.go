@@ -1,6 +1,8 @@
 package source
 
 import (
+	"sync"
+
 	"go.uber.org/atomic"
 )
 
@@ -10,6 +12,10 @@ type clockSync struct {
 	startTime atomic.Int64
 	endTime   atomic.Int64
 	delay     atomic.Int64
+
+	// when each track first produced media
+	trackStartsMu sync.Mutex
+	trackStarts   map[string]int64
 }
 
 func (c *clockSync) GetOrSetStartTime(t int64) int64 {
@@ -37,3 +43,26 @@ func (c *clockSync) GetEndTime() int64 {
 func (c *clockSync) GetDelay() int64 {
 	return c.delay.Load()
 }
+
+func (c *clockSync) SetTrackStartTime(trackID string, t int64) {
+	c.trackStartsMu.Lock()
+	defer c.trackStartsMu.Unlock()
+
+	if c.trackStarts == nil {
+		c.trackStarts = make(map[string]int64)
+	}
+	if _, ok := c.trackStarts[trackID]; !ok {
+		c.trackStarts[trackID] = t
+	}
+}
+
+func (c *clockSync) GetTrackStartTimes() map[string]int64 {
+	c.trackStartsMu.Lock()
+	defer c.trackStartsMu.Unlock()
+
+	starts := make(map[string]int64, len(c.trackStarts))
+	for trackID, t := range c.trackStarts {
+		starts[trackID] = t
+	}
+	return starts
+}
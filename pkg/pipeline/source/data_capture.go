@@ -0,0 +1,96 @@
+package source
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/livekit/protocol/logger"
+	lksdk "github.com/livekit/server-sdk-go"
+)
+
+// DataCaptureSuffix is added to the recording's name for the captured data messages
+const DataCaptureSuffix = ".data.jsonl"
+
+// dataCapture writes the data messages received from the room as json lines, so that chat and
+// reactions can be replayed alongside the recording
+type dataCapture struct {
+	cs     *clockSync
+	logger logger.Logger
+
+	mu      sync.Mutex
+	file    *os.File
+	encoder *json.Encoder
+}
+
+type dataMessage struct {
+	Time                int64  `json:"time"`   // unix nanoseconds
+	Offset              int64  `json:"offset"` // nanoseconds since the recording started
+	ParticipantSID      string `json:"participant_sid,omitempty"`
+	ParticipantIdentity string `json:"participant_identity,omitempty"`
+	Data                string `json:"data,omitempty"`        // utf-8 payloads
+	DataBase64          []byte `json:"data_base64,omitempty"` // binary payloads
+}
+
+func newDataCapture(cs *clockSync, logger logger.Logger) *dataCapture {
+	return &dataCapture{
+		cs:     cs,
+		logger: logger,
+	}
+}
+
+// open starts writing messages. Messages received before then are dropped
+func (d *dataCapture) open(filepath string) error {
+	file, err := os.Create(filepath)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	d.file = file
+	d.encoder = json.NewEncoder(file)
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *dataCapture) write(data []byte, rp *lksdk.RemoteParticipant) {
+	now := time.Now().UnixNano()
+	msg := &dataMessage{
+		Time: now,
+	}
+	if startTime := d.cs.GetStartTime(); startTime != 0 {
+		msg.Offset = now - startTime
+	}
+	if rp != nil {
+		msg.ParticipantSID = rp.SID()
+		msg.ParticipantIdentity = rp.Identity()
+	}
+	if utf8.Valid(data) {
+		msg.Data = string(data)
+	} else {
+		msg.DataBase64 = data
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.encoder == nil {
+		return
+	}
+	if err := d.encoder.Encode(msg); err != nil {
+		d.logger.Warnw("could not write data message", err)
+	}
+}
+
+func (d *dataCapture) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file != nil {
+		_ = d.file.Close()
+		d.file = nil
+		d.encoder = nil
+	}
+}
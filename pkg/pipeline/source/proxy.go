@@ -0,0 +1,232 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/livekit/protocol/logger"
+)
+
+// networkProxy is the only route out of a restricted chrome. It only connects to the allowed hosts, dialing the
+// addresses it resolves itself, so ip literals and other hosts can't be reached. Hosts resolving to the node's own
+// loopback or link-local addresses, such as its metrics and admin ports or a cloud metadata service, can't be reached
+// either, unless they're the configured template or livekit address
+type networkProxy struct {
+	server    *http.Server
+	listener  net.Listener
+	transport *http.Transport
+	hosts     []string        // hostnames, and wildcards such as *.example.com
+	local     map[string]bool // host:port addresses which can resolve to the node's own
+	logger    logger.Logger
+}
+
+func newNetworkProxy(hosts, local []string, logger logger.Logger) (*networkProxy, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &networkProxy{
+		listener: listener,
+		local:    make(map[string]bool),
+		logger:   logger,
+	}
+	for _, host := range hosts {
+		p.hosts = append(p.hosts, normalizeHost(host))
+	}
+	for _, addr := range local {
+		if host, port, err := net.SplitHostPort(addr); err == nil {
+			p.local[net.JoinHostPort(normalizeHost(host), port)] = true
+		}
+	}
+	p.transport = &http.Transport{
+		DialContext:       p.dial,
+		DisableKeepAlives: true,
+	}
+	p.server = &http.Server{Handler: p}
+
+	go func() {
+		_ = p.server.Serve(listener)
+	}()
+	return p, nil
+}
+
+// URL is chrome's proxy-server
+func (p *networkProxy) URL() string {
+	return fmt.Sprintf("http://%s", p.listener.Addr().String())
+}
+
+func (p *networkProxy) Close() {
+	_ = p.server.Close()
+}
+
+func (p *networkProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect:
+		p.tunnel(w, r, r.Host, false)
+	case r.Header.Get("Upgrade") != "":
+		// websockets take over the connection, so the request is sent ahead of the tunnel
+		p.tunnel(w, r, hostPort(r.URL), true)
+	default:
+		p.forward(w, r)
+	}
+}
+
+// tunnel connects the client to the host for https and websockets
+func (p *networkProxy) tunnel(w http.ResponseWriter, r *http.Request, addr string, upgrade bool) {
+	upstream, err := p.dial(r.Context(), "tcp", addr)
+	if err != nil {
+		p.reject(w, addr, err)
+		return
+	}
+	defer upstream.Close()
+
+	if upgrade {
+		r.Header.Del("Proxy-Connection")
+		if err = r.Write(upstream); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnel unsupported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if !upgrade {
+		if _, err = client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+			return
+		}
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		_, _ = io.Copy(upstream, buf)
+		done <- struct{}{}
+	}()
+	go func() {
+		_, _ = io.Copy(client, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// forward sends a plain http request to the host
+func (p *networkProxy) forward(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Host == "" {
+		http.Error(w, "proxy requests need an absolute url", http.StatusBadRequest)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+
+	res, err := p.transport.RoundTrip(req)
+	if err != nil {
+		p.reject(w, r.URL.Host, err)
+		return
+	}
+	defer res.Body.Close()
+
+	for name, values := range res.Header {
+		for _, value := range values {
+			w.Header().Add(name, value)
+		}
+	}
+	w.WriteHeader(res.StatusCode)
+	_, _ = io.Copy(w, res.Body)
+}
+
+func (p *networkProxy) reject(w http.ResponseWriter, addr string, err error) {
+	if blocked, ok := err.(blockedError); ok {
+		p.logger.Infow("chrome blocked from connecting", "address", addr, "reason", blocked.Error())
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+type blockedError string
+
+func (e blockedError) Error() string {
+	return string(e)
+}
+
+// dial connects to an allowed host, at an address that isn't the node's own unless it's a local address
+func (p *networkProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	hostname, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	hostname = normalizeHost(hostname)
+	if !p.allowed(hostname) {
+		return nil, blockedError(fmt.Sprintf("%s is not an allowed host", hostname))
+	}
+
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	local := p.local[net.JoinHostPort(hostname, port)]
+	var dialer net.Dialer
+	var lastErr error = blockedError(fmt.Sprintf("%s only resolves to node addresses", hostname))
+	for _, ip := range ips {
+		if !local && isNodeAddress(ip.IP) {
+			continue
+		}
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.IP.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (p *networkProxy) allowed(hostname string) bool {
+	for _, host := range p.hosts {
+		if host == hostname || (strings.HasPrefix(host, "*.") && strings.HasSuffix(hostname, host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// isNodeAddress returns true for addresses which only reach the node itself or its link, such as 127.0.0.1 or
+// 169.254.169.254
+func isNodeAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.Trim(host, "[]"), "."))
+}
+
+// hostPort returns the address of a url, with the scheme's default port
+func hostPort(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	switch u.Scheme {
+	case "https", "wss":
+		return net.JoinHostPort(u.Hostname(), "443")
+	default:
+		return net.JoinHostPort(u.Hostname(), "80")
+	}
+}
@@ -25,6 +25,10 @@ const (
 	VideoAppSource = "videoAppSrc"
 
 	subscriptionTimeout = 5 * time.Second
+
+	// completion causes for track and track composite egress
+	EndReasonTrackEnded    = "TRACK_ENDED"
+	EndReasonPublisherLeft = "PUBLISHER_LEFT"
 )
 
 type SDKSource struct {
@@ -50,6 +54,31 @@ type SDKSource struct {
 	videoWriter  *appWriter
 	videoPlaying chan struct{}
 
+	// room composite without a browser
+	composite       bool
+	compositeAudio  bool
+	compositeVideo  bool
+	compositeMu     sync.Mutex
+	compositeTracks map[string]*CompositeTrack
+	compositeOnly   map[string]bool // track composite layouts mix only the requested tracks
+	onTrackAdded    func(*CompositeTrack)
+	onTrackRemoved  func(*CompositeTrack)
+
+	// completing once tracks end
+	stopOnTrackEnd bool
+	trackEndLinger time.Duration
+	publishersMu   sync.Mutex
+	publishers     map[string]bool // participants publishing subscribed tracks
+	endedReasonMu  sync.Mutex
+	endedReason    string
+
+	// data messages, such as chat and reactions
+	data            *dataCapture
+	captions        *captionWriter
+	callbackMu      sync.Mutex
+	onCaption       func(text string, duration time.Duration)
+	onTimedMetadata func(*TimedMetadata)
+
 	mutedChan    chan bool
 	endRecording chan struct{}
 }
@@ -59,24 +88,49 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 	defer span.End()
 
 	s := &SDKSource{
-		logger:       p.Logger,
-		cs:           &clockSync{},
-		mutedChan:    p.MutedChan,
-		endRecording: make(chan struct{}),
+		logger:         p.Logger,
+		cs:             &clockSync{},
+		mutedChan:      p.MutedChan,
+		endRecording:   make(chan struct{}),
+		stopOnTrackEnd: p.StopOnTrackEnd,
+		trackEndLinger: p.TrackEndLinger,
+		publishers:     make(map[string]bool),
 	}
 
 	cb := lksdk.NewRoomCallback()
 	cb.OnTrackMuted = s.onTrackMuted
 	cb.OnTrackUnmuted = s.onTrackUnmuted
 	cb.OnTrackUnpublished = s.onTrackUnpublished
+	cb.OnTrackPublished = s.onTrackPublished
+	cb.OnParticipantDisconnected = s.onParticipantDisconnected
 	cb.OnDisconnected = s.onComplete
+	if p.EgressType == params.EgressTypeFile || p.EgressType == params.EgressTypeSegmentedFile {
+		if p.DataCapture {
+			s.data = newDataCapture(s.cs, s.logger)
+		}
+		if p.CaptionsFormat != "" {
+			s.captions = newCaptionWriter(s.cs, p.CaptionsFormat)
+		}
+		cb.OnDataReceived = s.onDataReceived
+	} else if p.EmbedCaptions {
+		cb.OnDataReceived = s.onDataReceived
+	}
 
 	var onSubscribeErr error
 	var wg sync.WaitGroup
 	cb.OnTrackSubscribed = func(track *webrtc.TrackRemote, _ *lksdk.RemoteTrackPublication, rp *lksdk.RemoteParticipant) {
+		if s.composite {
+			s.onCompositeTrackSubscribed(track, rp, p.GstReady)
+			return
+		}
+
 		defer wg.Done()
 		s.logger.Debugw("track subscribed", "trackID", track.ID(), "mime", track.Codec().MimeType)
 
+		s.publishersMu.Lock()
+		s.publishers[rp.SID()] = true
+		s.publishersMu.Unlock()
+
 		var codec params.MimeType
 		var appSrcName string
 		var err error
@@ -87,7 +141,12 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 			appSrcName = AudioAppSource
 			p.AudioEnabled = true
 			if p.AudioCodec == "" {
-				p.AudioCodec = codec
+				if p.OutputType == params.OutputTypeHLS {
+					// hls segments carry aac
+					p.AudioCodec = params.MimeTypeAAC
+				} else {
+					p.AudioCodec = codec
+				}
 			}
 
 		case strings.EqualFold(track.Codec().MimeType, string(params.MimeTypeVP8)):
@@ -96,15 +155,15 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 			p.VideoEnabled = true
 
 			if p.VideoCodec == "" {
-				if p.AudioEnabled {
-					// transcode to h264 for composite requests
+				if p.AudioEnabled || p.OutputType == params.OutputTypeHLS {
+					// transcode to h264 for composite requests and hls segments
 					p.VideoCodec = params.MimeTypeH264
 				} else {
 					p.VideoCodec = params.MimeTypeVP8
 				}
 			}
-			if p.TrackID != "" {
-				p.OutputType = params.OutputTypeIVF
+			if p.TrackID != "" && p.OutputType == "" {
+				p.OutputType = p.GetTrackOutputType(codec)
 			}
 
 		case strings.EqualFold(track.Codec().MimeType, string(params.MimeTypeH264)):
@@ -115,6 +174,9 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 			if p.VideoCodec == "" {
 				p.VideoCodec = params.MimeTypeH264
 			}
+			if p.TrackID != "" && p.OutputType == "" {
+				p.OutputType = p.GetTrackOutputType(codec)
+			}
 
 		default:
 			onSubscribeErr = errors.ErrNotSupported(track.Codec().MimeType)
@@ -129,15 +191,16 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 			return
 		}
 
-		// write blank frames only when writing to mp4
-		writeBlanks := p.VideoCodec == params.MimeTypeH264
+		// write blank frames only when encoding h264. Track egress keeps the published frames,
+		// which blank frames could change the resolution of
+		writeBlanks := p.VideoCodec == params.MimeTypeH264 && p.TrackID == ""
 
 		switch track.Kind() {
 		case webrtc.RTPCodecTypeAudio:
 			s.audioSrc = app.SrcFromElement(src)
 			s.audioPlaying = make(chan struct{})
 			s.audioCodec = track.Codec()
-			s.audioWriter, err = newAppWriter(track, codec, rp, s.logger, s.audioSrc, s.cs, s.audioPlaying, writeBlanks)
+			s.audioWriter, err = newAppWriter(track, codec, rp, s.logger, s.audioSrc, s.cs, s.audioPlaying, writeBlanks, p.DTXSilence)
 			if err != nil {
 				s.logger.Errorw("could not create app writer", err)
 				onSubscribeErr = err
@@ -148,7 +211,7 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 			s.videoSrc = app.SrcFromElement(src)
 			s.videoPlaying = make(chan struct{})
 			s.videoCodec = track.Codec()
-			s.videoWriter, err = newAppWriter(track, codec, rp, s.logger, s.videoSrc, s.cs, s.videoPlaying, writeBlanks)
+			s.videoWriter, err = newAppWriter(track, codec, rp, s.logger, s.videoSrc, s.cs, s.videoPlaying, writeBlanks, false)
 			if err != nil {
 				s.logger.Errorw("could not create app writer", err)
 				onSubscribeErr = err
@@ -162,8 +225,34 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 	var fileIdentifier string
 
 	switch p.Info.Request.(type) {
+	case *livekit.EgressInfo_RoomComposite:
+		// every track in the room is mixed, for as long as the room exists
+		s.composite = true
+		s.compositeAudio = p.AudioEnabled
+		s.compositeVideo = p.VideoEnabled
+		s.compositeTracks = make(map[string]*CompositeTrack)
+
+		// timestamps are relative to the start of the egress, since tracks can be published at any time
+		s.cs.GetOrSetStartTime(time.Now().UnixNano())
+
 	case *livekit.EgressInfo_TrackComposite:
 		fileIdentifier = p.Info.RoomName
+		if p.SDKComposite {
+			// the requested tracks are composited like a room composite, ending once they've all been unpublished
+			s.composite = true
+			s.compositeAudio = p.AudioEnabled
+			s.compositeVideo = p.VideoEnabled
+			s.compositeTracks = make(map[string]*CompositeTrack)
+			s.compositeOnly = make(map[string]bool)
+			for _, trackID := range p.CompositeVideoTrackIDs {
+				s.compositeOnly[trackID] = true
+			}
+			if p.AudioEnabled {
+				s.compositeOnly[p.AudioTrackID] = true
+			}
+			s.cs.GetOrSetStartTime(time.Now().UnixNano())
+			break
+		}
 		if p.AudioEnabled {
 			s.audioTrackID = p.AudioTrackID
 			wg.Add(1)
@@ -188,12 +277,28 @@ func NewSDKSource(ctx context.Context, p *params.Params) (*SDKSource, error) {
 		return nil, onSubscribeErr
 	}
 
-	if p.EgressType == params.EgressTypeFile {
+	if p.EgressType == params.EgressTypeFile && !s.composite {
 		if err := p.UpdateOutputTypeFromCodecs(fileIdentifier); err != nil {
 			s.logger.Errorw("could not update file params", err)
 			return nil, err
 		}
 	}
+	if p.EgressType == params.EgressTypeSegmentedFile && p.TrackID != "" {
+		// audio tracks use the audio only container
+		p.UpdateSegmentOutputType()
+	}
+
+	if s.data != nil {
+		// the file is named after the recording, so messages received while subscribing are left out
+		localFilepath, _ := p.GetSidecarFilepaths(DataCaptureSuffix)
+		if err := s.data.open(localFilepath); err != nil {
+			return nil, err
+		}
+	}
+	if s.captions != nil {
+		localFilepath, _ := p.GetSidecarFilepaths(CaptionsSuffix(p.CaptionsFormat))
+		s.captions.open(localFilepath)
+	}
 
 	return s, nil
 }
@@ -208,9 +313,16 @@ func (s *SDKSource) join(ctx context.Context, p *params.Params) error {
 	}
 
 	expecting := make(map[string]bool)
-	if s.trackID != "" {
+	switch {
+	case s.compositeOnly != nil:
+		for trackID := range s.compositeOnly {
+			expecting[trackID] = true
+		}
+	case s.composite:
+		return s.subscribeToRoom()
+	case s.trackID != "":
 		expecting[s.trackID] = true
-	} else {
+	default:
 		if s.audioTrackID != "" {
 			expecting[s.audioTrackID] = true
 		}
@@ -297,15 +409,83 @@ func (s *SDKSource) onTrackUnmuted(pub lksdk.TrackPublication, _ lksdk.Participa
 }
 
 func (s *SDKSource) onTrackUnpublished(track *lksdk.RemoteTrackPublication, _ *lksdk.RemoteParticipant) {
+	if s.composite {
+		// the composite continues until the room ends, or until a track composite's tracks have all ended
+		s.onCompositeTrackUnpublished(track.SID())
+		if s.compositeOnly[track.SID()] {
+			if s.stopOnTrackEnd {
+				s.endAfterLinger(EndReasonTrackEnded)
+			} else if s.active.Dec() == 0 {
+				s.setEndedReason(EndReasonTrackEnded)
+				s.onComplete()
+			}
+		}
+		return
+	}
+
+	if s.stopOnTrackEnd {
+		if s.getWriterForTrack(track.SID()) != nil {
+			s.endAfterLinger(EndReasonTrackEnded)
+		}
+		return
+	}
+
 	if w := s.getWriterForTrack(track.SID()); w != nil {
+		// show the slate, if any, for the rest of the recording
+		w.setStalled(true)
 		w.sendEOS()
 	}
 
 	if s.active.Dec() == 0 {
+		s.setEndedReason(EndReasonTrackEnded)
 		s.onComplete()
 	}
 }
 
+func (s *SDKSource) onParticipantDisconnected(rp *lksdk.RemoteParticipant) {
+	if (s.composite && s.compositeOnly == nil) || !s.stopOnTrackEnd {
+		return
+	}
+
+	s.publishersMu.Lock()
+	publisher := s.publishers[rp.SID()]
+	s.publishersMu.Unlock()
+
+	if publisher {
+		s.endAfterLinger(EndReasonPublisherLeft)
+	}
+}
+
+// endAfterLinger completes the egress once the linger has passed. Tracks that are still publishing keep recording until then
+func (s *SDKSource) endAfterLinger(reason string) {
+	if !s.setEndedReason(reason) {
+		return
+	}
+
+	s.logger.Infow("ending recording", "reason", reason, "linger", s.trackEndLinger)
+	time.AfterFunc(s.trackEndLinger, s.onComplete)
+}
+
+// EndedReason returns the reason the source ended the recording on its own, if it did
+func (s *SDKSource) EndedReason() string {
+	s.endedReasonMu.Lock()
+	defer s.endedReasonMu.Unlock()
+
+	return s.endedReason
+}
+
+// setEndedReason records the reason, returning false if the recording was already ending
+func (s *SDKSource) setEndedReason(reason string) bool {
+	s.endedReasonMu.Lock()
+	defer s.endedReasonMu.Unlock()
+
+	if s.endedReason != "" {
+		return false
+	}
+	s.endedReason = reason
+	return true
+}
+
 func (s *SDKSource) onComplete() {
 	select {
 	case <-s.endRecording:
@@ -329,6 +509,10 @@ func (s *SDKSource) getWriterForTrack(trackID string) *appWriter {
 		return s.videoWriter
 	}
 
+	if s.composite {
+		return s.getCompositeWriter(trackID)
+	}
+
 	return nil
 }
 
@@ -344,10 +528,37 @@ func (s *SDKSource) GetVideoSource() (*app.Source, webrtc.RTPCodecParameters) {
 	return s.videoSrc, s.videoCodec
 }
 
+// OnVideoStalled registers a callback for when the video track stops and resumes sending media
+func (s *SDKSource) OnVideoStalled(timeout time.Duration, f func(stalled bool)) {
+	if s.videoWriter != nil {
+		s.videoWriter.setStallHandler(timeout, f)
+	}
+}
+
+// OnCaption registers a callback for transcriptions received while recording, for captions embedded in the video
+func (s *SDKSource) OnCaption(f func(text string, duration time.Duration)) {
+	s.callbackMu.Lock()
+	s.onCaption = f
+	s.callbackMu.Unlock()
+}
+
+// OnTimedMetadata registers a callback for timed metadata sent by participants, which is added to HLS segments
+func (s *SDKSource) OnTimedMetadata(f func(*TimedMetadata)) {
+	s.callbackMu.Lock()
+	s.onTimedMetadata = f
+	s.callbackMu.Unlock()
+}
+
 func (s *SDKSource) GetStartTime() int64 {
 	return s.cs.startTime.Load()
 }
 
+// GetTrackStartTimes returns when each track first produced media, in unix nanoseconds. Tracks can start
+// seconds apart, which shows as leading black video or silence in the recording
+func (s *SDKSource) GetTrackStartTimes() map[string]int64 {
+	return s.cs.GetTrackStartTimes()
+}
+
 func (s *SDKSource) GetEndTime() int64 {
 	return s.cs.endTime.Load() + s.cs.delay.Load()
 }
@@ -378,6 +589,11 @@ func (s *SDKSource) EndRecording() chan struct{} {
 func (s *SDKSource) SendEOS() {
 	s.cs.SetEndTime(time.Now().UnixNano())
 
+	if s.composite {
+		s.sendCompositeEOS()
+		return
+	}
+
 	var wg sync.WaitGroup
 	if s.audioWriter != nil {
 		wg.Add(1)
@@ -398,4 +614,36 @@ func (s *SDKSource) SendEOS() {
 
 func (s *SDKSource) Close() {
 	s.room.Disconnect()
+	if s.data != nil {
+		s.data.close()
+	}
+	if s.captions != nil {
+		if err := s.captions.close(); err != nil {
+			s.logger.Errorw("could not write captions", err)
+		}
+	}
+}
+
+func (s *SDKSource) onDataReceived(data []byte, rp *lksdk.RemoteParticipant) {
+	if s.data != nil {
+		s.data.write(data, rp)
+	}
+	if s.captions != nil {
+		s.captions.write(data, rp)
+	}
+
+	s.callbackMu.Lock()
+	onCaption := s.onCaption
+	onTimedMetadata := s.onTimedMetadata
+	s.callbackMu.Unlock()
+	if onCaption != nil {
+		if cue := parseTranscription(data, rp, time.Now().UnixNano(), s.cs.GetStartTime()); cue != nil {
+			onCaption(cue.text, cue.end-cue.start)
+		}
+	}
+	if onTimedMetadata != nil {
+		if metadata := parseTimedMetadata(data); metadata != nil {
+			onTimedMetadata(metadata)
+		}
+	}
 }
@@ -0,0 +1,202 @@
+package source
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	lksdk "github.com/livekit/server-sdk-go"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+// CompositeTrack is a track mixed into a room composite that doesn't use a browser.
+// Tracks come and go during the egress, so each one is added to the running pipeline separately
+type CompositeTrack struct {
+	TrackID string
+	Kind    webrtc.RTPCodecType
+	Src     *app.Source
+	Codec   webrtc.RTPCodecParameters
+
+	writer      *appWriter
+	playing     chan struct{}
+	playingOnce sync.Once
+}
+
+// Playing allows the writer to push buffers, once the track's elements are in the running pipeline
+func (t *CompositeTrack) Playing() {
+	t.playingOnce.Do(func() {
+		close(t.playing)
+	})
+}
+
+// OnStalled registers a callback for when the track stops and resumes sending media
+func (t *CompositeTrack) OnStalled(timeout time.Duration, f func(stalled bool)) {
+	t.writer.setStallHandler(timeout, f)
+}
+
+// OnCompositeTrack registers callbacks for tracks joining and leaving the composite.
+// Tracks subscribed before the callbacks were registered are added right away
+func (s *SDKSource) OnCompositeTrack(onAdded, onRemoved func(*CompositeTrack)) {
+	s.compositeMu.Lock()
+	s.onTrackAdded = onAdded
+	s.onTrackRemoved = onRemoved
+	pending := make([]*CompositeTrack, 0, len(s.compositeTracks))
+	for _, t := range s.compositeTracks {
+		pending = append(pending, t)
+	}
+	s.compositeMu.Unlock()
+
+	for _, t := range pending {
+		onAdded(t)
+	}
+}
+
+func (s *SDKSource) subscribeToRoom() error {
+	for _, rp := range s.room.GetParticipants() {
+		for _, track := range rp.Tracks() {
+			if pub, ok := track.(*lksdk.RemoteTrackPublication); ok && s.shouldSubscribe(pub) {
+				if err := pub.SetSubscribed(true); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (s *SDKSource) shouldSubscribe(pub *lksdk.RemoteTrackPublication) bool {
+	if s.compositeOnly != nil {
+		return false
+	}
+
+	switch pub.Kind() {
+	case lksdk.TrackKindAudio:
+		return s.compositeAudio
+	case lksdk.TrackKindVideo:
+		return s.compositeVideo
+	default:
+		return false
+	}
+}
+
+func (s *SDKSource) onTrackPublished(pub *lksdk.RemoteTrackPublication, _ *lksdk.RemoteParticipant) {
+	if !s.composite || !s.shouldSubscribe(pub) {
+		return
+	}
+
+	if err := pub.SetSubscribed(true); err != nil {
+		s.logger.Errorw("could not subscribe to track", err, "trackID", pub.SID())
+	}
+}
+
+func (s *SDKSource) onCompositeTrackSubscribed(track *webrtc.TrackRemote, rp *lksdk.RemoteParticipant, gstReady chan struct{}) {
+	var codec params.MimeType
+	var appSrcName string
+	switch {
+	case strings.EqualFold(track.Codec().MimeType, string(params.MimeTypeOpus)):
+		codec = params.MimeTypeOpus
+		appSrcName = AudioAppSource
+	case strings.EqualFold(track.Codec().MimeType, string(params.MimeTypeVP8)):
+		codec = params.MimeTypeVP8
+		appSrcName = VideoAppSource
+	case strings.EqualFold(track.Codec().MimeType, string(params.MimeTypeH264)):
+		codec = params.MimeTypeH264
+		appSrcName = VideoAppSource
+	default:
+		// one unsupported track shouldn't end the recording
+		s.logger.Warnw("skipping track", errors.ErrNotSupported(track.Codec().MimeType), "trackID", track.ID())
+		return
+	}
+
+	if s.compositeOnly != nil {
+		s.publishersMu.Lock()
+		s.publishers[rp.SID()] = true
+		s.publishersMu.Unlock()
+	}
+
+	<-gstReady
+	src, err := gst.NewElementWithName("appsrc", fmt.Sprintf("%s_%s", appSrcName, track.ID()))
+	if err != nil {
+		s.logger.Errorw("could not create appsrc", err)
+		return
+	}
+
+	t := &CompositeTrack{
+		TrackID: track.ID(),
+		Kind:    track.Kind(),
+		Src:     app.SrcFromElement(src),
+		Codec:   track.Codec(),
+		playing: make(chan struct{}),
+	}
+	// the audio mixer fills pauses in dtx tracks
+	t.writer, err = newAppWriter(track, codec, rp, s.logger, t.Src, s.cs, t.playing, false, false)
+	if err != nil {
+		s.logger.Errorw("could not create app writer", err)
+		return
+	}
+
+	s.compositeMu.Lock()
+	s.compositeTracks[t.TrackID] = t
+	onAdded := s.onTrackAdded
+	s.compositeMu.Unlock()
+
+	if onAdded != nil {
+		onAdded(t)
+	}
+}
+
+// onCompositeTrackUnpublished drains the track's writer before its elements are removed from the pipeline
+func (s *SDKSource) onCompositeTrackUnpublished(trackID string) {
+	s.compositeMu.Lock()
+	t := s.compositeTracks[trackID]
+	delete(s.compositeTracks, trackID)
+	onRemoved := s.onTrackRemoved
+	s.compositeMu.Unlock()
+
+	if t == nil {
+		return
+	}
+
+	go func() {
+		t.writer.sendEOS()
+		if onRemoved != nil {
+			onRemoved(t)
+		}
+	}()
+}
+
+func (s *SDKSource) getCompositeWriter(trackID string) *appWriter {
+	s.compositeMu.Lock()
+	defer s.compositeMu.Unlock()
+
+	if t := s.compositeTracks[trackID]; t != nil {
+		return t.writer
+	}
+	return nil
+}
+
+func (s *SDKSource) sendCompositeEOS() {
+	s.compositeMu.Lock()
+	writers := make([]*appWriter, 0, len(s.compositeTracks))
+	for _, t := range s.compositeTracks {
+		writers = append(writers, t.writer)
+	}
+	s.compositeMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, w := range writers {
+		wg.Add(1)
+		go func(w *appWriter) {
+			defer wg.Done()
+			w.sendEOS()
+		}(w)
+	}
+	wg.Wait()
+}
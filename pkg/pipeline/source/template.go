@@ -0,0 +1,172 @@
+package source
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/fetch"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/chromedp"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const (
+	templateExpiresParam   = "expires"
+	templateIntegrityParam = "integrity"
+	templateSignatureParam = "signature"
+)
+
+// verifyTemplate checks the signature and expiry of a template, returning its url without the signing parameters, and
+// the integrity chrome's document needs to match, if any. Signed urls end with a signature parameter, the hex
+// hmac-sha256 of everything before it
+func verifyTemplate(conf *config.Config, templateBase string) (string, string, error) {
+	u, err := url.Parse(templateBase)
+	if err != nil {
+		return "", "", errors.ErrInvalidUrl(templateBase, "template")
+	}
+
+	query := u.Query()
+	integrity := ""
+	if query.Get(templateSignatureParam) != "" {
+		if err = verifySignature(conf.Templates.SigningKey, templateBase); err != nil {
+			return "", "", err
+		}
+		if expires := query.Get(templateExpiresParam); expires != "" {
+			ts, err := strconv.ParseInt(expires, 10, 64)
+			if err != nil {
+				return "", "", errors.ErrTemplateRejected("invalid expiry")
+			}
+			if time.Now().Unix() > ts {
+				return "", "", errors.ErrTemplateRejected("signature expired")
+			}
+		}
+		// only a signed url can pin its own integrity
+		integrity = query.Get(templateIntegrityParam)
+	} else if templateBase != conf.TemplateBase && conf.Templates.RequireSignature {
+		return "", "", errors.ErrTemplateRejected("custom templates must be signed")
+	}
+
+	query.Del(templateExpiresParam)
+	query.Del(templateIntegrityParam)
+	query.Del(templateSignatureParam)
+	u.RawQuery = query.Encode()
+	verified := u.String()
+
+	if pinned := conf.Templates.Integrity[verified]; pinned != "" {
+		integrity = pinned
+	}
+
+	return verified, integrity, nil
+}
+
+func verifySignature(key, templateBase string) error {
+	if key == "" {
+		return errors.ErrTemplateRejected("no signing key")
+	}
+
+	i := strings.LastIndex(templateBase, templateSignatureParam+"=")
+	if i < 1 || (templateBase[i-1] != '?' && templateBase[i-1] != '&') {
+		return errors.ErrTemplateRejected("invalid signature")
+	}
+	signature, err := hex.DecodeString(templateBase[i+len(templateSignatureParam)+1:])
+	if err != nil {
+		return errors.ErrTemplateRejected("invalid signature")
+	}
+
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(templateBase[:i-1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.ErrTemplateRejected("invalid signature")
+	}
+	return nil
+}
+
+// checkIntegrity compares the template document to a subresource integrity value, such as "sha384-<base64>".
+// Any of several space separated hashes can match
+func checkIntegrity(body []byte, integrity string) error {
+	for _, value := range strings.Fields(integrity) {
+		var h hash.Hash
+		switch {
+		case strings.HasPrefix(value, "sha256-"):
+			h = sha256.New()
+		case strings.HasPrefix(value, "sha384-"):
+			h = sha512.New384()
+		case strings.HasPrefix(value, "sha512-"):
+			h = sha512.New()
+		default:
+			continue
+		}
+
+		// options following the hash, such as "?ct=text/html", are ignored
+		expected := value[len("sha256-"):]
+		if i := strings.IndexByte(expected, '?'); i >= 0 {
+			expected = expected[:i]
+		}
+		h.Write(body)
+		actual := base64.StdEncoding.EncodeToString(h.Sum(nil))
+		if subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) == 1 {
+			return nil
+		}
+	}
+
+	return errors.ErrTemplateRejected("integrity mismatch")
+}
+
+// interceptDocuments pauses document responses, so the main frame's can be verified before chrome loads it
+func (s *WebSource) interceptDocuments() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if s.integrity == "" {
+			return nil
+		}
+		return fetch.Enable().WithPatterns([]*fetch.RequestPattern{{
+			ResourceType: network.ResourceTypeDocument,
+			RequestStage: fetch.RequestStageResponse,
+		}}).Do(ctx)
+	})
+}
+
+// verifyDocument checks the document chrome is loading in its main frame against the template's integrity, failing the
+// navigation on a mismatch. Iframes are let through, as are redirects, since the document they lead to is checked
+func (s *WebSource) verifyDocument(chromeCtx context.Context, ev *fetch.EventRequestPaused) {
+	// a page target's main frame shares its id
+	mainFrame := cdp.FrameID(chromedp.FromContext(chromeCtx).Target.TargetID)
+	redirect := ev.ResponseStatusCode >= 300 && ev.ResponseStatusCode < 400
+
+	var action chromedp.Action = fetch.ContinueRequest(ev.RequestID)
+	if ev.FrameID == mainFrame && !redirect && ev.ResponseErrorReason == "" {
+		var body []byte
+		err := chromedp.Run(chromeCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+			var err error
+			body, err = fetch.GetResponseBody(ev.RequestID).Do(ctx)
+			return err
+		}))
+		if err == nil {
+			err = checkIntegrity(body, s.integrity)
+		}
+		if err != nil {
+			s.logger.Warnw("template document rejected", err, "url", ev.Request.URL)
+			select {
+			case s.rejected <- err:
+			default:
+			}
+			action = fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient)
+		}
+	}
+
+	if err := chromedp.Run(chromeCtx, action); err != nil {
+		s.logger.Debugw("failed to resume template document", "error", err)
+	}
+}
@@ -0,0 +1,178 @@
+package source
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/livekit/egress/pkg/config"
+)
+
+const testSigningKey = "signing-key"
+
+func sign(key, unsigned string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(unsigned))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySignature(t *testing.T) {
+	base := "https://templates.example.com/grid?layout=speaker"
+
+	for _, test := range []struct {
+		name        string
+		key         string
+		templateUrl string
+		err         bool
+	}{
+		{
+			name:        "signed",
+			key:         testSigningKey,
+			templateUrl: fmt.Sprintf("%s&signature=%s", base, sign(testSigningKey, base)),
+		},
+		{
+			name:        "only parameter",
+			key:         testSigningKey,
+			templateUrl: "https://templates.example.com/grid?signature=" + sign(testSigningKey, "https://templates.example.com/grid"),
+		},
+		{
+			name:        "no key",
+			templateUrl: fmt.Sprintf("%s&signature=%s", base, sign(testSigningKey, base)),
+			err:         true,
+		},
+		{
+			name:        "wrong key",
+			key:         "other-key",
+			templateUrl: fmt.Sprintf("%s&signature=%s", base, sign(testSigningKey, base)),
+			err:         true,
+		},
+		{
+			name:        "modified",
+			key:         testSigningKey,
+			templateUrl: fmt.Sprintf("%s&x=1&signature=%s", base, sign(testSigningKey, base)),
+			err:         true,
+		},
+		{
+			name:        "part of another parameter",
+			key:         testSigningKey,
+			templateUrl: fmt.Sprintf("%s&xsignature=%s", base, sign(testSigningKey, base+"&x")),
+			err:         true,
+		},
+		{
+			name:        "not hex",
+			key:         testSigningKey,
+			templateUrl: base + "&signature=zz",
+			err:         true,
+		},
+		{
+			name:        "missing",
+			key:         testSigningKey,
+			templateUrl: base,
+			err:         true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifySignature(test.key, test.templateUrl)
+			if test.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestVerifyTemplate(t *testing.T) {
+	conf := &config.Config{TemplateBase: "https://templates.example.com/"}
+	conf.Templates.SigningKey = testSigningKey
+	conf.Templates.RequireSignature = true
+
+	signed := func(expires time.Time) string {
+		unsigned := "https://custom.example.com/grid?expires=" + strconv.FormatInt(expires.Unix(), 10) + "&integrity=sha256-abc"
+		return fmt.Sprintf("%s&signature=%s", unsigned, sign(testSigningKey, unsigned))
+	}
+
+	for _, test := range []struct {
+		name        string
+		templateUrl string
+		expected    string
+		integrity   string
+		err         bool
+	}{
+		{
+			name:        "default",
+			templateUrl: conf.TemplateBase,
+			expected:    conf.TemplateBase,
+		},
+		{
+			name:        "signed",
+			templateUrl: signed(time.Now().Add(time.Hour)),
+			expected:    "https://custom.example.com/grid",
+			integrity:   "sha256-abc",
+		},
+		{
+			name:        "expired",
+			templateUrl: signed(time.Now().Add(-time.Hour)),
+			err:         true,
+		},
+		{
+			name:        "unsigned",
+			templateUrl: "https://custom.example.com/grid",
+			err:         true,
+		},
+		{
+			name:        "unsigned integrity",
+			templateUrl: "https://custom.example.com/grid?integrity=sha256-abc",
+			err:         true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			verified, integrity, err := verifyTemplate(conf, test.templateUrl)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, verified)
+			require.Equal(t, test.integrity, integrity)
+		})
+	}
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	body := []byte("<html><body>template</body></html>")
+	sha256Sum := sha256.Sum256(body)
+	sha384Sum := sha512.Sum384(body)
+	sha256Value := "sha256-" + base64.StdEncoding.EncodeToString(sha256Sum[:])
+	sha384Value := "sha384-" + base64.StdEncoding.EncodeToString(sha384Sum[:])
+
+	for _, test := range []struct {
+		name      string
+		integrity string
+		err       bool
+	}{
+		{name: "sha256", integrity: sha256Value},
+		{name: "sha384", integrity: sha384Value},
+		{name: "options", integrity: sha384Value + "?ct=text/html"},
+		{name: "any of several", integrity: "sha256-AAAA " + sha384Value},
+		{name: "mismatch", integrity: "sha256-AAAA", err: true},
+		{name: "unsupported", integrity: "md5-" + base64.StdEncoding.EncodeToString(sha256Sum[:16]), err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := checkIntegrity(body, test.integrity)
+			if test.err {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
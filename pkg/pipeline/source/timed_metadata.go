@@ -0,0 +1,25 @@
+package source
+
+import (
+	"encoding/json"
+)
+
+// data and template messages with this type are added to HLS segments as ID3 timed metadata
+const TimedMetadataMessageType = "timed_metadata"
+
+// TimedMetadata is sent by a participant as a data message, or by the template, to mark a point in HLS outputs,
+// such as an ad cue or an interactive overlay. Players receive it as an ID3 TXXX frame when they reach that point
+type TimedMetadata struct {
+	Type  string `json:"type,omitempty"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// parseTimedMetadata returns the timed metadata in a data message, or nil if the message isn't timed metadata
+func parseTimedMetadata(data []byte) *TimedMetadata {
+	msg := &TimedMetadata{}
+	if err := json.Unmarshal(data, msg); err != nil || msg.Type != TimedMetadataMessageType {
+		return nil
+	}
+	return msg
+}
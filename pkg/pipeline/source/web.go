@@ -10,8 +10,10 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/chromedp/cdproto/fetch"
 	"github.com/chromedp/cdproto/runtime"
 	"github.com/chromedp/chromedp"
 
@@ -31,11 +33,20 @@ const (
 type WebSource struct {
 	pulseSink    string
 	xvfb         *exec.Cmd
+	chromeCtx    context.Context
 	chromeCancel context.CancelFunc
+	proxy        *networkProxy
+
+	integrity string     // the template document's, checked as chrome loads it
+	rejected  chan error // integrity mismatches, which fail chrome's navigation
 
 	startRecording chan struct{}
 	endRecording   chan struct{}
 
+	channelMu    sync.Mutex
+	onMessage    func(*TemplateMessage)
+	mainContexts map[runtime.ExecutionContextID]bool // the main frame's, which can use the binding
+
 	logger logger.Logger
 }
 
@@ -50,15 +61,25 @@ func NewWebSource(ctx context.Context, conf *config.Config, p *params.Params) (*
 	s := &WebSource{
 		startRecording: make(chan struct{}),
 		endRecording:   make(chan struct{}),
+		rejected:       make(chan error, 1),
+		mainContexts:   make(map[runtime.ExecutionContextID]bool),
 		logger:         p.Logger,
 	}
 
-	if err := s.createAudioSink(ctx, p.Info.EgressId); err != nil {
+	templateBase, integrity, err := verifyTemplate(conf, p.TemplateBase)
+	if err != nil {
+		s.logger.Errorw("failed to verify template", err)
+		return nil, err
+	}
+	p.TemplateBase = templateBase
+	s.integrity = integrity
+
+	if err = s.createAudioSink(ctx, p.Info.EgressId); err != nil {
 		s.logger.Errorw("failed to load pulse sink", err)
 		return nil, err
 	}
 
-	if err := s.launchXvfb(ctx, p.Display, p.Width, p.Height, p.Depth); err != nil {
+	if err = s.launchXvfb(ctx, p.Display, p.Width, p.Height, p.Depth); err != nil {
 		s.logger.Errorw("failed to launch xvfb", err)
 		s.Close()
 		return nil, err
@@ -68,7 +89,7 @@ func NewWebSource(ctx context.Context, conf *config.Config, p *params.Params) (*
 		"%s?layout=%s&url=%s&token=%s",
 		p.TemplateBase, p.Layout, url.QueryEscape(p.LKUrl), p.Token,
 	)
-	if err := s.launchChrome(ctx, inputUrl, p.Info.EgressId, p.Display, p.Width, p.Height, conf.Insecure); err != nil {
+	if err = s.launchChrome(ctx, inputUrl, p, conf); err != nil {
 		s.logger.Errorw("failed to launch chrome", err, "display", p.Display)
 		s.Close()
 		return nil, err
@@ -115,17 +136,17 @@ func (s *WebSource) launchXvfb(ctx context.Context, display string, width, heigh
 }
 
 // launches chrome and navigates to the url
-func (s *WebSource) launchChrome(ctx context.Context, url, egressID, display string, width, height int32, insecure bool) error {
+func (s *WebSource) launchChrome(ctx context.Context, url string, p *params.Params, conf *config.Config) error {
 	ctx, span := tracer.Start(ctx, "WebSource.launchChrome")
 	defer span.End()
 
 	s.logger.Debugw("launching chrome", "url", url)
 
+	egressID, display, width, height := p.Info.EgressId, p.Display, p.Width, p.Height
 	opts := []chromedp.ExecAllocatorOption{
 		chromedp.NoFirstRun,
 		chromedp.NoDefaultBrowserCheck,
 		chromedp.DisableGPU,
-		chromedp.NoSandbox,
 
 		// puppeteer default behavior
 		chromedp.Flag("disable-infobars", true),
@@ -164,15 +185,46 @@ func (s *WebSource) launchChrome(ctx context.Context, url, egressID, display str
 		chromedp.Flag("display", display),
 	}
 
-	if insecure {
+	if conf.Insecure {
 		opts = append(opts,
 			chromedp.Flag("disable-web-security", true),
 			chromedp.Flag("allow-running-insecure-content", true),
 		)
 	}
 
+	if !conf.Chrome.Sandbox {
+		opts = append(opts, chromedp.NoSandbox)
+	}
+	if len(conf.Chrome.Launcher) > 0 {
+		launcher := conf.Chrome.Launcher
+		opts = append(opts, chromedp.ModifyCmdFunc(func(cmd *exec.Cmd) {
+			// chrome's path and flags become the launcher's arguments
+			cmd.Args = append(append([]string{}, launcher...), cmd.Args...)
+			cmd.Path = launcher[0]
+			if path, err := exec.LookPath(launcher[0]); err == nil {
+				cmd.Path = path
+			}
+		}))
+	}
+	if conf.Chrome.RestrictNetwork {
+		hosts, local := getAllowedHosts(p, conf)
+		proxy, err := newNetworkProxy(hosts, local, s.logger)
+		if err != nil {
+			return err
+		}
+		s.proxy = proxy
+
+		// loopback isn't bypassed, so the node's own services are only reachable through the proxy as well
+		opts = append(opts,
+			chromedp.ProxyServer(proxy.URL()),
+			chromedp.Flag("proxy-bypass-list", "<-loopback>"),
+			chromedp.Flag("host-resolver-rules", getHostResolverRules(hosts)),
+		)
+	}
+
 	allocCtx, _ := chromedp.NewExecAllocator(context.Background(), opts...)
 	chromeCtx, cancel := chromedp.NewContext(allocCtx)
+	s.chromeCtx = chromeCtx
 	s.chromeCancel = cancel
 
 	chromedp.ListenTarget(chromeCtx, func(ev interface{}) {
@@ -188,27 +240,36 @@ func (s *WebSource) launchChrome(ctx context.Context, url, egressID, display str
 				msg := fmt.Sprint(val)
 				args = append(args, msg)
 				if msg == startRecordingLog {
-					select {
-					case <-s.startRecording:
-						continue
-					default:
-						close(s.startRecording)
-					}
+					s.signalStart()
 				} else if msg == endRecordingLog {
-					select {
-					case <-s.endRecording:
-						continue
-					default:
-						close(s.endRecording)
-					}
+					s.signalEnd()
 				}
 			}
 			s.logger.Debugw(fmt.Sprintf("chrome %s: %s", ev.Type.String(), strings.Join(args, " ")))
+
+		case *runtime.EventExecutionContextCreated:
+			s.addExecutionContext(chromeCtx, ev.Context)
+
+		case *runtime.EventExecutionContextDestroyed:
+			s.removeExecutionContext(ev.ExecutionContextID)
+
+		case *runtime.EventExecutionContextsCleared:
+			s.removeExecutionContext(0)
+
+		case *runtime.EventBindingCalled:
+			if ev.Name == templateBindingName {
+				s.receiveMessage(ev.ExecutionContextID, ev.Payload)
+			}
+
+		case *fetch.EventRequestPaused:
+			go s.verifyDocument(chromeCtx, ev)
 		}
 	})
 
 	var errString string
 	err := chromedp.Run(chromeCtx,
+		s.injectChannel(),
+		s.interceptDocuments(),
 		chromedp.Navigate(url),
 		chromedp.Evaluate(`
 			if (document.querySelector('div.error')) {
@@ -218,12 +279,60 @@ func (s *WebSource) launchChrome(ctx context.Context, url, egressID, display str
 			}`, &errString,
 		),
 	)
+	select {
+	case rejected := <-s.rejected:
+		return rejected
+	default:
+	}
 	if err == nil && errString != "" {
 		err = errors.New(errString)
 	}
 	return err
 }
 
+// getAllowedHosts returns the hosts a restricted chrome can connect to - the template, livekit, and allowed hosts -
+// and the addresses among them which can be on the node itself. Only the configured template and livekit addresses
+// can be, as in development, since a request's custom template could otherwise reach the node's other services
+func getAllowedHosts(p *params.Params, conf *config.Config) ([]string, []string) {
+	var hosts, local []string
+	for _, rawUrl := range []string{conf.TemplateBase, p.LKUrl} {
+		if u, err := url.Parse(rawUrl); err == nil && u.Hostname() != "" {
+			hosts = append(hosts, u.Hostname())
+			local = append(local, hostPort(u))
+		}
+	}
+	if u, err := url.Parse(p.TemplateBase); err == nil && u.Hostname() != "" {
+		hosts = append(hosts, u.Hostname())
+	}
+	return append(hosts, conf.Chrome.AllowedHosts...), local
+}
+
+// getHostResolverRules fails dns lookups for every host other than the allowed ones, for webrtc, which doesn't use the
+// proxy. Its connections to the hosts' ice candidates aren't affected
+func getHostResolverRules(hosts []string) string {
+	rules := []string{"MAP * ~NOTFOUND"}
+	for _, host := range hosts {
+		rules = append(rules, fmt.Sprintf("EXCLUDE %s", host))
+	}
+	return strings.Join(rules, ", ")
+}
+
+func (s *WebSource) signalStart() {
+	select {
+	case <-s.startRecording:
+	default:
+		close(s.startRecording)
+	}
+}
+
+func (s *WebSource) signalEnd() {
+	select {
+	case <-s.endRecording:
+	default:
+		close(s.endRecording)
+	}
+}
+
 func (s *WebSource) StartRecording() chan struct{} {
 	return s.startRecording
 }
@@ -238,6 +347,11 @@ func (s *WebSource) Close() {
 		s.chromeCancel = nil
 	}
 
+	if s.proxy != nil {
+		s.proxy.Close()
+		s.proxy = nil
+	}
+
 	if s.xvfb != nil {
 		err := s.xvfb.Process.Signal(os.Interrupt)
 		if err != nil {
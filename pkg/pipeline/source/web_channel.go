@@ -0,0 +1,150 @@
+package source
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+const (
+	templateBindingName = "__egressSend"
+
+	// messages sent by the template which the web source handles itself
+	TemplateMessageStartRecording = "start_recording"
+	TemplateMessageEndRecording   = "end_recording"
+)
+
+// templateScript is injected before the template loads. Templates send messages with
+// window.egress.send(type, data), and receive them with window.egress.onmessage or "egress-message" events.
+// The binding is in every frame, but only the main frame's messages are handled, so iframes can't end the recording
+const templateScript = `(() => {
+	const send = window.` + templateBindingName + `;
+	window.egress = {
+		onmessage: null,
+		send: (type, data) => send(JSON.stringify({ type, data })),
+		_receive: (msg) => {
+			if (window.egress.onmessage) {
+				window.egress.onmessage(msg);
+			}
+			window.dispatchEvent(new CustomEvent('egress-message', { detail: msg }));
+		},
+	};
+})();`
+
+// TemplateMessage is sent between the handler and the template over chrome's devtools connection
+type TemplateMessage struct {
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// OnTemplateMessage registers a handler for messages sent by the template, other than start and end recording
+func (s *WebSource) OnTemplateMessage(onMessage func(*TemplateMessage)) {
+	s.channelMu.Lock()
+	s.onMessage = onMessage
+	s.channelMu.Unlock()
+}
+
+// SendTemplateMessage pushes a message to the template, such as layout parameters or a countdown
+func (s *WebSource) SendTemplateMessage(msgType string, data interface{}) error {
+	if s.chromeCtx == nil {
+		return errors.New("chrome not running")
+	}
+
+	msg, err := json.Marshal(map[string]interface{}{"type": msgType, "data": data})
+	if err != nil {
+		return err
+	}
+
+	return chromedp.Run(s.chromeCtx, chromedp.ActionFunc(func(ctx context.Context) error {
+		_, exp, err := runtime.Evaluate(fmt.Sprintf("window.egress && window.egress._receive(%s)", msg)).Do(ctx)
+		if err != nil {
+			return err
+		}
+		if exp != nil {
+			return exp
+		}
+		return nil
+	}))
+}
+
+// injectChannel adds the binding and script the template uses, before navigating
+func (s *WebSource) injectChannel() chromedp.Action {
+	return chromedp.ActionFunc(func(ctx context.Context) error {
+		if err := runtime.AddBinding(templateBindingName).Do(ctx); err != nil {
+			return err
+		}
+		_, err := page.AddScriptToEvaluateOnNewDocument(templateScript).Do(ctx)
+		return err
+	})
+}
+
+// addExecutionContext tracks the main frame's default execution contexts, which are replaced as it navigates
+func (s *WebSource) addExecutionContext(chromeCtx context.Context, desc *runtime.ExecutionContextDescription) {
+	aux := &struct {
+		FrameID   cdp.FrameID `json:"frameId"`
+		IsDefault bool        `json:"isDefault"`
+	}{}
+	if err := json.Unmarshal(desc.AuxData, aux); err != nil || !aux.IsDefault {
+		return
+	}
+
+	// a page target's main frame shares its id
+	if aux.FrameID != cdp.FrameID(chromedp.FromContext(chromeCtx).Target.TargetID) {
+		return
+	}
+
+	s.channelMu.Lock()
+	s.mainContexts[desc.ID] = true
+	s.channelMu.Unlock()
+}
+
+// removeExecutionContext forgets a destroyed execution context, or all of them for 0
+func (s *WebSource) removeExecutionContext(id runtime.ExecutionContextID) {
+	s.channelMu.Lock()
+	if id == 0 {
+		s.mainContexts = make(map[runtime.ExecutionContextID]bool)
+	} else {
+		delete(s.mainContexts, id)
+	}
+	s.channelMu.Unlock()
+}
+
+func (s *WebSource) receiveMessage(contextID runtime.ExecutionContextID, payload string) {
+	s.channelMu.Lock()
+	mainFrame := s.mainContexts[contextID]
+	s.channelMu.Unlock()
+	if !mainFrame {
+		s.logger.Debugw("ignoring template message from iframe")
+		return
+	}
+
+	msg := &TemplateMessage{}
+	if err := json.Unmarshal([]byte(payload), msg); err != nil {
+		s.logger.Warnw("invalid template message", err)
+		return
+	}
+
+	switch msg.Type {
+	case TemplateMessageStartRecording:
+		s.signalStart()
+	case TemplateMessageEndRecording:
+		s.signalEnd()
+	default:
+		s.channelMu.Lock()
+		onMessage := s.onMessage
+		s.channelMu.Unlock()
+
+		if onMessage != nil {
+			onMessage(msg)
+		} else {
+			s.logger.Debugw("unhandled template message", "type", msg.Type)
+		}
+	}
+}
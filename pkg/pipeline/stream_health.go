@@ -0,0 +1,101 @@
+package pipeline
+
+import (
+	"math"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/livekit/egress/pkg/stats"
+)
+
+// monitorStreamHealth scores each active stream output at the configured interval, until done is closed. The score is
+// the share of the encoded bitrate which was sent, scaled down by how full the output's queue is, and by 10% for each
+// time the url was added again after failing
+func (p *Pipeline) monitorStreamHealth(done chan struct{}) {
+	defer p.recoverPanic()
+
+	ticker := time.NewTicker(p.StreamHealthInterval)
+	defer ticker.Stop()
+
+	sent := make(map[string]uint64)
+	statuses := make(map[string]string)
+	last := time.Now()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+
+			streamStats := p.out.StreamStats()
+			p.mu.Lock()
+			reconnects := make(map[string]int, len(p.startedAt))
+			for u := range p.startedAt {
+				reconnects[u] = p.streamReconnects[u]
+			}
+			p.mu.Unlock()
+
+			health := make([]*stats.StreamHealth, 0, len(streamStats))
+			current := make(map[string]uint64, len(streamStats))
+			for u, s := range streamStats {
+				current[u] = s.Bytes
+				prev, ok := sent[u]
+				if _, active := reconnects[u]; !ok || !active {
+					// scored once it has been sending for a full interval
+					continue
+				}
+
+				ratio := 1.0
+				if s.TargetBitrate > 0 {
+					achieved := float64(s.Bytes-prev) * 8 / 1000 / elapsed
+					ratio = math.Min(achieved/float64(s.TargetBitrate), 1)
+				}
+				score := ratio * (1 - s.BufferOccupancy) * math.Pow(0.9, float64(reconnects[u]))
+				h := &stats.StreamHealth{
+					EgressID:        p.Info.EgressId,
+					Destination:     streamDestination(u),
+					Score:           math.Round(score*100) / 100,
+					BufferOccupancy: math.Round(s.BufferOccupancy*100) / 100,
+					Reconnects:      reconnects[u],
+					BitrateRatio:    math.Round(ratio*100) / 100,
+				}
+				h.Status = stats.StreamHealthStatus(h.Score)
+				health = append(health, h)
+
+				if statuses[u] != h.Status {
+					p.Logger.Infow("stream health changed",
+						"destination", h.Destination,
+						"status", h.Status,
+						"score", h.Score,
+					)
+					statuses[u] = h.Status
+				}
+			}
+			sent = current
+			for u := range statuses {
+				if _, ok := current[u]; !ok {
+					delete(statuses, u)
+				}
+			}
+
+			if onStreamHealth := p.onStreamHealth; onStreamHealth != nil {
+				onStreamHealth(p.Info.EgressId, health)
+			}
+		}
+	}
+}
+
+// streamDestination returns the url without its stream key, which is the last element of the path, or its user or query
+func streamDestination(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return ""
+	}
+	destination := url.URL{Scheme: u.Scheme, Host: u.Host}
+	if dir := path.Dir(u.Path); dir != "/" && dir != "." {
+		destination.Path = dir
+	}
+	return destination.String()
+}
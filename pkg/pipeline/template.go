@@ -0,0 +1,75 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/livekit/protocol/tracer"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/source"
+)
+
+// messages pushed to the template
+const (
+	templateMessageRecording = "recording" // sent once the recording starts, with its start and end times
+	templateMessageEnding    = "ending"    // sent when the egress is stopping, with the reason
+)
+
+// messages received from the template
+const (
+	templateMessageMarker = "marker"
+)
+
+// startTemplateChannel lets the template know the recording started, and when a session limit will end it
+func (p *Pipeline) startTemplateChannel(s *source.WebSource) {
+	s.OnTemplateMessage(p.handleTemplateMessage)
+
+	data := map[string]int64{"started_at": p.Info.StartedAt}
+	if timeout, _ := p.GetSessionTimeout(); timeout > 0 {
+		data["ends_at"] = time.Now().Add(timeout).UnixNano()
+	}
+	p.sendTemplateMessage(s, templateMessageRecording, data)
+}
+
+func (p *Pipeline) sendTemplateMessage(s *source.WebSource, msgType string, data interface{}) {
+	go func() {
+		if err := s.SendTemplateMessage(msgType, data); err != nil {
+			p.Logger.Debugw("could not send template message", "type", msgType, "error", err)
+		}
+	}()
+}
+
+// SendTemplateMessage relays a message to the template, such as layout parameters, a marker or a countdown. The messages
+// the egress sends itself can't be relayed, so templates can rely on them
+func (p *Pipeline) SendTemplateMessage(ctx context.Context, msg *source.TemplateMessage) error {
+	_, span := tracer.Start(ctx, "Pipeline.SendTemplateMessage")
+	defer span.End()
+
+	s, ok := p.in.Source.(*source.WebSource)
+	if !ok {
+		return errors.ErrNoTemplate
+	}
+
+	switch msg.Type {
+	case "", templateMessageRecording, templateMessageEnding:
+		return errors.ErrInvalidInput("type")
+	}
+	if err := s.SendTemplateMessage(msg.Type, msg.Data); err != nil {
+		return err
+	}
+	p.Logger.Debugw("template message sent", "type", msg.Type)
+	return nil
+}
+
+func (p *Pipeline) handleTemplateMessage(msg *source.TemplateMessage) {
+	switch msg.Type {
+	case templateMessageMarker:
+		offset := time.Duration(time.Now().UnixNano() - p.Info.StartedAt)
+		p.Logger.Infow("template marker", "offset", offset, "data", string(msg.Data))
+	case source.TimedMetadataMessageType:
+		p.handleTemplateTimedMetadata(msg)
+	default:
+		p.Logger.Debugw("template message", "type", msg.Type, "data", string(msg.Data))
+	}
+}
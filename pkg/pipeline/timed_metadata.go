@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/livekit/egress/pkg/pipeline/sink"
+	"github.com/livekit/egress/pkg/pipeline/source"
+)
+
+// timedMetadata holds ID3 tags until the segment which was recording when they were received ends
+type timedMetadata struct {
+	mu            sync.Mutex
+	inserter      *sink.ID3Inserter
+	playingAt     time.Time // segment running times count from here
+	pending       []pendingID3
+	segmentStarts map[string]int64 // running time of each open segment
+}
+
+type pendingID3 struct {
+	runningTime time.Duration
+	tag         []byte
+}
+
+func newTimedMetadata() *timedMetadata {
+	return &timedMetadata{
+		inserter:      sink.NewID3Inserter(),
+		segmentStarts: make(map[string]int64),
+	}
+}
+
+func (t *timedMetadata) playing() {
+	t.mu.Lock()
+	t.playingAt = time.Now()
+	t.mu.Unlock()
+}
+
+// add returns false if nothing is being recorded yet
+func (t *timedMetadata) add(key, value string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.playingAt.IsZero() {
+		return false
+	}
+	t.pending = append(t.pending, pendingID3{
+		runningTime: time.Since(t.playingAt),
+		tag:         sink.ID3Tag(key, value),
+	})
+	return true
+}
+
+func (t *timedMetadata) segmentOpened(localPath string, runningTime int64) {
+	t.mu.Lock()
+	t.segmentStarts[localPath] = runningTime
+	t.mu.Unlock()
+}
+
+// insert adds the tags received before the segment ended. Tags received late are shown at its start
+func (t *timedMetadata) insert(localPath string, endTime int64, data []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	start := t.segmentStarts[localPath]
+	delete(t.segmentStarts, localPath)
+
+	var tags []sink.TimedID3
+	var remaining []pendingID3
+	for _, m := range t.pending {
+		if int64(m.runningTime) >= endTime {
+			remaining = append(remaining, m)
+			continue
+		}
+		offset := m.runningTime - time.Duration(start)
+		if offset < 0 {
+			offset = 0
+		}
+		tags = append(tags, sink.TimedID3{Offset: offset, Tag: m.tag})
+	}
+	t.pending = remaining
+
+	return t.inserter.Insert(data, tags)
+}
+
+func (p *Pipeline) addTimedMetadata(metadata *source.TimedMetadata) {
+	if p.timedMetadata.add(metadata.Key, metadata.Value) {
+		p.Logger.Debugw("timed metadata received", "key", metadata.Key)
+	}
+}
+
+// handleTemplateTimedMetadata reads timed metadata sent by the template with window.egress.send("timed_metadata", {key, value})
+func (p *Pipeline) handleTemplateTimedMetadata(msg *source.TemplateMessage) {
+	if p.timedMetadata == nil {
+		return
+	}
+	metadata := &source.TimedMetadata{}
+	if err := json.Unmarshal(msg.Data, metadata); err != nil {
+		p.Logger.Warnw("invalid timed metadata", err)
+		return
+	}
+	p.addTimedMetadata(metadata)
+}
+
+// insertTimedMetadata adds pending timed metadata to a segment before it's stored
+func (p *Pipeline) insertTimedMetadata(update segmentUpdate) segmentUpdate {
+	data := update.data
+	if !p.SegmentsInMemory {
+		var err error
+		if data, err = os.ReadFile(update.localPath); err != nil {
+			p.Logger.Errorw("failed to read segment", err, "path", update.localPath)
+			return update
+		}
+	}
+
+	data, err := p.timedMetadata.insert(update.localPath, update.endTime, data)
+	if err != nil {
+		// the segment is stored without metadata
+		p.Logger.Errorw("failed to add timed metadata", err, "path", update.localPath)
+		return update
+	}
+
+	if p.SegmentsInMemory {
+		update.data = data
+	} else if err = os.WriteFile(update.localPath, data, 0644); err != nil {
+		p.Logger.Errorw("failed to write segment", err, "path", update.localPath)
+	}
+	return update
+}
@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"sync"
+
+	"github.com/livekit/egress/pkg/errors"
+)
+
+// uploadGroup stores files concurrently, up to a limit, collecting their errors
+type uploadGroup struct {
+	wg   sync.WaitGroup
+	sem  chan struct{}
+	mu   sync.Mutex
+	errs []error
+}
+
+func newUploadGroup(limit int) *uploadGroup {
+	if limit < 1 {
+		limit = 1
+	}
+	return &uploadGroup{
+		sem: make(chan struct{}, limit),
+	}
+}
+
+func (g *uploadGroup) Go(upload func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+
+		g.sem <- struct{}{}
+		err := upload()
+		<-g.sem
+
+		if err != nil {
+			g.mu.Lock()
+			g.errs = append(g.errs, err)
+			g.mu.Unlock()
+		}
+	}()
+}
+
+// Wait returns once every upload has ended, with an error describing any that failed
+func (g *uploadGroup) Wait() error {
+	g.wg.Wait()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	switch len(g.errs) {
+	case 0:
+		return nil
+	case 1:
+		return g.errs[0]
+	default:
+		return errors.ErrUploadsFailed(g.errs)
+	}
+}
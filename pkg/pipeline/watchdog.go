@@ -0,0 +1,94 @@
+package pipeline
+
+import (
+	"context"
+	"os"
+	"runtime"
+	"time"
+
+	"github.com/tinyzimmer/go-gst/gst"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+)
+
+const (
+	frozenDotSuffix    = ".frozen.dot"
+	frozenStacksSuffix = ".frozen.txt"
+	frozenError        = "pipeline frozen"
+)
+
+// onFrozen runs when the pipeline hasn't finished within the watchdog timeout of being sent EOS.
+// Diagnostics are stored before anything is torn down, and the output is finalized if the config allows it
+func (p *Pipeline) onFrozen() {
+	p.Logger.Errorw(frozenError, nil)
+	p.Info.Error = frozenError
+
+	if p.Watchdog.DotDump {
+		p.storeDiagnostic(frozenDotSuffix, []byte(p.pipeline.DebugBinToDotData(gst.DebugGraphShowAll)))
+	}
+	if p.Watchdog.StackTraces {
+		p.storeDiagnostic(frozenStacksSuffix, goroutineStacks())
+	}
+
+	if p.Watchdog.Finalize && p.finalizing.CAS(false, true) {
+		// the EOS is handled by the message watch like any other, and the pipeline is stopped if it doesn't arrive
+		p.Logger.Infow("finalizing frozen pipeline")
+		p.setEOSTimer(p.stop)
+		go p.in.ForceEOS()
+		return
+	}
+
+	p.stop()
+}
+
+// setEOSTimer runs f if EOS hasn't been received within the watchdog timeout, replacing the previous timer.
+// Once EOS has been received, no more timers are started
+func (p *Pipeline) setEOSTimer(f func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.eosReceived {
+		return
+	}
+	p.eosTimer = time.AfterFunc(p.Watchdog.Timeout, f)
+}
+
+// stopEOSTimer stops the watchdog once EOS is received
+func (p *Pipeline) stopEOSTimer() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.eosReceived = true
+	if p.eosTimer != nil {
+		p.eosTimer.Stop()
+	}
+}
+
+// storeDiagnostic stores a file next to the recording, or logs it for stream outputs
+func (p *Pipeline) storeDiagnostic(suffix string, data []byte) {
+	localFilepath, storageFilepath := p.GetSidecarFilepaths(suffix)
+	if localFilepath == "" {
+		p.Logger.Infow("pipeline diagnostic", "type", suffix, "data", string(data))
+		return
+	}
+
+	if err := os.WriteFile(localFilepath, data, 0644); err != nil {
+		p.Logger.Errorw("could not write pipeline diagnostic", err, "type", suffix)
+		return
+	}
+	if _, _, err := p.storeFile(context.Background(), localFilepath, storageFilepath, params.OutputTypeTXT); err != nil {
+		p.Logger.Errorw("could not store pipeline diagnostic", err, "type", suffix)
+	}
+}
+
+// goroutineStacks returns the stacks of every goroutine, growing the buffer until they fit
+func goroutineStacks() []byte {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, len(buf)*2)
+	}
+}
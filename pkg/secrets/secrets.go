@@ -0,0 +1,145 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const resolveTimeout = 10 * time.Second
+
+// Provider looks up secrets for references using its scheme. The name is everything after scheme://
+type Provider interface {
+	Resolve(ctx context.Context, name string) (string, error)
+}
+
+var (
+	mu        sync.RWMutex
+	providers = map[string]Provider{
+		"env":     envProvider{},
+		"vault":   vaultProvider{},
+		"aws-ssm": ssmProvider{},
+	}
+
+	// references embedded in a larger value, such as a stream key in an rtmp url
+	placeholder = regexp.MustCompile(`\$\{([a-z0-9-]+://[^}]+)\}`)
+)
+
+// Register adds a provider for references using the scheme, replacing any existing one
+func Register(scheme string, provider Provider) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	providers[scheme] = provider
+}
+
+// Resolve returns the secret for a reference such as vault://secret/data/egress#secret.
+// Values using other schemes, or none, are returned unchanged
+func Resolve(value string) (string, error) {
+	provider, name := getProvider(value)
+	if provider == nil {
+		return value, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+
+	secret, err := provider.Resolve(ctx, name)
+	if err != nil {
+		// the error names the reference, never the secret
+		return "", fmt.Errorf("could not resolve secret %s: %v", value, err)
+	}
+	return secret, nil
+}
+
+// ResolveEmbedded replaces each ${reference} within a value, such as
+// rtmp://a.rtmp.youtube.com/live2/${vault://secret/data/youtube#stream_key}
+func ResolveEmbedded(value string) (string, error) {
+	var err error
+	resolved := placeholder.ReplaceAllStringFunc(value, func(match string) string {
+		if err != nil {
+			return match
+		}
+		var secret string
+		secret, err = Resolve(placeholder.FindStringSubmatch(match)[1])
+		return secret
+	})
+	if err != nil {
+		return "", err
+	}
+	return resolved, nil
+}
+
+// ResolveRequest resolves a value sent with a request, such as upload credentials. Whoever starts an egress chooses
+// these values, so a reference is only resolved if it starts with one of the allowed prefixes, and any other reference
+// is rejected. Values which aren't references are returned unchanged
+func ResolveRequest(value string, allowed []string) (string, error) {
+	if provider, _ := getProvider(value); provider == nil {
+		return value, nil
+	}
+	if !isAllowed(value, allowed) {
+		return "", fmt.Errorf("secret %s can't be used in requests", value)
+	}
+	return Resolve(value)
+}
+
+// ResolveEmbeddedRequest replaces each ${reference} within a value sent with a request, such as a stream url. Like
+// ResolveRequest, every reference has to start with one of the allowed prefixes
+func ResolveEmbeddedRequest(value string, allowed []string) (string, error) {
+	for _, match := range placeholder.FindAllStringSubmatch(value, -1) {
+		if !isAllowed(match[1], allowed) {
+			return "", fmt.Errorf("secret %s can't be used in requests", match[1])
+		}
+	}
+	return ResolveEmbedded(value)
+}
+
+// isAllowed checks a reference against prefixes such as vault://secret/data/youtube#. References which could leave
+// the prefix's path are never allowed
+func isAllowed(reference string, allowed []string) bool {
+	if strings.Contains(reference, "..") {
+		return false
+	}
+	for _, prefix := range allowed {
+		if prefix != "" && strings.HasPrefix(reference, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func getProvider(value string) (Provider, string) {
+	parts := strings.SplitN(value, "://", 2)
+	if len(parts) != 2 {
+		return nil, ""
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return providers[parts[0]], parts[1]
+}
+
+// envProvider reads environment variables, as in env://AWS_SECRET_ACCESS_KEY
+type envProvider struct{}
+
+func (envProvider) Resolve(_ context.Context, name string) (string, error) {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return value, nil
+}
+
+// splitKey separates a path from the key of the value within it, as in secret/data/egress#access_key
+func splitKey(name string) (string, string, error) {
+	parts := strings.SplitN(name, "#", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("missing #key")
+	}
+	return parts[0], parts[1], nil
+}
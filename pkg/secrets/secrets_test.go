@@ -0,0 +1,173 @@
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testProvider map[string]string
+
+func (p testProvider) Resolve(_ context.Context, name string) (string, error) {
+	if value, ok := p[name]; ok {
+		return value, nil
+	}
+	return "", fmt.Errorf("%s not found", name)
+}
+
+func init() {
+	Register("test", testProvider{
+		"youtube#stream_key": "yt-key",
+		"twitch#stream_key":  "tw-key",
+		"admin#secret":       "admin-secret",
+	})
+}
+
+func TestResolve(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		value    string
+		expected string
+		err      bool
+	}{
+		{name: "plain", value: "AKIA123", expected: "AKIA123"},
+		{name: "unknown scheme", value: "https://example.com", expected: "https://example.com"},
+		{name: "reference", value: "test://youtube#stream_key", expected: "yt-key"},
+		{name: "missing", value: "test://missing#key", err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := Resolve(test.value)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, resolved)
+		})
+	}
+}
+
+func TestResolveEmbedded(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		value    string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "none",
+			value:    "rtmp://a.rtmp.youtube.com/live2/key",
+			expected: "rtmp://a.rtmp.youtube.com/live2/key",
+		},
+		{
+			name:     "one",
+			value:    "rtmp://a.rtmp.youtube.com/live2/${test://youtube#stream_key}",
+			expected: "rtmp://a.rtmp.youtube.com/live2/yt-key",
+		},
+		{
+			name:     "several",
+			value:    "srt://host:9000?streamid=${test://youtube#stream_key}&passphrase=${test://twitch#stream_key}",
+			expected: "srt://host:9000?streamid=yt-key&passphrase=tw-key",
+		},
+		{
+			name:     "not a reference",
+			value:    "rtmp://host/live/${key}",
+			expected: "rtmp://host/live/${key}",
+		},
+		{
+			name:  "missing",
+			value: "rtmp://host/live/${test://missing#key}",
+			err:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := ResolveEmbedded(test.value)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, resolved)
+		})
+	}
+}
+
+func TestResolveRequest(t *testing.T) {
+	allowed := []string{"test://youtube#", "test://twitch#"}
+
+	for _, test := range []struct {
+		name     string
+		value    string
+		allowed  []string
+		expected string
+		err      bool
+	}{
+		{name: "plain", value: "AKIA123", allowed: allowed, expected: "AKIA123"},
+		{name: "allowed", value: "test://youtube#stream_key", allowed: allowed, expected: "yt-key"},
+		{name: "not allowed", value: "test://admin#secret", allowed: allowed, err: true},
+		{name: "nothing allowed", value: "test://youtube#stream_key", err: true},
+		{name: "env", value: "env://AWS_SECRET_ACCESS_KEY", allowed: allowed, err: true},
+		{name: "leaves prefix", value: "test://youtube#/../admin#secret", allowed: allowed, err: true},
+		{name: "empty prefix", value: "test://admin#secret", allowed: []string{""}, err: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := ResolveRequest(test.value, test.allowed)
+			if test.err {
+				require.Error(t, err)
+				require.NotContains(t, err.Error(), "admin-secret")
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, resolved)
+		})
+	}
+}
+
+func TestResolveEmbeddedRequest(t *testing.T) {
+	allowed := []string{"test://youtube#"}
+
+	for _, test := range []struct {
+		name     string
+		value    string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "none",
+			value:    "rtmp://a.rtmp.youtube.com/live2/key",
+			expected: "rtmp://a.rtmp.youtube.com/live2/key",
+		},
+		{
+			name:     "allowed",
+			value:    "rtmp://a.rtmp.youtube.com/live2/${test://youtube#stream_key}",
+			expected: "rtmp://a.rtmp.youtube.com/live2/yt-key",
+		},
+		{
+			name:  "not allowed",
+			value: "rtmp://attacker.example/live/${test://admin#secret}",
+			err:   true,
+		},
+		{
+			name:  "env",
+			value: "rtmp://attacker.example/live/${env://AWS_SECRET_ACCESS_KEY}",
+			err:   true,
+		},
+		{
+			name:  "one of several not allowed",
+			value: "rtmp://attacker.example/live/${test://youtube#stream_key}?k=${test://admin#secret}",
+			err:   true,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			resolved, err := ResolveEmbeddedRequest(test.value, allowed)
+			if test.err {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, test.expected, resolved)
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package secrets
+
+import (
+	"context"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// ssmProvider reads AWS Systems Manager parameters, decrypting SecureStrings, as in aws-ssm:///egress/stream_key.
+// Credentials come from the default AWS chain, and the region from AWS_DEFAULT_REGION
+type ssmProvider struct{}
+
+func (ssmProvider) Resolve(ctx context.Context, name string) (string, error) {
+	sess, err := session.NewSession(&aws.Config{
+		Region: aws.String(os.Getenv("AWS_DEFAULT_REGION")),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	out, err := ssm.New(sess).GetParameterWithContext(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"time"
+
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/logger"
+	"github.com/livekit/protocol/tracer"
+
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+	"github.com/livekit/egress/pkg/stats"
+)
+
+// endedEgress is kept for delete_window after an egress ends, so that its uploads can be deleted on request
+type endedEgress struct {
+	req      *livekit.StartEgressRequest
+	uploaded *stats.UploadedFiles
+	endedAt  time.Time
+	deleting bool
+}
+
+// recordUploaded keeps the files an egress stored, along with the request holding its storage config
+func (s *Service) recordUploaded(req *livekit.StartEgressRequest, uploaded *stats.UploadedFiles) {
+	if s.conf.DeleteWindow == 0 || uploaded == nil {
+		return
+	}
+	if len(uploaded.StorageFilepaths) == 0 && len(uploaded.FailoverFilepaths) == 0 {
+		return
+	}
+
+	s.endedMu.Lock()
+	defer s.endedMu.Unlock()
+
+	s.pruneEnded()
+	s.ended[req.EgressId] = &endedEgress{
+		req:      req,
+		uploaded: uploaded,
+		endedAt:  time.Now(),
+	}
+}
+
+// DeleteEgress deletes everything an egress which recently ended on this instance uploaded.
+// Files which couldn't be deleted are kept, so the request can be retried
+func (s *Service) DeleteEgress(ctx context.Context, egressID string) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "Service.DeleteEgress")
+	defer span.End()
+
+	if _, ok := s.processes.Load(egressID); ok {
+		return nil, errors.ErrEgressRunning
+	}
+
+	// the files are copied, and deleted without holding the lock, which every ending egress needs
+	s.endedMu.Lock()
+	s.pruneEnded()
+	ended := s.ended[egressID]
+	if ended == nil {
+		s.endedMu.Unlock()
+		return nil, errors.ErrEgressNotFound
+	}
+	if ended.deleting {
+		s.endedMu.Unlock()
+		return nil, errors.ErrDeleteInProgress
+	}
+	ended.deleting = true
+	uploaded := *ended.uploaded
+	s.endedMu.Unlock()
+
+	deleted, err := s.deleteUploaded(ctx, ended.req, &uploaded)
+	if err != nil {
+		span.RecordError(err)
+	}
+
+	s.endedMu.Lock()
+	defer s.endedMu.Unlock()
+
+	ended.deleting = false
+	ended.uploaded = &uploaded
+	if err == nil && s.ended[egressID] == ended {
+		delete(s.ended, egressID)
+	}
+	return deleted, err
+}
+
+// deleteUploaded deletes an egress's files, leaving the ones which couldn't be deleted in uploaded
+func (s *Service) deleteUploaded(ctx context.Context, req *livekit.StartEgressRequest, uploaded *stats.UploadedFiles) ([]string, error) {
+	// the storage config, with storage profiles and secrets resolved, is the same one the handler used
+	p, err := params.GetUploadParams(ctx, s.conf, req)
+	if err != nil {
+		return nil, err
+	}
+
+	var deleted []string
+	var errs []error
+	deleteFiles := func(upload interface{}, storageFilepaths []string) []string {
+		var remaining []string
+		for _, storageFilepath := range storageFilepaths {
+			if err := sink.DeleteUploaded(ctx, upload, storageFilepath); err != nil {
+				errs = append(errs, err)
+				remaining = append(remaining, storageFilepath)
+				continue
+			}
+			deleted = append(deleted, storageFilepath)
+		}
+		return remaining
+	}
+	uploaded.StorageFilepaths = deleteFiles(p.FileUpload, uploaded.StorageFilepaths)
+	uploaded.FailoverFilepaths = deleteFiles(p.FailoverUpload, uploaded.FailoverFilepaths)
+
+	logger.Infow("deleted egress uploads", "egressID", req.EgressId, "deleted", len(deleted), "failed", len(errs))
+	if len(errs) > 0 {
+		return deleted, errors.ErrDeletesFailed(errs)
+	}
+	return deleted, nil
+}
+
+// pruneEnded forgets egresses which ended before the delete window
+func (s *Service) pruneEnded() {
+	for egressID, ended := range s.ended {
+		if time.Since(ended.endedAt) > s.conf.DeleteWindow {
+			delete(s.ended, egressID)
+		}
+	}
+}
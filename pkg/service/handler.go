@@ -2,6 +2,11 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"strings"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
@@ -14,19 +19,53 @@ import (
 	"github.com/livekit/egress/pkg/errors"
 	"github.com/livekit/egress/pkg/pipeline"
 	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/source"
+	"github.com/livekit/egress/pkg/stats"
 )
 
 type Handler struct {
 	conf      *config.Config
 	rpcServer egress.RPCServer
+	uploads   *stats.UploadReporter
+	tempPath  string // holds the admin socket, when set
 	kill      chan struct{}
+	abort     chan struct{}
+	layouts   chan string
+	overlays  chan string
+	messages  chan string // relayed to the template
+
+	// the last update read from each file, so that unchanged ones aren't applied again
+	updates map[string]string
+}
+
+// files holding the latest updates for a handler, written by the service to the handler's temp path
+const (
+	layoutFilename      = "layout"
+	textOverlayFilename = "text_overlay"
+
+	// template messages are each written to their own file, numbered in order
+	templateMessagePrefix = "template_message."
+	maxTemplateMessages   = 16
+)
+
+// TextOverlay is text shown over the video of a running egress
+type TextOverlay struct {
+	Text     string `json:"text"`               // hides the overlay if empty
+	Position string `json:"position,omitempty"` // such as bottom-left. Defaults to the current position
 }
 
-func NewHandler(conf *config.Config, rpcServer egress.RPCServer) *Handler {
+func NewHandler(conf *config.Config, rpcServer egress.RPCServer, uploads *stats.UploadReporter, tempPath string) *Handler {
 	return &Handler{
 		conf:      conf,
 		rpcServer: rpcServer,
+		uploads:   uploads,
+		tempPath:  tempPath,
 		kill:      make(chan struct{}),
+		abort:     make(chan struct{}),
+		layouts:   make(chan string, 1),
+		overlays:  make(chan string, 1),
+		messages:  make(chan string, maxTemplateMessages),
+		updates:   make(map[string]string),
 	}
 }
 
@@ -53,21 +92,89 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 		}
 	}()
 
+	if h.tempPath != "" {
+		admin, err := h.serveAdmin(ctx, p)
+		if err != nil {
+			logger.Warnw("could not open admin socket", err, "egressID", p.GetInfo().EgressId)
+		} else {
+			defer admin.Close()
+		}
+	}
+
 	// start egress
 	result := make(chan *livekit.EgressInfo, 1)
 	go func() {
+		defer func() {
+			// Run recovers from its own panics, unless they happen while it's cleaning up
+			if r := recover(); r != nil {
+				result <- p.RecoverResult(r)
+			}
+		}()
 		result <- p.Run(ctx)
 	}()
 
+	// a panic while handling requests fails the egress, but what was recorded is still finalized and uploaded
+	defer func() {
+		if r := recover(); r != nil {
+			p.Recover(ctx, r)
+
+			// the watchdog stops the pipeline if the EOS doesn't make it through, and Run gets as long again to upload
+			select {
+			case res := <-result:
+				h.handleResult(ctx, p, res)
+			case <-time.After(2 * h.conf.Watchdog.Timeout):
+				info := p.PanicInfo()
+				logger.Warnw("egress did not end after panic", nil, "egressID", info.EgressId)
+				h.uploads.ReportEnded(&stats.EndedMetrics{
+					EgressID: info.EgressId,
+					Reason:   pipeline.EndReasonError,
+					Status:   info.Status.String(),
+				})
+				h.sendUpdate(ctx, info)
+			}
+		}
+	}()
+
+	abort := h.abort
 	for {
 		select {
 		case <-h.kill:
 			// kill signal received
-			p.SendEOS(ctx)
+			p.SendEOS(ctx, pipeline.EndReasonShutdown)
+
+		case <-abort:
+			// abort signal received, nothing is uploaded
+			p.Abort(ctx)
+			abort = nil
+
+		case layout := <-h.layouts:
+			// layout update received from the service
+			if err = p.UpdateLayout(ctx, layout); err != nil {
+				logger.Warnw("could not update layout", err, "egressID", p.GetInfo().EgressId, "layout", layout)
+			}
+
+		case update := <-h.overlays:
+			// text overlay update received from the service
+			overlay := &TextOverlay{}
+			if err = json.Unmarshal([]byte(update), overlay); err == nil {
+				err = p.UpdateTextOverlay(ctx, overlay.Text, overlay.Position)
+			}
+			if err != nil {
+				logger.Warnw("could not update text overlay", err, "egressID", p.GetInfo().EgressId)
+			}
+
+		case update := <-h.messages:
+			// template message received from the service
+			msg := &source.TemplateMessage{}
+			if err = json.Unmarshal([]byte(update), msg); err == nil {
+				err = p.SendTemplateMessage(ctx, msg)
+			}
+			if err != nil {
+				logger.Warnw("could not send template message", err, "egressID", p.GetInfo().EgressId)
+			}
 
 		case res := <-result:
-			// recording finished
-			h.sendUpdate(ctx, res)
+			h.handleResult(ctx, p, res)
 			return
 
 		case msg := <-requests.Channel():
@@ -84,7 +191,7 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 			case *livekit.EgressRequest_UpdateStream:
 				err = p.UpdateStream(ctx, req.UpdateStream)
 			case *livekit.EgressRequest_Stop:
-				p.SendEOS(ctx)
+				p.SendEOS(ctx, pipeline.EndReasonAPIStop)
 			default:
 				err = errors.ErrInvalidRPC
 			}
@@ -94,6 +201,26 @@ func (h *Handler) HandleRequest(ctx context.Context, req *livekit.StartEgressReq
 	}
 }
 
+// handleResult reports the end of the egress, unless its upload was handed off to the service
+func (h *Handler) handleResult(ctx context.Context, p *pipeline.Pipeline, res *livekit.EgressInfo) {
+	// reported before the handoff, which adds its own file once uploaded
+	h.uploads.ReportUploaded(p.UploadedFiles())
+	if handoff := p.DeferredUpload(); handoff != nil && h.uploads.ReportHandoff(handoff) {
+		// the service uploads the file, and sends the final update
+		logger.Infow("egress ended, handing off upload", "egressID", res.EgressId, "reason", p.EndedReason())
+		return
+	}
+
+	// recording finished
+	logger.Infow("egress ended", "egressID", res.EgressId, "reason", p.EndedReason(), "status", res.Status)
+	h.uploads.ReportEnded(&stats.EndedMetrics{
+		EgressID: res.EgressId,
+		Reason:   p.EndedReason(),
+		Status:   res.Status.String(),
+	})
+	h.sendUpdate(ctx, res)
+}
+
 func (h *Handler) buildPipeline(ctx context.Context, req *livekit.StartEgressRequest) (*pipeline.Pipeline, error) {
 	ctx, span := tracer.Start(ctx, "Handler.buildPipeline")
 	defer span.End()
@@ -116,6 +243,11 @@ func (h *Handler) buildPipeline(ctx context.Context, req *livekit.StartEgressReq
 	}
 
 	p.OnStatusUpdate(h.sendUpdate)
+	p.OnUpload(h.uploads.Report)
+	p.OnStreamHealth(h.uploads.ReportStreamHealth)
+	if h.conf.BackgroundUploads && h.uploads != nil {
+		p.DeferFileUpload()
+	}
 	return p, nil
 }
 
@@ -160,3 +292,90 @@ func (h *Handler) Kill() {
 		close(h.kill)
 	}
 }
+
+// Abort ends the egress without uploading it, and deletes anything already uploaded
+func (h *Handler) Abort() {
+	select {
+	case <-h.abort:
+		return
+	default:
+		close(h.abort)
+	}
+}
+
+// Update reads the updates the service wrote to the handler's temp path, and applies the ones which changed to the
+// running egress. Only the latest of each kind is kept, other than template messages
+func (h *Handler) Update(tempPath string) {
+	if layout, ok := h.readUpdate(tempPath, layoutFilename); ok {
+		sendLatest(h.layouts, strings.TrimSpace(layout))
+	}
+	if overlay, ok := h.readUpdate(tempPath, textOverlayFilename); ok {
+		sendLatest(h.overlays, overlay)
+	}
+	h.readTemplateMessages(tempPath)
+}
+
+// readTemplateMessages queues the template messages in the temp path in order, removing each once it's read
+func (h *Handler) readTemplateMessages(tempPath string) {
+	entries, err := os.ReadDir(tempPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnw("could not read template messages", err)
+		}
+		return
+	}
+
+	// entries are sorted by name, so messages are read in the order they were sent
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, templateMessagePrefix) || strings.HasSuffix(name, ".tmp") {
+			continue
+		}
+
+		filename := path.Join(tempPath, name)
+		b, err := os.ReadFile(filename)
+		_ = os.Remove(filename)
+		if err != nil {
+			logger.Warnw("could not read template message", err, "filename", name)
+			continue
+		}
+
+		select {
+		case h.messages <- string(b):
+		default:
+			logger.Warnw("dropping template message", errors.New("too many pending messages"), "filename", name)
+		}
+	}
+}
+
+func (h *Handler) readUpdate(tempPath, filename string) (string, bool) {
+	b, err := os.ReadFile(path.Join(tempPath, filename))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warnw("could not read update", err, "filename", filename)
+		}
+		return "", false
+	}
+
+	update := string(b)
+	if last, ok := h.updates[filename]; ok && last == update {
+		return "", false
+	}
+	h.updates[filename] = update
+	return update, true
+}
+
+// sendLatest replaces an update which hasn't been applied yet
+func sendLatest(updates chan string, update string) {
+	for {
+		select {
+		case updates <- update:
+			return
+		default:
+			select {
+			case <-updates:
+			default:
+			}
+		}
+	}
+}
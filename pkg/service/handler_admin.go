@@ -0,0 +1,83 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"path"
+
+	"google.golang.org/protobuf/encoding/protojson"
+
+	"github.com/livekit/protocol/logger"
+
+	"github.com/livekit/egress/pkg/pipeline"
+)
+
+// the handler's admin socket, in a directory of its temp path which only the handler's user can open
+const (
+	adminSocketDir      = "admin"
+	adminSocketFilename = "admin.sock"
+)
+
+const (
+	AdminPathInfo     = "/info"     // GET, the current EgressInfo
+	AdminPathPipeline = "/pipeline" // GET, the pipeline state and queue levels
+	AdminPathDot      = "/dot"      // GET, the pipeline graph in dot format
+	AdminPathEOS      = "/eos"      // POST, stops the egress like StopEgress
+)
+
+// GetAdminSocketPath returns the admin socket of the handler running an egress on this node
+func GetAdminSocketPath(egressID string) string {
+	return path.Join(getHandlerTempPath(egressID), adminSocketDir, adminSocketFilename)
+}
+
+// serveAdmin answers local inspection requests on a unix socket in the handler's temp path, until the returned
+// listener is closed
+func (h *Handler) serveAdmin(ctx context.Context, p *pipeline.Pipeline) (net.Listener, error) {
+	// the socket can end the egress, so it's bound in a directory created for it, which only the handler's user can
+	// open. Mkdir fails if anything else created the directory in the meantime
+	socketDir := path.Join(h.tempPath, adminSocketDir)
+	_ = os.RemoveAll(socketDir)
+	if err := os.Mkdir(socketDir, 0700); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path.Join(socketDir, adminSocketFilename))
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(AdminPathInfo, func(w http.ResponseWriter, r *http.Request) {
+		b, err := protojson.Marshal(p.GetInfo())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(b)
+	})
+	mux.HandleFunc(AdminPathPipeline, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(p.Inspect())
+	})
+	mux.HandleFunc(AdminPathDot, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		_, _ = w.Write([]byte(p.GetDotData()))
+	})
+	mux.HandleFunc(AdminPathEOS, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		logger.Infow("stop requested on admin socket", "egressID", p.GetInfo().EgressId)
+		p.SendEOS(ctx, pipeline.EndReasonAdminStop)
+		w.WriteHeader(http.StatusAccepted)
+	})
+
+	go func() {
+		_ = http.Serve(listener, mux)
+	}()
+	return listener, nil
+}
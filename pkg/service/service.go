@@ -9,7 +9,9 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -23,7 +25,11 @@ import (
 	"github.com/livekit/protocol/tracer"
 
 	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline"
 	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+	"github.com/livekit/egress/pkg/pipeline/source"
 	"github.com/livekit/egress/pkg/stats"
 )
 
@@ -37,12 +43,54 @@ type Service struct {
 
 	handlingRoomComposite atomic.Bool
 	processes             sync.Map
+	uploads               sync.WaitGroup // file uploads handed off by handlers
+	templateMessages      atomic.Uint64  // orders the messages relayed to templates
 	shutdown              chan struct{}
+
+	// uploads of recently ended egresses, which can be deleted on request
+	endedMu sync.Mutex
+	ended   map[string]*endedEgress
 }
 
 type process struct {
 	req *livekit.StartEgressRequest
 	cmd *exec.Cmd
+
+	// signals sent before the handler is ready to receive them are held until it is
+	mu      sync.Mutex
+	ready   bool
+	pending []os.Signal
+}
+
+// signal sends a signal to the handler, or holds it until the handler reports that it's ready
+func (p *process) signal(sig os.Signal) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ready {
+		return p.cmd.Process.Signal(sig)
+	}
+	for _, pending := range p.pending {
+		if pending == sig {
+			return nil
+		}
+	}
+	p.pending = append(p.pending, sig)
+	return nil
+}
+
+// setReady sends the signals held for the handler
+func (p *process) setReady() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.ready = true
+	for _, sig := range p.pending {
+		if err := p.cmd.Process.Signal(sig); err != nil {
+			logger.Errorw("failed to signal handler", err, "egressID", p.req.EgressId, "signal", sig)
+		}
+	}
+	p.pending = nil
 }
 
 func NewService(conf *config.Config, rpcServer egress.RPCServer) *Service {
@@ -51,6 +99,7 @@ func NewService(conf *config.Config, rpcServer egress.RPCServer) *Service {
 		rpcServer: rpcServer,
 		monitor:   stats.NewMonitor(),
 		shutdown:  make(chan struct{}),
+		ended:     make(map[string]*endedEgress),
 	}
 
 	if conf.PrometheusPort > 0 {
@@ -98,6 +147,7 @@ func (s *Service) Run() error {
 			for !s.isIdle() {
 				time.Sleep(shutdownTimer)
 			}
+			s.uploads.Wait()
 			return nil
 
 		case msg := <-requests.Channel():
@@ -111,24 +161,16 @@ func (s *Service) Run() error {
 			}
 
 			if s.acceptRequest(ctx, req) {
-				// validate before launching handler
-				info, err := params.ValidateRequest(ctx, s.conf, req)
-				s.sendResponse(ctx, req, info, err)
-				if err != nil {
-					span.RecordError(err)
-					span.End()
-					continue
-				}
-
+				// validated off the request loop, since checking upload credentials waits on storage
 				switch req.Request.(type) {
 				case *livekit.StartEgressRequest_RoomComposite:
 					s.handlingRoomComposite.Store(true)
 					go func() {
-						s.launchHandler(ctx, req)
+						s.startEgress(ctx, req)
 						s.handlingRoomComposite.Store(false)
 					}()
 				default:
-					go s.launchHandler(ctx, req)
+					go s.startEgress(ctx, req)
 				}
 			}
 
@@ -209,6 +251,53 @@ func (s *Service) acceptRequest(ctx context.Context, req *livekit.StartEgressReq
 	return true
 }
 
+// startEgress validates a claimed request, and launches its handler if it's valid
+func (s *Service) startEgress(ctx context.Context, req *livekit.StartEgressRequest) {
+	ctx, span := tracer.Start(ctx, "Service.startEgress")
+	defer span.End()
+
+	var info *livekit.EgressInfo
+	var err error
+	if s.conf.UploadVerification {
+		var p *params.Params
+		p, err = params.GetPipelineParams(ctx, s.conf, req)
+		if err == nil {
+			err = s.verifyUpload(ctx, p)
+		}
+		info = p.Info
+	} else {
+		info, err = params.ValidateRequest(ctx, s.conf, req)
+	}
+
+	s.sendResponse(ctx, req, info, err)
+	if err != nil {
+		span.RecordError(err)
+		return
+	}
+
+	s.launchHandler(ctx, req, info)
+}
+
+func (s *Service) verifyUpload(ctx context.Context, p *params.Params) error {
+	ctx, span := tracer.Start(ctx, "Service.verifyUpload")
+	defer span.End()
+
+	var dir string
+	switch p.EgressType {
+	case params.EgressTypeFile:
+		dir, _ = path.Split(p.StorageFilepath)
+	case params.EgressTypeSegmentedFile:
+		dir = p.StoragePathPrefix
+	default:
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, sink.UploadVerificationTimeout)
+	defer cancel()
+
+	return sink.VerifyUpload(ctx, p.FileUpload, dir)
+}
+
 func (s *Service) sendResponse(ctx context.Context, req *livekit.StartEgressRequest, info *livekit.EgressInfo, err error) {
 	if err != nil {
 		logger.Infow("bad request",
@@ -224,7 +313,9 @@ func (s *Service) sendResponse(ctx context.Context, req *livekit.StartEgressRequ
 	}
 }
 
-func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressRequest) {
+// launchHandler runs the egress in a handler process. info is the egress info sent in the response, which is failed
+// if the handler exits without ending the egress
+func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressRequest, info *livekit.EgressInfo) {
 	ctx, span := tracer.Start(ctx, "Service.launchHandler")
 	defer span.End()
 
@@ -244,37 +335,112 @@ func (s *Service) launchHandler(ctx context.Context, req *livekit.StartEgressReq
 
 	tempPath := getHandlerTempPath(req.EgressId)
 
+	// the handler reports upload metrics through a pipe, passed as fd 3
+	uploadMetrics, uploadMetricsWriter, err := os.Pipe()
+	if err != nil {
+		span.RecordError(err)
+		logger.Errorw("could not create upload metrics pipe", err)
+		return
+	}
+
 	cmd := exec.Command("egress",
 		"run-handler",
 		"--config-body", string(confString),
 		"--request", string(reqString),
 		"--temp-path", tempPath,
+		"--upload-metrics-fd", "3",
 	)
 	cmd.Dir = "/"
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = []*os.File{uploadMetricsWriter}
 
+	var handoff *stats.UploadHandoff
+	var uploaded *stats.UploadedFiles
+	var ended bool
 	s.monitor.EgressStarted(req)
-	s.processes.Store(req.EgressId, &process{
+	proc := &process{
 		req: req,
 		cmd: cmd,
-	})
+	}
+	s.processes.Store(req.EgressId, proc)
 	defer func() {
+		if handoff != nil {
+			// counted before the process is removed, so that shutdown doesn't see the node as idle and exit first
+			s.uploads.Add(1)
+		}
 		s.monitor.EgressEnded(req)
 		s.processes.Delete(req.EgressId)
+		if handoff != nil {
+			// the handler's resources are freed while the file uploads
+			go func() {
+				defer s.uploads.Done()
+				if s.finishUpload(ctx, req, handoff) && uploaded != nil {
+					uploaded.StorageFilepaths = append(uploaded.StorageFilepaths, handoff.StorageFilepath)
+				}
+				s.recordUploaded(req, uploaded)
+				logger.Infow("deleting handler temporary directory", "path", tempPath)
+				_ = os.RemoveAll(tempPath)
+			}()
+			return
+		}
+		s.recordUploaded(req, uploaded)
 		logger.Infow("deleting handler temporary directory", "path", tempPath)
 		_ = os.RemoveAll(tempPath)
 	}()
 
-	err = cmd.Run()
+	err = cmd.Start()
+	_ = uploadMetricsWriter.Close()
 	if err != nil {
+		_ = uploadMetrics.Close()
 		logger.Errorw("could not launch handler", err)
+		return
+	}
+
+	reportsDone := make(chan struct{})
+	go func() {
+		s.monitor.ReadUploadMetrics(uploadMetrics, proc.setReady, func(h *stats.UploadHandoff) {
+			handoff = h
+		}, func(u *stats.UploadedFiles) {
+			uploaded = u
+		}, func() {
+			ended = true
+		})
+		close(reportsDone)
+	}()
+
+	err = cmd.Wait()
+	// the pipe closes once the handler exits
+	<-reportsDone
+	if err != nil {
+		logger.Errorw("handler failed", err, "egressID", req.EgressId)
+		if !ended && handoff == nil {
+			// the handler died without sending its final update
+			s.sendHandlerFailed(ctx, info, err)
+		}
+	}
+}
+
+// sendHandlerFailed fails an egress whose handler exited without ending it, so it isn't left active
+func (s *Service) sendHandlerFailed(ctx context.Context, started *livekit.EgressInfo, handlerErr error) {
+	info := proto.Clone(started).(*livekit.EgressInfo)
+	info.Error = fmt.Sprintf("handler exited unexpectedly: %v", handlerErr)
+	info.Status = livekit.EgressStatus_EGRESS_FAILED
+	info.EndedAt = time.Now().UnixNano()
+	s.monitor.EgressCompleted(&stats.EndedMetrics{
+		EgressID: info.EgressId,
+		Reason:   pipeline.EndReasonHandlerExited,
+		Status:   info.Status.String(),
+	})
+	if err := s.rpcServer.SendUpdate(ctx, info); err != nil {
+		logger.Errorw("failed to send update", err)
 	}
 }
 
 func (s *Service) Status() ([]byte, error) {
 	info := map[string]interface{}{
-		"CpuLoad": s.monitor.GetCPULoad(),
+		"CpuLoad":      s.monitor.GetCPULoad(),
+		"StreamHealth": s.monitor.GetStreamHealth(),
 	}
 	s.processes.Range(func(key, value interface{}) bool {
 		p := value.(*process)
@@ -303,6 +469,107 @@ func (s *Service) Stop(kill bool) {
 	}
 }
 
+// AbortEgress signals an egress's handler to end it without uploading, deleting anything already uploaded
+func (s *Service) AbortEgress(egressID string) error {
+	p, err := s.getLaunchedProcess(egressID)
+	if err != nil {
+		return err
+	}
+
+	logger.Infow("aborting egress", "egressID", egressID)
+	return p.signal(syscall.SIGUSR1)
+}
+
+// UpdateLayout rearranges the video tracks of a running track composite with a layout
+func (s *Service) UpdateLayout(egressID, layout string) error {
+	p, err := s.getLaunchedProcess(egressID)
+	if err != nil {
+		return err
+	}
+
+	trackComposite := p.req.GetTrackComposite()
+	if !s.conf.TrackLayouts || trackComposite == nil || !strings.ContainsAny(trackComposite.VideoTrackId, ":,") {
+		return errors.ErrNoTrackLayout
+	}
+
+	logger.Infow("updating layout", "egressID", egressID, "layout", layout)
+	return sendUpdate(p, egressID, layoutFilename, []byte(layout))
+}
+
+// UpdateTextOverlay sets the text shown over the video of a running egress, or hides it if the text is empty
+func (s *Service) UpdateTextOverlay(egressID string, overlay *TextOverlay) error {
+	p, err := s.getLaunchedProcess(egressID)
+	if err != nil {
+		return err
+	}
+
+	// track egress remuxes the published video, so there's nothing to draw on
+	if !s.conf.TextOverlay.Enabled || p.req.GetTrack() != nil {
+		return errors.ErrNoTextOverlay
+	}
+
+	b, err := json.Marshal(overlay)
+	if err != nil {
+		return err
+	}
+
+	logger.Infow("updating text overlay", "egressID", egressID, "text", overlay.Text, "position", overlay.Position)
+	return sendUpdate(p, egressID, textOverlayFilename, b)
+}
+
+// SendTemplateMessage relays a message to the template of a running room composite, such as layout parameters, a marker
+// or a countdown. Unlike other updates, every message is delivered, in order
+func (s *Service) SendTemplateMessage(egressID string, msg *source.TemplateMessage) error {
+	p, err := s.getLaunchedProcess(egressID)
+	if err != nil {
+		return err
+	}
+
+	if p.req.GetRoomComposite() == nil {
+		return errors.ErrNoTemplate
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	logger.Infow("sending template message", "egressID", egressID, "type", msg.Type)
+	filename := fmt.Sprintf("%s%020d", templateMessagePrefix, s.templateMessages.Inc())
+	return sendUpdate(p, egressID, filename, b)
+}
+
+func (s *Service) getLaunchedProcess(egressID string) (*process, error) {
+	value, ok := s.processes.Load(egressID)
+	if !ok {
+		return nil, errors.ErrEgressNotFound
+	}
+	p := value.(*process)
+	if p.cmd.Process == nil {
+		// not launched yet
+		return nil, errors.ErrEgressNotFound
+	}
+	return p, nil
+}
+
+// sendUpdate writes an update to the handler's temp path, and signals the handler to read it.
+// It's renamed into place, so the handler never reads a partial update
+func sendUpdate(p *process, egressID, filename string, update []byte) error {
+	tempPath := getHandlerTempPath(egressID)
+	// the handler may not have created it yet
+	if err := os.MkdirAll(tempPath, 0755); err != nil {
+		return err
+	}
+	tmp := path.Join(tempPath, filename+".tmp")
+	if err := os.WriteFile(tmp, update, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path.Join(tempPath, filename)); err != nil {
+		return err
+	}
+	return p.signal(syscall.SIGUSR2)
+}
+
 func (s *Service) ListEgress() []string {
 	res := make([]string, 0)
 
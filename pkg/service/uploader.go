@@ -0,0 +1,96 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/logger"
+	"github.com/livekit/protocol/tracer"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/errors"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+	"github.com/livekit/egress/pkg/stats"
+)
+
+// finishUpload stores a file handed off by its handler, then sends the egress's final update. Returns true if the file was stored
+func (s *Service) finishUpload(ctx context.Context, req *livekit.StartEgressRequest, handoff *stats.UploadHandoff) bool {
+	ctx, span := tracer.Start(ctx, "Service.finishUpload")
+	defer span.End()
+
+	info := &livekit.EgressInfo{}
+	if err := proto.Unmarshal(handoff.Info, info); err != nil {
+		logger.Errorw("could not read handed off egress info", err, "egressID", req.EgressId)
+		return false
+	}
+
+	// removed once the upload ends, like the handler would have
+	defer func() {
+		if dir, _ := path.Split(handoff.LocalFilepath); dir != "" {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+
+	// the upload config, with storage profiles and secrets resolved, is the same one the handler used
+	p, err := params.GetPipelineParams(ctx, s.conf, req)
+	if err == nil {
+		err = s.uploadFile(info, p.FileUpload, p.Retention, handoff)
+	}
+	if err != nil {
+		span.RecordError(err)
+		info.Error = err.Error()
+		info.Status = livekit.EgressStatus_EGRESS_FAILED
+		logger.Warnw("egress failed", err, "egressID", info.EgressId)
+	} else {
+		logger.Infow("egress completed", "egressID", info.EgressId)
+	}
+
+	s.monitor.EgressCompleted(&stats.EndedMetrics{
+		EgressID: info.EgressId,
+		Reason:   handoff.Reason,
+		Status:   info.Status.String(),
+	})
+	if err = s.rpcServer.SendUpdate(ctx, info); err != nil {
+		logger.Errorw("failed to send update", err)
+	}
+	return info.Status != livekit.EgressStatus_EGRESS_FAILED
+}
+
+func (s *Service) uploadFile(info *livekit.EgressInfo, upload interface{}, retention config.RetentionConfig, handoff *stats.UploadHandoff) error {
+	file, err := os.Open(handoff.LocalFilepath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	storage, location, retries, err := sink.Upload(upload, file, fileInfo.Size(), handoff.StorageFilepath, params.OutputType(handoff.OutputType), "", retention)
+	s.monitor.UploadCompleted(&stats.UploadMetrics{
+		EgressID:   info.EgressId,
+		Location:   storage,
+		Bytes:      fileInfo.Size(),
+		Duration:   time.Since(start),
+		Retries:    retries,
+		ErrorClass: sink.UploadErrorClass(err),
+	})
+	if err != nil {
+		return errors.ErrUploadFailed(storage, err)
+	}
+
+	if f := info.GetFile(); f != nil {
+		f.Location = location
+		f.Size = fileInfo.Size()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package stats
 import (
 	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/frostbyte73/go-throttle"
@@ -15,6 +16,7 @@ import (
 	"github.com/livekit/protocol/logger"
 
 	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/pipeline/params"
 )
 
 type Monitor struct {
@@ -23,6 +25,17 @@ type Monitor struct {
 	promCPULoad  prometheus.Gauge
 	requestGauge *prometheus.GaugeVec
 
+	uploadDuration   *prometheus.HistogramVec
+	uploadSize       *prometheus.HistogramVec
+	uploadThroughput *prometheus.HistogramVec
+	uploadRetries    *prometheus.CounterVec
+	uploadErrors     *prometheus.CounterVec
+	egressEnded      *prometheus.CounterVec
+
+	streamHealth         *prometheus.GaugeVec
+	streamHealthMu       sync.Mutex
+	streamHealthByEgress map[string][]*StreamHealth
+
 	idleCPUs        atomic.Float64
 	pendingCPUs     atomic.Float64
 	numCPUs         float64
@@ -31,8 +44,9 @@ type Monitor struct {
 
 func NewMonitor() *Monitor {
 	return &Monitor{
-		numCPUs:         float64(runtime.NumCPU()),
-		warningThrottle: throttle.New(time.Minute),
+		numCPUs:              float64(runtime.NumCPU()),
+		warningThrottle:      throttle.New(time.Minute),
+		streamHealthByEgress: make(map[string][]*StreamHealth),
 	}
 }
 
@@ -63,6 +77,8 @@ func (m *Monitor) Start(conf *config.Config, close chan struct{}, isAvailable fu
 	}, []string{"type"})
 
 	prometheus.MustRegister(promNodeAvailable, m.promCPULoad, m.requestGauge)
+	m.registerUploadMetrics(conf.NodeID)
+	m.registerStreamHealthMetrics(conf.NodeID)
 
 	go m.monitorCPULoad(close)
 	return nil
@@ -153,35 +169,33 @@ func (m *Monitor) GetCPULoad() float64 {
 }
 
 func (m *Monitor) CanAcceptRequest(req *livekit.StartEgressRequest) bool {
-	accept := false
 	available := m.idleCPUs.Load() - m.pendingCPUs.Load()
-
-	switch req.Request.(type) {
-	case *livekit.StartEgressRequest_RoomComposite:
-		accept = available > m.cpuCostConfig.RoomCompositeCpuCost
-	case *livekit.StartEgressRequest_TrackComposite:
-		accept = available > m.cpuCostConfig.TrackCompositeCpuCost
-	case *livekit.StartEgressRequest_Track:
-		accept = available > m.cpuCostConfig.TrackCpuCost
-	}
+	accept := available > m.getCPUCost(req)
 
 	logger.Debugw("cpu request", "accepted", accept, "availableCPUs", available, "numCPUs", runtime.NumCPU())
 	return accept
 }
 
 func (m *Monitor) AcceptRequest(req *livekit.StartEgressRequest) {
-	var cpuHold float64
-	switch req.Request.(type) {
+	cpuHold := m.getCPUCost(req)
+	m.pendingCPUs.Add(cpuHold)
+	time.AfterFunc(time.Second, func() { m.pendingCPUs.Sub(cpuHold) })
+}
+
+func (m *Monitor) getCPUCost(req *livekit.StartEgressRequest) float64 {
+	switch r := req.Request.(type) {
 	case *livekit.StartEgressRequest_RoomComposite:
-		cpuHold = m.cpuCostConfig.RoomCompositeCpuCost
+		if params.UsesSDKComposite(r.RoomComposite) {
+			// no browser, so it costs about as much as a track composite
+			return m.cpuCostConfig.TrackCompositeCpuCost
+		}
+		return m.cpuCostConfig.RoomCompositeCpuCost
 	case *livekit.StartEgressRequest_TrackComposite:
-		cpuHold = m.cpuCostConfig.TrackCompositeCpuCost
+		return m.cpuCostConfig.TrackCompositeCpuCost
 	case *livekit.StartEgressRequest_Track:
-		cpuHold = m.cpuCostConfig.TrackCpuCost
+		return m.cpuCostConfig.TrackCpuCost
 	}
-
-	m.pendingCPUs.Add(cpuHold)
-	time.AfterFunc(time.Second, func() { m.pendingCPUs.Sub(cpuHold) })
+	return 0
 }
 
 func (m *Monitor) EgressStarted(req *livekit.StartEgressRequest) {
@@ -196,6 +210,8 @@ func (m *Monitor) EgressStarted(req *livekit.StartEgressRequest) {
 }
 
 func (m *Monitor) EgressEnded(req *livekit.StartEgressRequest) {
+	m.streamHealthEnded(req.EgressId)
+
 	switch req.Request.(type) {
 	case *livekit.StartEgressRequest_RoomComposite:
 		m.requestGauge.With(prometheus.Labels{"type": "room_composite"}).Sub(1)
@@ -0,0 +1,100 @@
+package stats
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	StreamHealthy   = "healthy"
+	StreamDegraded  = "degraded"
+	StreamUnhealthy = "unhealthy"
+)
+
+// StreamHealth describes a stream destination of a running egress. It's reported by the handler at an interval,
+// with every destination of the egress, and exported by the service
+type StreamHealth struct {
+	EgressID        string  `json:"egress_id"`
+	Destination     string  `json:"destination"`      // the url without its stream key, user or query
+	Score           float64 `json:"score"`            // from 0 to 1
+	Status          string  `json:"status"`           // healthy, degraded or unhealthy
+	BufferOccupancy float64 `json:"buffer_occupancy"` // how full the destination's send queue is, from 0 to 1
+	Reconnects      int     `json:"reconnects"`       // times the url was added again after failing
+	BitrateRatio    float64 `json:"bitrate_ratio"`    // bitrate sent over the bitrate encoded for it, up to 1
+}
+
+// StreamHealthStatus returns the status for a score
+func StreamHealthStatus(score float64) string {
+	switch {
+	case score >= 0.8:
+		return StreamHealthy
+	case score >= 0.5:
+		return StreamDegraded
+	default:
+		return StreamUnhealthy
+	}
+}
+
+// ReportStreamHealth reports the health of every stream destination of the egress
+func (r *UploadReporter) ReportStreamHealth(egressID string, health []*StreamHealth) {
+	r.report(&handlerReport{StreamHealth: &streamHealthReport{EgressID: egressID, Destinations: health}})
+}
+
+type streamHealthReport struct {
+	EgressID     string          `json:"egress_id"`
+	Destinations []*StreamHealth `json:"destinations"`
+}
+
+func (m *Monitor) registerStreamHealthMetrics(nodeID string) {
+	m.streamHealth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "stream_health",
+		ConstLabels: prometheus.Labels{"node_id": nodeID},
+	}, []string{"egress_id", "destination"})
+
+	prometheus.MustRegister(m.streamHealth)
+}
+
+// StreamHealthUpdated replaces the health of an egress's stream destinations, dropping destinations it no longer has
+func (m *Monitor) StreamHealthUpdated(egressID string, health []*StreamHealth) {
+	m.streamHealthMu.Lock()
+	defer m.streamHealthMu.Unlock()
+
+	if m.streamHealth != nil {
+		current := make(map[string]bool, len(health))
+		for _, h := range health {
+			current[h.Destination] = true
+			m.streamHealth.WithLabelValues(egressID, h.Destination).Set(h.Score)
+		}
+		for _, h := range m.streamHealthByEgress[egressID] {
+			if !current[h.Destination] {
+				m.streamHealth.DeleteLabelValues(egressID, h.Destination)
+			}
+		}
+	}
+	m.streamHealthByEgress[egressID] = health
+}
+
+// GetStreamHealth returns the latest health of every running egress's stream destinations
+func (m *Monitor) GetStreamHealth() map[string][]*StreamHealth {
+	m.streamHealthMu.Lock()
+	defer m.streamHealthMu.Unlock()
+
+	health := make(map[string][]*StreamHealth, len(m.streamHealthByEgress))
+	for egressID, h := range m.streamHealthByEgress {
+		health[egressID] = h
+	}
+	return health
+}
+
+func (m *Monitor) streamHealthEnded(egressID string) {
+	m.streamHealthMu.Lock()
+	defer m.streamHealthMu.Unlock()
+
+	if m.streamHealth != nil {
+		for _, h := range m.streamHealthByEgress[egressID] {
+			m.streamHealth.DeleteLabelValues(egressID, h.Destination)
+		}
+	}
+	delete(m.streamHealthByEgress, egressID)
+}
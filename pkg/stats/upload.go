@@ -0,0 +1,220 @@
+package stats
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/livekit/protocol/logger"
+)
+
+// UploadMetrics describes a single upload. Uploads happen in handler processes, so they are
+// reported to the service over a pipe and exported from there.
+type UploadMetrics struct {
+	EgressID   string        `json:"egress_id"`
+	Location   string        `json:"location"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration"`
+	Retries    int           `json:"retries"`
+	ErrorClass string        `json:"error_class,omitempty"`
+}
+
+// EndedMetrics describes why an egress ended, reported over the same pipe once the handler is done
+type EndedMetrics struct {
+	EgressID string `json:"egress_id"`
+	Reason   string `json:"reason"`
+	Status   string `json:"status"`
+}
+
+// UploadHandoff passes a finished file to the service to upload, so that the handler can exit right after EOS.
+// The service sends the final egress info once the upload ends
+type UploadHandoff struct {
+	Info            []byte `json:"info"` // marshaled EgressInfo
+	LocalFilepath   string `json:"local_filepath"`
+	StorageFilepath string `json:"storage_filepath"`
+	OutputType      string `json:"output_type"`
+	Reason          string `json:"reason"` // why the egress ended
+}
+
+// UploadedFiles lists the files an egress stored, reported once it ends so that they can be deleted later
+type UploadedFiles struct {
+	EgressID          string   `json:"egress_id"`
+	StorageFilepaths  []string `json:"storage_filepaths,omitempty"`
+	FailoverFilepaths []string `json:"failover_filepaths,omitempty"` // stored in the failover storage
+}
+
+// handlerReport is a single message on the pipe, holding exactly one of its fields
+type handlerReport struct {
+	Ready        bool                `json:"ready,omitempty"` // the handler can receive signals
+	Upload       *UploadMetrics      `json:"upload,omitempty"`
+	Ended        *EndedMetrics       `json:"ended,omitempty"`
+	Handoff      *UploadHandoff      `json:"handoff,omitempty"`
+	Uploaded     *UploadedFiles      `json:"uploaded,omitempty"`
+	StreamHealth *streamHealthReport `json:"stream_health,omitempty"`
+}
+
+type UploadReporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func NewUploadReporter(w io.Writer) *UploadReporter {
+	return &UploadReporter{
+		enc: json.NewEncoder(w),
+	}
+}
+
+// ReportReady lets the service know that signals sent to the handler won't be lost
+func (r *UploadReporter) ReportReady() {
+	r.report(&handlerReport{Ready: true})
+}
+
+func (r *UploadReporter) Report(m *UploadMetrics) {
+	r.report(&handlerReport{Upload: m})
+}
+
+func (r *UploadReporter) ReportEnded(m *EndedMetrics) {
+	r.report(&handlerReport{Ended: m})
+}
+
+func (r *UploadReporter) ReportUploaded(u *UploadedFiles) {
+	r.report(&handlerReport{Uploaded: u})
+}
+
+// ReportHandoff returns false if there's no service to hand the upload to
+func (r *UploadReporter) ReportHandoff(h *UploadHandoff) bool {
+	if r == nil {
+		return false
+	}
+	r.report(&handlerReport{Handoff: h})
+	return true
+}
+
+func (r *UploadReporter) report(report *handlerReport) {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.enc.Encode(report); err != nil {
+		logger.Errorw("failed to report handler metrics", err)
+	}
+}
+
+func (m *Monitor) registerUploadMetrics(nodeID string) {
+	labels := prometheus.Labels{"node_id": nodeID}
+
+	m.uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_duration_seconds",
+		ConstLabels: labels,
+		Buckets:     prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"location", "status"})
+
+	m.uploadSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_size_bytes",
+		ConstLabels: labels,
+		Buckets:     prometheus.ExponentialBuckets(64*1024, 4, 10),
+	}, []string{"location"})
+
+	m.uploadThroughput = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_throughput_bytes_per_second",
+		ConstLabels: labels,
+		Buckets:     prometheus.ExponentialBuckets(128*1024, 2, 12),
+	}, []string{"location"})
+
+	m.uploadRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_retries_total",
+		ConstLabels: labels,
+	}, []string{"location"})
+
+	m.uploadErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "upload_errors_total",
+		ConstLabels: labels,
+	}, []string{"location", "class"})
+
+	m.egressEnded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   "livekit",
+		Subsystem:   "egress",
+		Name:        "ended_total",
+		ConstLabels: labels,
+	}, []string{"reason", "status"})
+
+	prometheus.MustRegister(m.uploadDuration, m.uploadSize, m.uploadThroughput, m.uploadRetries, m.uploadErrors, m.egressEnded)
+}
+
+// ReadUploadMetrics records upload, completion and stream health metrics reported by a handler until r is closed.
+// onReady is called once the handler can receive signals, uploads handed off by the handler are passed to onHandoff,
+// the files it stored to onUploaded, and onEnded is called once it has reported the end of the egress
+func (m *Monitor) ReadUploadMetrics(r io.ReadCloser, onReady func(), onHandoff func(*UploadHandoff), onUploaded func(*UploadedFiles), onEnded func()) {
+	defer r.Close()
+
+	dec := json.NewDecoder(r)
+	for {
+		report := &handlerReport{}
+		if err := dec.Decode(report); err != nil {
+			if err != io.EOF {
+				logger.Errorw("failed to read upload metrics", err)
+			}
+			return
+		}
+		switch {
+		case report.Ready:
+			onReady()
+		case report.Upload != nil:
+			m.UploadCompleted(report.Upload)
+		case report.Ended != nil:
+			m.EgressCompleted(report.Ended)
+			onEnded()
+		case report.Handoff != nil:
+			onHandoff(report.Handoff)
+		case report.Uploaded != nil:
+			onUploaded(report.Uploaded)
+		case report.StreamHealth != nil:
+			m.StreamHealthUpdated(report.StreamHealth.EgressID, report.StreamHealth.Destinations)
+		}
+	}
+}
+
+func (m *Monitor) UploadCompleted(metrics *UploadMetrics) {
+	if m.uploadDuration == nil {
+		return
+	}
+
+	status := "success"
+	if metrics.ErrorClass != "" {
+		status = "failure"
+		m.uploadErrors.WithLabelValues(metrics.Location, metrics.ErrorClass).Inc()
+	}
+
+	m.uploadDuration.WithLabelValues(metrics.Location, status).Observe(metrics.Duration.Seconds())
+	m.uploadRetries.WithLabelValues(metrics.Location).Add(float64(metrics.Retries))
+	if status == "success" {
+		m.uploadSize.WithLabelValues(metrics.Location).Observe(float64(metrics.Bytes))
+		if metrics.Duration > 0 {
+			m.uploadThroughput.WithLabelValues(metrics.Location).Observe(float64(metrics.Bytes) / metrics.Duration.Seconds())
+		}
+	}
+}
+
+func (m *Monitor) EgressCompleted(metrics *EndedMetrics) {
+	if m.egressEnded == nil {
+		return
+	}
+
+	m.egressEnded.WithLabelValues(metrics.Reason, metrics.Status).Inc()
+}
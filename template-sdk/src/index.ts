@@ -86,6 +86,40 @@ const EgressHelper = {
   onLayoutChanged(f: (layout: string) => void) {
     layoutChangedCallback = f;
   },
+
+  /**
+   * Sends a message to the egress, such as a marker. Only available in templates run by egress
+   * @param type
+   * @param data
+   */
+  sendMessage(type: string, data?: unknown) {
+    getEgressChannel()?.send(type, data);
+  },
+
+  /**
+   * Registers a callback for messages pushed by the egress, such as `recording` and `ending`.
+   * @param f
+   */
+  onMessage(f: (message: EgressMessage) => void) {
+    const channel = getEgressChannel();
+    if (channel) {
+      channel.onmessage = f;
+    }
+  },
+}
+
+export interface EgressMessage {
+  type: string;
+  data?: any;
+}
+
+interface EgressChannel {
+  send: (type: string, data?: unknown) => void;
+  onmessage: ((message: EgressMessage) => void) | null;
+}
+
+function getEgressChannel(): EgressChannel | undefined {
+  return (window as any).egress;
 }
 
 let currentRoom: Room | undefined;
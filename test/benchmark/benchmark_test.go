@@ -0,0 +1,177 @@
+//go:build benchmark
+
+package benchmark
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tinyzimmer/go-gst/gst"
+	"github.com/tinyzimmer/go-gst/gst/app"
+
+	"github.com/livekit/protocol/livekit"
+
+	"github.com/livekit/egress/pkg/config"
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/egress/pkg/pipeline/sink"
+)
+
+const (
+	rtpPayloadSize = 1200
+	segmentSize    = 1 << 20
+)
+
+func TestMain(m *testing.M) {
+	gst.Init(nil)
+	os.Exit(m.Run())
+}
+
+// BenchmarkAppSrcPush measures the cost of handing a sample to gstreamer, done by the app writers for every packet
+func BenchmarkAppSrcPush(b *testing.B) {
+	pipeline, err := gst.NewPipelineFromString("appsrc name=src format=time is-live=true ! fakesink sync=false")
+	require.NoError(b, err)
+	element, err := pipeline.GetElementByName("src")
+	require.NoError(b, err)
+	src := app.SrcFromElement(element)
+
+	require.NoError(b, pipeline.SetState(gst.StatePlaying))
+	defer func() {
+		_ = pipeline.SetState(gst.StateNull)
+	}()
+
+	payload := randomBytes(rtpPayloadSize)
+	frameDuration := time.Second / 30
+
+	b.SetBytes(rtpPayloadSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buffer := gst.NewBufferFromBytes(payload)
+		buffer.SetPresentationTimestamp(time.Duration(i) * frameDuration)
+		if flow := src.PushBuffer(buffer); flow != gst.FlowOK {
+			b.Fatalf("unexpected flow return %s", flow.String())
+		}
+	}
+}
+
+// BenchmarkSplitInitSection measures separating the init section from the first fmp4 segment
+func BenchmarkSplitInitSection(b *testing.B) {
+	segment := fmp4Segment(segmentSize)
+
+	b.SetBytes(int64(len(segment)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := sink.SplitInitSection(segment); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkEncryptSegment measures AES-128 encryption of a finalized segment
+func BenchmarkEncryptSegment(b *testing.B) {
+	key := randomBytes(16)
+	segment := randomBytes(segmentSize)
+
+	b.SetBytes(segmentSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sink.EncryptSegment(key, uint64(i), segment); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPlaylistWriter measures ending a segment, which rewrites the playlist, at different playlist lengths
+func BenchmarkPlaylistWriter(b *testing.B) {
+	for _, length := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("segments-%d", length), func(b *testing.B) {
+			dir := b.TempDir()
+			p := &params.Params{}
+			p.OutputType = params.OutputTypeHLS
+			p.SegmentOutputType = params.OutputTypeTS
+			p.AudioEnabled = true
+			p.AudioBitrate = 128
+			p.LocalFilePrefix = path.Join(dir, "segment")
+			p.PlaylistFilename = path.Join(dir, "playlist.m3u8")
+			p.MasterPlaylistFilename = path.Join(dir, "playlist-master.m3u8")
+			// a live window keeps the playlist length constant
+			p.PlaylistWindow = length
+
+			w, err := sink.NewPlaylistWriter(p)
+			require.NoError(b, err)
+
+			segmentDuration := int64(6 * time.Second)
+			endSegment := func(i int) {
+				filepath := p.GetSegmentFilepath(i)
+				if err := w.StartSegment(filepath, int64(i)*segmentDuration); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := w.EndSegment(filepath, int64(i+1)*segmentDuration); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			for i := 0; i < length; i++ {
+				endSegment(i)
+			}
+
+			b.ResetTimer()
+			for i := length; i < length+b.N; i++ {
+				endSegment(i)
+			}
+		})
+	}
+}
+
+// BenchmarkUploadGCP measures the upload path against a local storage emulator
+func BenchmarkUploadGCP(b *testing.B) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"bucket":"egress-benchmark","name":"segment.ts"}`))
+	}))
+	defer server.Close()
+
+	b.Setenv("STORAGE_EMULATOR_HOST", server.URL)
+	conf := &livekit.GCPUpload{Bucket: "egress-benchmark"}
+	segment := randomBytes(segmentSize)
+
+	b.SetBytes(segmentSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := sink.UploadGCP(conf, bytes.NewReader(segment), segmentSize, "segment.ts", params.OutputTypeTS, "", config.RetentionConfig{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// fmp4Segment builds a segment with an init section (ftyp, moov) followed by media (moof, mdat)
+func fmp4Segment(size int) []byte {
+	var buf bytes.Buffer
+	writeBox(&buf, "ftyp", randomBytes(16))
+	writeBox(&buf, "moov", randomBytes(1024))
+	writeBox(&buf, "moof", randomBytes(512))
+	writeBox(&buf, "mdat", randomBytes(size))
+	return buf.Bytes()
+}
+
+func writeBox(w io.Writer, boxType string, payload []byte) {
+	size := uint32(len(payload) + 8)
+	_, _ = w.Write([]byte{byte(size >> 24), byte(size >> 16), byte(size >> 8), byte(size)})
+	_, _ = w.Write([]byte(boxType))
+	_, _ = w.Write(payload)
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v3"
@@ -32,6 +33,13 @@ type Config struct {
 	Muting                  bool   `yaml:"muting"`
 	GstDebug                int    `yaml:"gst_debug"`
 
+	// publisher impairment for resilience tests
+	PacketLoss float64       `yaml:"packet_loss"` // fraction of samples dropped, defaults to 0.02
+	Jitter     time.Duration `yaml:"jitter"`      // maximum delay added to each sample, defaults to 30ms
+
+	// runs a single long segmented egress instead of the test suite
+	SoakDuration time.Duration `yaml:"soak_duration"`
+
 	svc       *service.Service `yaml:"-"`
 	rpcClient egress.RPCClient `yaml:"-"`
 	room      *lksdk.Room      `yaml:"-"`
@@ -5,7 +5,9 @@ package test
 import (
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
@@ -124,7 +126,8 @@ func verifyStreams(t *testing.T, p *params.Params, urls ...string) {
 	}
 }
 
-func verifySegments(t *testing.T, conf *Config, p *params.Params, res *livekit.EgressInfo, playlistPath string, expectedStatus livekit.EgressStatus) {
+// verifySegments checks the egress result and the playlist, returning the playlist's local path
+func verifySegments(t *testing.T, conf *Config, p *params.Params, res *livekit.EgressInfo, playlistPath string, expectedStatus livekit.EgressStatus) string {
 	// egress info
 	require.Equal(t, res.Status, expectedStatus)
 	if res.Status == livekit.EgressStatus_EGRESS_COMPLETE {
@@ -150,8 +153,19 @@ func verifySegments(t *testing.T, conf *Config, p *params.Params, res *livekit.E
 		base := playlistPath[:len(playlistPath)-5]
 		localPlaylistPath = fmt.Sprintf("%s/%s", conf.LocalOutputDirectory, playlistPath)
 		download(t, p.FileUpload, localPlaylistPath, playlistPath)
+
+		ext := params.FileExtensionTS
+		switch p.GetSegmentOutputType() {
+		case params.OutputTypeMP4:
+			ext = params.FileExtensionM4S
+			cloudPath := fmt.Sprintf("%s_init%s", base, params.FileExtensionMP4)
+			localPath := fmt.Sprintf("%s/%s", conf.LocalOutputDirectory, cloudPath)
+			download(t, p.FileUpload, localPath, cloudPath)
+		case params.OutputTypeAAC:
+			ext = params.FileExtensionAAC
+		}
 		for i := 0; i < int(segments.SegmentCount); i++ {
-			cloudPath := fmt.Sprintf("%s_%05d.ts", base, i)
+			cloudPath := fmt.Sprintf("%s_%05d%s", base, i, ext)
 			localPath := fmt.Sprintf("%s/%s", conf.LocalOutputDirectory, cloudPath)
 			download(t, p.FileUpload, localPath, cloudPath)
 		}
@@ -159,6 +173,41 @@ func verifySegments(t *testing.T, conf *Config, p *params.Params, res *livekit.E
 
 	// verify
 	verify(t, localPlaylistPath, p, res, ResultTypeSegments, conf.Muting)
+	verifyMasterPlaylist(t, conf, p, res, playlistPath)
+	return localPlaylistPath
+}
+
+var bandwidthRegexp = regexp.MustCompile(`[:,](AVERAGE-)?BANDWIDTH=(\d+)`)
+
+// verifyMasterPlaylist checks that the master playlist advertises the bandwidth measured from the segments
+func verifyMasterPlaylist(t *testing.T, conf *Config, p *params.Params, res *livekit.EgressInfo, playlistPath string) {
+	masterPath := fmt.Sprintf("%s-master.m3u8", strings.TrimSuffix(playlistPath, ".m3u8"))
+	localMasterPath := masterPath
+	if p.FileUpload != nil {
+		localMasterPath = fmt.Sprintf("%s/%s", conf.LocalOutputDirectory, masterPath)
+		download(t, p.FileUpload, localMasterPath, masterPath)
+	}
+
+	master, err := os.ReadFile(localMasterPath)
+	require.NoError(t, err)
+
+	var peak, average float64
+	for _, match := range bandwidthRegexp.FindAllStringSubmatch(string(master), -1) {
+		bandwidth, err := strconv.ParseFloat(match[2], 64)
+		require.NoError(t, err)
+		if match[1] == "" {
+			peak = bandwidth
+		} else {
+			average = bandwidth
+		}
+	}
+	require.NotZero(t, average)
+	require.GreaterOrEqual(t, peak, average)
+
+	// the egress size also counts the init segment and playlists
+	segments := res.GetSegments()
+	expected := float64(segments.Size*8) / time.Duration(segments.Duration).Seconds()
+	require.InEpsilon(t, expected, average, 0.25)
 }
 
 func verify(t *testing.T, input string, p *params.Params, res *livekit.EgressInfo, resultType ResultType, withMuting bool) {
@@ -170,6 +219,9 @@ func verify(t *testing.T, input string, p *params.Params, res *livekit.EgressInf
 		require.Equal(t, 0, info.Format.ProbeScore)
 	case params.OutputTypeIVF:
 		require.Equal(t, 98, info.Format.ProbeScore)
+	case params.OutputTypeAAC, params.OutputTypeMP3:
+		// raw adts and mp3 frames are matched with the extension score
+		require.GreaterOrEqual(t, info.Format.ProbeScore, 50)
 	default:
 		require.Equal(t, 100, info.Format.ProbeScore)
 	}
@@ -227,9 +279,18 @@ func verify(t *testing.T, input string, p *params.Params, res *livekit.EgressInf
 				require.Equal(t, "48000", stream.SampleRate)
 				require.Equal(t, "stereo", stream.ChannelLayout)
 
+			case params.MimeTypeMP3:
+				require.Equal(t, "mp3", stream.CodecName)
+				require.Equal(t, fmt.Sprint(p.AudioFrequency), stream.SampleRate)
+
 			case params.MimeTypeRaw:
-				require.Equal(t, "pcm_s16le", stream.CodecName)
-				require.Equal(t, "48000", stream.SampleRate)
+				if p.OutputType == params.OutputTypeWAV {
+					require.Equal(t, fmt.Sprintf("pcm_s%dle", p.AudioBitDepth), stream.CodecName)
+					require.Equal(t, fmt.Sprint(p.AudioFrequency), stream.SampleRate)
+				} else {
+					require.Equal(t, "pcm_s16le", stream.CodecName)
+					require.Equal(t, "48000", stream.SampleRate)
+				}
 			}
 
 			// channels
@@ -7,6 +7,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"sync"
 	"testing"
 	"time"
 
@@ -27,6 +28,8 @@ const (
 	streamUrl2    = "rtmp://localhost:1935/live/stream2"
 	badStreamUrl1 = "rtmp://sfo.contribute.live-video.net/app/fake1"
 	badStreamUrl2 = "rtmp://localhost:1934/live/stream2"
+
+	streamChurnIterations = 5
 )
 
 type testCase struct {
@@ -39,6 +42,9 @@ type testCase struct {
 	fileType livekit.EncodedFileType
 	options  *livekit.EncodingOptions
 
+	// used by room composite tests, defaults to speaker-dark
+	layout string
+
 	// used by segmented file tests
 	playlist string
 
@@ -86,8 +92,17 @@ func RunTestSuite(t *testing.T, conf *Config, rpcClient egress.RPCClient, rpcSer
 	// check status
 	if conf.HealthPort != 0 {
 		status := getStatus(t, svc)
-		require.Len(t, status, 1)
+		require.Len(t, status, 2)
 		require.Contains(t, status, "CpuLoad")
+		require.Contains(t, status, "StreamHealth")
+	}
+
+	// soak mode replaces the regular tests
+	if conf.SoakDuration > 0 {
+		t.Run("Soak", func(t *testing.T) {
+			testSoak(t, conf)
+		})
+		return
 	}
 
 	// run tests
@@ -108,6 +123,12 @@ func RunTestSuite(t *testing.T, conf *Config, rpcClient egress.RPCClient, rpcSer
 			testTrack(t, conf)
 		})
 	}
+
+	if !conf.TrackTestsOnly && !conf.StreamTestsOnly && !conf.SegmentedFileTestsOnly && !conf.RoomTestsOnly {
+		t.Run("Resilience", func(t *testing.T) {
+			testResilience(t, conf)
+		})
+	}
 }
 
 func runFileTest(t *testing.T, conf *Config, req *livekit.StartEgressRequest, test *testCase, filepath string) {
@@ -236,7 +257,104 @@ func runMultipleStreamTest(t *testing.T, conf *Config, req *livekit.StartEgressR
 	}
 }
 
-func runSegmentsTest(t *testing.T, conf *Config, req *livekit.StartEgressRequest, playlistPath string) {
+// runStreamChurnTest repeatedly adds and removes outputs, with concurrent requests and invalid urls,
+// checking that the egress keeps running and that every output is accounted for
+func runStreamChurnTest(t *testing.T, conf *Config, req *livekit.StartEgressRequest) {
+	ctx := context.Background()
+	egressID := startEgress(t, conf, req)
+
+	time.Sleep(time.Second * 5)
+
+	// get params
+	p, err := params.GetPipelineParams(ctx, conf.Config, req)
+	require.NoError(t, err)
+
+	verifyStreams(t, p, streamUrl1)
+
+	updateStream := func(add, remove []string) error {
+		_, err := conf.rpcClient.SendRequest(ctx, &livekit.EgressRequest{
+			EgressId: egressID,
+			Request: &livekit.EgressRequest_UpdateStream{
+				UpdateStream: &livekit.UpdateStreamRequest{
+					EgressId:         req.EgressId,
+					AddOutputUrls:    add,
+					RemoveOutputUrls: remove,
+				},
+			},
+		})
+		return err
+	}
+
+	for i := 0; i < streamChurnIterations; i++ {
+		// add a good url and two bad ones in parallel
+		var wg sync.WaitGroup
+		var goodErr, badErr error
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			goodErr = updateStream([]string{streamUrl2}, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			// this one can fail after the output has started, which goes through handleError instead
+			_ = updateStream([]string{badStreamUrl1}, nil)
+		}()
+		go func() {
+			defer wg.Done()
+			badErr = updateStream([]string{badStreamUrl2}, nil)
+		}()
+		wg.Wait()
+		require.NoError(t, goodErr)
+		require.Error(t, badErr)
+
+		time.Sleep(time.Second * 2)
+		if i == 0 {
+			verifyStreams(t, p, streamUrl1, streamUrl2)
+		}
+
+		// remove the good url while removing one that was never added
+		var removeErr, missingErr error
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			removeErr = updateStream(nil, []string{streamUrl2})
+		}()
+		go func() {
+			defer wg.Done()
+			missingErr = updateStream(nil, []string{badStreamUrl2})
+		}()
+		wg.Wait()
+		require.NoError(t, removeErr)
+		require.Error(t, missingErr)
+	}
+
+	// the original output should be unaffected
+	time.Sleep(time.Second * 5)
+	verifyStreams(t, p, streamUrl1)
+
+	// stop
+	res := stopEgress(t, conf, egressID)
+
+	// verify egress info
+	require.Empty(t, res.Error)
+	var count1, count2 int
+	for _, info := range res.GetStream().Info {
+		switch info.Url {
+		case streamUrl1:
+			count1++
+		case streamUrl2:
+			count2++
+			require.Greater(t, info.Duration, int64(0))
+		case badStreamUrl1:
+		default:
+			t.Fatalf("unexpected stream url in result: %s", info.Url)
+		}
+	}
+	require.Equal(t, 1, count1)
+	require.Equal(t, streamChurnIterations, count2)
+}
+
+func runSegmentsTest(t *testing.T, conf *Config, req *livekit.StartEgressRequest, test *testCase, playlistPath string) {
 	egressID := startEgress(t, conf, req)
 
 	var res *livekit.EgressInfo
@@ -259,6 +377,15 @@ func runSegmentsTest(t *testing.T, conf *Config, req *livekit.StartEgressRequest
 	// get params
 	p, err := params.GetPipelineParams(context.Background(), conf.Config, req)
 	require.NoError(t, err)
+	if req.GetTrack() != nil {
+		// track egress only knows its track's kind once it subscribes, and hls segments carry aac and h264
+		if test.audioOnly {
+			p.AudioEnabled, p.AudioCodec = true, params.MimeTypeAAC
+		} else {
+			p.VideoEnabled, p.VideoCodec = true, params.MimeTypeH264
+		}
+		p.UpdateSegmentOutputType()
+	}
 
 	verifySegments(t, conf, p, res, playlistPath, expectedStatus)
 }
@@ -319,7 +446,7 @@ func checkStoppedEgress(t *testing.T, conf *Config, egressID string, expectedSta
 	// check status
 	if conf.HealthPort != 0 {
 		status := getStatus(t, conf.svc)
-		require.Len(t, status, 1)
+		require.Len(t, status, 2)
 	}
 
 	return info
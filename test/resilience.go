@@ -0,0 +1,134 @@
+//go:build integration
+
+package test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/stretchr/testify/require"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/utils"
+)
+
+const (
+	defaultPacketLoss = 0.02
+	defaultJitter     = 30 * time.Millisecond
+	churnDuration     = 3 * time.Second
+)
+
+type impairment struct {
+	loss   float64       // fraction of samples dropped
+	jitter time.Duration // maximum delay added before a sample is sent
+}
+
+// impairedSampleProvider simulates a bad publisher connection
+type impairedSampleProvider struct {
+	*loopingSampleProvider
+	impairment *impairment
+}
+
+func (i *impairedSampleProvider) NextSample() (media.Sample, error) {
+	var dropped uint16
+	for {
+		sample, err := i.loopingSampleProvider.NextSample()
+		if err != nil {
+			return sample, err
+		}
+
+		if rand.Float64() < i.impairment.loss {
+			dropped++
+			continue
+		}
+
+		if i.impairment.jitter > 0 {
+			time.Sleep(time.Duration(rand.Int63n(int64(i.impairment.jitter))))
+		}
+
+		// dropped samples still advance the rtp timestamp, so the receiver sees a gap instead of a shorter track
+		sample.PrevDroppedPackets = dropped
+		return sample, nil
+	}
+}
+
+func testResilience(t *testing.T, conf *Config) {
+	now := time.Now().Unix()
+
+	imp := &impairment{
+		loss:   conf.PacketLoss,
+		jitter: conf.Jitter,
+	}
+	if imp.loss == 0 {
+		imp.loss = defaultPacketLoss
+	}
+	if imp.jitter == 0 {
+		imp.jitter = defaultJitter
+	}
+
+	t.Run("tc-impaired-mp4", func(t *testing.T) {
+		audioTrackID := publishLoopingSampleToRoom(t, conf.room, params.MimeTypeOpus, imp)
+		videoTrackID := publishLoopingSampleToRoom(t, conf.room, params.MimeTypeVP8, imp)
+		time.Sleep(time.Second)
+
+		runTrackCompositeFileTest(t, conf, &testCase{
+			name:       "tc-impaired-mp4",
+			fileType:   livekit.EncodedFileType_MP4,
+			audioCodec: params.MimeTypeOpus,
+			videoCodec: params.MimeTypeVP8,
+			filename:   fmt.Sprintf("tc-impaired-%v.mp4", now),
+		}, audioTrackID, videoTrackID)
+	})
+
+	if !conf.TrackCompositeTestsOnly {
+		t.Run("room-publisher-churn", func(t *testing.T) {
+			testPublisherChurn(t, conf, fmt.Sprintf("room-churn-%v.mp4", now))
+		})
+	}
+}
+
+// testPublisherChurn unpublishes and republishes the room's tracks during a room composite recording,
+// which should keep recording through the gap
+func testPublisherChurn(t *testing.T, conf *Config, filename string) {
+	audioTrackID, videoTrackID := publishSamplesToRoom(t, conf.room, params.MimeTypeOpus, params.MimeTypeVP8, false)
+
+	req := &livekit.StartEgressRequest{
+		EgressId: utils.NewGuid(utils.EgressPrefix),
+		Request: &livekit.StartEgressRequest_RoomComposite{
+			RoomComposite: &livekit.RoomCompositeEgressRequest{
+				RoomName: conf.room.Name(),
+				Layout:   "speaker-dark",
+				Output: &livekit.RoomCompositeEgressRequest_File{
+					File: &livekit.EncodedFileOutput{
+						FileType: livekit.EncodedFileType_MP4,
+						Filepath: getFilePath(conf.Config, filename),
+					},
+				},
+			},
+		},
+	}
+
+	egressID := startEgress(t, conf, req)
+	time.Sleep(time.Second * 10)
+
+	// drop the tracks, then bring them back
+	require.NoError(t, conf.room.LocalParticipant.UnpublishTrack(audioTrackID))
+	require.NoError(t, conf.room.LocalParticipant.UnpublishTrack(videoTrackID))
+	time.Sleep(churnDuration)
+	publishSamplesToRoom(t, conf.room, params.MimeTypeOpus, params.MimeTypeVP8, false)
+	time.Sleep(time.Second * 12)
+
+	res := stopEgress(t, conf, egressID)
+
+	// get params
+	p, err := params.GetPipelineParams(context.Background(), conf.Config, req)
+	require.NoError(t, err)
+
+	// the recording covers the whole egress, including the gap
+	verifyFile(t, conf, p, res, getFilePath(conf.Config, filename), livekit.EgressStatus_EGRESS_COMPLETE)
+}
@@ -43,6 +43,41 @@ func testRoomComposite(t *testing.T, conf *Config) {
 				},
 				filename: fmt.Sprintf("room-opus-%v.ogg", now),
 			},
+			{
+				name:      "mp3",
+				audioOnly: true,
+				options: &livekit.EncodingOptions{
+					AudioBitrate: 192,
+				},
+				filename: fmt.Sprintf("room-%v.mp3", now),
+			},
+			{
+				name:      "aac",
+				audioOnly: true,
+				filename:  fmt.Sprintf("room-%v.aac", now),
+			},
+			{
+				name:      "wav",
+				audioOnly: true,
+				options: &livekit.EncodingOptions{
+					AudioFrequency: 48000,
+				},
+				filename: fmt.Sprintf("room-%v.wav", now),
+			},
+			{
+				name:      "grid-video-only-mp4",
+				videoOnly: true,
+				layout:    "grid-dark",
+				filename:  fmt.Sprintf("room-grid-video-only-%v.mp4", now),
+			},
+			{
+				name:     "h264-mkv",
+				filename: fmt.Sprintf("room-h264-%v.mkv", now),
+			},
+			{
+				name:     "h264-ts",
+				filename: fmt.Sprintf("room-h264-%v.ts", now),
+			},
 		} {
 			t.Run(test.name, func(t *testing.T) {
 				runRoomCompositeFileTest(t, conf, test)
@@ -60,6 +95,12 @@ func testRoomComposite(t *testing.T, conf *Config) {
 		})
 		// Give some time for the previous handler to finish and release the room handling lock
 		time.Sleep(1 * time.Second)
+		if conf.SessionLimits.StreamOutputMaxDuration == 0 {
+			t.Run("room-rtmp-churn", func(t *testing.T) {
+				testRoomCompositeStreamChurn(t, conf)
+			})
+			time.Sleep(1 * time.Second)
+		}
 	}
 
 	if !conf.FileTestsOnly && !conf.StreamTestsOnly {
@@ -86,10 +127,15 @@ func testRoomComposite(t *testing.T, conf *Config) {
 
 func runRoomCompositeFileTest(t *testing.T, conf *Config, test *testCase) {
 	filepath := getFilePath(conf.Config, test.filename)
+	layout := test.layout
+	if layout == "" {
+		layout = "speaker-dark"
+	}
 	roomRequest := &livekit.RoomCompositeEgressRequest{
 		RoomName:  conf.room.Name(),
-		Layout:    "speaker-dark",
+		Layout:    layout,
 		AudioOnly: test.audioOnly,
+		VideoOnly: test.videoOnly,
 		Output: &livekit.RoomCompositeEgressRequest_File{
 			File: &livekit.EncodedFileOutput{
 				FileType: test.fileType,
@@ -134,6 +180,26 @@ func testRoomCompositeStream(t *testing.T, conf *Config) {
 	runStreamTest(t, conf, req)
 }
 
+func testRoomCompositeStreamChurn(t *testing.T, conf *Config) {
+	req := &livekit.StartEgressRequest{
+		EgressId: utils.NewGuid(utils.EgressPrefix),
+		Request: &livekit.StartEgressRequest_RoomComposite{
+			RoomComposite: &livekit.RoomCompositeEgressRequest{
+				RoomName: conf.room.Name(),
+				Layout:   "speaker-dark",
+				Output: &livekit.RoomCompositeEgressRequest_Stream{
+					Stream: &livekit.StreamOutput{
+						Protocol: livekit.StreamProtocol_RTMP,
+						Urls:     []string{streamUrl1},
+					},
+				},
+			},
+		},
+	}
+
+	runStreamChurnTest(t, conf, req)
+}
+
 func testStreamFailure(t *testing.T, conf *Config) {
 	ctx := context.Background()
 
@@ -190,5 +256,5 @@ func runRoomCompositeSegmentsTest(t *testing.T, conf *Config, test *testCase) {
 		},
 	}
 
-	runSegmentsTest(t, conf, req, getFilePath(conf.Config, test.playlist))
+	runSegmentsTest(t, conf, req, test, getFilePath(conf.Config, test.playlist))
 }
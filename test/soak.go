@@ -0,0 +1,309 @@
+//go:build integration
+
+package test
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafov/m3u8"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/ivfreader"
+	"github.com/pion/webrtc/v3/pkg/media/oggreader"
+	"github.com/stretchr/testify/require"
+
+	"github.com/livekit/egress/pkg/pipeline/params"
+	"github.com/livekit/protocol/livekit"
+	"github.com/livekit/protocol/utils"
+	lksdk "github.com/livekit/server-sdk-go"
+)
+
+const (
+	soakSampleInterval  = time.Minute
+	soakWarmup          = time.Minute * 10
+	soakMaxMemoryGrowth = 64 << 20 // bytes
+)
+
+// testSoak runs a single segmented egress for conf.SoakDuration, checking handler memory as it goes,
+// and the playlist for gaps once it's done
+func testSoak(t *testing.T, conf *Config) {
+	require.Greater(t, conf.SoakDuration, soakWarmup, "soak duration must be longer than the warmup")
+
+	audioTrackID := publishLoopingSampleToRoom(t, conf.room, params.MimeTypeOpus, nil)
+	videoTrackID := publishLoopingSampleToRoom(t, conf.room, params.MimeTypeVP8, nil)
+	time.Sleep(time.Second)
+
+	now := time.Now().Unix()
+	filename := fmt.Sprintf("soak-%v", now)
+	playlist := fmt.Sprintf("soak-%v.m3u8", now)
+
+	req := &livekit.StartEgressRequest{
+		EgressId: utils.NewGuid(utils.EgressPrefix),
+		Request: &livekit.StartEgressRequest_TrackComposite{
+			TrackComposite: &livekit.TrackCompositeEgressRequest{
+				RoomName:     conf.room.Name(),
+				AudioTrackId: audioTrackID,
+				VideoTrackId: videoTrackID,
+				Output: &livekit.TrackCompositeEgressRequest_Segments{
+					Segments: &livekit.SegmentedFileOutput{
+						FilenamePrefix: getFilePath(conf.Config, filename),
+						PlaylistName:   playlist,
+					},
+				},
+			},
+		},
+	}
+
+	egressID := startEgress(t, conf, req)
+
+	// sample handler memory until the soak is over
+	var memory []uint64
+	deadline := time.Now().Add(conf.SoakDuration)
+	for time.Now().Before(deadline) {
+		time.Sleep(soakSampleInterval)
+
+		rss, err := handlerMemory()
+		require.NoError(t, err)
+		t.Logf("handler memory: %d MB", rss>>20)
+		memory = append(memory, rss)
+	}
+
+	res := stopEgress(t, conf, egressID)
+
+	// get params
+	p, err := params.GetPipelineParams(context.Background(), conf.Config, req)
+	require.NoError(t, err)
+
+	localPlaylistPath := verifySegments(t, conf, p, res, getFilePath(conf.Config, playlist), livekit.EgressStatus_EGRESS_COMPLETE)
+	verifyPlaylist(t, localPlaylistPath, path.Base(filename), p, res)
+	verifyMemory(t, memory)
+}
+
+// verifyMemory compares memory at the end of the soak with memory once the pipeline has warmed up
+func verifyMemory(t *testing.T, samples []uint64) {
+	warmup := int(soakWarmup / soakSampleInterval)
+	require.Greater(t, len(samples), warmup)
+
+	baseline := samples[warmup]
+	final := samples[len(samples)-1]
+	if final > baseline {
+		require.Less(t, final-baseline, uint64(soakMaxMemoryGrowth),
+			"handler memory grew from %d MB to %d MB", baseline>>20, final>>20)
+	}
+}
+
+// verifyPlaylist checks that the playlist is complete, and that segments are consecutive and cover the whole egress
+func verifyPlaylist(t *testing.T, playlistPath, prefix string, p *params.Params, res *livekit.EgressInfo) {
+	f, err := os.Open(playlistPath)
+	require.NoError(t, err)
+	defer f.Close()
+
+	playlist, listType, err := m3u8.DecodeFrom(f, true)
+	require.NoError(t, err)
+	require.Equal(t, m3u8.MEDIA, listType)
+
+	mediaPlaylist := playlist.(*m3u8.MediaPlaylist)
+	require.True(t, mediaPlaylist.Closed, "playlist missing EXT-X-ENDLIST")
+
+	segments := mediaPlaylist.Segments[:mediaPlaylist.Count()]
+	require.Equal(t, res.GetSegments().SegmentCount, int64(len(segments)))
+
+	var total float64
+	for i, segment := range segments {
+		// segments are numbered in order, so a missing or repeated number is a gap
+		require.Equal(t, fmt.Sprintf("%s_%05d%s", prefix, i, p.GetSegmentFileExtension()), segment.URI)
+		if i < len(segments)-1 {
+			require.InDelta(t, float64(p.SegmentDuration), segment.Duration, 1.0, "segment %d", i)
+		}
+		total += segment.Duration
+	}
+	require.InDelta(t, float64(res.GetSegments().Duration)/1e9, total, float64(p.SegmentDuration))
+}
+
+// handlerMemory returns the resident memory of the handler processes started by the service
+func handlerMemory() (uint64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	children := make(map[int][]int)
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil {
+			continue
+		}
+		// the command name can contain spaces, so fields are counted from the closing parenthesis
+		fields := strings.Fields(string(b[strings.LastIndexByte(string(b), ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		children[ppid] = append(children[ppid], pid)
+	}
+
+	var total uint64
+	pending := children[os.Getpid()]
+	for len(pending) > 0 {
+		pid := pending[0]
+		pending = append(pending[1:], children[pid]...)
+
+		rss, err := processMemory(pid)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		total += rss
+	}
+
+	return total, nil
+}
+
+func processMemory(pid int) (uint64, error) {
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) >= 2 && fields[0] == "VmRSS:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			return kb << 10, err
+		}
+	}
+	return 0, scanner.Err()
+}
+
+// publishLoopingSampleToRoom publishes a sample that never ends, optionally dropping and delaying samples before they're sent
+func publishLoopingSampleToRoom(t *testing.T, room *lksdk.Room, codec params.MimeType, impairment *impairment) string {
+	var capability webrtc.RTPCodecCapability
+	switch codec {
+	case params.MimeTypeOpus:
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	case params.MimeTypeVP8:
+		capability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	default:
+		t.Fatalf("looping samples not supported for %s", codec)
+	}
+
+	track, err := lksdk.NewLocalSampleTrack(capability)
+	require.NoError(t, err)
+
+	provider := &loopingSampleProvider{
+		filename:      samples[codec],
+		codec:         codec,
+		frameDuration: frameDurations[codec],
+	}
+	require.NoError(t, provider.open())
+	if impairment != nil {
+		require.NoError(t, track.StartWrite(&impairedSampleProvider{loopingSampleProvider: provider, impairment: impairment}, nil))
+	} else {
+		require.NoError(t, track.StartWrite(provider, nil))
+	}
+
+	pub, err := room.LocalParticipant.PublishTrack(track, &lksdk.TrackPublicationOptions{Name: provider.filename})
+	require.NoError(t, err)
+
+	trackID := pub.SID()
+	t.Cleanup(func() {
+		_ = room.LocalParticipant.UnpublishTrack(trackID)
+	})
+
+	return trackID
+}
+
+// loopingSampleProvider replays a sample file indefinitely, for tests that outlast the file
+type loopingSampleProvider struct {
+	filename      string
+	codec         params.MimeType
+	frameDuration time.Duration
+
+	file        *os.File
+	ivf         *ivfreader.IVFReader
+	ogg         *oggreader.OggReader
+	lastGranule uint64
+}
+
+func (l *loopingSampleProvider) open() error {
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+
+	f, err := os.Open(l.filename)
+	if err != nil {
+		return err
+	}
+	l.file = f
+
+	switch l.codec {
+	case params.MimeTypeVP8:
+		l.ivf, _, err = ivfreader.NewWith(f)
+	case params.MimeTypeOpus:
+		l.ogg, _, err = oggreader.NewWith(f)
+		l.lastGranule = 0
+	}
+	return err
+}
+
+func (l *loopingSampleProvider) NextSample() (media.Sample, error) {
+	sample, err := l.next()
+	if err == io.EOF {
+		// start over
+		if err = l.open(); err != nil {
+			return media.Sample{}, err
+		}
+		sample, err = l.next()
+	}
+	return sample, err
+}
+
+func (l *loopingSampleProvider) next() (media.Sample, error) {
+	switch l.codec {
+	case params.MimeTypeVP8:
+		frame, _, err := l.ivf.ParseNextFrame()
+		if err != nil {
+			return media.Sample{}, err
+		}
+		return media.Sample{Data: frame, Duration: l.frameDuration}, nil
+
+	default:
+		page, header, err := l.ogg.ParseNextPage()
+		if err != nil {
+			return media.Sample{}, err
+		}
+		// opus granule positions are in 48kHz samples
+		duration := time.Duration(header.GranulePosition-l.lastGranule) * time.Second / 48000
+		l.lastGranule = header.GranulePosition
+		return media.Sample{Data: page, Duration: duration}, nil
+	}
+}
+
+func (l *loopingSampleProvider) OnBind() error {
+	return nil
+}
+
+func (l *loopingSampleProvider) OnUnbind() error {
+	return nil
+}
+
+func (l *loopingSampleProvider) Close() error {
+	if l.file != nil {
+		return l.file.Close()
+	}
+	return nil
+}
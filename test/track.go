@@ -68,6 +68,27 @@ func testTrack(t *testing.T, conf *Config) {
 			})
 		}
 	}
+
+	if !conf.FileTestsOnly && !conf.StreamTestsOnly {
+		for _, test := range []*testCase{
+			{
+				name:       "track-h264-hls",
+				videoOnly:  true,
+				videoCodec: params.MimeTypeH264,
+				playlist:   fmt.Sprintf("track-h264-hls-%v.m3u8", now),
+			},
+			{
+				name:       "track-opus-hls",
+				audioOnly:  true,
+				audioCodec: params.MimeTypeOpus,
+				playlist:   fmt.Sprintf("track-opus-hls-%v.m3u8", now),
+			},
+		} {
+			t.Run(test.name, func(t *testing.T) {
+				runTrackSegmentsTest(t, conf, test)
+			})
+		}
+	}
 }
 
 func runTrackFileTest(t *testing.T, conf *Config, test *testCase) {
@@ -101,6 +122,35 @@ func runTrackFileTest(t *testing.T, conf *Config, test *testCase) {
 	runFileTest(t, conf, req, test, filepath)
 }
 
+func runTrackSegmentsTest(t *testing.T, conf *Config, test *testCase) {
+	codec := test.videoCodec
+	if test.audioOnly {
+		codec = test.audioCodec
+	}
+	trackID := publishSampleToRoom(t, conf.room, codec, conf.Muting)
+	time.Sleep(time.Second)
+
+	playlistPath := getFilePath(conf.Config, test.playlist)
+	trackRequest := &livekit.TrackEgressRequest{
+		RoomName: conf.room.Name(),
+		TrackId:  trackID,
+		Output: &livekit.TrackEgressRequest_File{
+			File: &livekit.DirectFileOutput{
+				Filepath: playlistPath,
+			},
+		},
+	}
+
+	req := &livekit.StartEgressRequest{
+		EgressId: utils.NewGuid(utils.EgressPrefix),
+		Request: &livekit.StartEgressRequest_Track{
+			Track: trackRequest,
+		},
+	}
+
+	runSegmentsTest(t, conf, req, test, playlistPath)
+}
+
 func runTrackWebsocketTest(t *testing.T, conf *Config, test *testCase) {
 	codec := test.videoCodec
 	if test.audioCodec != "" {
@@ -140,7 +190,7 @@ func runTrackWebsocketTest(t *testing.T, conf *Config, test *testCase) {
 
 	// record for ~30s. Takes about 5s to start
 	time.AfterFunc(time.Second*35, func() {
-		rec.SendEOS(ctx)
+		rec.SendEOS(ctx, pipeline.EndReasonAPIStop)
 	})
 	res := rec.Run(ctx)
 
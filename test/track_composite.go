@@ -30,12 +30,40 @@ func testTrackComposite(t *testing.T, conf *Config) {
 				videoCodec: params.MimeTypeH264,
 				filename:   fmt.Sprintf("tc-h264-%v.mp4", now),
 			},
+			{
+				name:       "tc-opus-ogg",
+				fileType:   livekit.EncodedFileType_OGG,
+				audioOnly:  true,
+				audioCodec: params.MimeTypeOpus,
+				filename:   fmt.Sprintf("tc-opus-%v.ogg", now),
+			},
+			{
+				name:       "tc-vp8-webm",
+				audioCodec: params.MimeTypeOpus,
+				videoCodec: params.MimeTypeVP8,
+				filename:   fmt.Sprintf("tc-vp8-%v.webm", now),
+			},
 		} {
 			t.Run(test.name, func(t *testing.T) {
 				audioTrackID, videoTrackID := publishSamplesToRoom(t, conf.room, test.audioCodec, test.videoCodec, conf.Muting)
 				runTrackCompositeFileTest(t, conf, test, audioTrackID, videoTrackID)
 			})
 		}
+
+		t.Run("tc-pip-mp4", func(t *testing.T) {
+			if !conf.TrackLayouts {
+				t.Skip("track layouts not enabled")
+			}
+			audioTrackID, videoTrackID := publishSamplesToRoom(t, conf.room, params.MimeTypeOpus, params.MimeTypeVP8, false)
+			insetTrackID := publishSampleToRoom(t, conf.room, params.MimeTypeH264, false)
+			runTrackCompositeFileTest(t, conf, &testCase{
+				name:       "tc-pip-mp4",
+				fileType:   livekit.EncodedFileType_MP4,
+				audioCodec: params.MimeTypeOpus,
+				videoCodec: params.MimeTypeH264,
+				filename:   fmt.Sprintf("tc-pip-%v.mp4", now),
+			}, audioTrackID, fmt.Sprintf("%s:%s,%s", params.TrackLayoutPiP, videoTrackID, insetTrackID))
+		})
 	}
 
 	if !conf.FileTestsOnly && !conf.SegmentedFileTestsOnly {
@@ -60,6 +88,13 @@ func testTrackComposite(t *testing.T, conf *Config) {
 				filename:   fmt.Sprintf("tc-h264-hls-%v", now),
 				playlist:   fmt.Sprintf("tc-h264-hls-%v.m3u8", now),
 			},
+			{
+				name:       "tc-audio-hls",
+				audioOnly:  true,
+				audioCodec: params.MimeTypeOpus,
+				filename:   fmt.Sprintf("tc-audio-hls-%v", now),
+				playlist:   fmt.Sprintf("tc-audio-hls-%v.m3u8", now),
+			},
 		} {
 			t.Run(test.name, func(t *testing.T) {
 				audioTrackID, videoTrackID := publishSamplesToRoom(t, conf.room, test.audioCodec, test.videoCodec, conf.Muting)
@@ -160,5 +195,5 @@ func runTrackCompositeSegmentsTest(t *testing.T, conf *Config, test *testCase, a
 		},
 	}
 
-	runSegmentsTest(t, conf, req, getFilePath(conf.Config, test.playlist))
+	runSegmentsTest(t, conf, req, test, getFilePath(conf.Config, test.playlist))
 }